@@ -0,0 +1,194 @@
+package moogration
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultAgentInterval is how often an agent polls if AgentConfig.Interval
+// isn't set
+const defaultAgentInterval = 30 * time.Second
+
+// defaultAgentClient makes an agent's requests if AgentConfig.Client isn't
+// set. Its timeout keeps a stalled control endpoint from hanging the agent.
+var defaultAgentClient = &http.Client{Timeout: time.Minute}
+
+// AgentConfig configures RunAgent
+type AgentConfig struct {
+	// URL is the control endpoint. The agent GETs it to poll for a plan, and
+	// POSTs its report to it, with a "target" query parameter.
+	URL string
+	// Target identifies the agent's database to the control plane
+	Target string
+	// Interval is how often the agent polls, by default every 30 seconds
+	Interval time.Duration
+	// Client makes the requests, by default a client with a one-minute
+	// timeout
+	Client *http.Client
+	// PublicKey is the control plane's ed25519 public key. If it is set,
+	// the agent only runs plans signed with Bundle.Sign by the matching
+	// private key. Without it, a plan is any SQL the endpoint serves, so the
+	// endpoint must be trusted and reached over TLS.
+	PublicKey ed25519.PublicKey
+	// Codec decodes plans and encodes reports, by default JSONCodec, and
+	// ContentType is the media type of its reports, by default
+	// application/json
+	Codec       Codec
+	ContentType string
+}
+
+// RunAgent runs the Migrator as an agent of a control plane, which manages
+// the schema of many databases centrally, until ctx is done. Every interval
+// it polls the control endpoint for the approved plan targeting its
+// database: a Bundle holding the database's full migration set. The
+// endpoint responds 204 No Content when there is no plan. The agent runs the
+// plan's pending migrations as RunLatest does, with the Migrator's options
+// and so its locking, strict mode and other checks, but never with force,
+// then POSTs a Report naming the bundle. A plan served again after it has
+// been run, even if it failed, isn't run again; its report is sent again
+// instead, and the control plane decides what to serve next. Failed polls
+// and reports are logged and retried at the next interval. RunAgent returns
+// ctx's error.
+//
+// The agent runs whatever SQL its plans hold. Set AgentConfig.PublicKey to
+// refuse plans the control plane didn't sign; otherwise the endpoint must be
+// trusted and served over TLS.
+func (mg *Migrator) RunAgent(ctx context.Context, conf AgentConfig) error {
+	conf = conf.withDefaults()
+	var last *Report
+	for {
+		report, err := mg.pollAgent(ctx, conf, last)
+		if err != nil && mg.logger != nil {
+			mg.logger.Printf("ERROR: agent for %s: %s", conf.Target, err)
+		}
+		if report != nil {
+			last = report
+		}
+		err = sleep(ctx, conf.Interval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// PollAgent polls the control endpoint once, runs the plan it returns, if
+// any, and reports the result. Unlike RunAgent, it doesn't remember the
+// plans it has run. It returns an error if the plan failed, once its report
+// has been sent. See RunAgent.
+func (mg *Migrator) PollAgent(ctx context.Context, conf AgentConfig) error {
+	_, err := mg.pollAgent(ctx, conf.withDefaults(), nil)
+	return err
+}
+
+func (conf AgentConfig) withDefaults() AgentConfig {
+	if conf.Interval <= 0 {
+		conf.Interval = defaultAgentInterval
+	}
+	if conf.Client == nil {
+		conf.Client = defaultAgentClient
+	}
+	if conf.Codec == nil {
+		conf.Codec = JSONCodec
+	}
+	if conf.ContentType == "" {
+		conf.ContentType = "application/json"
+	}
+	return conf
+}
+
+// pollAgent polls for a plan, runs it unless it is the plan last was
+// reported for, and reports the result. It returns the report, once the
+// plan has been run, and an error if the plan failed.
+func (mg *Migrator) pollAgent(ctx context.Context, conf AgentConfig, last *Report) (*Report, error) {
+	endpoint, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control endpoint: %w", err)
+	}
+	query := endpoint.Query()
+	query.Set("target", conf.Target)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conf.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error polling for a plan: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("error polling for a plan: control endpoint responded %s", resp.Status)
+	}
+	bundle, err := conf.Codec.DecodeBundle(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if conf.PublicKey != nil {
+		err = bundle.Verify(conf.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("refusing plan: %w", err)
+		}
+	}
+
+	report := last
+	if report == nil || report.Bundle != bundle.Digest {
+		report = mg.runBundle(ctx, bundle)
+	}
+	err = mg.sendReport(ctx, conf, endpoint.String(), *report)
+	if err == nil && !report.OK {
+		err = fmt.Errorf("plan %s failed: %s", report.Bundle, report.Error)
+	}
+	return report, err
+}
+
+// runBundle runs the pending migrations of a bundle and describes the result
+func (mg *Migrator) runBundle(ctx context.Context, bundle Bundle) *Report {
+	var result Result
+	registry, err := bundle.Registry()
+	if err == nil {
+		sub := *mg
+		sub.registry = registry
+		if mg.logger != nil {
+			mg.logger.Printf("migrate :: agent running plan %s of %d migrations", bundle.Digest, len(bundle.Migrations))
+		}
+		result, err = sub.RunLatestReportContext(ctx, false, false)
+	}
+	report := NewReport(result, err)
+	report.Bundle = bundle.Digest
+	return &report
+}
+
+// sendReport POSTs a report to the control endpoint
+func (mg *Migrator) sendReport(ctx context.Context, conf AgentConfig, endpoint string, report Report) error {
+	var body bytes.Buffer
+	err := conf.Codec.EncodeReport(&body, report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", conf.ContentType)
+	resp, err := conf.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending report: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error sending report: control endpoint responded %s", resp.Status)
+	}
+	return nil
+}
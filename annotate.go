@@ -0,0 +1,148 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Severity is the level of a Finding. Its values match the GitHub Actions
+// workflow commands they are written as.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityNotice  Severity = "notice"
+)
+
+// Finding is a problem with a registered or applied migration, located at the
+// file and line the migration was registered from where that is known
+type Finding struct {
+	Severity  Severity
+	Migration string
+	File      string
+	// Line is 0 when the migration was loaded from a file of its own
+	Line    int
+	Message string
+}
+
+// Check compares the default registry with the migrations applied to db. See
+// Migrator.Check.
+func Check(db DBTX) ([]Finding, error) {
+	return defaultMigrator(db, nil).CheckContext(context.Background())
+}
+
+// Check compares the Migrator's registry with the migrations applied to its
+// database. A migration edited since it was applied is an error; a migration
+// applied but no longer registered is a warning.
+func (mg *Migrator) Check() ([]Finding, error) {
+	return mg.CheckContext(context.Background())
+}
+
+// CheckContext is like Check, with a context
+func (mg *Migrator) CheckContext(ctx context.Context) ([]Finding, error) {
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	findings := []Finding{}
+	registered := map[string]bool{}
+	for _, m := range mg.registry.Migrations() {
+		registered[m.Name] = true
+		hash, hasRun := applied[m.Name]
+		if !hasRun || m.matchesHash(hash) || m.Repeatable {
+			continue
+		}
+		file, line := mg.registry.location(m.Name)
+		findings = append(findings, Finding{
+			Severity:  SeverityError,
+			Migration: m.Name,
+			File:      file,
+			Line:      line,
+			Message:   fmt.Sprintf("migration '%s' has changed since it was applied", m.Name),
+		})
+	}
+
+	unregistered := []string{}
+	for name := range applied {
+		if !registered[name] {
+			unregistered = append(unregistered, name)
+		}
+	}
+	sort.Strings(unregistered)
+	for _, name := range unregistered {
+		findings = append(findings, Finding{
+			Severity:  SeverityWarning,
+			Migration: name,
+			Message:   fmt.Sprintf("migration '%s' has been applied but is not registered", name),
+		})
+	}
+
+	return findings, nil
+}
+
+// location splits the recorded registration site of a migration into a file
+// and line
+func (r *Registry) location(name string) (string, int) {
+	from, ok := r.registeredAt(name)
+	if !ok {
+		return "", 0
+	}
+	i := strings.LastIndex(from, ":")
+	if i < 0 {
+		return from, 0
+	}
+	line, err := strconv.Atoi(from[i+1:])
+	if err != nil {
+		return from, 0
+	}
+	return from[:i], line
+}
+
+// WriteGitHubAnnotations writes findings as GitHub Actions workflow commands,
+// so they appear inline on the pull request that introduced them. Files are
+// made relative to GITHUB_WORKSPACE when it is set.
+func WriteGitHubAnnotations(w io.Writer, findings []Finding) error {
+	workspace := os.Getenv("GITHUB_WORKSPACE")
+	for _, f := range findings {
+		props := []string{"title=" + escapeProperty("moogration: "+f.Migration)}
+		if f.File != "" {
+			file := f.File
+			if workspace != "" {
+				if rel, err := filepath.Rel(workspace, file); err == nil && !strings.HasPrefix(rel, "..") {
+					file = filepath.ToSlash(rel)
+				}
+			}
+			props = append(props, "file="+escapeProperty(file))
+			if f.Line > 0 {
+				props = append(props, "line="+strconv.Itoa(f.Line))
+			}
+		}
+		_, err := fmt.Fprintf(w, "::%s %s::%s\n", f.Severity, strings.Join(props, ","), escapeData(f.Message))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeData escapes a workflow command's message
+func escapeData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+// escapeProperty escapes a workflow command property value
+func escapeProperty(s string) string {
+	s = escapeData(s)
+	s = strings.ReplaceAll(s, ":", "%3A")
+	return strings.ReplaceAll(s, ",", "%2C")
+}
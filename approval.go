@@ -0,0 +1,156 @@
+package moogration
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrBatchRejected is wrapped by the error of a run whose batch was rejected
+// by the approver set with WithBatchApproval
+var ErrBatchRejected = errors.New("batch was not approved")
+
+// BatchApproval asks an external system, such as a deployment pipeline, to
+// approve a batch before it runs
+type BatchApproval struct {
+	// ID identifies the request, and is the same each time the same batch
+	// is submitted, so an approver can poll with it
+	ID string `json:"id"`
+	// Operation is "run" for RunLatest and "rollback" for Rollback
+	Operation string `json:"operation"`
+	// Direction is "up" or "down"
+	Direction string `json:"direction"`
+	Batch     int    `json:"batch"`
+	// Plan is the migrations the batch will run, in order
+	Plan []PlannedMigration `json:"plan"`
+}
+
+// Approver approves a batch by returning nil, or rejects it by returning an
+// error. It may block until a decision is made, and should return ctx's
+// error if ctx is done first.
+type Approver func(ctx context.Context, req BatchApproval) error
+
+// WithBatchApproval makes RunLatest and Rollback ask approve before each
+// batch, once the migration lock is held, so an orchestrator can gate each
+// batch as a deployment stage. A batch with nothing to run isn't submitted.
+// A rejected batch ends the run before any of its migrations, with an error
+// wrapping ErrBatchRejected. See WebhookApprover.
+func WithBatchApproval(approve Approver) Option {
+	return func(m *Migrator) {
+		m.approve = approve
+	}
+}
+
+// requestApproval submits a batch to the approver, if one is set
+func (mg *Migrator) requestApproval(ctx context.Context, operation string, down bool, batch int, plan []PlannedMigration) error {
+	if mg.approve == nil || len(plan) == 0 {
+		return nil
+	}
+	req := BatchApproval{Operation: operation, Direction: direction(down), Batch: batch, Plan: plan}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d", mg.qualifiedTable(), req.Operation, req.Direction, req.Batch)
+	for _, p := range plan {
+		fmt.Fprintf(h, "\x00%s", p.Name)
+	}
+	req.ID = hex.EncodeToString(h.Sum(nil))[:16]
+
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: waiting for approval of batch %d (%d migrations, starting with %s)", batch, len(plan), plan[0].Name)
+	}
+	err := mg.approve(ctx, req)
+	if err != nil {
+		mg.audit("batch %d (%s %s, %d migrations) was not approved: %s", batch, req.Operation, req.Direction, len(plan), err)
+		return fmt.Errorf("%w: batch %d: %w", ErrBatchRejected, batch, err)
+	}
+	mg.audit("batch %d (%s %s, %d migrations) was approved", batch, req.Operation, req.Direction, len(plan))
+	return nil
+}
+
+// webhookPollInterval is how long WebhookApprover waits before submitting a
+// pending request again, if the response has no Retry-After header
+var webhookPollInterval = 5 * time.Second
+
+// WebhookApprover returns an Approver that POSTs each BatchApproval as JSON
+// to url, using client, or http.DefaultClient if it is nil. The endpoint
+// responds with one of:
+//
+//   - 200 OK with a JSON body {"approved": true} to approve the batch, or
+//     {"approved": false, "reason": "..."} to reject it
+//   - 202 Accepted while the decision is pending: the request is POSTed
+//     again, with the same id, after the number of seconds in the
+//     Retry-After header, or 5 seconds
+//
+// Any other status rejects the batch. The Approver blocks until a decision
+// is made or ctx is done.
+func WebhookApprover(url string, client *http.Client) Approver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context, req BatchApproval) error {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		for {
+			wait, err := postApproval(ctx, client, url, body)
+			if err != nil || wait == 0 {
+				return err
+			}
+			err = sleep(ctx, wait)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// postApproval submits an approval request once. It returns how long to wait
+// before submitting it again if the decision is pending, or else the
+// decision.
+func postApproval(ctx context.Context, client *http.Client, url string, body []byte) (time.Duration, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("error requesting approval: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		io.Copy(io.Discard, resp.Body)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, nil
+		}
+		return webhookPollInterval, nil
+	case http.StatusOK:
+		var decision struct {
+			Approved bool   `json:"approved"`
+			Reason   string `json:"reason"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&decision)
+		if err != nil {
+			return 0, fmt.Errorf("error reading approval: %w", err)
+		}
+		if !decision.Approved {
+			if decision.Reason == "" {
+				decision.Reason = "rejected"
+			}
+			return 0, errors.New(decision.Reason)
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("approval endpoint responded %s", resp.Status)
+	}
+}
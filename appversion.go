@@ -0,0 +1,105 @@
+package moogration
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrAppVersion is wrapped by the error of a run refused because a pending
+// migration requires a newer application than the one running it
+var ErrAppVersion = errors.New("migration requires a newer application")
+
+// WithAppVersion sets the version of the running application, such as
+// "1.4.2", which pending migrations' MinAppVersion is compared against. A run
+// refuses to start, with an error wrapping ErrAppVersion, if any migration it
+// would apply requires a newer version, so a replica of an old release that
+// migrates on boot doesn't land schema changes ahead of the code that
+// understands them. Without it, MinAppVersion isn't checked.
+func WithAppVersion(version string) Option {
+	return func(m *Migrator) {
+		m.appVersion = version
+	}
+}
+
+// checkAppVersion refuses pending migrations that require a newer
+// application than the one set with WithAppVersion
+func (mg *Migrator) checkAppVersion(pending []Migration) error {
+	if mg.appVersion == "" {
+		return nil
+	}
+	for _, m := range pending {
+		if m.MinAppVersion == "" {
+			continue
+		}
+		cmp, err := compareVersions(m.MinAppVersion, mg.appVersion)
+		if err != nil {
+			return fmt.Errorf("error checking the application version of migration '%s': %w", m.Name, err)
+		}
+		if cmp > 0 {
+			return fmt.Errorf("%w: '%s' requires %s, but %s is running", ErrAppVersion, m.Name, m.MinAppVersion, mg.appVersion)
+		}
+	}
+	return nil
+}
+
+// compareVersions compares two dotted versions, such as "v1.4.2" or
+// "1.5.0-rc.1", returning -1, 0 or 1 as a is older than, the same as or newer
+// than b. Missing components are zero, and a pre-release is older than its
+// release; pre-releases of the same version are compared as strings.
+func compareVersions(a, b string) (int, error) {
+	aNums, aPre, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bNums, bPre, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(aNums) || i < len(bNums); i++ {
+		var x, y int
+		if i < len(aNums) {
+			x = aNums[i]
+		}
+		if i < len(bNums) {
+			y = bNums[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0, nil
+	case aPre == "":
+		return 1, nil
+	case bPre == "":
+		return -1, nil
+	case aPre < bPre:
+		return -1, nil
+	default:
+		return 1, nil
+	}
+}
+
+// parseVersion splits a version into its numeric components and its
+// pre-release, dropping a leading "v" and any build metadata
+func parseVersion(v string) ([]int, string, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(v), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, _ := strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("invalid version %q", v)
+		}
+		nums[i] = n
+	}
+	return nums, pre, nil
+}
@@ -0,0 +1,162 @@
+package moogration
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// AuditTable declares a table whose inserts, updates and deletes are recorded
+// in a history table by triggers generated with WithAudit
+type AuditTable struct {
+	Name string
+	// Columns are captured in each history row. They are required on MySQL
+	// and SQLite; on PostgreSQL the whole row is captured if none are given.
+	Columns []string
+}
+
+// WithAudit registers a repeatable migration, named audit_<table>, for each
+// table, which creates a <table>_history table and triggers recording every
+// insert, update and delete as a JSON copy of the row. Changing a table's
+// columns re-runs its migration to replace the triggers. Rolling it back
+// drops the triggers but keeps the history. The migrations are generated for
+// the Migrator's dialect and added to its registry by New. If a MySQL or
+// SQLite table has no Columns, none are added and the Migrator's runs return
+// the error.
+func WithAudit(tables ...AuditTable) Option {
+	return func(m *Migrator) {
+		m.auditTables = append(m.auditTables, tables...)
+	}
+}
+
+// registerAudit adds the audit migrations declared with WithAudit to the
+// registry, unless a previous Migrator sharing it already has. An error is
+// recorded for runs to return.
+func (mg *Migrator) registerAudit() {
+	migrations := make([]Migration, 0, len(mg.auditTables))
+	for _, table := range mg.auditTables {
+		migration, err := auditMigration(mg.driver, table)
+		if err != nil {
+			mg.auditErr = err
+			return
+		}
+		migrations = append(migrations, migration)
+	}
+	mg.registry.registerMissing("moogration audit", migrations...)
+}
+
+// auditMigration generates the repeatable migration auditing a table
+func auditMigration(d driver, table AuditTable) (Migration, error) {
+	up, ok := auditUp[d]
+	if !ok {
+		return Migration{}, fmt.Errorf("audit triggers are not supported for dialect \"%s\"", d)
+	}
+	if len(table.Columns) == 0 && d != postgres {
+		return Migration{}, fmt.Errorf("audit table '%s' needs Columns on %s", table.Name, d)
+	}
+
+	data := struct {
+		Table   string
+		Columns []string
+	}{table.Name, table.Columns}
+	var upSQL, downSQL bytes.Buffer
+	err := up.Execute(&upSQL, data)
+	if err != nil {
+		return Migration{}, err
+	}
+	err = auditDown[d].Execute(&downSQL, data)
+	if err != nil {
+		return Migration{}, err
+	}
+	return Migration{
+		Name:        "audit_" + table.Name,
+		Description: fmt.Sprintf("Audit history of %s", table.Name),
+		Up:          upSQL.String(),
+		Down:        downSQL.String(),
+		Repeatable:  true,
+	}, nil
+}
+
+// jsonPairs renders the arguments of a JSON object function copying the
+// named columns of row (NEW or OLD)
+func jsonPairs(row string, columns []string) string {
+	pairs := make([]string, len(columns))
+	for i, c := range columns {
+		pairs[i] = fmt.Sprintf("'%s', %s.%s", c, row, c)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+var auditFuncs = template.FuncMap{"json": jsonPairs}
+
+var auditUp = map[driver]*template.Template{
+	sqlite: template.Must(template.New("").Funcs(auditFuncs).Parse(`CREATE TABLE IF NOT EXISTS {{ .Table }}_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	operation TEXT NOT NULL,
+	changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	row_data TEXT
+);
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_insert;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_update;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_delete;
+CREATE TRIGGER {{ .Table }}_audit_insert AFTER INSERT ON {{ .Table }} BEGIN
+	INSERT INTO {{ .Table }}_history (operation, row_data) VALUES ('INSERT', json_object({{ json "NEW" .Columns }}));
+END;
+CREATE TRIGGER {{ .Table }}_audit_update AFTER UPDATE ON {{ .Table }} BEGIN
+	INSERT INTO {{ .Table }}_history (operation, row_data) VALUES ('UPDATE', json_object({{ json "NEW" .Columns }}));
+END;
+CREATE TRIGGER {{ .Table }}_audit_delete AFTER DELETE ON {{ .Table }} BEGIN
+	INSERT INTO {{ .Table }}_history (operation, row_data) VALUES ('DELETE', json_object({{ json "OLD" .Columns }}));
+END;
+`)),
+	mysql: template.Must(template.New("").Funcs(auditFuncs).Parse(`CREATE TABLE IF NOT EXISTS {{ .Table }}_history (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	operation VARCHAR(6) NOT NULL,
+	changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	row_data JSON
+);
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_insert;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_update;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_delete;
+CREATE TRIGGER {{ .Table }}_audit_insert AFTER INSERT ON {{ .Table }} FOR EACH ROW
+	INSERT INTO {{ .Table }}_history (operation, row_data) VALUES ('INSERT', JSON_OBJECT({{ json "NEW" .Columns }}));
+CREATE TRIGGER {{ .Table }}_audit_update AFTER UPDATE ON {{ .Table }} FOR EACH ROW
+	INSERT INTO {{ .Table }}_history (operation, row_data) VALUES ('UPDATE', JSON_OBJECT({{ json "NEW" .Columns }}));
+CREATE TRIGGER {{ .Table }}_audit_delete AFTER DELETE ON {{ .Table }} FOR EACH ROW
+	INSERT INTO {{ .Table }}_history (operation, row_data) VALUES ('DELETE', JSON_OBJECT({{ json "OLD" .Columns }}));
+`)),
+	postgres: template.Must(template.New("").Funcs(auditFuncs).Parse(`CREATE TABLE IF NOT EXISTS {{ .Table }}_history (
+	id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	operation VARCHAR(6) NOT NULL,
+	changed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	row_data JSONB
+);
+CREATE OR REPLACE FUNCTION {{ .Table }}_audit() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		INSERT INTO {{ .Table }}_history (operation, row_data) VALUES (TG_OP, {{ if .Columns }}jsonb_build_object({{ json "OLD" .Columns }}){{ else }}to_jsonb(OLD){{ end }});
+		RETURN OLD;
+	END IF;
+	INSERT INTO {{ .Table }}_history (operation, row_data) VALUES (TG_OP, {{ if .Columns }}jsonb_build_object({{ json "NEW" .Columns }}){{ else }}to_jsonb(NEW){{ end }});
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit ON {{ .Table }};
+CREATE TRIGGER {{ .Table }}_audit AFTER INSERT OR UPDATE OR DELETE ON {{ .Table }} FOR EACH ROW EXECUTE FUNCTION {{ .Table }}_audit();
+`)),
+}
+
+var auditDown = map[driver]*template.Template{
+	sqlite: template.Must(template.New("").Parse(`DROP TRIGGER IF EXISTS {{ .Table }}_audit_insert;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_update;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_delete;
+`)),
+	mysql: template.Must(template.New("").Parse(`DROP TRIGGER IF EXISTS {{ .Table }}_audit_insert;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_update;
+DROP TRIGGER IF EXISTS {{ .Table }}_audit_delete;
+`)),
+	postgres: template.Must(template.New("").Parse(`DROP TRIGGER IF EXISTS {{ .Table }}_audit ON {{ .Table }};
+DROP FUNCTION IF EXISTS {{ .Table }}_audit();
+`)),
+}
@@ -0,0 +1,99 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Baseline records the migrations in the default registry up to through as
+// applied, without running them. See Migrator.Baseline.
+func Baseline(db DBTX, through string, logger *log.Logger) ([]string, error) {
+	return defaultMigrator(db, logger).BaselineContext(context.Background(), through)
+}
+
+// Baseline adopts a database whose schema already exists: every registered
+// migration sorting up to and including the migration named through, and
+// not yet applied, is recorded as applied in batch 0 with its current hash,
+// without its SQL being run. Later migrations then run as usual. Batch 0 is
+// never rolled back by Rollback or RollbackAll, as its migrations weren't
+// applied by moogration. It returns the names of the migrations recorded.
+func (mg *Migrator) Baseline(through string) ([]string, error) {
+	return mg.BaselineContext(context.Background(), through)
+}
+
+// BaselineContext is like Baseline, with a context
+func (mg *Migrator) BaselineContext(ctx context.Context, through string) (baselined []string, err error) {
+	if err := mg.refuseDryRun("Baseline"); err != nil {
+		return nil, err
+	}
+	if err := mg.refuseStrict("Baseline"); err != nil {
+		return nil, err
+	}
+	if len(mg.groups) > 0 {
+		return nil, fmt.Errorf("Baseline is not supported with migration groups")
+	}
+	if _, ok := mg.registry.Get(through); !ok {
+		return nil, fmt.Errorf("baseline migration '%s' is not registered", through)
+	}
+
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+	err = mg.withLock(ctx, func(mg *Migrator) error {
+		state.set("", "baseline")
+		baselined, err = mg.baseline(ctx, through)
+		return err
+	})
+	return baselined, err
+}
+
+func (mg *Migrator) baseline(ctx context.Context, through string) ([]string, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	pending := []Migration{}
+	for _, m := range mg.registry.Migrations() {
+		if _, hasRun := applied[m.Name]; !hasRun && m.Name <= through {
+			pending = append(pending, m)
+		}
+	}
+	baselined := []string{}
+	if len(pending) == 0 {
+		return baselined, nil
+	}
+
+	var db DBTX = mg.db
+	tx, err := begin(ctx, mg.db)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction for baseline: %w", err)
+	}
+	if tx != nil {
+		db = tx
+	}
+	stmt := mg.stmt("INSERT INTO %s (name, sql_hash, batch, applied_by) VALUES (?, ?, 0, ?)")
+	for _, m := range pending {
+		_, err := db.ExecContext(ctx, stmt, m.Name, m.hash(), mg.applier())
+		if err != nil {
+			if tx != nil {
+				tx.Rollback()
+			}
+			return nil, fmt.Errorf("error inserting baseline record for migration '%s': %w", m.Name, err)
+		}
+		baselined = append(baselined, m.Name)
+	}
+	if tx != nil {
+		err = tx.Commit()
+		if err != nil {
+			return nil, fmt.Errorf("error committing baseline records: %w", err)
+		}
+	}
+
+	mg.audit("baselined %d migrations through '%s' without running them", len(baselined), through)
+	return baselined, nil
+}
@@ -0,0 +1,242 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Risk grades the impact of a statement on a live database
+type Risk string
+
+const (
+	RiskLow  Risk = "low"
+	RiskHigh Risk = "high"
+)
+
+// Impact describes what a single statement of a pending migration touches
+type Impact struct {
+	Migration string
+	Statement string
+	// Operation is the kind of statement, e.g. "ALTER TABLE" or "DELETE"
+	Operation string
+	Table     string
+	Columns   []string
+	Index     string
+	Risk      Risk
+	// Reasons explains a high risk
+	Reasons []string
+}
+
+// BlastRadius analyzes the migrations in the default registry pending on db.
+// See Migrator.BlastRadius.
+func BlastRadius(db DBTX, hotTables []string) ([]Impact, error) {
+	return defaultMigrator(db, nil).BlastRadiusContext(context.Background(), hotTables)
+}
+
+// BlastRadius reports the tables, columns and indexes each statement of the
+// pending migrations touches, in the order they would run. Statements that
+// destroy data, rewrite or lock a table, or touch one of hotTables are
+// graded RiskHigh. The analysis matches common statement shapes rather than
+// parsing SQL, so unrecognized statements are reported with only their
+// operation.
+func (mg *Migrator) BlastRadius(hotTables []string) ([]Impact, error) {
+	return mg.BlastRadiusContext(context.Background(), hotTables)
+}
+
+// BlastRadiusContext is like BlastRadius, with a context
+func (mg *Migrator) BlastRadiusContext(ctx context.Context, hotTables []string) ([]Impact, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	hot := map[string]bool{}
+	for _, table := range hotTables {
+		hot[strings.ToLower(table)] = true
+	}
+
+	impacts := []Impact{}
+	for _, m := range mg.registry.Migrations() {
+		if _, hasRun := applied[m.Name]; hasRun {
+			continue
+		}
+		for _, stmt := range splitStatements(m.Up) {
+			impact := analyzeStatement(stmt)
+			impact.Migration = m.Name
+			if hot[strings.ToLower(impact.Table)] && impact.Operation != "CREATE TABLE" {
+				impact.Risk = RiskHigh
+				impact.Reasons = append(impact.Reasons, fmt.Sprintf("table '%s' is hot", impact.Table))
+			}
+			impacts = append(impacts, impact)
+		}
+	}
+	return impacts, nil
+}
+
+// HighRisk returns the impacts graded RiskHigh
+func HighRisk(impacts []Impact) []Impact {
+	high := []Impact{}
+	for _, impact := range impacts {
+		if impact.Risk == RiskHigh {
+			high = append(high, impact)
+		}
+	}
+	return high
+}
+
+const identifier = "([`\"\\[]?[\\w.]+[`\"\\]]?)"
+
+var (
+	reCreateTable = regexp.MustCompile(`(?is)^CREATE\s+(?:TEMPORARY\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?` + identifier)
+	reDropTable   = regexp.MustCompile(`(?is)^DROP\s+TABLE\s+(?:IF\s+EXISTS\s+)?` + identifier)
+	reAlterTable  = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(?:ONLY\s+)?(?:IF\s+EXISTS\s+)?` + identifier + `\s+(.*)$`)
+	reCreateIndex = regexp.MustCompile(`(?is)^CREATE\s+(?:UNIQUE\s+)?INDEX\s+(CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?` + identifier + `\s+ON\s+` + identifier + `\s*(?:USING\s+\w+\s*)?\(([^)]*)\)`)
+	reDropIndex   = regexp.MustCompile(`(?is)^DROP\s+INDEX\s+(?:CONCURRENTLY\s+)?(?:IF\s+EXISTS\s+)?` + identifier + `(?:\s+ON\s+` + identifier + `)?`)
+	reRenameTable = regexp.MustCompile(`(?is)^RENAME\s+TABLE\s+` + identifier)
+	reTruncate    = regexp.MustCompile(`(?is)^TRUNCATE\s+(?:TABLE\s+)?` + identifier)
+	reDelete      = regexp.MustCompile(`(?is)^DELETE\s+FROM\s+` + identifier)
+	reUpdate      = regexp.MustCompile(`(?is)^UPDATE\s+` + identifier + `\s+SET\s+(.*)$`)
+	reInsert      = regexp.MustCompile(`(?is)^(?:INSERT|REPLACE)\s+(?:IGNORE\s+)?INTO\s+` + identifier)
+	reWhere       = regexp.MustCompile(`(?is)\bWHERE\b`)
+	reAlterAction = regexp.MustCompile(`(?is)^(ADD|DROP|MODIFY|CHANGE|ALTER|RENAME)\s+(?:COLUMN\s+)?(?:IF\s+(?:NOT\s+)?EXISTS\s+)?` + identifier)
+	reSetColumn   = regexp.MustCompile(`(?is)(?:^|,)\s*` + identifier + `\s*=`)
+)
+
+// analyzeStatement reports what a single statement touches
+func analyzeStatement(stmt string) Impact {
+	impact := Impact{Statement: stmt, Risk: RiskLow}
+	high := func(reason string) {
+		impact.Risk = RiskHigh
+		impact.Reasons = append(impact.Reasons, reason)
+	}
+
+	switch {
+	case reCreateTable.MatchString(stmt):
+		impact.Operation = "CREATE TABLE"
+		impact.Table = unquote(reCreateTable.FindStringSubmatch(stmt)[1])
+	case reDropTable.MatchString(stmt):
+		impact.Operation = "DROP TABLE"
+		impact.Table = unquote(reDropTable.FindStringSubmatch(stmt)[1])
+		high("drops a table and its data")
+	case reAlterTable.MatchString(stmt):
+		match := reAlterTable.FindStringSubmatch(stmt)
+		impact.Operation = "ALTER TABLE"
+		impact.Table = unquote(match[1])
+		for _, action := range splitTopLevel(match[2]) {
+			analyzeAlterAction(&impact, strings.TrimSpace(action), high)
+		}
+	case reCreateIndex.MatchString(stmt):
+		match := reCreateIndex.FindStringSubmatch(stmt)
+		impact.Operation = "CREATE INDEX"
+		impact.Index = unquote(match[2])
+		impact.Table = unquote(match[3])
+		for _, col := range strings.Split(match[4], ",") {
+			if fields := strings.Fields(col); len(fields) > 0 {
+				impact.Columns = append(impact.Columns, unquote(fields[0]))
+			}
+		}
+		if match[1] == "" {
+			high("builds an index while blocking writes")
+		}
+	case reDropIndex.MatchString(stmt):
+		match := reDropIndex.FindStringSubmatch(stmt)
+		impact.Operation = "DROP INDEX"
+		impact.Index = unquote(match[1])
+		impact.Table = unquote(match[2])
+	case reRenameTable.MatchString(stmt):
+		impact.Operation = "RENAME TABLE"
+		impact.Table = unquote(reRenameTable.FindStringSubmatch(stmt)[1])
+		high("renames a table out from under running code")
+	case reTruncate.MatchString(stmt):
+		impact.Operation = "TRUNCATE"
+		impact.Table = unquote(reTruncate.FindStringSubmatch(stmt)[1])
+		high("deletes every row")
+	case reDelete.MatchString(stmt):
+		impact.Operation = "DELETE"
+		impact.Table = unquote(reDelete.FindStringSubmatch(stmt)[1])
+		if !reWhere.MatchString(stmt) {
+			high("deletes every row")
+		}
+	case reUpdate.MatchString(stmt):
+		match := reUpdate.FindStringSubmatch(stmt)
+		impact.Operation = "UPDATE"
+		impact.Table = unquote(match[1])
+		set := reWhere.Split(match[2], 2)[0]
+		for _, col := range reSetColumn.FindAllStringSubmatch(set, -1) {
+			impact.Columns = append(impact.Columns, unquote(col[1]))
+		}
+		if !reWhere.MatchString(match[2]) {
+			high("updates every row")
+		}
+	case reInsert.MatchString(stmt):
+		impact.Operation = "INSERT"
+		impact.Table = unquote(reInsert.FindStringSubmatch(stmt)[1])
+	default:
+		if fields := strings.Fields(stmt); len(fields) > 0 {
+			impact.Operation = strings.ToUpper(fields[0])
+		}
+	}
+	return impact
+}
+
+// analyzeAlterAction records a single action of an ALTER TABLE statement
+func analyzeAlterAction(impact *Impact, action string, high func(string)) {
+	match := reAlterAction.FindStringSubmatch(action)
+	if match == nil {
+		return
+	}
+	verb := strings.ToUpper(match[1])
+	name := unquote(match[2])
+	switch strings.ToUpper(name) {
+	case "INDEX", "KEY", "CONSTRAINT", "PRIMARY", "UNIQUE", "FOREIGN", "TO":
+		// not a column: ADD INDEX ..., DROP CONSTRAINT ..., RENAME TO ...
+		if verb == "RENAME" {
+			high("renames a table out from under running code")
+		}
+		return
+	}
+	impact.Columns = append(impact.Columns, name)
+	switch verb {
+	case "DROP":
+		high(fmt.Sprintf("drops column '%s' and its data", name))
+	case "MODIFY", "CHANGE":
+		high(fmt.Sprintf("changes the definition of column '%s', which may rewrite the table", name))
+	case "RENAME":
+		high(fmt.Sprintf("renames column '%s' out from under running code", name))
+	case "ADD":
+		if strings.Contains(strings.ToUpper(action), "NOT NULL") && !strings.Contains(strings.ToUpper(action), "DEFAULT") {
+			high(fmt.Sprintf("adds NOT NULL column '%s' without a default", name))
+		}
+	}
+}
+
+// splitTopLevel splits s on commas outside parentheses
+func splitTopLevel(s string) []string {
+	parts := []string{}
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote strips identifier quoting
+func unquote(name string) string {
+	return strings.Trim(name, "`\"[]")
+}
@@ -0,0 +1,239 @@
+package moogration
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// bundleFormat is the version of the Bundle format written by NewBundle
+const bundleFormat = 1
+
+// Bundle is the serializable form of a set of SQL migrations, with their
+// hashes and metadata, so a control plane can ship a migration plan to
+// agents running next to each database. Agents rebuild a registry from it
+// with Registry, and report back with a Report.
+type Bundle struct {
+	Format int `json:"format"`
+	// Digest fingerprints the migrations, with all their metadata, so
+	// Registry can detect a bundle corrupted in transit and a Report can
+	// name the bundle it is for. It isn't keyed: anyone who can edit the
+	// bundle can recompute it, so only Signature detects a deliberate edit.
+	Digest     string             `json:"digest"`
+	Migrations []BundledMigration `json:"migrations"`
+	// Signature is the ed25519 signature of Digest by the control plane,
+	// base64 encoded, set by Sign and checked by Verify
+	Signature string `json:"signature,omitempty"`
+}
+
+// BundledMigration is a Migration in a Bundle. Durations are in
+// milliseconds.
+type BundledMigration struct {
+	Name            string            `json:"name"`
+	Hash            string            `json:"hash"`
+	Up              string            `json:"up"`
+	Down            string            `json:"down"`
+	Version         string            `json:"version,omitempty"`
+	Description     string            `json:"description,omitempty"`
+	Tags            []string          `json:"tags,omitempty"`
+	Group           string            `json:"group,omitempty"`
+	NoTransaction   bool              `json:"no_transaction,omitempty"`
+	SkipReplication bool              `json:"skip_replication,omitempty"`
+	EstimateMS      int64             `json:"estimate_ms,omitempty"`
+	TimeoutMS       int64             `json:"timeout_ms,omitempty"`
+	ManualRollback  string            `json:"manual_rollback,omitempty"`
+	FollowUps       []BundledFollowUp `json:"follow_ups,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Repeatable      bool              `json:"repeatable,omitempty"`
+	AllowTableCopy  bool              `json:"allow_table_copy,omitempty"`
+	ForeignKeysOff  bool              `json:"foreign_keys_off,omitempty"`
+	Squashes        []string          `json:"squashes,omitempty"`
+	MinAppVersion   string            `json:"min_app_version,omitempty"`
+}
+
+// BundledFollowUp is a FollowUp in a Bundle
+type BundledFollowUp struct {
+	Name    string `json:"name"`
+	SQL     string `json:"sql"`
+	AfterMS int64  `json:"after_ms"`
+}
+
+// NewBundle bundles migrations, sorted by name. Go migrations can't be
+// bundled, as their code can't be serialized.
+func NewBundle(migrations []Migration) (Bundle, error) {
+	sorted := cloneMigrations(migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	b := Bundle{Format: bundleFormat, Migrations: make([]BundledMigration, len(sorted))}
+	for i, m := range sorted {
+		if m.UpFunc != nil || m.DownFunc != nil {
+			return Bundle{}, fmt.Errorf("cannot bundle Go migration '%s'", m.Name)
+		}
+		bm := BundledMigration{
+			Name:            m.Name,
+			Hash:            m.hash(),
+			Up:              m.Up,
+			Down:            m.Down,
+			Version:         m.Version,
+			Description:     m.Description,
+			Tags:            m.Tags,
+			Group:           m.Group,
+			NoTransaction:   m.NoTransaction,
+			SkipReplication: m.SkipReplication,
+			EstimateMS:      m.Estimate.Milliseconds(),
+			TimeoutMS:       m.Timeout.Milliseconds(),
+			ManualRollback:  m.ManualRollback,
+			Labels:          m.Labels,
+			Repeatable:      m.Repeatable,
+			AllowTableCopy:  m.AllowTableCopy,
+			ForeignKeysOff:  m.ForeignKeysOff,
+			Squashes:        m.Squashes,
+			MinAppVersion:   m.MinAppVersion,
+		}
+		for _, f := range m.FollowUps {
+			bm.FollowUps = append(bm.FollowUps, BundledFollowUp{Name: f.Name, SQL: f.SQL, AfterMS: f.After.Milliseconds()})
+		}
+		b.Migrations[i] = bm
+	}
+	b.Digest = b.digest()
+	return b, nil
+}
+
+// Bundle bundles the Migrator's registered migrations. See NewBundle.
+func (mg *Migrator) Bundle() (Bundle, error) {
+	return NewBundle(mg.registry.snapshot())
+}
+
+// digest fingerprints every field of the bundle's migrations, by their JSON
+// encoding, whose field order and map key order are fixed
+func (b Bundle) digest() string {
+	h := sha256.New()
+	// plain strings, numbers, slices and maps always encode
+	json.NewEncoder(h).Encode(b.Migrations)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Sign signs the bundle's digest with the control plane's key, so agents
+// holding its public key can refuse a bundle edited since with Verify
+func (b *Bundle) Sign(key ed25519.PrivateKey) {
+	b.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(b.Digest)))
+}
+
+// Verify returns an error unless the bundle was signed by the holder of
+// key's private key and its digest matches its migrations
+func (b Bundle) Verify(key ed25519.PublicKey) error {
+	if b.Signature == "" {
+		return errors.New("bundle is not signed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(b.Signature)
+	if err != nil || !ed25519.Verify(key, []byte(b.Digest), sig) {
+		return fmt.Errorf("bundle %s has an invalid signature", b.Digest)
+	}
+	if b.digest() != b.Digest {
+		return fmt.Errorf("bundle digest %s doesn't match its migrations", b.Digest)
+	}
+	return nil
+}
+
+// Registry returns a registry of the bundle's migrations, for an agent to
+// run with WithRegistry. It returns an error if the bundle's format is
+// newer than this package reads, or if a migration's SQL no longer matches
+// its hash or the bundle's digest doesn't match its migrations, as when the
+// bundle was corrupted in transit. It doesn't detect a deliberate edit,
+// which can recompute the hashes and digest; check a signed bundle with
+// Verify first.
+func (b Bundle) Registry() (*Registry, error) {
+	if b.Format > bundleFormat {
+		return nil, fmt.Errorf("bundle format %d is newer than the supported format %d", b.Format, bundleFormat)
+	}
+	if b.digest() != b.Digest {
+		return nil, fmt.Errorf("bundle digest %s doesn't match its migrations", b.Digest)
+	}
+	migrations := make([]Migration, len(b.Migrations))
+	for i, bm := range b.Migrations {
+		m := Migration{
+			Name:            bm.Name,
+			Up:              bm.Up,
+			Down:            bm.Down,
+			Version:         bm.Version,
+			Description:     bm.Description,
+			Tags:            bm.Tags,
+			Group:           bm.Group,
+			NoTransaction:   bm.NoTransaction,
+			SkipReplication: bm.SkipReplication,
+			Estimate:        time.Duration(bm.EstimateMS) * time.Millisecond,
+			Timeout:         time.Duration(bm.TimeoutMS) * time.Millisecond,
+			ManualRollback:  bm.ManualRollback,
+			Labels:          bm.Labels,
+			Repeatable:      bm.Repeatable,
+			AllowTableCopy:  bm.AllowTableCopy,
+			ForeignKeysOff:  bm.ForeignKeysOff,
+			Squashes:        bm.Squashes,
+			MinAppVersion:   bm.MinAppVersion,
+		}
+		for _, f := range bm.FollowUps {
+			m.FollowUps = append(m.FollowUps, FollowUp{Name: f.Name, SQL: f.SQL, After: time.Duration(f.AfterMS) * time.Millisecond})
+		}
+		if m.computeHash() != bm.Hash {
+			return nil, fmt.Errorf("migration '%s' doesn't match its hash in the bundle", bm.Name)
+		}
+		migrations[i] = m
+	}
+	r := NewRegistry()
+	r.register("bundle "+b.Digest, migrations...)
+	return r, nil
+}
+
+// Codec encodes and decodes bundles and reports for transfer between a
+// control plane and its agents. JSONCodec is built in; another wire format,
+// such as protocol buffers, can be plugged in by implementing Codec over the
+// same types.
+type Codec interface {
+	EncodeBundle(w io.Writer, b Bundle) error
+	DecodeBundle(r io.Reader) (Bundle, error)
+	EncodeReport(w io.Writer, r Report) error
+	DecodeReport(r io.Reader) (Report, error)
+}
+
+// JSONCodec encodes bundles and reports as JSON, with the field names of
+// their json tags
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) EncodeBundle(w io.Writer, b Bundle) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(b)
+}
+
+func (jsonCodec) DecodeBundle(r io.Reader) (Bundle, error) {
+	var b Bundle
+	err := json.NewDecoder(r).Decode(&b)
+	if err != nil {
+		return Bundle{}, fmt.Errorf("error decoding migration bundle: %w", err)
+	}
+	return b, nil
+}
+
+func (jsonCodec) EncodeReport(w io.Writer, r Report) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+func (jsonCodec) DecodeReport(r io.Reader) (Report, error) {
+	var report Report
+	err := json.NewDecoder(r).Decode(&report)
+	if err != nil {
+		return Report{}, fmt.Errorf("error decoding run report: %w", err)
+	}
+	return report, nil
+}
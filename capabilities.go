@@ -0,0 +1,71 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrMultiStatementsDisabled was wrapped into migration errors when a migration
+// containing several statements failed on a connection that could not execute
+// them.
+//
+// Deprecated: migrations are now split into statements executed one at a
+// time, so they no longer depend on multi-statement support.
+var ErrMultiStatementsDisabled = errors.New("connection does not accept multiple statements per Exec (for MySQL, add multiStatements=true to the DSN)")
+
+// Capabilities describes what the connected database and driver support
+type Capabilities struct {
+	// MultiStatements is true if a single Exec may contain several statements
+	MultiStatements bool
+	// TransactionalDDL is true if schema changes can be rolled back in a transaction
+	TransactionalDDL bool
+	// AdvisoryLocks is true if the database provides named advisory locks,
+	// unless WithMinimalPermissions avoids them
+	AdvisoryLocks bool
+}
+
+// DetectCapabilities probes the connection for the features migrations depend on
+func DetectCapabilities(db DBTX) (Capabilities, error) {
+	return New(db).DetectCapabilities()
+}
+
+// DetectCapabilities probes the Migrator's connection for the features
+// migrations depend on
+func (mg *Migrator) DetectCapabilities() (Capabilities, error) {
+	return mg.DetectCapabilitiesContext(context.Background())
+}
+
+// DetectCapabilitiesContext is like DetectCapabilities, with a context
+func (mg *Migrator) DetectCapabilitiesContext(ctx context.Context) (Capabilities, error) {
+	caps := Capabilities{}
+
+	_, err := mg.db.ExecContext(ctx, "SELECT 1; SELECT 1")
+	caps.MultiStatements = err == nil
+
+	switch mg.driver {
+	case mysql:
+		// MySQL implicitly commits DDL statements
+		caps.TransactionalDDL = false
+		if !mg.minimalPermissions {
+			var free sql.NullInt64
+			err := mg.db.QueryRowContext(ctx, "SELECT IS_FREE_LOCK('moogration')").Scan(&free)
+			caps.AdvisoryLocks = err == nil
+		}
+	case sqlite:
+		caps.TransactionalDDL = true
+		caps.AdvisoryLocks = false
+	case postgres:
+		caps.TransactionalDDL = true
+		caps.AdvisoryLocks = !mg.minimalPermissions
+	default:
+		return caps, fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+	if mg.dialect != nil {
+		caps.TransactionalDDL = mg.dialect.TransactionalDDL()
+		caps.AdvisoryLocks = caps.AdvisoryLocks && !mg.rowLock()
+	}
+
+	return caps, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// defaultConfigFile is read from the working directory if -config isn't given
+const defaultConfigFile = "moog.json"
+
+// config holds the connection and migration settings shared by every command
+type config struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+	Dir    string `json:"dir"`
+	Table  string `json:"table"`
+	Schema string `json:"schema"`
+}
+
+// configFlags registers the shared settings on a command's flag set. Their
+// values are only used if the flags are set explicitly.
+type configFlags struct {
+	file *string
+	set  *flag.FlagSet
+}
+
+func addConfigFlags(set *flag.FlagSet) *configFlags {
+	c := &configFlags{set: set}
+	c.file = set.String("config", "", "JSON config file (default moog.json, if present)")
+	set.String("driver", "", "database dialect: mysql or sqlite (env MOOG_DRIVER, default mysql)")
+	set.String("dsn", "", "data source name of the database (env MOOG_DSN)")
+	set.String("dir", "", "directory of .up.sql and .down.sql files (env MOOG_DIR, default migrations)")
+	set.String("table", "", "migration tracking table (env MOOG_TABLE, default migration)")
+	set.String("schema", "", "schema of the tracking table (env MOOG_SCHEMA)")
+	return c
+}
+
+// load resolves the settings: flags override the environment, which
+// overrides the config file, which overrides the defaults
+func (c *configFlags) load() (config, error) {
+	conf := config{Driver: "mysql", Dir: "migrations", Table: "migration"}
+
+	path := *c.file
+	data, err := os.ReadFile(orDefault(path, defaultConfigFile))
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, &conf)
+		if err != nil {
+			return conf, fmt.Errorf("error parsing config file: %w", err)
+		}
+	case errors.Is(err, fs.ErrNotExist) && path == "":
+		// the default config file is optional
+	default:
+		return conf, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	fields := map[string]*string{
+		"driver": &conf.Driver,
+		"dsn":    &conf.DSN,
+		"dir":    &conf.Dir,
+		"table":  &conf.Table,
+		"schema": &conf.Schema,
+	}
+	for name, field := range fields {
+		if value, ok := os.LookupEnv("MOOG_" + strings.ToUpper(name)); ok {
+			*field = value
+		}
+	}
+	c.set.Visit(func(f *flag.Flag) {
+		if field, ok := fields[f.Name]; ok {
+			*field = f.Value.String()
+		}
+	})
+	return conf, nil
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,646 @@
+// moog runs and inspects migrations stored as SQL files, such as
+// 001_create_users.up.sql and 001_create_users.down.sql, so a team can
+// migrate a database from CI without writing its own wrapper.
+//
+//	moog up -driver mysql -dsn 'user:pass@tcp(localhost:3306)/app' -dir migrations
+//
+// Connection settings are read from flags, then MOOG_* environment variables,
+// then a JSON config file (moog.json by default).
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nate-anderson/moogration"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
+)
+
+// errFailed ends a command that has already reported its failure
+var errFailed = errors.New("failed")
+
+// command is a moog subcommand. run receives the arguments after the
+// command name.
+type command struct {
+	usage string
+	run   func(args []string, out io.Writer) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"up":       {"run pending migrations", up},
+		"down":     {"run the down of every applied migration", down},
+		"rollback": {"roll back the latest batches", rollback},
+		"status":   {"list migrations and whether they are applied", status},
+		"verify":   {"check applied migrations haven't changed", verify},
+		"redo":     {"roll back and re-apply a single migration", redo},
+		"baseline": {"record migrations up to a name as applied without running them", baseline},
+		"create":   {"create a pair of migration files", create},
+		"squash":   {"replace the applied migrations with one dumped from the database", squash},
+		"plan":     {"list the migrations up or down would run", plan},
+		"script":   {"write a SQL script of the pending migrations for a DBA to run", script},
+		"doctor":   {"diagnose the database and tracking table", doctor},
+		"compat":   {"check pending migrations don't break the deployed application's queries", compat},
+		"agent":    {"poll a control endpoint for approved plans, apply them and report back", agent},
+		"init":     {"create a project with migrations, a registry, a config file and main.go", scaffold},
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs a command and returns the process's exit code
+func run(args []string, out, errOut io.Writer) int {
+	if len(args) == 0 {
+		usage(errOut)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(errOut)
+		return 2
+	}
+
+	err := cmd.run(args[1:], out)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 2
+	case errors.Is(err, errFailed):
+		return 1
+	default:
+		fmt.Fprintf(errOut, "moog %s: %s\n", args[0], err)
+		return 1
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: moog <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s%s\n", name, commands[name].usage)
+	}
+}
+
+// migrator opens the configured database and registers the migration files
+func migrator(conf config, opts ...moogration.Option) (*moogration.Migrator, *sql.DB, error) {
+	registry := moogration.NewRegistry()
+	err := registry.RegisterFS(os.DirFS(conf.Dir), ".")
+	if err != nil {
+		return nil, nil, err
+	}
+	return connect(conf, append(opts, moogration.WithRegistry(registry))...)
+}
+
+// connect opens the configured database
+func connect(conf config, opts ...moogration.Option) (*moogration.Migrator, *sql.DB, error) {
+	opts = append(opts,
+		moogration.WithTableName(conf.Table),
+		moogration.WithLogger(log.New(os.Stderr, "", log.LstdFlags)),
+	)
+	if conf.Schema != "" {
+		opts = append(opts, moogration.WithSchema(conf.Schema))
+	}
+	switch conf.Driver {
+	case "mysql":
+		opts = append(opts, moogration.WithMySQL())
+	case "sqlite":
+		opts = append(opts, moogration.WithSQLite())
+	default:
+		return nil, nil, fmt.Errorf("unsupported driver %q", conf.Driver)
+	}
+
+	db, err := sql.Open(conf.Driver, conf.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	return moogration.New(db, opts...), db, nil
+}
+
+// stealLock returns the options for -steal-lock, which makes a run take the
+// migration lock over from an instance that died holding it
+func stealLock(steal bool) []moogration.Option {
+	if !steal {
+		return nil
+	}
+	return []moogration.Option{moogration.WithStealLock()}
+}
+
+// approval returns the options for -approval-webhook, which makes a run ask
+// an orchestrator to approve each batch
+func approval(url string) []moogration.Option {
+	if url == "" {
+		return nil
+	}
+	return []moogration.Option{moogration.WithBatchApproval(moogration.WebhookApprover(url, nil))}
+}
+
+// parse parses a command's flags and loads the configuration
+func parse(set *flag.FlagSet, args []string) (config, error) {
+	conf := addConfigFlags(set)
+	err := set.Parse(args)
+	if err != nil {
+		return config{}, err
+	}
+	return conf.load()
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("moog "+name, flag.ContinueOnError)
+}
+
+func up(args []string, out io.Writer) error {
+	set := newFlagSet("up")
+	force := set.Bool("force", false, "run migrations that have changed since they were applied")
+	steal := set.Bool("steal-lock", false, "take the migration lock over from its holder, recording an audit entry")
+	webhook := set.String("approval-webhook", "", "URL asked to approve each batch before it runs")
+	asJSON := set.Bool("json", false, "print the result as JSON")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	m, db, err := migrator(conf, append(stealLock(*steal), approval(*webhook)...)...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return summarize(out, *asJSON)(m.RunLatestReport(false, *force))
+}
+
+func down(args []string, out io.Writer) error {
+	set := newFlagSet("down")
+	force := set.Bool("force", false, "roll back migrations that have changed since they were applied")
+	confirm := set.String("confirm", "", "in strict mode, the name of the most recently applied migration")
+	steal := set.Bool("steal-lock", false, "take the migration lock over from its holder, recording an audit entry")
+	interactive := set.Bool("interactive", false, "list the migrations to roll back and ask for confirmation")
+	webhook := set.String("approval-webhook", "", "URL asked to approve each batch before it runs")
+	asJSON := set.Bool("json", false, "print the result as JSON")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	opts := append(stealLock(*steal), moogration.WithDownConfirmation(*confirm))
+	opts = append(opts, approval(*webhook)...)
+	if *interactive {
+		opts = append(opts, moogration.WithConfirm(confirmer(os.Stdin, out)))
+	}
+	m, db, err := migrator(conf, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return summarize(out, *asJSON)(m.RunLatestReport(true, *force))
+}
+
+func rollback(args []string, out io.Writer) error {
+	set := newFlagSet("rollback")
+	n := set.Int("n", 1, "number of batches to roll back")
+	force := set.Bool("force", false, "roll back migrations that have changed since they were applied")
+	confirm := set.String("confirm", "", "in strict mode, the name of the most recently applied migration")
+	steal := set.Bool("steal-lock", false, "take the migration lock over from its holder, recording an audit entry")
+	interactive := set.Bool("interactive", false, "list the migrations to roll back and ask for confirmation")
+	webhook := set.String("approval-webhook", "", "URL asked to approve each batch before it runs")
+	asJSON := set.Bool("json", false, "print the result as JSON")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	opts := append(stealLock(*steal), moogration.WithDownConfirmation(*confirm))
+	opts = append(opts, approval(*webhook)...)
+	if *interactive {
+		opts = append(opts, moogration.WithConfirm(confirmer(os.Stdin, out)))
+	}
+	m, db, err := migrator(conf, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return summarize(out, *asJSON)(m.RollbackReport(*n, *force))
+}
+
+// confirmer returns a ConfirmFunc listing the migrations to roll back on out
+// and reading the answer from in
+func confirmer(in io.Reader, out io.Writer) moogration.ConfirmFunc {
+	return func(plan []moogration.Migration) bool {
+		fmt.Fprintln(out, "the down of these migrations will run, which may drop data:")
+		for _, m := range plan {
+			fmt.Fprintf(out, "  %s\n", m.Name)
+		}
+		fmt.Fprint(out, "continue? [y/N] ")
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
+
+// summarize returns a func printing the summary of a run, including the
+// migrations run before a failure, and passing on the run's error. With
+// asJSON, the summary is printed as JSON, including the error, which is then
+// only reported through the exit code.
+func summarize(out io.Writer, asJSON bool) func(moogration.Result, error) error {
+	return func(result moogration.Result, err error) error {
+		if asJSON {
+			if werr := result.WriteJSON(out, err); werr != nil {
+				return werr
+			}
+			if err != nil {
+				return errFailed
+			}
+			return nil
+		}
+		if werr := result.WriteSummary(out); werr != nil && err == nil {
+			err = werr
+		}
+		return err
+	}
+}
+
+func status(args []string, out io.Writer) error {
+	set := newFlagSet("status")
+	asJSON := set.Bool("json", false, "print the statuses as JSON")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return moogration.WriteStatusJSON(out, statuses)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tBATCH\tMIGRATED AT\tAPPLIED BY")
+	for _, s := range statuses {
+		batch, migratedAt := "", ""
+		if s.Applied {
+			batch = strconv.Itoa(s.Batch)
+			migratedAt = s.MigratedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.State(), batch, migratedAt, s.AppliedBy)
+	}
+	return w.Flush()
+}
+
+func verify(args []string, out io.Writer) error {
+	conf, err := parse(newFlagSet("verify"), args)
+	if err != nil {
+		return err
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := m.Verify()
+	if err != nil {
+		return err
+	}
+	for _, c := range report.Changed {
+		fmt.Fprintf(out, "changed: %s (batch %d, recorded %s, now %s)\n", c.Name, c.Batch, c.Stored, c.Current)
+	}
+	for _, name := range report.Unregistered {
+		fmt.Fprintf(out, "unregistered: %s\n", name)
+	}
+	fmt.Fprintf(out, "%d verified, %d changed, %d unregistered, %d pending\n",
+		len(report.Verified), len(report.Changed), len(report.Unregistered), len(report.Pending))
+	if !report.OK() {
+		return errFailed
+	}
+	return nil
+}
+
+func redo(args []string, out io.Writer) error {
+	set := newFlagSet("redo")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	if set.NArg() != 1 {
+		return errors.New("expected the name of a migration")
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return m.Redo(set.Arg(0))
+}
+
+func baseline(args []string, out io.Writer) error {
+	set := newFlagSet("baseline")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	if set.NArg() != 1 {
+		return errors.New("expected the name of the last migration the database already has")
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	baselined, err := m.Baseline(set.Arg(0))
+	for _, name := range baselined {
+		fmt.Fprintf(out, "baselined %s\n", name)
+	}
+	return err
+}
+
+func create(args []string, out io.Writer) error {
+	set := newFlagSet("create")
+	timestamp := set.Bool("timestamp", false, "prefix the name with the current UTC time rather than the next number")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	if set.NArg() != 1 {
+		return errors.New("expected a name for the migration, such as create_table_user")
+	}
+
+	entries, err := os.ReadDir(conf.Dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	existing := []string{}
+	for _, entry := range entries {
+		existing = append(existing, strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".up.sql"), ".down.sql"))
+	}
+	// follow the convention of the existing migrations, unless told otherwise
+	strategy := moogration.AnyNames
+	if *timestamp {
+		strategy = moogration.TimestampNames
+	}
+
+	err = os.MkdirAll(conf.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	base := strategy.NextName(set.Arg(0), existing)
+	for _, suffix := range []string{".up.sql", ".down.sql"} {
+		path := filepath.Join(conf.Dir, base+suffix)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+		fmt.Fprintln(out, path)
+	}
+	return nil
+}
+
+func squash(args []string, out io.Writer) error {
+	set := newFlagSet("squash")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	name := "squashed"
+	switch set.NArg() {
+	case 0:
+	case 1:
+		name = set.Arg(0)
+	default:
+		return errors.New("expected at most a name for the squashed migration")
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entries, err := os.ReadDir(conf.Dir)
+	if err != nil {
+		return err
+	}
+	existing := []string{}
+	for _, entry := range entries {
+		existing = append(existing, strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".up.sql"), ".down.sql"))
+	}
+	// numbered after the originals, so later migrations follow it
+	squashed, err := m.Squash(moogration.AnyNames.NextName(name, existing))
+	if err != nil {
+		return err
+	}
+
+	up := fmt.Sprintf("-- %s\n-- squashes: %s\n\n%s", squashed.Description, strings.Join(squashed.Squashes, ", "), squashed.Up)
+	files := map[string]string{".up.sql": up, ".down.sql": squashed.Down}
+	for _, suffix := range []string{".up.sql", ".down.sql"} {
+		path := filepath.Join(conf.Dir, squashed.Name+suffix)
+		err := os.WriteFile(path, []byte(files[suffix]), 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, path)
+	}
+
+	// the originals are kept out of the registry, for reference
+	archive := filepath.Join(conf.Dir, "squashed")
+	err = os.MkdirAll(archive, 0755)
+	if err != nil {
+		return err
+	}
+	for _, original := range squashed.Squashes {
+		for _, suffix := range []string{".up.sql", ".down.sql"} {
+			err := os.Rename(filepath.Join(conf.Dir, original+suffix), filepath.Join(archive, original+suffix))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(out, "moved %d squashed migrations to %s\n", len(squashed.Squashes), archive)
+	return nil
+}
+
+func plan(args []string, out io.Writer) error {
+	set := newFlagSet("plan")
+	isDown := set.Bool("down", false, "plan the down of every applied migration")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	planned, err := m.PlanLatest(*isDown)
+	if err != nil {
+		return err
+	}
+	if len(planned) == 0 {
+		fmt.Fprintln(out, "nothing to run")
+	}
+	for _, p := range planned {
+		fmt.Fprintf(out, "-- %s %s (batch %d)\n%s\n", p.Direction, p.Name, p.Batch, strings.TrimSpace(p.SQL))
+		for _, w := range p.Warnings {
+			fmt.Fprintf(out, "-- WARNING: %s\n", w)
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+func script(args []string, out io.Writer) error {
+	set := newFlagSet("script")
+	appliedBy := set.String("applied-by", "", "the applier to record the migrations under (default \"script\")")
+	noTx := set.Bool("no-transaction", false, "don't wrap the script in a transaction")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return m.GenerateScript(out, moogration.ScriptOptions{AppliedBy: *appliedBy, NoTransaction: *noTx})
+}
+
+func doctor(args []string, out io.Writer) error {
+	conf, err := parse(newFlagSet("doctor"), args)
+	if err != nil {
+		return err
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	failed := false
+	for _, d := range m.Doctor() {
+		status := "ok"
+		if !d.OK {
+			status = "FAIL"
+			failed = true
+		}
+		fmt.Fprintf(out, "[%s] %s: %s\n", status, d.Check, d.Detail)
+		if d.Remedy != "" {
+			fmt.Fprintf(out, "       fix: %s\n", d.Remedy)
+		}
+	}
+	if failed {
+		return errFailed
+	}
+	return nil
+}
+
+func compat(args []string, out io.Writer) error {
+	set := newFlagSet("compat")
+	queriesFile := set.String("queries", "", "file of the deployed application's queries, as SQL or a query log")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	if *queriesFile == "" {
+		return errors.New("expected -queries")
+	}
+	f, err := os.Open(*queriesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	queries, err := moogration.ReadQueries(f)
+	if err != nil {
+		return err
+	}
+	m, db, err := migrator(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	breakages, err := m.CheckCompatibility(queries)
+	if err != nil {
+		return err
+	}
+	for _, b := range breakages {
+		fmt.Fprintf(out, "%s: %s\n    %s\n", b.Migration, b.Reason, b.Query)
+	}
+	fmt.Fprintf(out, "%d queries checked, %d would break\n", len(queries), len(breakages))
+	if len(breakages) > 0 {
+		return errFailed
+	}
+	return nil
+}
+
+func agent(args []string, out io.Writer) error {
+	set := newFlagSet("agent")
+	url := set.String("url", "", "control endpoint polled for plans and sent reports")
+	target := set.String("target", "", "name of this database at the control endpoint")
+	interval := set.Duration("interval", 30*time.Second, "how often to poll")
+	once := set.Bool("once", false, "poll once and exit")
+	publicKey := set.String("public-key", "", "base64 ed25519 public key plans must be signed with")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	if *url == "" || *target == "" {
+		return errors.New("expected -url and -target")
+	}
+	var key ed25519.PublicKey
+	if *publicKey != "" {
+		key, err = base64.StdEncoding.DecodeString(*publicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("-public-key must be a base64 ed25519 public key")
+		}
+	}
+	m, db, err := connect(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	agentConf := moogration.AgentConfig{URL: *url, Target: *target, Interval: *interval, PublicKey: key}
+	if *once {
+		return m.PollAgent(context.Background(), agentConf)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = m.RunAgent(ctx, agentConf)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/format"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/nate-anderson/moogration"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "moog.json")
+	err := os.WriteFile(file, []byte(`{"driver": "sqlite", "dsn": "from-file", "table": "file_migration"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MOOG_DSN", "from-env")
+
+	set := newFlagSet("test")
+	conf, err := parse(set, []string{"-config", file, "-table", "flag_migration"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := config{Driver: "sqlite", DSN: "from-env", Dir: "migrations", Table: "flag_migration"}
+	if conf != expected {
+		t.Fatalf("expected %+v, got %+v", expected, conf)
+	}
+
+	_, err = parse(newFlagSet("test"), []string{"-config", filepath.Join(dir, "missing.json")})
+	if err == nil {
+		t.Fatal("expected an error for a missing config file")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "0009_create_users.up.sql"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	code := run([]string{"create", "-dir", dir, "Add Index"}, &out, &out)
+	if code != 0 {
+		t.Fatalf("create failed: %s", out.String())
+	}
+	for _, name := range []string{"0010_add_index.up.sql", "0010_add_index.down.sql"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected %s to be created: %s", name, err)
+		}
+	}
+
+	out.Reset()
+	code = run([]string{"create", "-dir", dir, "-timestamp", "add_column"}, &out, &out)
+	if code != 0 || !regexp.MustCompile(`/\d{14}_add_column\.up\.sql\n`).MatchString(out.String()) {
+		t.Fatalf("unexpected create -timestamp (exit %d):\n%s", code, out.String())
+	}
+}
+
+func TestUpStatusRollback(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"001_create_user.up.sql":   "CREATE TABLE user (id INTEGER PRIMARY KEY);",
+		"001_create_user.down.sql": "DROP TABLE user;",
+		"002_create_post.up.sql":   "CREATE TABLE post (id INTEGER PRIMARY KEY);",
+		"002_create_post.down.sql": "DROP TABLE post;",
+	}
+	for name, sql := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := []string{"-driver", "sqlite", "-dsn", filepath.Join(dir, "test.db"), "-dir", dir}
+	moog := func(args ...string) (int, string) {
+		var out bytes.Buffer
+		code := run(append(args[:1], append(flags, args[1:]...)...), &out, &out)
+		return code, out.String()
+	}
+
+	code, out := moog("plan")
+	if code != 0 || !strings.Contains(out, "-- up 001_create_user (batch 1)") {
+		t.Fatalf("unexpected plan (exit %d):\n%s", code, out)
+	}
+
+	code, out = moog("up")
+	if code != 0 || !strings.Contains(out, "2 migrations run") {
+		t.Fatalf("unexpected up (exit %d):\n%s", code, out)
+	}
+	code, out = moog("status")
+	if code != 0 || strings.Count(out, "applied") != 2 {
+		t.Fatalf("unexpected status (exit %d):\n%s", code, out)
+	}
+	code, out = moog("verify")
+	if code != 0 || !strings.Contains(out, "2 verified") {
+		t.Fatalf("unexpected verify (exit %d):\n%s", code, out)
+	}
+
+	// an edited migration fails verification
+	err := os.WriteFile(filepath.Join(dir, "002_create_post.up.sql"), []byte("CREATE TABLE post (id INT);"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, out = moog("verify")
+	if code != 1 || !strings.Contains(out, "changed: 002_create_post") {
+		t.Fatalf("unexpected verify (exit %d):\n%s", code, out)
+	}
+
+	if code, out := moog("rollback", "-force", "-steal-lock"); code != 0 {
+		t.Fatalf("rollback failed: %s", out)
+	}
+	code, out = moog("status")
+	if code != 0 || strings.Count(out, "pending") != 2 {
+		t.Fatalf("unexpected status (exit %d):\n%s", code, out)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"001_create_user.up.sql":   "CREATE TABLE user (id INTEGER PRIMARY KEY);",
+		"001_create_user.down.sql": "DROP TABLE user;",
+		"002_create_post.up.sql":   "CREATE TABLE post (id INTEGER PRIMARY KEY);",
+		"002_create_post.down.sql": "DROP TABLE post;",
+	}
+	for name, sql := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := []string{"-driver", "sqlite", "-dsn", filepath.Join(dir, "test.db"), "-dir", dir}
+
+	var out bytes.Buffer
+	code := run(append([]string{"baseline"}, append(flags, "001_create_user")...), &out, &out)
+	if code != 0 || out.String() != "baselined 001_create_user\n" {
+		t.Fatalf("unexpected baseline (exit %d):\n%s", code, out.String())
+	}
+	out.Reset()
+	code = run(append([]string{"up"}, flags...), &out, &out)
+	if code != 0 || !strings.Contains(out.String(), "1 migrations run") {
+		t.Fatalf("unexpected up (exit %d):\n%s", code, out.String())
+	}
+}
+
+func TestSquash(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"001_create_user.up.sql":   "CREATE TABLE user (id INTEGER PRIMARY KEY);",
+		"001_create_user.down.sql": "DROP TABLE user;",
+		"002_create_post.up.sql":   "CREATE TABLE post (id INTEGER PRIMARY KEY);",
+		"002_create_post.down.sql": "DROP TABLE post;",
+	}
+	for name, sql := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	moog := func(dsn string, args ...string) (int, string) {
+		var out bytes.Buffer
+		flags := []string{"-driver", "sqlite", "-dsn", filepath.Join(dir, dsn), "-dir", dir}
+		code := run(append(args[:1], append(flags, args[1:]...)...), &out, &out)
+		return code, out.String()
+	}
+
+	if code, out := moog("test.db", "up"); code != 0 {
+		t.Fatalf("up failed: %s", out)
+	}
+	code, out := moog("test.db", "squash")
+	if code != 0 || !strings.Contains(out, "003_squashed.up.sql") || !strings.Contains(out, "moved 2 squashed migrations") {
+		t.Fatalf("unexpected squash (exit %d):\n%s", code, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "squashed", "001_create_user.up.sql")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the existing database records it as applied, and a new one runs it
+	for _, dsn := range []string{"test.db", "fresh.db"} {
+		if code, out := moog(dsn, "up"); code != 0 {
+			t.Fatalf("up failed: %s", out)
+		}
+		code, out = moog(dsn, "status")
+		if code != 0 || strings.Count(out, "applied") != 1 || !strings.Contains(out, "003_squashed") {
+			t.Fatalf("unexpected status (exit %d):\n%s", code, out)
+		}
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var out bytes.Buffer
+	if code := run([]string{"sideways"}, &out, &out); code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+	if !strings.Contains(out.String(), "usage: moog") {
+		t.Fatalf("expected usage, got:\n%s", out.String())
+	}
+}
+
+func TestInit(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+	code := run([]string{"init", "-driver", "sqlite", "-dsn", "app.db", dir}, &out, &out)
+	if code != 0 {
+		t.Fatalf("init failed: %s", out.String())
+	}
+
+	for _, name := range []string{"migrations.go", "main.go"} {
+		src, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		formatted, err := format.Source(src)
+		if err != nil {
+			t.Fatalf("%s doesn't parse: %s", name, err)
+		}
+		if !bytes.Equal(src, formatted) {
+			t.Fatalf("%s isn't gofmt'd:\n%s", name, src)
+		}
+	}
+	main, _ := os.ReadFile(filepath.Join(dir, "main.go"))
+	if !strings.Contains(string(main), `_ "modernc.org/sqlite"`) {
+		t.Fatalf("main.go doesn't import the sqlite driver:\n%s", main)
+	}
+	conf, _ := os.ReadFile(filepath.Join(dir, "moog.json"))
+	if !strings.Contains(string(conf), `"dsn": "app.db"`) {
+		t.Fatalf("unexpected config file:\n%s", conf)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "migrations", "001_create_example.up.sql")); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	if code := run([]string{"init", "-driver", "sqlite", dir}, &out, &out); code != 1 || !strings.Contains(out.String(), "already exists") {
+		t.Fatalf("expected init to refuse to overwrite the scaffold, got %d: %s", code, out.String())
+	}
+}
+
+func TestConfirmer(t *testing.T) {
+	plan := []moogration.Migration{{Name: "002_create_post"}, {Name: "001_create_user"}}
+	var out bytes.Buffer
+	if !confirmer(strings.NewReader("y\n"), &out)(plan) {
+		t.Fatal("expected y to confirm")
+	}
+	if !strings.Contains(out.String(), "  002_create_post\n  001_create_user\n") {
+		t.Fatalf("unexpected prompt:\n%s", out.String())
+	}
+	for _, answer := range []string{"n\n", "\n", ""} {
+		if confirmer(strings.NewReader(answer), &out)(plan) {
+			t.Fatalf("expected %q not to confirm", answer)
+		}
+	}
+}
+
+func TestCompat(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"001_create_user.up.sql":     "CREATE TABLE user (id INTEGER PRIMARY KEY, nickname TEXT);",
+		"001_create_user.down.sql":   "DROP TABLE user;",
+		"002_drop_nickname.up.sql":   "ALTER TABLE user DROP COLUMN nickname;",
+		"002_drop_nickname.down.sql": "ALTER TABLE user ADD COLUMN nickname TEXT;",
+		"queries.sql":                "SELECT id FROM user;\nSELECT nickname FROM user WHERE id = ?;",
+	}
+	for name, sql := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := []string{"-driver", "sqlite", "-dsn", filepath.Join(dir, "test.db"), "-dir", dir, "-queries", filepath.Join(dir, "queries.sql")}
+
+	var out bytes.Buffer
+	code := run(append([]string{"compat"}, flags...), &out, &out)
+	if code != 1 || !strings.Contains(out.String(), "002_drop_nickname: uses column 'nickname' of 'user'") ||
+		!strings.Contains(out.String(), "2 queries checked, 1 would break") {
+		t.Fatalf("unexpected compat (exit %d):\n%s", code, out.String())
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"001_create_user.up.sql":   "CREATE TABLE user (id INTEGER PRIMARY KEY);",
+		"001_create_user.down.sql": "DROP TABLE user;",
+	}
+	for name, sql := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := []string{"-driver", "sqlite", "-dsn", filepath.Join(dir, "test.db"), "-dir", dir, "-json"}
+	moog := func(command string) (int, string) {
+		var out bytes.Buffer
+		code := run(append([]string{command}, flags...), &out, &out)
+		return code, out.String()
+	}
+
+	code, out := moog("up")
+	var result struct {
+		OK         bool
+		Migrations []struct{ Name, Direction, Status string }
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil || code != 0 {
+		t.Fatalf("unexpected up (exit %d, %v):\n%s", code, err, out)
+	}
+	if !result.OK || len(result.Migrations) != 1 || result.Migrations[0].Status != "ok" {
+		t.Fatalf("unexpected up result:\n%s", out)
+	}
+
+	code, out = moog("status")
+	var statuses []struct{ Name, Status string }
+	if err := json.Unmarshal([]byte(out), &statuses); err != nil || code != 0 {
+		t.Fatalf("unexpected status (exit %d, %v):\n%s", code, err, out)
+	}
+	if len(statuses) != 1 || statuses[0].Status != "applied" {
+		t.Fatalf("unexpected statuses:\n%s", out)
+	}
+}
+
+func TestScript(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"001_create_user.up.sql":   "CREATE TABLE user (id INTEGER PRIMARY KEY);",
+		"001_create_user.down.sql": "DROP TABLE user;",
+	}
+	for name, sql := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(sql), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags := []string{"-driver", "sqlite", "-dsn", filepath.Join(dir, "test.db"), "-dir", dir}
+
+	var out bytes.Buffer
+	code := run(append([]string{"script", "-applied-by", "dba"}, flags...), &out, &out)
+	if code != 0 || !strings.Contains(out.String(), "CREATE TABLE user (id INTEGER PRIMARY KEY);") ||
+		!strings.Contains(out.String(), "'001_create_user'") || !strings.Contains(out.String(), "'dba'") {
+		t.Fatalf("unexpected script (exit %d):\n%s", code, out.String())
+	}
+
+	// the script doesn't apply anything
+	out.Reset()
+	code = run(append([]string{"plan"}, flags...), &out, &out)
+	if code != 0 || !strings.Contains(out.String(), "-- up 001_create_user") {
+		t.Fatalf("unexpected plan (exit %d):\n%s", code, out.String())
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// scaffoldFile is a file written by moog init, relative to the project
+type scaffoldFile struct {
+	path string
+	tmpl *template.Template
+}
+
+// scaffoldData is what the scaffold templates are executed with
+type scaffoldData struct {
+	Package string
+	Dir     string
+	Import  string
+	// Config is the name of the config file, and ConfigJSON its contents
+	Config     string
+	ConfigJSON string
+}
+
+// driverImports are the packages registering each driver moog supports
+var driverImports = map[string]string{
+	"mysql":  "github.com/go-sql-driver/mysql",
+	"sqlite": "modernc.org/sqlite",
+}
+
+var registryTemplate = template.Must(template.New("migrations.go").Parse(`package {{ .Package }}
+
+import (
+	"embed"
+
+	"github.com/nate-anderson/moogration"
+)
+
+// migrationFiles are the .up.sql and .down.sql files in {{ .Dir }}. Add
+// migrations with moog create.
+//
+//go:embed {{ .Dir }}
+var migrationFiles embed.FS
+
+// migrations is the application's migration registry
+var migrations = moogration.NewRegistry()
+
+func init() {
+	err := migrations.RegisterFS(migrationFiles, "{{ .Dir }}")
+	if err != nil {
+		panic(err)
+	}
+}
+`))
+
+var mainTemplate = template.Must(template.New("main.go").Parse(`package {{ .Package }}
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nate-anderson/moogration"
+
+	_ "{{ .Import }}"
+)
+
+// config is the moog config file, so the application and moog share one
+type config struct {
+	Driver string ` + "`json:\"driver\"`" + `
+	DSN    string ` + "`json:\"dsn\"`" + `
+}
+
+func main() {
+	configFile := flag.String("config", "{{ .Config }}", "config file")
+	migrate := flag.String("migrate", "", "run migrations: up or down")
+	status := flag.Bool("status", false, "list migrations and whether they are applied")
+	flag.Parse()
+
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var conf config
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dsn := os.Getenv("DATABASE_DSN"); dsn != "" {
+		conf.DSN = dsn
+	}
+
+	db, err := sql.Open(conf.Driver, conf.DSN)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	opts := []moogration.Option{
+		moogration.WithRegistry(migrations),
+		moogration.WithLogger(log.New(os.Stderr, "", log.LstdFlags)),
+	}
+	if conf.Driver == "sqlite" {
+		opts = append(opts, moogration.WithSQLite())
+	} else {
+		opts = append(opts, moogration.WithMySQL())
+	}
+	m := moogration.New(db, opts...)
+
+	switch {
+	case *migrate == "up" || *migrate == "down":
+		err = m.RunLatest(*migrate == "down", false)
+	case *status:
+		var statuses []moogration.MigrationStatus
+		statuses, err = m.Status()
+		for _, s := range statuses {
+			fmt.Printf("%s\tapplied: %t\n", s.Name, s.Applied)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+`))
+
+var configTemplate = template.Must(template.New("config").Parse(`{{ .ConfigJSON }}
+`))
+
+var exampleUpTemplate = template.Must(template.New("up").Parse(`CREATE TABLE example (
+	id INTEGER PRIMARY KEY
+);
+`))
+
+var exampleDownTemplate = template.Must(template.New("down").Parse(`DROP TABLE IF EXISTS example;
+`))
+
+func scaffold(args []string, out io.Writer) error {
+	set := newFlagSet("init")
+	pkg := set.String("package", "main", "package of the generated Go files")
+	conf, err := parse(set, args)
+	if err != nil {
+		return err
+	}
+	if set.NArg() > 1 {
+		return errors.New("expected at most one project directory")
+	}
+	project := "."
+	if set.NArg() == 1 {
+		project = set.Arg(0)
+	}
+	driverImport, ok := driverImports[conf.Driver]
+	if !ok {
+		return fmt.Errorf("unsupported driver %q", conf.Driver)
+	}
+	if filepath.IsAbs(conf.Dir) {
+		return errors.New("the migrations directory must be relative to the project, to be embedded")
+	}
+
+	configJSON, err := json.MarshalIndent(map[string]string{
+		"driver": conf.Driver,
+		"dsn":    conf.DSN,
+		"dir":    filepath.ToSlash(conf.Dir),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	data := scaffoldData{
+		Package:    *pkg,
+		Dir:        filepath.ToSlash(conf.Dir),
+		Import:     driverImport,
+		Config:     defaultConfigFile,
+		ConfigJSON: string(configJSON),
+	}
+	files := []scaffoldFile{
+		{filepath.Join(conf.Dir, "001_create_example.up.sql"), exampleUpTemplate},
+		{filepath.Join(conf.Dir, "001_create_example.down.sql"), exampleDownTemplate},
+		{"migrations.go", registryTemplate},
+		{"main.go", mainTemplate},
+		{defaultConfigFile, configTemplate},
+	}
+
+	// refuse before writing anything, rather than leave a partial scaffold
+	for _, f := range files {
+		path := filepath.Join(project, f.path)
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		}
+	}
+	err = os.MkdirAll(filepath.Join(project, conf.Dir), 0755)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := filepath.Join(project, f.path)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		err = f.tmpl.Execute(file, data)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, path)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// moogration-gen writes a registry.go file listing every moogration.Migration
+// declared at package level in a directory, as an explicit slice sorted by
+// migration name. The generated slice can be passed to RunLatestFrom and
+// RollbackFrom, so no init() registration is needed.
+//
+//	//go:generate go run github.com/nate-anderson/moogration/cmd/moogration-gen -var Migrations
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const importPath = "github.com/nate-anderson/moogration"
+
+// a package-level migration declaration found in the source directory
+type declaration struct {
+	ident string
+	name  string
+	pos   token.Position
+}
+
+func main() {
+	dir := flag.String("dir", ".", "directory containing the migration declarations")
+	out := flag.String("out", "registry.go", "output file, relative to -dir")
+	varName := flag.String("var", "Migrations", "name of the generated slice variable")
+	flag.Parse()
+
+	src, err := generate(*dir, filepath.Base(*out), *varName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(*dir, *out), src, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate parses the package in dir, skipping the output file itself, and
+// returns the formatted source of the registry file
+func generate(dir, outFile, varName string) ([]byte, error) {
+	fset := token.NewFileSet()
+	skipOutput := func(fi os.FileInfo) bool {
+		return fi.Name() != outFile && !strings.HasSuffix(fi.Name(), "_test.go")
+	}
+	pkgs, err := parser.ParseDir(fset, dir, skipOutput, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", dir, err)
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected exactly one package in %s, found %d", dir, len(pkgs))
+	}
+
+	var pkgName string
+	var decls []declaration
+	for name, pkg := range pkgs {
+		pkgName = name
+		for _, file := range pkg.Files {
+			found, err := findMigrations(fset, file)
+			if err != nil {
+				return nil, err
+			}
+			decls = append(decls, found...)
+		}
+	}
+
+	seen := make(map[string]declaration, len(decls))
+	for _, d := range decls {
+		if prev, ok := seen[d.name]; ok {
+			return nil, fmt.Errorf("%s: duplicate migration name '%s' (first declared at %s)", d.pos, d.name, prev.pos)
+		}
+		seen[d.name] = d
+	}
+
+	sort.Slice(decls, func(i, j int) bool {
+		return decls[i].name < decls[j].name
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by moogration-gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+	fmt.Fprintf(&buf, "import %q\n\n", importPath)
+	fmt.Fprintf(&buf, "// %s lists the migrations declared in this package, sorted by name\n", varName)
+	fmt.Fprintf(&buf, "var %s = []moogration.Migration{\n", varName)
+	for _, d := range decls {
+		fmt.Fprintf(&buf, "\t%s,\n", d.ident)
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	return format.Source(buf.Bytes())
+}
+
+// findMigrations returns the package-level variables in file initialised with
+// a moogration.Migration literal. The Name field must be a string literal so
+// the generated order can be determined statically.
+func findMigrations(fset *token.FileSet, file *ast.File) ([]declaration, error) {
+	qualifier, ok := importName(file)
+	if !ok {
+		return nil, nil
+	}
+
+	var decls []declaration
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, value := range vs.Values {
+				lit, ok := value.(*ast.CompositeLit)
+				if !ok || !isMigrationType(lit.Type, qualifier) {
+					continue
+				}
+				pos := fset.Position(vs.Names[i].Pos())
+				name, err := literalName(lit)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s: %w", pos, vs.Names[i].Name, err)
+				}
+				decls = append(decls, declaration{
+					ident: vs.Names[i].Name,
+					name:  name,
+					pos:   pos,
+				})
+			}
+		}
+	}
+	return decls, nil
+}
+
+// importName returns the name the moogration package is imported under
+func importName(file *ast.File) (string, bool) {
+	for _, imp := range file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		if path != importPath {
+			continue
+		}
+		if imp.Name != nil {
+			return imp.Name.Name, true
+		}
+		return "moogration", true
+	}
+	return "", false
+}
+
+func isMigrationType(expr ast.Expr, qualifier string) bool {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Migration" {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && pkg.Name == qualifier
+}
+
+func literalName(lit *ast.CompositeLit) (string, error) {
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := kv.Key.(*ast.Ident)
+		if !ok || key.Name != "Name" {
+			continue
+		}
+		basic, ok := kv.Value.(*ast.BasicLit)
+		if !ok || basic.Kind != token.STRING {
+			return "", fmt.Errorf("migration Name must be a string literal")
+		}
+		return strconv.Unquote(basic.Value)
+	}
+	return "", fmt.Errorf("migration has no Name")
+}
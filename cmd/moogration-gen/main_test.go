@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMigrationsSource = `package migrations
+
+import moo "github.com/nate-anderson/moogration"
+
+var createPosts = moo.Migration{
+	Name: "002_create_table_post",
+	Up:   "CREATE TABLE post (id int);",
+	Down: "DROP TABLE post;",
+}
+
+var createUsers = moo.Migration{
+	Name: "001_create_table_user",
+	Up:   "CREATE TABLE user (id int);",
+	Down: "DROP TABLE user;",
+}
+`
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "migrations.go"), []byte(testMigrationsSource), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a stale output file must not be parsed
+	err = os.WriteFile(filepath.Join(dir, "registry.go"), []byte("package migrations\n\nvar broken ="), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := generate(dir, "registry.go", "Migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(src)
+	users := strings.Index(out, "createUsers,")
+	posts := strings.Index(out, "createPosts,")
+	if users < 0 || posts < 0 || users > posts {
+		t.Fatalf("migrations missing or out of order:\n%s", out)
+	}
+	if !strings.Contains(out, "var Migrations = []moogration.Migration{") {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+}
+
+func TestGenerateDuplicateName(t *testing.T) {
+	dir := t.TempDir()
+	src := strings.Replace(testMigrationsSource, "002_create_table_post", "001_create_table_user", 1)
+	err := os.WriteFile(filepath.Join(dir, "migrations.go"), []byte(src), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = generate(dir, "registry.go", "Migrations")
+	if err == nil || !strings.Contains(err.Error(), "duplicate migration name") {
+		t.Fatalf("expected duplicate name error, got %v", err)
+	}
+}
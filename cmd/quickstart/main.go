@@ -0,0 +1,112 @@
+// quickstart is a starting point for an application that defines its
+// migrations in Go: copy this package into your module, replace the
+// migrations in migrations.go with your own, and keep the driver you use.
+// For migrations stored as SQL files, see cmd/moog instead.
+//
+//	quickstart -driver sqlite -dsn app.db -migrate up
+//	quickstart -driver sqlite -dsn app.db -status
+//	quickstart -driver sqlite -dsn app.db -rollback 1
+//
+// The DSN defaults to the DATABASE_DSN environment variable.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/nate-anderson/moogration"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run parses flags, runs the requested operation and returns the process's
+// exit code
+func run(args []string, out, errOut io.Writer) int {
+	set := flag.NewFlagSet("quickstart", flag.ContinueOnError)
+	set.SetOutput(errOut)
+	driver := set.String("driver", "mysql", "database driver: mysql or sqlite")
+	dsn := set.String("dsn", os.Getenv("DATABASE_DSN"), "data source name (default $DATABASE_DSN)")
+	migrate := set.String("migrate", "", "run migrations: up or down")
+	rollback := set.Int("rollback", 0, "roll back the latest `n` batches")
+	status := set.Bool("status", false, "list migrations and whether they are applied")
+	force := set.Bool("force", false, "run migrations that have changed since they were applied")
+	if err := set.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := log.New(errOut, "", log.LstdFlags)
+	opts := []moogration.Option{moogration.WithRegistry(migrations), moogration.WithLogger(logger)}
+	switch *driver {
+	case "mysql":
+		opts = append(opts, moogration.WithMySQL())
+	case "sqlite":
+		opts = append(opts, moogration.WithSQLite())
+	default:
+		fmt.Fprintf(errOut, "unsupported driver %q\n", *driver)
+		return 2
+	}
+
+	db, err := sql.Open(*driver, *dsn)
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	defer db.Close()
+	m := moogration.New(db, opts...)
+
+	switch {
+	case *migrate == "up" || *migrate == "down":
+		err = m.RunLatest(*migrate == "down", *force)
+	case *rollback > 0:
+		err = m.Rollback(*rollback, *force)
+	case *status:
+		err = printStatus(m, out)
+	default:
+		set.Usage()
+		return 2
+	}
+	if err != nil {
+		logger.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// printStatus writes a table of the registered and applied migrations
+func printStatus(m *moogration.Migrator, out io.Writer) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tBATCH")
+	for _, s := range statuses {
+		state := "pending"
+		switch {
+		case !s.Registered:
+			state = "unregistered"
+		case s.Dirty:
+			state = "dirty"
+		case s.Changed:
+			state = "changed"
+		case s.Applied:
+			state = "applied"
+		}
+		batch := ""
+		if s.Applied {
+			batch = fmt.Sprint(s.Batch)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, state, batch)
+	}
+	return w.Flush()
+}
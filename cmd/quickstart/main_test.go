@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestQuickstart(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "quickstart.db")
+	quickstart := func(args ...string) string {
+		var out, errOut bytes.Buffer
+		code := run(append([]string{"-driver", "sqlite", "-dsn", dsn}, args...), &out, &errOut)
+		if code != 0 {
+			t.Fatalf("quickstart %v exited %d: %s", args, code, errOut.String())
+		}
+		return out.String()
+	}
+
+	quickstart("-migrate", "up")
+	out := quickstart("-status")
+	if !regexp.MustCompile(`001_create_account\s+applied\s+1\n002_create_post\s+applied\s+1\n`).MatchString(out) {
+		t.Fatalf("unexpected status after up:\n%s", out)
+	}
+
+	quickstart("-rollback", "1")
+	out = quickstart("-status")
+	if !regexp.MustCompile(`001_create_account\s+pending\s+\n002_create_post\s+pending`).MatchString(out) {
+		t.Fatalf("unexpected status after rollback:\n%s", out)
+	}
+
+	var errOut bytes.Buffer
+	if code := run([]string{"-driver", "sqlite", "-dsn", dsn}, &errOut, &errOut); code != 2 {
+		t.Fatalf("expected usage exit code 2 without an operation, got %d", code)
+	}
+}
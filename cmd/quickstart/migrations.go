@@ -0,0 +1,30 @@
+package main
+
+import "github.com/nate-anderson/moogration"
+
+// migrations are the application's migrations, registered in init so they
+// are all registered before main runs. In a larger application each can
+// live in its own file.
+var migrations = moogration.NewRegistry()
+
+func init() {
+	migrations.Register(
+		moogration.Migration{
+			Name: "001_create_account",
+			Up: `CREATE TABLE account (
+				id INTEGER PRIMARY KEY,
+				email VARCHAR(255) NOT NULL UNIQUE
+			);`,
+			Down: `DROP TABLE IF EXISTS account;`,
+		},
+		moogration.Migration{
+			Name: "002_create_post",
+			Up: `CREATE TABLE post (
+				id INTEGER PRIMARY KEY,
+				account_id INTEGER NOT NULL REFERENCES account (id),
+				body TEXT NOT NULL
+			);`,
+			Down: `DROP TABLE IF EXISTS post;`,
+		},
+	)
+}
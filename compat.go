@@ -0,0 +1,265 @@
+package moogration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Breakage is a query of the deployed application that a pending migration
+// would break
+type Breakage struct {
+	Migration string
+	Statement string
+	Query     string
+	Table     string
+	// Column is empty when the whole table is removed
+	Column string
+	Reason string
+}
+
+// CheckCompatibility checks the migrations in the default registry pending
+// on db against queries. See Migrator.CheckCompatibility.
+func CheckCompatibility(db DBTX, queries []string) ([]Breakage, error) {
+	return defaultMigrator(db, nil).CheckCompatibilityContext(context.Background(), queries)
+}
+
+// CheckCompatibility reports the queries the currently deployed application
+// issues that would fail once the pending migrations are applied: those
+// using a table or column that a migration drops or renames, and inserts
+// that omit a NOT NULL column added without a default. An empty result
+// means the application can keep running, or be rolled back to, while the
+// migrations go forward. A removal undone by a later pending migration, such
+// as a table rebuilt under its old name, isn't reported. Like BlastRadius,
+// the analysis matches common statement shapes rather than parsing SQL, and
+// queries selecting * aren't reported for a dropped column.
+func (mg *Migrator) CheckCompatibility(queries []string) ([]Breakage, error) {
+	return mg.CheckCompatibilityContext(context.Background(), queries)
+}
+
+// CheckCompatibilityContext is like CheckCompatibility, with a context
+func (mg *Migrator) CheckCompatibilityContext(ctx context.Context, queries []string) ([]Breakage, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	removed := []removal{}
+	for _, m := range mg.registry.Migrations() {
+		if _, hasRun := applied[m.Name]; hasRun {
+			continue
+		}
+		for _, stmt := range splitSQL(m.Up, mg.driver) {
+			removed = analyzeRemovals(removed, m.Name, stmt)
+		}
+	}
+
+	breakages := []Breakage{}
+	for _, query := range queries {
+		q := analyzeQuery(query)
+		for _, r := range removed {
+			if !q.tables[r.table] {
+				continue
+			}
+			var reason string
+			switch {
+			case r.insert:
+				if q.insert && !q.words[r.column] {
+					reason = fmt.Sprintf("inserts into '%s' without column '%s', which %s", r.table, r.column, r.reason)
+				}
+			case r.column == "":
+				reason = fmt.Sprintf("uses table '%s', which %s", r.table, r.reason)
+			case q.words[r.column]:
+				reason = fmt.Sprintf("uses column '%s' of '%s', which %s", r.column, r.table, r.reason)
+			}
+			if reason == "" {
+				continue
+			}
+			breakages = append(breakages, Breakage{
+				Migration: r.migration,
+				Statement: r.statement,
+				Query:     query,
+				Table:     r.table,
+				Column:    r.column,
+				Reason:    reason,
+			})
+		}
+	}
+	return breakages, nil
+}
+
+// removal is a table or column a pending migration removes from under the
+// deployed application
+type removal struct {
+	migration string
+	statement string
+	table     string
+	column    string
+	reason    string
+	// insert is set for a column that only breaks inserts omitting it
+	insert bool
+}
+
+// analyzeRemovals adds the removals of stmt to removed, and drops the
+// earlier removals stmt undoes
+func analyzeRemovals(removed []removal, migration, stmt string) []removal {
+	remove := func(table, column, reason string, insert bool) {
+		removed = append(removed, removal{migration, stmt, table, column, reason, insert})
+	}
+	restore := func(table, column string) {
+		kept := removed[:0]
+		for _, r := range removed {
+			if r.table != table || (column != "" && r.column != column) {
+				kept = append(kept, r)
+			}
+		}
+		removed = kept
+	}
+
+	switch {
+	case reCreateTable.MatchString(stmt):
+		restore(tableName(reCreateTable.FindStringSubmatch(stmt)[1]), "")
+	case reDropTable.MatchString(stmt):
+		remove(tableName(reDropTable.FindStringSubmatch(stmt)[1]), "", "is dropped", false)
+	case reRenameTable.MatchString(stmt):
+		for _, pair := range splitTopLevel(reRenameTable.ReplaceAllString(stmt, "$1")) {
+			if match := reRenamePair.FindStringSubmatch(pair); match != nil {
+				remove(tableName(match[1]), "", "is renamed", false)
+				restore(tableName(match[2]), "")
+			}
+		}
+	case reAlterTable.MatchString(stmt):
+		match := reAlterTable.FindStringSubmatch(stmt)
+		table := tableName(match[1])
+		for _, action := range splitTopLevel(match[2]) {
+			action = strings.TrimSpace(action)
+			alter := reAlterAction.FindStringSubmatch(action)
+			if alter == nil {
+				continue
+			}
+			verb := strings.ToUpper(alter[1])
+			name := strings.ToLower(unquote(alter[2]))
+			// the words after the column, such as the new name in
+			// RENAME COLUMN a TO b or CHANGE a b
+			rest := append(strings.Fields(action[len(alter[0]):]), "", "")
+			switch name {
+			case "index", "key", "constraint", "primary", "unique", "foreign":
+				continue
+			case "to":
+				if verb == "RENAME" {
+					remove(table, "", "is renamed", false)
+					restore(tableName(rest[0]), "")
+				}
+				continue
+			}
+			switch verb {
+			case "DROP":
+				remove(table, name, "is dropped", false)
+			case "RENAME":
+				remove(table, name, "is renamed", false)
+				restore(table, strings.ToLower(unquote(rest[1])))
+			case "CHANGE":
+				if renamed := strings.ToLower(unquote(rest[0])); renamed != name {
+					remove(table, name, "is renamed", false)
+					restore(table, renamed)
+				}
+			case "ADD":
+				restore(table, name)
+				upper := strings.ToUpper(action)
+				if strings.Contains(upper, "NOT NULL") && !strings.Contains(upper, "DEFAULT") {
+					remove(table, name, "is added NOT NULL without a default", true)
+				}
+			}
+		}
+	}
+	return removed
+}
+
+// tableName normalizes a table name for comparison, dropping any schema
+func tableName(name string) string {
+	name = strings.ToLower(unquote(strings.TrimSpace(name)))
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = unquote(name[i+1:])
+	}
+	return name
+}
+
+var (
+	reRenamePair   = regexp.MustCompile(`(?is)^\s*` + identifier + `\s+TO\s+` + identifier + `\s*$`)
+	reQueryTable   = regexp.MustCompile(`(?i)\b(?:FROM|JOIN|INTO|UPDATE|TABLE)\s+` + identifier)
+	reQueryWord    = regexp.MustCompile(`[A-Za-z_]\w*`)
+	reQueryLiteral = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	reQueryInsert  = regexp.MustCompile(`(?i)^\s*(?:INSERT|REPLACE)\b`)
+)
+
+// query is what a query of the deployed application uses
+type query struct {
+	tables map[string]bool
+	words  map[string]bool
+	insert bool
+}
+
+// analyzeQuery reports the tables and identifiers a query uses
+func analyzeQuery(sql string) query {
+	stripped := reQueryLiteral.ReplaceAllString(sql, "''")
+	q := query{tables: map[string]bool{}, words: map[string]bool{}, insert: reQueryInsert.MatchString(stripped)}
+	for _, match := range reQueryTable.FindAllStringSubmatch(stripped, -1) {
+		q.tables[tableName(match[1])] = true
+	}
+	for _, word := range reQueryWord.FindAllString(stripped, -1) {
+		q.words[strings.ToLower(word)] = true
+	}
+	return q
+}
+
+// reLogQuery matches the query in a line of a MySQL general query log or a
+// PostgreSQL statement log
+var reLogQuery = regexp.MustCompile(`(?:\bQuery(?:\t|\s{2,})|\b(?:statement|execute [^:]*):\s+)(.+)$`)
+
+// ReadQueries reads the queries an application issues, for
+// CheckCompatibility, from a file of SQL statements separated by semicolons
+// or from a MySQL general query log or PostgreSQL log with
+// log_statement enabled, whose lines each hold a query. Repeated queries are
+// returned once.
+func ReadQueries(r io.Reader) ([]string, error) {
+	queries := []string{}
+	seen := map[string]bool{}
+	add := func(q string) {
+		q = strings.TrimSuffix(strings.TrimSpace(q), ";")
+		if q != "" && !seen[q] {
+			seen[q] = true
+			queries = append(queries, q)
+		}
+	}
+
+	var file strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := reLogQuery.FindStringSubmatch(line); match != nil {
+			for _, stmt := range splitStatements(file.String()) {
+				add(stmt)
+			}
+			file.Reset()
+			add(match[1])
+			continue
+		}
+		file.WriteString(line)
+		file.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading queries: %w", err)
+	}
+	for _, stmt := range splitStatements(file.String()) {
+		add(stmt)
+	}
+	return queries, nil
+}
@@ -0,0 +1,88 @@
+package moogration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrNotConfirmed is returned when the func set with WithConfirm declines
+	// a down migration or rollback
+	ErrNotConfirmed = errors.New("down migrations were not confirmed")
+	// ErrProtectedEnvironment is returned when a down migration or rollback
+	// is requested without force in an environment protected with
+	// WithProtectedEnvironments
+	ErrProtectedEnvironment = errors.New("down migrations in a protected environment require force")
+)
+
+// ConfirmFunc is asked to confirm a destructive operation: plan holds the
+// migrations whose Down is about to run, in order. It returns false to
+// cancel the operation.
+type ConfirmFunc func(plan []Migration) bool
+
+// WithConfirm makes down runs, rollbacks and redos ask confirm before running
+// anything, for example by prompting the operator. It isn't asked when there
+// is nothing to roll back.
+func WithConfirm(confirm ConfirmFunc) Option {
+	return func(m *Migrator) {
+		m.confirm = confirm
+	}
+}
+
+// WithProtectedEnvironments refuses down runs and rollbacks without force
+// when MOOGRATION_ENV names one of envs. In strict mode, where force is
+// refused, the token set with WithDownConfirmation stands in for it.
+func WithProtectedEnvironments(envs ...string) Option {
+	return func(m *Migrator) {
+		m.protectedEnvs = append(m.protectedEnvs, envs...)
+	}
+}
+
+// protectedEnv reports whether the Migrator runs in a protected environment
+func (mg *Migrator) protectedEnv() bool {
+	env := os.Getenv(EnvVar)
+	for _, protected := range mg.protectedEnvs {
+		if env == protected {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmDown guards an operation running the Down of the migrations plan
+// returns: it is refused in a protected environment unless forced, and
+// needs the confirmation of the func set with WithConfirm. It must be called
+// after guard, which enforces strict mode.
+func (mg *Migrator) confirmDown(ctx context.Context, force bool, plan func() ([]Migration, error)) error {
+	if mg.confirm == nil && !mg.protectedEnv() {
+		return nil
+	}
+	migrations, err := plan()
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		return nil
+	}
+	if mg.protectedEnv() && !force && !mg.strict {
+		return fmt.Errorf("%w: %s is %s", ErrProtectedEnvironment, EnvVar, os.Getenv(EnvVar))
+	}
+	if mg.confirm != nil && !mg.confirm(migrations) {
+		mg.audit("down of %d migrations, from '%s', was not confirmed", len(migrations), migrations[0].Name)
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+// plannedMigrations returns the registered migrations of plan
+func (mg *Migrator) plannedMigrations(plan []PlannedMigration) []Migration {
+	migrations := []Migration{}
+	for _, p := range plan {
+		if m, ok := mg.registry.Get(p.Name); ok {
+			migrations = append(migrations, *m)
+		}
+	}
+	return migrations
+}
@@ -0,0 +1,74 @@
+package moogration
+
+import "fmt"
+
+// Conventions names the standard timestamp and soft-delete columns. Empty
+// names default to created_at, updated_at and deleted_at.
+type Conventions struct {
+	CreatedAt string
+	UpdatedAt string
+	DeletedAt string
+}
+
+func (c Conventions) withDefaults() Conventions {
+	if c.CreatedAt == "" {
+		c.CreatedAt = "created_at"
+	}
+	if c.UpdatedAt == "" {
+		c.UpdatedAt = "updated_at"
+	}
+	if c.DeletedAt == "" {
+		c.DeletedAt = "deleted_at"
+	}
+	return c
+}
+
+// DefineConventions defines the convention snippets on the default registry,
+// for the dialect selected with UseSQLite, UseMySQL or UsePostgres. See
+// Migrator.DefineConventions.
+func DefineConventions(c Conventions) error {
+	return defaultMigrator(nil, nil).DefineConventions(c)
+}
+
+// DefineConventions defines snippets on the Migrator's registry for the
+// standard columns and their indexes, in its dialect:
+//
+//   - "timestamps": created and updated time columns, both defaulting to the
+//     current time. On MySQL the updated column also updates itself.
+//   - "soft_delete": a nullable deleted time column
+//   - "timestamp_indexes": indexes the created time column of the table
+//     passed to it, as in {{ template "timestamp_indexes" "post" }}
+//   - "soft_delete_index": indexes the deleted time column of the table
+//     passed to it
+//
+// Define them before registering the migrations that use them.
+func (mg *Migrator) DefineConventions(c Conventions) error {
+	c = c.withDefaults()
+	timestampType, ok := map[driver]string{
+		sqlite:   "TIMESTAMP",
+		mysql:    "TIMESTAMP",
+		postgres: "TIMESTAMPTZ",
+	}[mg.driver]
+	if !ok {
+		return fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+	onUpdate := ""
+	if mg.driver == mysql {
+		onUpdate = " ON UPDATE CURRENT_TIMESTAMP"
+	}
+
+	snippets := []struct{ name, sql string }{
+		{"timestamps", fmt.Sprintf("%s %s NOT NULL DEFAULT CURRENT_TIMESTAMP, %s %s NOT NULL DEFAULT CURRENT_TIMESTAMP%s",
+			c.CreatedAt, timestampType, c.UpdatedAt, timestampType, onUpdate)},
+		{"soft_delete", fmt.Sprintf("%s %s NULL", c.DeletedAt, timestampType)},
+		{"timestamp_indexes", fmt.Sprintf("CREATE INDEX {{ . }}_%[1]s ON {{ . }} (%[1]s);", c.CreatedAt)},
+		{"soft_delete_index", fmt.Sprintf("CREATE INDEX {{ . }}_%[1]s ON {{ . }} (%[1]s);", c.DeletedAt)},
+	}
+	for _, s := range snippets {
+		err := mg.registry.DefineSnippet(s.name, s.sql)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
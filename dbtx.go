@@ -0,0 +1,66 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+)
+
+// DBTX is the database handle migrations run on. *sql.DB, *sql.Tx and
+// *sql.Conn satisfy it, as do wrappers such as sqlx.DB and instrumented
+// connections.
+//
+// Given a *sql.DB, or any handle that can begin transactions, each migration
+// runs in its own transaction where the dialect allows, and the migration
+// lock is held on a reserved connection. Given a *sql.Tx, or any handle that
+// can't, everything runs directly on the handle, which is treated as a
+// single session: a test can run migrations inside a transaction it rolls
+// back afterwards.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type beginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+type conner interface {
+	Conn(ctx context.Context) (*sql.Conn, error)
+}
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// begin starts a transaction on db. It returns a nil transaction if db can't
+// begin one, such as when db is itself a transaction, in which case the
+// caller runs on db directly.
+func begin(ctx context.Context, db DBTX) (*sql.Tx, error) {
+	b, ok := db.(beginner)
+	if !ok {
+		return nil, nil
+	}
+	return b.BeginTx(ctx, nil)
+}
+
+// session returns a handle pinned to a single database session: a connection
+// reserved from db's pool or, if db has no pool, db itself. release returns
+// a reserved connection to the pool or, with discard set, closes it for good.
+func session(ctx context.Context, db DBTX) (conn DBTX, release func(discard bool), err error) {
+	c, ok := db.(conner)
+	if !ok {
+		return db, func(bool) {}, nil
+	}
+	reserved, err := c.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reserved, func(discard bool) {
+		if discard {
+			reserved.Raw(func(interface{}) error { return sqldriver.ErrBadConn })
+		}
+		reserved.Close()
+	}, nil
+}
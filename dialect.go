@@ -0,0 +1,309 @@
+package moogration
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type driver string
+
+const (
+	sqlite   driver = "sqlite"
+	mysql    driver = "mysql"
+	postgres driver = "postgres"
+)
+
+var selectedDriver driver
+
+// selectedDialect is the dialect selected with UseDialect, if any
+var selectedDialect Dialect
+
+// UseSQLite sets the package's mode to SQLite
+func UseSQLite() {
+	selectedDriver = sqlite
+	selectedDialect = nil
+}
+
+// UseMySQL sets the package's mode to MySQL
+func UseMySQL() {
+	selectedDriver = mysql
+	selectedDialect = nil
+}
+
+// UsePostgres sets the package's mode to PostgreSQL
+func UsePostgres() {
+	selectedDriver = postgres
+	selectedDialect = nil
+}
+
+// Dialect describes a database other than the built-in MySQL, PostgreSQL and
+// SQLite, such as TiDB or CockroachDB, so it can be used without forking the
+// package. The database must accept the SQL of one of the built-in dialects,
+// named by Base, which moogration's own queries (its status, lock and audit
+// tables, and so on) are written in; the Dialect overrides what differs.
+type Dialect interface {
+	// Name identifies the dialect, for RegisterDialect and UseDialect
+	Name() string
+	// Base names the built-in dialect whose SQL the database accepts:
+	// "mysql", "postgres" or "sqlite"
+	Base() string
+	// TrackingTableSQL returns the statement creating the tracking table
+	// named table if it doesn't exist, with the columns of Base's tracking
+	// table
+	TrackingTableSQL(table string) string
+	// Placeholder returns the bind parameter placeholder for the nth
+	// argument of a query, counting from 1
+	Placeholder(n int) string
+	// LockStrategy is how WithLock guards the migration table
+	LockStrategy() LockStrategy
+	// TransactionalDDL reports whether schema changes can be rolled back in
+	// a transaction, so each migration runs in one
+	TransactionalDDL() bool
+}
+
+// LockStrategy is how a Dialect takes the migration lock
+type LockStrategy int
+
+const (
+	// LockTable inserts a row in a table named after the tracking table with
+	// a "_lock" suffix, which works on any database
+	LockTable LockStrategy = iota
+	// LockSession takes the session lock of the Base dialect: GET_LOCK on
+	// MySQL or an advisory lock on PostgreSQL. On SQLite it is LockTable.
+	LockSession
+)
+
+// dialects are the dialects registered with RegisterDialect, by name
+var dialects = struct {
+	sync.Mutex
+	byName map[string]Dialect
+}{byName: map[string]Dialect{}}
+
+// RegisterDialect makes d available to UseDialect under its name. It returns
+// an error if the name is taken, including by a built-in dialect, or if d's
+// Base isn't a built-in dialect.
+func RegisterDialect(d Dialect) error {
+	switch driver(d.Name()) {
+	case mysql, postgres, sqlite:
+		return fmt.Errorf("dialect '%s' is built in", d.Name())
+	}
+	switch driver(d.Base()) {
+	case mysql, postgres, sqlite:
+	default:
+		return fmt.Errorf("dialect '%s' has base '%s', which isn't a built-in dialect", d.Name(), d.Base())
+	}
+	dialects.Lock()
+	defer dialects.Unlock()
+	if _, ok := dialects.byName[d.Name()]; ok {
+		return fmt.Errorf("dialect '%s' is already registered", d.Name())
+	}
+	dialects.byName[d.Name()] = d
+	return nil
+}
+
+// LookupDialect returns the dialect registered under name
+func LookupDialect(name string) (Dialect, bool) {
+	dialects.Lock()
+	defer dialects.Unlock()
+	d, ok := dialects.byName[name]
+	return d, ok
+}
+
+// UseDialect sets the package's mode to the dialect registered under name
+func UseDialect(name string) error {
+	d, ok := LookupDialect(name)
+	if !ok {
+		return fmt.Errorf("dialect '%s' is not registered", name)
+	}
+	selectedDriver = driver(d.Base())
+	selectedDialect = d
+	return nil
+}
+
+// this table tracks migratipn statuses. Columns added since the first
+// release are listed in trackingColumns too, to upgrade existing tables.
+const createMigrationTableMySQL = `
+	CREATE TABLE IF NOT EXISTS %s (
+		id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255),
+		batch int NOT NULL,
+		sql_hash VARCHAR(255),
+		migrated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		dirty BOOLEAN NOT NULL DEFAULT FALSE,
+		duration_ms BIGINT,
+		applied_by VARCHAR(255),
+		applied_sql LONGTEXT,
+		dirty_direction VARCHAR(4)
+	);
+`
+
+const createMigrationTableSQLite = `
+	CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		batch INTEGER NOT NULL,
+		sql_hash TEXT,
+		migrated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		dirty INTEGER NOT NULL DEFAULT 0,
+		duration_ms INTEGER,
+		applied_by TEXT,
+		applied_sql TEXT,
+		dirty_direction TEXT
+	);
+`
+
+const createMigrationTablePostgres = `
+	CREATE TABLE IF NOT EXISTS %s (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		name VARCHAR(255),
+		batch INTEGER NOT NULL,
+		sql_hash VARCHAR(255),
+		migrated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		dirty BOOLEAN NOT NULL DEFAULT FALSE,
+		duration_ms BIGINT,
+		applied_by VARCHAR(255),
+		applied_sql TEXT,
+		dirty_direction VARCHAR(4)
+	);
+`
+
+// these tables hold follow-ups scheduled by applied migrations
+const createFollowUpTableMySQL = `
+	CREATE TABLE IF NOT EXISTS %s_followup (
+		id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		migration VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		statement TEXT NOT NULL,
+		not_before BIGINT NOT NULL,
+		completed_at TIMESTAMP NULL
+	);
+`
+
+const createFollowUpTableSQLite = `
+	CREATE TABLE IF NOT EXISTS %s_followup (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		migration TEXT NOT NULL,
+		name TEXT NOT NULL,
+		statement TEXT NOT NULL,
+		not_before INTEGER NOT NULL,
+		completed_at TIMESTAMP NULL
+	);
+`
+
+const createFollowUpTablePostgres = `
+	CREATE TABLE IF NOT EXISTS %s_followup (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		migration VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		statement TEXT NOT NULL,
+		not_before BIGINT NOT NULL,
+		completed_at TIMESTAMPTZ NULL
+	);
+`
+
+// these tables hold the labels applied migrations were run with
+const createLabelTableMySQL = `
+	CREATE TABLE IF NOT EXISTS %s_label (
+		migration VARCHAR(255) NOT NULL,
+		label_key VARCHAR(255) NOT NULL,
+		label_value TEXT NOT NULL,
+		PRIMARY KEY (migration, label_key)
+	);
+`
+
+const createLabelTableSQLite = `
+	CREATE TABLE IF NOT EXISTS %s_label (
+		migration TEXT NOT NULL,
+		label_key TEXT NOT NULL,
+		label_value TEXT NOT NULL,
+		PRIMARY KEY (migration, label_key)
+	);
+`
+
+const createLabelTablePostgres = `
+	CREATE TABLE IF NOT EXISTS %s_label (
+		migration VARCHAR(255) NOT NULL,
+		label_key VARCHAR(255) NOT NULL,
+		label_value TEXT NOT NULL,
+		PRIMARY KEY (migration, label_key)
+	);
+`
+
+// SQLite has no session locks, so WithLock holds a single row in this table,
+// as it does on every dialect with WithMinimalPermissions
+const createLockTableSQL = `
+	CREATE TABLE IF NOT EXISTS %s_lock (
+		id INTEGER NOT NULL PRIMARY KEY,
+		acquired_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+`
+
+// this table records which instance holds the migration lock, in every
+// dialect
+const createLockHolderTableSQL = `
+	CREATE TABLE IF NOT EXISTS %s_lock_holder (
+		id INTEGER NOT NULL PRIMARY KEY,
+		host VARCHAR(255) NOT NULL,
+		pid INTEGER NOT NULL,
+		acquired_at BIGINT NOT NULL,
+		heartbeat_at BIGINT NOT NULL,
+		lease_ms BIGINT NOT NULL
+	);
+`
+
+// rebind rewrites the ? placeholders used by internal queries into the
+// driver's placeholder style. Internal queries never contain a literal ?.
+func (d driver) rebind(query string) string {
+	if d != postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// stmt formats an internal query against the Migrator's tracking table, in
+// the placeholder style of its driver
+func (mg *Migrator) stmt(format string) string {
+	return mg.rebind(strings.ReplaceAll(format, "%s", mg.qualifiedTable()))
+}
+
+// rebind rewrites the ? placeholders of an internal query into the
+// placeholder style of the Migrator's dialect
+func (mg *Migrator) rebind(query string) string {
+	if mg.dialect == nil {
+		return mg.driver.rebind(query)
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(mg.dialect.Placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// qualifiedTable is the tracking table's name, qualified with its schema if
+// one is configured. Tables the Migrator keeps alongside it, such as the
+// lock table, share the schema and the name as a prefix.
+func (mg *Migrator) qualifiedTable() string {
+	if mg.schema == "" {
+		return mg.table
+	}
+	return mg.schema + "." + mg.table
+}
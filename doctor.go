@@ -0,0 +1,188 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Diagnostic is the outcome of one of Doctor's checks
+type Diagnostic struct {
+	Check string
+	OK    bool
+	// Detail describes what was found
+	Detail string
+	// Remedy suggests how to fix a failed check
+	Remedy string
+}
+
+// Doctor diagnoses db and the default registry. See Migrator.Doctor.
+func Doctor(db DBTX) []Diagnostic {
+	return defaultMigrator(db, nil).DoctorContext(context.Background())
+}
+
+// Doctor runs a battery of diagnostics: connectivity, driver capabilities,
+// permission to create, alter and drop tables, tracking table health, and,
+// if any migrations are registered, drift and orphaned records. A failed
+// check comes with a suggested remedy. Checks after a failed connectivity
+// check are skipped.
+func (mg *Migrator) Doctor() []Diagnostic {
+	return mg.DoctorContext(context.Background())
+}
+
+// DoctorContext is like Doctor, with a context
+func (mg *Migrator) DoctorContext(ctx context.Context) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	add := func(d Diagnostic) {
+		diagnostics = append(diagnostics, d)
+	}
+
+	var err error
+	if p, ok := mg.db.(pinger); ok {
+		err = p.PingContext(ctx)
+	} else {
+		_, err = mg.db.ExecContext(ctx, "SELECT 1")
+	}
+	if err != nil {
+		add(Diagnostic{
+			Check:  "connectivity",
+			Detail: err.Error(),
+			Remedy: "check the DSN, that the server is running and reachable, and the credentials",
+		})
+		return diagnostics
+	}
+	add(Diagnostic{Check: "connectivity", OK: true, Detail: fmt.Sprintf("connected (%s dialect)", mg.driver)})
+
+	add(mg.diagnoseCapabilities(ctx))
+	add(mg.diagnosePermissions(ctx))
+
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		add(Diagnostic{Check: "tracking table", Detail: err.Error(), Remedy: "check the tracking table and schema configuration"})
+		return diagnostics
+	}
+	if !exists {
+		add(Diagnostic{Check: "tracking table", OK: true, Detail: fmt.Sprintf("%s does not exist yet and will be created by the first run", mg.qualifiedTable())})
+		return diagnostics
+	}
+	add(mg.diagnoseTrackingTable(ctx))
+
+	if mg.registry.Count() == 0 {
+		return diagnostics
+	}
+	add(mg.diagnoseDrift(ctx))
+	return diagnostics
+}
+
+func (mg *Migrator) diagnoseCapabilities(ctx context.Context) Diagnostic {
+	caps, err := mg.DetectCapabilitiesContext(ctx)
+	if err != nil {
+		return Diagnostic{Check: "driver capabilities", Detail: err.Error(), Remedy: "check the configured dialect matches the database"}
+	}
+	return Diagnostic{
+		Check:  "driver capabilities",
+		OK:     true,
+		Detail: fmt.Sprintf("multiple statements per Exec: %t, transactional DDL: %t, advisory locks: %t", caps.MultiStatements, caps.TransactionalDDL, caps.AdvisoryLocks),
+	}
+}
+
+// diagnosePermissions creates, alters and drops a scratch table
+func (mg *Migrator) diagnosePermissions(ctx context.Context) Diagnostic {
+	scratch := mg.qualifiedTable() + "_doctor"
+	steps := []string{
+		fmt.Sprintf("CREATE TABLE %s (id INTEGER)", scratch),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN note VARCHAR(16)", scratch),
+		fmt.Sprintf("DROP TABLE %s", scratch),
+	}
+	for _, step := range steps {
+		_, err := mg.db.ExecContext(ctx, step)
+		if err != nil {
+			// don't leave the scratch table behind if a later step failed
+			mg.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", scratch))
+			return Diagnostic{
+				Check:  "permissions",
+				Detail: fmt.Sprintf("%s: %s", strings.Fields(step)[0]+" "+strings.Fields(step)[1], err),
+				Remedy: "grant the migration user CREATE, ALTER and DROP on the schema",
+			}
+		}
+	}
+	return Diagnostic{Check: "permissions", OK: true, Detail: "can create, alter and drop tables"}
+}
+
+// diagnoseTrackingTable looks for duplicate and incomplete status records
+func (mg *Migrator) diagnoseTrackingTable(ctx context.Context) Diagnostic {
+	var total int
+	err := mg.db.QueryRowContext(ctx, mg.stmt("SELECT COUNT(*) FROM %s")).Scan(&total)
+	if err != nil {
+		return Diagnostic{
+			Check:  "tracking table",
+			Detail: err.Error(),
+			Remedy: fmt.Sprintf("check that %s has the name, batch and sql_hash columns and the migration user can read it", mg.qualifiedTable()),
+		}
+	}
+
+	problems := []string{}
+	rows, err := mg.db.QueryContext(ctx, mg.stmt("SELECT name FROM %s GROUP BY name HAVING COUNT(*) > 1"))
+	if err != nil {
+		return Diagnostic{Check: "tracking table", Detail: err.Error()}
+	}
+	duplicates := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil {
+			duplicates = append(duplicates, name)
+		}
+	}
+	rows.Close()
+	if len(duplicates) > 0 {
+		problems = append(problems, fmt.Sprintf("migrations recorded more than once: %s", strings.Join(duplicates, ", ")))
+	}
+
+	var missingHashes int
+	err = mg.db.QueryRowContext(ctx, mg.stmt("SELECT COUNT(*) FROM %s WHERE sql_hash IS NULL OR sql_hash = ''")).Scan(&missingHashes)
+	if err == nil && missingHashes > 0 {
+		problems = append(problems, fmt.Sprintf("%d records have no hash", missingHashes))
+	}
+
+	if len(problems) > 0 {
+		return Diagnostic{
+			Check:  "tracking table",
+			Detail: strings.Join(problems, "; "),
+			Remedy: fmt.Sprintf("delete duplicate rows from %s, keeping the lowest id, and re-record missing hashes with Redo", mg.qualifiedTable()),
+		}
+	}
+	return Diagnostic{Check: "tracking table", OK: true, Detail: fmt.Sprintf("%d migrations recorded", total)}
+}
+
+// diagnoseDrift compares the registry with the tracking table
+func (mg *Migrator) diagnoseDrift(ctx context.Context) Diagnostic {
+	findings, err := mg.CheckContext(ctx)
+	if err != nil {
+		return Diagnostic{Check: "drift", Detail: err.Error()}
+	}
+
+	changed := []string{}
+	orphaned := []string{}
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			changed = append(changed, f.Migration)
+		} else {
+			orphaned = append(orphaned, f.Migration)
+		}
+	}
+	if len(changed) == 0 && len(orphaned) == 0 {
+		return Diagnostic{Check: "drift", OK: true, Detail: "every applied migration is registered and unchanged"}
+	}
+
+	details := []string{}
+	remedies := []string{}
+	if len(changed) > 0 {
+		details = append(details, fmt.Sprintf("changed since applied: %s", strings.Join(changed, ", ")))
+		remedies = append(remedies, "revert edits to applied migrations and make the change in a new migration")
+	}
+	if len(orphaned) > 0 {
+		details = append(details, fmt.Sprintf("applied but not registered: %s", strings.Join(orphaned, ", ")))
+		remedies = append(remedies, "check every migration package is imported, or Prune records of removed migrations")
+	}
+	return Diagnostic{Check: "drift", Detail: strings.Join(details, "; "), Remedy: strings.Join(remedies, "; ")}
+}
@@ -0,0 +1,61 @@
+package moogration
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrDiverged is wrapped into the error returned when a migration's status
+	// differs between the primary and the dual-write target
+	ErrDiverged = errors.New("dual-write target has diverged from the primary")
+	// ErrDualWriteRollback is returned by Rollback in dual-write mode, where
+	// batch numbers are tracked separately on each database
+	ErrDualWriteRollback = errors.New("rollback is not supported in dual-write mode; run down migrations with RunLatest instead")
+)
+
+// WithDualWrite applies every migration to target as well as the Migrator's
+// own database, for cutovers using logical replication where the new primary
+// must not miss a schema change. Each migration is applied to the primary and
+// then to target before the next one starts, and each database tracks its own
+// statuses. A run aborts with ErrDiverged before touching a migration whose
+// status differs between the two.
+func WithDualWrite(target DBTX) Option {
+	return func(m *Migrator) {
+		m.dualWrite = target
+	}
+}
+
+// mirror returns a Migrator for the dual-write target
+func (mg *Migrator) mirror() *Migrator {
+	sub := *mg
+	sub.db = mg.dualWrite
+	sub.dualWrite = nil
+	// hooks are called, and spans started, for the primary only
+	sub.hooks = hooks{}
+	sub.tracer = nil
+	// readers set with WithReadYourWrites read from the primary
+	sub.visibility = nil
+	return &sub
+}
+
+// checkDiverged returns an error if m's status on any target differs from
+// its status on the first
+func checkDiverged(m Migration, targets []*runTarget) error {
+	primaryHash, primaryRun := targets[0].applied[m.Name]
+	for _, t := range targets[1:] {
+		hash, hasRun := t.applied[m.Name]
+		if hasRun != primaryRun || hash != primaryHash {
+			return fmt.Errorf("%w: migration '%s' is %s on the primary but %s on the target",
+				ErrDiverged, m.Name, describeStatus(primaryHash, primaryRun), describeStatus(hash, hasRun))
+		}
+	}
+	return nil
+}
+
+func describeStatus(hash string, hasRun bool) string {
+	if !hasRun {
+		return "not applied"
+	}
+	return fmt.Sprintf("applied with hash %s", hash)
+}
@@ -0,0 +1,223 @@
+package moogration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpHeader begins a schema dump, followed by the dialect it was taken from
+const dumpHeader = "-- moogration schema dump: "
+
+// DumpSchema writes the schema of db and its tracking table to w. See
+// Migrator.DumpSchema.
+func DumpSchema(db DBTX, w io.Writer) error {
+	return defaultMigrator(db, nil).DumpSchemaContext(context.Background(), w)
+}
+
+// LoadSchema restores a dump written by DumpSchema to db. See
+// Migrator.LoadSchema.
+func LoadSchema(db DBTX, r io.Reader) error {
+	return defaultMigrator(db, nil).LoadSchemaContext(context.Background(), r)
+}
+
+// DumpSchema writes the schema of the Migrator's database to w as SQL, with
+// its tracking table and the rows recording which migrations are applied,
+// and the follow-ups and labels recorded with them, so a test suite can
+// build its database from the dump with LoadSchema instead of replaying
+// every migration. The schema is dumped as for Squash:
+// from sqlite_master on SQLite and with SHOW CREATE TABLE on MySQL;
+// PostgreSQL isn't supported. Data in other tables isn't dumped.
+func (mg *Migrator) DumpSchema(w io.Writer) error {
+	return mg.DumpSchemaContext(context.Background(), w)
+}
+
+// DumpSchemaContext is like DumpSchema, with a context
+func (mg *Migrator) DumpSchemaContext(ctx context.Context, w io.Writer) error {
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("cannot dump schema: tracking table %s doesn't exist", mg.qualifiedTable())
+	}
+	objects, err := mg.schemaObjects(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "%s%s\n\n", dumpHeader, mg.driver)
+	for _, o := range objects {
+		stmt := strings.TrimSuffix(strings.TrimSpace(o.sql), ";")
+		tracked := o.kind == "table" && mg.tracksTable(o.name)
+		if match := reCreateTable.FindStringSubmatchIndex(stmt); tracked && match != nil {
+			// the loading database may have created empty tracking tables
+			stmt = "CREATE TABLE IF NOT EXISTS " + stmt[match[2]:]
+		}
+		fmt.Fprintf(b, "%s;\n\n", stmt)
+	}
+	for _, suffix := range trackedSuffixes {
+		exists, err := mg.hasTable(ctx, mg.table+suffix)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		err = mg.dumpTrackingRows(ctx, b, mg.table+suffix)
+		if err != nil {
+			return err
+		}
+	}
+	return b.Flush()
+}
+
+// dumpTrackingRows writes an INSERT for each row of table, the tracking table
+// or one recording the state of applied migrations alongside it
+func (mg *Migrator) dumpTrackingRows(ctx context.Context, w io.Writer, table string) error {
+	qualified := mg.driver.quote(table)
+	if mg.schema != "" {
+		qualified = mg.driver.quote(mg.schema) + "." + qualified
+	}
+	rows, err := mg.db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s ORDER BY 1, 2", qualified))
+	if err != nil {
+		return fmt.Errorf("error dumping tracking table %s: %w", table, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("error dumping tracking table %s: %w", table, err)
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = mg.driver.quote(c)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES", qualified, strings.Join(quoted, ", "))
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		err := rows.Scan(pointers...)
+		if err != nil {
+			return fmt.Errorf("error dumping tracking table %s: %w", table, err)
+		}
+		literals := make([]string, len(values))
+		for i, v := range values {
+			literals[i] = mg.driver.literal(v)
+		}
+		_, err = fmt.Fprintf(w, "%s (%s);\n", insert, strings.Join(literals, ", "))
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// literal formats a value scanned from the database as a SQL literal
+func (d driver) literal(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return "'" + v.UTC().Format("2006-01-02 15:04:05") + "'"
+	case []byte:
+		return d.literal(string(v))
+	default:
+		s := fmt.Sprint(v)
+		if d == mysql {
+			s = strings.ReplaceAll(s, `\`, `\\`)
+		}
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+}
+
+// LoadSchema restores a dump written by DumpSchema, from a database of the
+// same dialect and with the same tracking table name, to the Migrator's
+// database, which must have no migrations applied yet. Where the dialect
+// supports transactional DDL, the dump is loaded in a single transaction.
+// Afterwards, migrations registered since the dump was taken are pending.
+func (mg *Migrator) LoadSchema(r io.Reader) error {
+	return mg.LoadSchemaContext(context.Background(), r)
+}
+
+// LoadSchemaContext is like LoadSchema, with a context
+func (mg *Migrator) LoadSchemaContext(ctx context.Context, r io.Reader) error {
+	if err := mg.refuseDryRun("LoadSchema"); err != nil {
+		return err
+	}
+	if err := mg.refuseStrict("LoadSchema"); err != nil {
+		return err
+	}
+	dump, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading schema dump: %w", err)
+	}
+	header, _, _ := strings.Cut(string(dump), "\n")
+	if !strings.HasPrefix(header, dumpHeader) {
+		return fmt.Errorf("not a schema dump written by DumpSchema")
+	}
+	if from := driver(strings.TrimPrefix(header, dumpHeader)); from != mg.driver {
+		return fmt.Errorf("cannot load a schema dump from %s into %s", from, mg.driver)
+	}
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		var applied int
+		err = mg.db.QueryRowContext(ctx, mg.stmt("SELECT COUNT(*) FROM %s")).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("error reading tracking table: %w", err)
+		}
+		if applied > 0 {
+			return fmt.Errorf("cannot load schema: %d migrations are already applied", applied)
+		}
+	}
+
+	var db DBTX = mg.db
+	tx, err := begin(ctx, mg.db)
+	if err != nil {
+		return fmt.Errorf("error starting transaction for schema load: %w", err)
+	}
+	if tx != nil {
+		db = tx
+	}
+	statements := splitSQL(string(dump), mg.driver)
+	for _, stmt := range statements {
+		_, err := db.ExecContext(ctx, stmt)
+		if err != nil {
+			if tx != nil {
+				tx.Rollback()
+			}
+			return fmt.Errorf("error loading schema: %w: %s", err, stmt)
+		}
+	}
+	if tx != nil {
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("error committing schema load: %w", err)
+		}
+	}
+
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: loaded schema dump of %d statements", len(statements))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package moogration
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is returned by the public API in place of a panic raised while a
+// migration was being processed. It records which migration was running and in
+// which phase, along with the stack at the time of the panic.
+type PanicError struct {
+	Migration string
+	Phase     string
+	Value     interface{}
+	Stack     []byte
+}
+
+func (e *PanicError) Error() string {
+	if e.Migration == "" {
+		return fmt.Sprintf("moogration panicked during %s: %v", e.Phase, e.Value)
+	}
+	return fmt.Sprintf("moogration panicked during %s of migration '%s': %v", e.Phase, e.Migration, e.Value)
+}
+
+// Unwrap returns the panic value if it was an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// runState tracks the migration and phase currently being processed, so a
+// recovered panic can be attributed, along with the run's throttle
+type runState struct {
+	migration string
+	phase     string
+	throttle  *throttle
+	result    *Result
+	// failures are the migration failures the run continued past
+	failures []error
+}
+
+func (s *runState) set(migration, phase string) {
+	s.migration = migration
+	s.phase = phase
+}
+
+// recoverPanic converts a panic into a *PanicError assigned to err. It must be
+// deferred directly by the public function whose error it sets.
+func recoverPanic(err *error, state *runState) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	*err = &PanicError{
+		Migration: state.migration,
+		Phase:     state.phase,
+		Value:     r,
+		Stack:     debug.Stack(),
+	}
+}
@@ -0,0 +1,23 @@
+package moogration
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	boom := errors.New("boom")
+	err := func() (err error) {
+		state := &runState{}
+		defer recoverPanic(&err, state)
+		state.set("001_test_migration", "up")
+		panic(boom)
+	}()
+
+	var panicErr *PanicError
+	assertEquals(t, true, errors.As(err, &panicErr))
+	assertEquals(t, "001_test_migration", panicErr.Migration)
+	assertEquals(t, "up", panicErr.Phase)
+	assertEquals(t, true, errors.Is(err, boom))
+	assertEquals(t, true, len(panicErr.Stack) > 0)
+}
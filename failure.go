@@ -0,0 +1,214 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// FailurePolicy is what a run does when a migration fails
+type FailurePolicy int
+
+const (
+	// StopOnError stops the run at the first failed migration, without
+	// recording its status. It is the default.
+	StopOnError FailurePolicy = iota
+	// SkipAndContinue leaves a failed migration unrecorded and continues with
+	// the next one. The run reports each failure in Result.Skipped and
+	// returns an error joining them once it has finished.
+	SkipAndContinue
+	// MarkDirty stops the run like StopOnError, but records a failed
+	// migration that didn't run in a transaction as dirty, as it may have been
+	// partly applied. Later runs refuse to start, with an error wrapping
+	// ErrDirty, until the database is repaired and ResolveDirty called.
+	MarkDirty
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case SkipAndContinue:
+		return "skip and continue"
+	case MarkDirty:
+		return "mark dirty"
+	default:
+		return "stop on error"
+	}
+}
+
+// ErrDirty is wrapped by the error of a run refused because a migration is
+// recorded as dirty, and by the error of the migration recorded as dirty
+var ErrDirty = errors.New("migration is dirty")
+
+// WithFailurePolicy sets what a run does when a migration fails. Passing
+// force to a run no longer changes it: a failed migration is never recorded
+// as applied.
+func WithFailurePolicy(p FailurePolicy) Option {
+	return func(m *Migrator) {
+		m.failurePolicy = p
+	}
+}
+
+// migrationFailure is the error of a migration's own SQL or function, as
+// opposed to an error recording its status
+type migrationFailure struct {
+	err error
+}
+
+func (f *migrationFailure) Error() string {
+	return f.err.Error()
+}
+
+func (f *migrationFailure) Unwrap() error {
+	return f.err
+}
+
+// skipFailure reports whether err is the failure of m and the run should
+// continue past it, recording it in the run's result. A migration recorded
+// as dirty always stops the run.
+func (mg *Migrator) skipFailure(m Migration, err error, state *runState) bool {
+	var failure *migrationFailure
+	if mg.failurePolicy != SkipAndContinue || !errors.As(err, &failure) || errors.Is(err, ErrDirty) {
+		return false
+	}
+	if mg.logger != nil {
+		mg.logger.Printf("ERROR: migration '%s' failed, continuing: %s", m.Name, err)
+	}
+	state.failures = append(state.failures, err)
+	if state.result != nil {
+		state.result.Skipped = append(state.result.Skipped, SkippedMigration{Name: m.Name, Reason: fmt.Sprintf("failed: %s", err)})
+		state.result.Failed = nil
+	}
+	return true
+}
+
+// failed returns the failures a run continued past, or nil if there were
+// none
+func (s *runState) failed() error {
+	if len(s.failures) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d migrations failed: %w", len(s.failures), errors.Join(s.failures...))
+}
+
+// markDirty records m as dirty after it failed outside a transaction, with
+// the direction that failed. A failed up is recorded as applied, replacing
+// any earlier record of a repeatable migration, and a failed down keeps its
+// record, so the migration is rolled back or resolved before anything else
+// runs.
+func (mg *Migrator) markDirty(ctx context.Context, m Migration, down bool, batch int) error {
+	var db DBTX = mg.db
+	tx, err := begin(ctx, mg.db)
+	if err != nil {
+		return fmt.Errorf("error marking migration '%s' dirty: %w", m.Name, err)
+	}
+	if tx != nil {
+		db = tx
+		// a no-op once committed
+		defer tx.Rollback()
+	}
+
+	updated := int64(0)
+	if down {
+		var res sql.Result
+		res, err = db.ExecContext(ctx, mg.stmt("UPDATE %s SET dirty = ?, dirty_direction = ? WHERE name = ?"), true, direction(down), m.Name)
+		if err == nil {
+			updated, err = res.RowsAffected()
+		}
+	} else {
+		_, err = db.ExecContext(ctx, mg.stmt("DELETE FROM %s WHERE name = ?"), m.Name)
+	}
+	if err == nil && updated == 0 {
+		// an up, or a down without a record to mark, is recorded anew
+		_, err = db.ExecContext(ctx, mg.stmt("INSERT INTO %s (name, sql_hash, batch, dirty, dirty_direction, applied_by) VALUES (?, ?, ?, ?, ?, ?)"),
+			m.Name, m.hash(), batch, true, direction(down), mg.applier())
+	}
+	if err == nil && tx != nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("error marking migration '%s' dirty: %w", m.Name, err)
+	}
+	mg.auditMigration(m, "marked migration '%s' dirty after its %s failed", m.Name, direction(down))
+	return nil
+}
+
+// checkDirty returns an error wrapping ErrDirty if a migration is recorded
+// as dirty
+func (mg *Migrator) checkDirty(ctx context.Context) error {
+	var name string
+	err := mg.db.QueryRowContext(ctx, mg.stmt("SELECT name FROM %s WHERE dirty = ? ORDER BY id LIMIT 1"), true).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking for dirty migrations: %w", err)
+	}
+	return fmt.Errorf("%w: '%s' failed partway; repair the database, then call ResolveDirty", ErrDirty, name)
+}
+
+// ResolveDirty clears the dirty migration name of the default registry. See
+// Migrator.ResolveDirty.
+func ResolveDirty(db DBTX, name string, completed bool, logger *log.Logger) error {
+	return defaultMigrator(db, logger).ResolveDirtyContext(context.Background(), name, completed)
+}
+
+// ResolveDirty clears a migration recorded as dirty by MarkDirty, once the
+// database has been repaired by hand, so runs can start again. completed
+// says how it was repaired: true if the failed direction's changes were
+// completed, false if they were undone. A migration left applied, by a
+// completed up or an undone down, keeps its record; otherwise its record is
+// deleted.
+func (mg *Migrator) ResolveDirty(name string, completed bool) error {
+	return mg.ResolveDirtyContext(context.Background(), name, completed)
+}
+
+// ResolveDirtyContext is like ResolveDirty, with a context
+func (mg *Migrator) ResolveDirtyContext(ctx context.Context, name string, completed bool) (err error) {
+	if err := mg.refuseDryRun("ResolveDirty"); err != nil {
+		return err
+	}
+	if err := mg.refuseStrict("ResolveDirty"); err != nil {
+		return err
+	}
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+	return mg.withLock(ctx, func(mg *Migrator) error {
+		state.set(name, "resolve dirty")
+		err := mg.createMigrationTable(ctx)
+		if err != nil {
+			return err
+		}
+
+		// rows marked dirty before the direction was recorded were ups
+		var failed sql.NullString
+		err = mg.db.QueryRowContext(ctx, mg.stmt("SELECT dirty_direction FROM %s WHERE name = ? AND dirty = ?"), name, true).Scan(&failed)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("migration '%s' is not dirty", name)
+		}
+		if err != nil {
+			return fmt.Errorf("error resolving dirty migration '%s': %w", name, err)
+		}
+
+		down := failed.String == "down"
+		stmt := mg.stmt("DELETE FROM %s WHERE name = ? AND dirty = ?")
+		args := []interface{}{name, true}
+		if completed != down {
+			// the migration is left applied
+			stmt = mg.stmt("UPDATE %s SET dirty = ?, dirty_direction = NULL WHERE name = ? AND dirty = ?")
+			args = []interface{}{false, name, true}
+		}
+		_, err = mg.db.ExecContext(ctx, stmt, args...)
+		if err != nil {
+			return fmt.Errorf("error resolving dirty migration '%s': %w", name, err)
+		}
+
+		resolution := "undone"
+		if completed {
+			resolution = "completed"
+		}
+		mg.audit("resolved dirty %s of migration '%s' as %s", direction(down), name, resolution)
+		return nil
+	})
+}
@@ -0,0 +1,389 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjected is the error a Fault fails a statement with unless it sets its
+// own
+var ErrInjected = errors.New("injected fault")
+
+// Fault is a failure a FaultInjector injects into matching statements
+type Fault struct {
+	// Match limits the fault to statements containing it, ignoring case. An
+	// empty Match matches every statement, including those moogration runs
+	// on its tracking table.
+	Match string
+	// Statement is the number of the matching statement the fault applies
+	// to, counting from 1. Zero applies it to every matching statement.
+	Statement int
+	// Err fails the statement without running it. If the fault sets neither
+	// Delay nor DropConnection, it defaults to ErrInjected.
+	Err error
+	// DropConnection closes the connection the statement is run on, failing
+	// it with driver.ErrBadConn. database/sql retries a statement run outside
+	// a transaction or reserved connection on another connection, where it
+	// may then succeed.
+	DropConnection bool
+	// Delay holds the statement back before running it, or until its context
+	// is done
+	Delay time.Duration
+}
+
+// FaultInjector opens databases whose statements can be made to fail, lose
+// their connection or run slowly, for deterministic tests of failure
+// handling: that a migration is recorded dirty, a run reports which
+// migrations failed, or a timeout fires. Faults apply to every statement,
+// including those run inside transactions.
+type FaultInjector struct {
+	mu     sync.Mutex
+	faults []*faultState
+	count  int
+}
+
+// faultState is a Fault and the number of statements it has matched
+type faultState struct {
+	Fault
+	seen int
+}
+
+// NewFaultInjector returns a FaultInjector injecting faults
+func NewFaultInjector(faults ...Fault) *FaultInjector {
+	fi := &FaultInjector{}
+	fi.Inject(faults...)
+	return fi
+}
+
+// Inject adds faults, counting statements from when they are added
+func (fi *FaultInjector) Inject(faults ...Fault) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, f := range faults {
+		fi.faults = append(fi.faults, &faultState{Fault: f})
+	}
+}
+
+// Reset removes every fault
+func (fi *FaultInjector) Reset() {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults = nil
+}
+
+// Statements returns the number of statements run through the injector's
+// databases
+func (fi *FaultInjector) Statements() int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.count
+}
+
+// Open opens a database like sql.Open, with the injector's faults
+func (fi *FaultInjector) Open(driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+
+	connector := &faultConnector{fi: fi, drv: drv, dsn: dsn}
+	if dc, ok := drv.(sqldriver.DriverContext); ok {
+		connector.inner, err = dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// fault returns the fault that applies to query, if any
+func (fi *FaultInjector) fault(query string) *Fault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.count++
+	var match *Fault
+	for _, f := range fi.faults {
+		if f.Match != "" && !strings.Contains(strings.ToLower(query), strings.ToLower(f.Match)) {
+			continue
+		}
+		f.seen++
+		if match == nil && (f.Statement == 0 || f.Statement == f.seen) {
+			match = &f.Fault
+		}
+	}
+	return match
+}
+
+// inject applies the fault for query, if any, on c. It returns the error to
+// fail the statement with, or nil to run it.
+func (fi *FaultInjector) inject(ctx context.Context, c *faultConn, query string) error {
+	if c.dropped {
+		return sqldriver.ErrBadConn
+	}
+	f := fi.fault(query)
+	if f == nil {
+		return nil
+	}
+	if f.Delay > 0 {
+		timer := time.NewTimer(f.Delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if f.DropConnection {
+		c.dropped = true
+		c.Conn.Close()
+		return sqldriver.ErrBadConn
+	}
+	if f.Err != nil {
+		return f.Err
+	}
+	if f.Delay == 0 {
+		return ErrInjected
+	}
+	return nil
+}
+
+type faultConnector struct {
+	fi    *FaultInjector
+	drv   sqldriver.Driver
+	dsn   string
+	inner sqldriver.Connector
+}
+
+func (c *faultConnector) Connect(ctx context.Context) (sqldriver.Conn, error) {
+	var conn sqldriver.Conn
+	var err error
+	if c.inner != nil {
+		conn, err = c.inner.Connect(ctx)
+	} else {
+		conn, err = c.drv.Open(c.dsn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, fi: c.fi}, nil
+}
+
+func (c *faultConnector) Driver() sqldriver.Driver {
+	return c.drv
+}
+
+// faultConn wraps a driver connection, injecting faults into its statements
+type faultConn struct {
+	sqldriver.Conn
+	fi *FaultInjector
+	// dropped is set once a fault has closed the connection
+	dropped bool
+}
+
+func (c *faultConn) Prepare(query string) (sqldriver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *faultConn) PrepareContext(ctx context.Context, query string) (sqldriver.Stmt, error) {
+	if c.dropped {
+		return nil, sqldriver.ErrBadConn
+	}
+	var stmt sqldriver.Stmt
+	var err error
+	if p, ok := c.Conn.(sqldriver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &faultStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *faultConn) Close() error {
+	if c.dropped {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+func (c *faultConn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
+	if c.dropped {
+		return nil, sqldriver.ErrBadConn
+	}
+	var tx sqldriver.Tx
+	var err error
+	if b, ok := c.Conn.(sqldriver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &faultTx{Tx: tx, conn: c}, nil
+}
+
+// faultTx wraps a transaction, which ends with its connection if a fault
+// drops it
+type faultTx struct {
+	sqldriver.Tx
+	conn *faultConn
+}
+
+func (tx *faultTx) Commit() error {
+	if tx.conn.dropped {
+		return sqldriver.ErrBadConn
+	}
+	return tx.Tx.Commit()
+}
+
+func (tx *faultTx) Rollback() error {
+	if tx.conn.dropped {
+		return sqldriver.ErrBadConn
+	}
+	return tx.Tx.Rollback()
+}
+
+func (c *faultConn) ExecContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	e, ok := c.Conn.(sqldriver.ExecerContext)
+	if !ok {
+		// database/sql falls back to a prepared statement, which injects
+		return nil, sqldriver.ErrSkip
+	}
+	err := c.fi.inject(ctx, c, query)
+	if err != nil {
+		return nil, err
+	}
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c *faultConn) QueryContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	q, ok := c.Conn.(sqldriver.QueryerContext)
+	if !ok {
+		return nil, sqldriver.ErrSkip
+	}
+	err := c.fi.inject(ctx, c, query)
+	if err != nil {
+		return nil, err
+	}
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c *faultConn) Ping(ctx context.Context) error {
+	if c.dropped {
+		return sqldriver.ErrBadConn
+	}
+	if p, ok := c.Conn.(sqldriver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *faultConn) ResetSession(ctx context.Context) error {
+	if c.dropped {
+		return sqldriver.ErrBadConn
+	}
+	if r, ok := c.Conn.(sqldriver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *faultConn) IsValid() bool {
+	if c.dropped {
+		return false
+	}
+	if v, ok := c.Conn.(sqldriver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *faultConn) CheckNamedValue(nv *sqldriver.NamedValue) error {
+	if checker, ok := c.Conn.(sqldriver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return sqldriver.ErrSkip
+}
+
+// faultStmt wraps a prepared statement, injecting faults when it is run
+type faultStmt struct {
+	sqldriver.Stmt
+	conn  *faultConn
+	query string
+}
+
+func (s *faultStmt) Close() error {
+	if s.conn.dropped {
+		// closed with its connection
+		return nil
+	}
+	return s.Stmt.Close()
+}
+
+func (s *faultStmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	err := s.conn.fi.inject(context.Background(), s.conn, s.query)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(args)
+}
+
+func (s *faultStmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	err := s.conn.fi.inject(context.Background(), s.conn, s.query)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(args)
+}
+
+func (s *faultStmt) ExecContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	err := s.conn.fi.inject(ctx, s.conn, s.query)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := s.Stmt.(sqldriver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(values)
+}
+
+func (s *faultStmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	err := s.conn.fi.inject(ctx, s.conn, s.query)
+	if err != nil {
+		return nil, err
+	}
+	if q, ok := s.Stmt.(sqldriver.StmtQueryContext); ok {
+		return q.QueryContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(values)
+}
+
+// namedValues converts arguments for a driver without named parameters
+func namedValues(args []sqldriver.NamedValue) ([]sqldriver.Value, error) {
+	values := make([]sqldriver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("the driver does not support named parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,208 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Generator returns the value of a fixture column for row, counting from 0,
+// drawing any randomness from r so the rows are the same for the same seed
+type Generator func(r *rand.Rand, row int) interface{}
+
+// FixtureColumn is a column a Fixture fills and the Generator of its values
+type FixtureColumn struct {
+	Name  string
+	Value Generator
+}
+
+// Fixture describes fake rows to insert into a table, so a data migration
+// such as a backfill can be exercised against realistic volumes in CI
+type Fixture struct {
+	Table   string
+	Rows    int
+	Columns []FixtureColumn
+	// Before names the migration the rows are inserted ahead of, once the
+	// migrations before it have created the table
+	Before string
+}
+
+// fixtureBatchSize is how many fixture rows are inserted per transaction
+const fixtureBatchSize = 1000
+
+// WithFixtures inserts the fixtures' rows, generated deterministically from
+// seed, ahead of the migrations they name. Fixtures are only loaded by
+// ValidateShadow, into its throwaway database; other runs ignore them. Rows
+// are only inserted into an empty table, so running a migration up again
+// doesn't insert them twice.
+func WithFixtures(seed int64, fixtures ...Fixture) Option {
+	return func(m *Migrator) {
+		m.fixtureSeed = seed
+		m.fixtures = append(m.fixtures, fixtures...)
+	}
+}
+
+// Load inserts the fixture's rows into db, generated deterministically from
+// seed, for tests that set up their own database. Placeholders and quoting
+// follow the dialect selected with UseSQLite, UseMySQL or UsePostgres.
+func (f Fixture) Load(ctx context.Context, db DBTX, seed int64) error {
+	return defaultMigrator(db, nil).loadFixture(ctx, f, seed)
+}
+
+// Generate returns the fixture's rows, generated deterministically from
+// seed. Each table draws from its own source, so adding a fixture doesn't
+// change the rows of the others.
+func (f Fixture) Generate(seed int64) [][]interface{} {
+	h := fnv.New64a()
+	h.Write([]byte(f.Table))
+	r := rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+	rows := make([][]interface{}, f.Rows)
+	for i := range rows {
+		rows[i] = make([]interface{}, len(f.Columns))
+		for j, c := range f.Columns {
+			rows[i][j] = c.Value(r, i)
+		}
+	}
+	return rows
+}
+
+// loadFixtures inserts the rows of the fixtures to be loaded before m
+func (mg *Migrator) loadFixtures(ctx context.Context, m Migration) error {
+	for _, f := range mg.fixtures {
+		if f.Before != m.Name {
+			continue
+		}
+		var rows int
+		err := mg.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+mg.driver.quote(f.Table)).Scan(&rows)
+		if err != nil {
+			return fmt.Errorf("error loading fixture for table %s: %w", f.Table, err)
+		}
+		if rows > 0 {
+			continue
+		}
+		err = mg.loadFixture(ctx, f, mg.fixtureSeed)
+		if err != nil {
+			return err
+		}
+		if mg.logger != nil {
+			mg.logger.Printf("migrate :: loaded %d fixture rows into %s before %s", f.Rows, f.Table, m.Name)
+		}
+	}
+	return nil
+}
+
+// loadFixture inserts a fixture's rows in batches, each in a transaction
+// where the driver supports it
+func (mg *Migrator) loadFixture(ctx context.Context, f Fixture, seed int64) error {
+	if len(f.Columns) == 0 {
+		return fmt.Errorf("fixture for table %s has no columns", f.Table)
+	}
+	names := make([]string, len(f.Columns))
+	for i, c := range f.Columns {
+		names[i] = mg.driver.quote(c.Name)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(f.Columns)), ", ")
+	insert := mg.rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", mg.driver.quote(f.Table), strings.Join(names, ", "), placeholders))
+
+	rows := f.Generate(seed)
+	for start := 0; start < len(rows); start += fixtureBatchSize {
+		end := start + fixtureBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var db DBTX = mg.db
+		tx, err := begin(ctx, mg.db)
+		if err != nil {
+			return fmt.Errorf("error starting transaction for fixture of table %s: %w", f.Table, err)
+		}
+		if tx != nil {
+			db = tx
+		}
+		for i, row := range rows[start:end] {
+			_, err := db.ExecContext(ctx, insert, row...)
+			if err != nil {
+				if tx != nil {
+					tx.Rollback()
+				}
+				return fmt.Errorf("error inserting fixture row %d into table %s: %w", start+i, f.Table, err)
+			}
+		}
+		if tx != nil {
+			err = tx.Commit()
+			if err != nil {
+				return fmt.Errorf("error committing fixture rows for table %s: %w", f.Table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Sequence generates consecutive integers from start, such as ids
+func Sequence(start int64) Generator {
+	return func(r *rand.Rand, row int) interface{} {
+		return start + int64(row)
+	}
+}
+
+// IntRange generates integers between min and max inclusive
+func IntRange(min, max int64) Generator {
+	return func(r *rand.Rand, row int) interface{} {
+		return min + r.Int63n(max-min+1)
+	}
+}
+
+// OneOf generates one of values
+func OneOf(values ...interface{}) Generator {
+	return func(r *rand.Rand, row int) interface{} {
+		return values[r.Intn(len(values))]
+	}
+}
+
+// fixtureWords are the words Words draws from
+var fixtureWords = strings.Fields(`alpha bravo charlie delta echo foxtrot golf hotel india juliet
+	kilo lima mike november oscar papa quebec romeo sierra tango uniform victor whiskey
+	xray yankee zulu`)
+
+// Words generates text of between min and max words inclusive
+func Words(min, max int) Generator {
+	return func(r *rand.Rand, row int) interface{} {
+		n := min + r.Intn(max-min+1)
+		words := make([]string, n)
+		for i := range words {
+			words[i] = fixtureWords[r.Intn(len(fixtureWords))]
+		}
+		return strings.Join(words, " ")
+	}
+}
+
+// Emails generates a distinct email address for each row
+func Emails(domain string) Generator {
+	return func(r *rand.Rand, row int) interface{} {
+		return fmt.Sprintf("%s%d@%s", fixtureWords[r.Intn(len(fixtureWords))], row, domain)
+	}
+}
+
+// TimeRange generates times between from and to, in whole seconds
+func TimeRange(from, to time.Time) Generator {
+	return func(r *rand.Rand, row int) interface{} {
+		seconds := int64(to.Sub(from) / time.Second)
+		return from.Add(time.Duration(r.Int63n(seconds+1)) * time.Second).UTC()
+	}
+}
+
+// Nullable generates NULL for about fraction of rows, and values from g for
+// the others
+func Nullable(fraction float64, g Generator) Generator {
+	return func(r *rand.Rand, row int) interface{} {
+		// drawn first either way, so g's draws don't depend on the fraction
+		null := r.Float64() < fraction
+		value := g(r, row)
+		if null {
+			return nil
+		}
+		return value
+	}
+}
@@ -0,0 +1,199 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fleet applies one set of migrations to many databases, such as one
+// database per tenant. Each tenant has its own Migrator, and so its own
+// tracking table and migration lock.
+type Fleet struct {
+	registry    *Registry
+	opts        []Option
+	parallelism int
+
+	mu       sync.Mutex
+	tenants  []string
+	migrator map[string]*Migrator
+	results  map[string]TenantResult
+}
+
+// TenantResult is the outcome of the last run on a tenant of a Fleet
+type TenantResult struct {
+	Tenant string
+	Result Result
+	Err    error
+	// Ran is false for a tenant that hasn't been run yet, or whose run was
+	// never started because its context was done
+	Ran      bool
+	Duration time.Duration
+}
+
+// FleetError is returned by a Fleet run that failed on some tenants. The
+// other tenants were migrated.
+type FleetError struct {
+	// Failed are the results of the tenants that failed, in the order they
+	// were added
+	Failed []TenantResult
+	// Total is the number of tenants in the run
+	Total int
+}
+
+func (e *FleetError) Error() string {
+	failures := make([]string, len(e.Failed))
+	for i, r := range e.Failed {
+		failures[i] = fmt.Sprintf("%s: %s", r.Tenant, r.Err)
+	}
+	return fmt.Sprintf("migrations failed on %d of %d tenants: %s", len(e.Failed), e.Total, strings.Join(failures, "; "))
+}
+
+// Unwrap returns the errors of the failed tenants
+func (e *FleetError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, r := range e.Failed {
+		errs[i] = r.Err
+	}
+	return errs
+}
+
+// NewFleet creates a Fleet migrating up to parallelism tenants at a time, or
+// one at a time if parallelism is less than 1. opts configure each tenant's
+// Migrator. Its migrations are registered with Register, or by passing
+// WithRegistry.
+func NewFleet(parallelism int, opts ...Option) *Fleet {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	registry := NewRegistry()
+	return &Fleet{
+		registry:    registry,
+		opts:        append([]Option{WithRegistry(registry)}, opts...),
+		parallelism: parallelism,
+		migrator:    map[string]*Migrator{},
+		results:     map[string]TenantResult{},
+	}
+}
+
+// Register adds migrations to the Fleet's registry
+func (f *Fleet) Register(m ...Migration) {
+	f.registry.register(callerLocation(), m...)
+}
+
+// Add adds a tenant's database to the Fleet. Adding a tenant again replaces
+// its database.
+func (f *Fleet) Add(tenant string, db DBTX) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.migrator[tenant]; !ok {
+		f.tenants = append(f.tenants, tenant)
+	}
+	f.migrator[tenant] = New(db, f.opts...)
+	delete(f.results, tenant)
+}
+
+// Migrator returns the Migrator of a tenant, for operations the Fleet
+// doesn't coordinate, such as Status or Rollback
+func (f *Fleet) Migrator(tenant string) (*Migrator, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mg, ok := f.migrator[tenant]
+	return mg, ok
+}
+
+// RunLatest runs the pending migrations on every tenant, up to the Fleet's
+// parallelism at a time. A failure on one tenant doesn't stop the others:
+// once every tenant has been run, the failures are returned together as a
+// *FleetError. Each tenant's outcome is kept, for Results and Resume.
+func (f *Fleet) RunLatest(force bool) error {
+	return f.RunLatestContext(context.Background(), force)
+}
+
+// RunLatestContext is like RunLatest, with a context. Once ctx is done, no
+// more tenants are started.
+func (f *Fleet) RunLatestContext(ctx context.Context, force bool) error {
+	f.mu.Lock()
+	tenants := append([]string(nil), f.tenants...)
+	f.mu.Unlock()
+	return f.run(ctx, tenants, force)
+}
+
+// Resume runs the pending migrations on the tenants that failed, or weren't
+// started, in the Fleet's previous runs, and on those added since
+func (f *Fleet) Resume(force bool) error {
+	return f.ResumeContext(context.Background(), force)
+}
+
+// ResumeContext is like Resume, with a context
+func (f *Fleet) ResumeContext(ctx context.Context, force bool) error {
+	f.mu.Lock()
+	tenants := []string{}
+	for _, tenant := range f.tenants {
+		if r, ok := f.results[tenant]; !ok || !r.Ran || r.Err != nil {
+			tenants = append(tenants, tenant)
+		}
+	}
+	f.mu.Unlock()
+	return f.run(ctx, tenants, force)
+}
+
+// Results returns the outcome of the last run on each tenant, in the order
+// they were added
+func (f *Fleet) Results() []TenantResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	results := make([]TenantResult, len(f.tenants))
+	for i, tenant := range f.tenants {
+		r, ok := f.results[tenant]
+		if !ok {
+			r = TenantResult{Tenant: tenant}
+		}
+		results[i] = r
+	}
+	return results
+}
+
+// run migrates tenants, up to the Fleet's parallelism at a time
+func (f *Fleet) run(ctx context.Context, tenants []string, force bool) error {
+	results := make([]TenantResult, len(tenants))
+	slots := make(chan struct{}, f.parallelism)
+	var wg sync.WaitGroup
+	for i, tenant := range tenants {
+		results[i] = TenantResult{Tenant: tenant}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+		mg, _ := f.Migrator(tenant)
+		wg.Add(1)
+		go func(r *TenantResult) {
+			defer func() { <-slots; wg.Done() }()
+			start := time.Now()
+			r.Result, r.Err = mg.RunLatestReportContext(ctx, false, force)
+			r.Ran, r.Duration = true, time.Since(start)
+			if r.Err != nil && mg.logger != nil {
+				mg.logger.Printf("ERROR: migrations failed on tenant %s: %s", r.Tenant, r.Err)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fleetErr := &FleetError{Total: len(tenants)}
+	for _, r := range results {
+		f.results[r.Tenant] = r
+		if r.Err != nil {
+			fleetErr.Failed = append(fleetErr.Failed, r)
+		}
+	}
+	if len(fleetErr.Failed) > 0 {
+		return fleetErr
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// FollowUp is work a migration schedules for later, such as validating a
+// constraint or dropping a column once no deployed code reads it
+type FollowUp struct {
+	// Name identifies the follow-up among its migration's follow-ups
+	Name string
+	// SQL is run when the follow-up is due
+	SQL string
+	// After is how long after the migration is applied the follow-up is due
+	After time.Duration
+}
+
+// ScheduledFollowUp is a follow-up recorded in the tracking store
+type ScheduledFollowUp struct {
+	Migration string
+	Name      string
+	SQL       string
+	NotBefore time.Time
+}
+
+// RunDueFollowUps runs the follow-ups scheduled on db that are due. See
+// Migrator.RunDueFollowUps.
+func RunDueFollowUps(db DBTX, logger *log.Logger) error {
+	return defaultMigrator(db, logger).RunDueFollowUpsContext(context.Background())
+}
+
+// RunDueFollowUps runs each follow-up whose time has come and marks it
+// completed, oldest first. Where the dialect supports transactional DDL, a
+// follow-up and its completion are committed together. It stops at the first
+// failure, which stays scheduled.
+func (mg *Migrator) RunDueFollowUps() error {
+	return mg.RunDueFollowUpsContext(context.Background())
+}
+
+// RunDueFollowUpsContext is like RunDueFollowUps, with a context
+func (mg *Migrator) RunDueFollowUpsContext(ctx context.Context) (err error) {
+	if err := mg.refuseDryRun("RunDueFollowUps"); err != nil {
+		return err
+	}
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+	return mg.withLock(ctx, func(mg *Migrator) error {
+		state.set("", "follow-ups")
+		due, err := mg.scheduledFollowUps(ctx, true)
+		if err != nil {
+			return err
+		}
+
+		caps, err := mg.DetectCapabilitiesContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range due {
+			state.set(f.Migration, "follow-up "+f.Name)
+			err := mg.runFollowUp(ctx, f, caps)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PendingFollowUps returns the follow-ups not yet run, due or not
+func (mg *Migrator) PendingFollowUps() ([]ScheduledFollowUp, error) {
+	return mg.scheduledFollowUps(context.Background(), false)
+}
+
+// scheduledFollowUps returns the uncompleted follow-ups, optionally only
+// those that are due, oldest first
+func (mg *Migrator) scheduledFollowUps(ctx context.Context, dueOnly bool) ([]ScheduledFollowUp, error) {
+	err := mg.createFollowUpTable(ctx, mg.db)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT migration, name, statement, not_before FROM %s_followup WHERE completed_at IS NULL"
+	args := []interface{}{}
+	if dueOnly {
+		query += " AND not_before <= ?"
+		args = append(args, time.Now().Unix())
+	}
+	query += " ORDER BY not_before, id"
+
+	rows, err := mg.db.QueryContext(ctx, mg.stmt(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading follow-ups: %w", err)
+	}
+	defer rows.Close()
+
+	followUps := []ScheduledFollowUp{}
+	for rows.Next() {
+		var f ScheduledFollowUp
+		var notBefore int64
+		err := rows.Scan(&f.Migration, &f.Name, &f.SQL, &notBefore)
+		if err != nil {
+			return nil, fmt.Errorf("error loading follow-ups: %w", err)
+		}
+		f.NotBefore = time.Unix(notBefore, 0)
+		followUps = append(followUps, f)
+	}
+	return followUps, rows.Err()
+}
+
+func (mg *Migrator) runFollowUp(ctx context.Context, f ScheduledFollowUp, caps Capabilities) error {
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: FOLLOW-UP :: %s :: %s", f.Migration, f.Name)
+	}
+
+	var db execer = mg.db
+	var tx *sql.Tx
+	if caps.TransactionalDDL {
+		var err error
+		tx, err = begin(ctx, mg.db)
+		if err != nil {
+			return fmt.Errorf("error starting transaction for follow-up '%s' of migration '%s': %w", f.Name, f.Migration, err)
+		}
+		if tx != nil {
+			db = tx
+		}
+	}
+
+	var err error
+	for _, stmt := range splitSQL(f.SQL, mg.driver) {
+		_, err = db.ExecContext(ctx, stmt)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		stmt := mg.stmt("UPDATE %s_followup SET completed_at = CURRENT_TIMESTAMP WHERE migration = ? AND name = ? AND completed_at IS NULL")
+		_, err = db.ExecContext(ctx, stmt, f.Migration, f.Name)
+	}
+	if err != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return fmt.Errorf("error running follow-up '%s' of migration '%s': %w", f.Name, f.Migration, err)
+	}
+
+	if tx != nil {
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("error committing follow-up '%s' of migration '%s': %w", f.Name, f.Migration, err)
+		}
+	}
+	return nil
+}
+
+// scheduleFollowUps records m's follow-ups when it is applied, and cancels
+// those still pending when it is rolled back
+func (mg *Migrator) scheduleFollowUps(ctx context.Context, db execer, m Migration, down bool) error {
+	if len(m.FollowUps) == 0 {
+		return nil
+	}
+	err := mg.createFollowUpTable(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	if down {
+		_, err := db.ExecContext(ctx, mg.stmt("DELETE FROM %s_followup WHERE migration = ? AND completed_at IS NULL"), m.Name)
+		if err != nil {
+			return fmt.Errorf("error cancelling follow-ups of migration '%s': %w", m.Name, err)
+		}
+		return nil
+	}
+
+	stmt := mg.stmt("INSERT INTO %s_followup (migration, name, statement, not_before) VALUES (?, ?, ?, ?)")
+	now := time.Now()
+	for _, f := range m.FollowUps {
+		_, err := db.ExecContext(ctx, stmt, m.Name, f.Name, f.SQL, now.Add(f.After).Unix())
+		if err != nil {
+			return fmt.Errorf("error scheduling follow-up '%s' of migration '%s': %w", f.Name, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (mg *Migrator) createFollowUpTable(ctx context.Context, db execer) error {
+	var createFollowUpTableSQL string
+	switch mg.driver {
+	case mysql:
+		createFollowUpTableSQL = createFollowUpTableMySQL
+	case sqlite:
+		createFollowUpTableSQL = createFollowUpTableSQLite
+	case postgres:
+		createFollowUpTableSQL = createFollowUpTablePostgres
+	default:
+		return fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(createFollowUpTableSQL, mg.qualifiedTable()))
+	if err != nil {
+		return fmt.Errorf("error creating follow-up table: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package moogration
+
+import (
+	"context"
+	"log"
+)
+
+// RollbackAll rolls back every applied batch in the default registry. See
+// Migrator.RollbackAll.
+func RollbackAll(db DBTX, force bool, logger *log.Logger) error {
+	return defaultMigrator(db, logger).RollbackAllContext(context.Background(), force)
+}
+
+// Fresh rolls back and re-applies every migration in the default registry.
+// See Migrator.Fresh.
+func Fresh(db DBTX, force bool, logger *log.Logger) error {
+	return defaultMigrator(db, logger).FreshContext(context.Background(), force)
+}
+
+// RollbackAll rolls back every applied batch, newest first, like Rollback
+// with the number of applied batches. Nothing is done if no migrations are
+// applied.
+func (mg *Migrator) RollbackAll(force bool) error {
+	return mg.RollbackAllContext(context.Background(), force)
+}
+
+// RollbackAllContext is like RollbackAll, with a context
+func (mg *Migrator) RollbackAllContext(ctx context.Context, force bool) error {
+	if len(mg.groups) > 0 {
+		return mg.eachGroup(func(sub *Migrator) error {
+			return sub.RollbackAllContext(ctx, force)
+		})
+	}
+
+	exists, err := mg.tableExists(ctx)
+	if err != nil || !exists {
+		return err
+	}
+	batches, err := mg.allBatches(ctx)
+	if err != nil || len(batches) == 0 {
+		return err
+	}
+	return mg.RollbackContext(ctx, len(batches), force)
+}
+
+// Fresh rolls back every applied batch and then runs every migration in a
+// single new batch: the usual way to reset a development or test database.
+// force applies to the rollback. Strict mode refuses it like any other down.
+func (mg *Migrator) Fresh(force bool) error {
+	return mg.FreshContext(context.Background(), force)
+}
+
+// FreshContext is like Fresh, with a context
+func (mg *Migrator) FreshContext(ctx context.Context, force bool) error {
+	err := mg.RollbackAllContext(ctx, force)
+	if err != nil {
+		return err
+	}
+	return mg.RunLatestContext(ctx, false, false)
+}
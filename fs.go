@@ -0,0 +1,176 @@
+package moogration
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	upSuffix   = ".up.sql"
+	downSuffix = ".down.sql"
+)
+
+// RegisterFS registers the file-based migrations in dir with the default
+// registry. See Registry.RegisterFS.
+func RegisterFS(fsys fs.FS, dir string) error {
+	return defaultRegistry.RegisterFS(fsys, dir)
+}
+
+// SetStrictHeaders makes RegisterFS on the default registry refuse
+// unrecognised headers. See Registry.SetStrictHeaders.
+func SetStrictHeaders(strict bool) {
+	defaultRegistry.SetStrictHeaders(strict)
+}
+
+// SetStrictHeaders makes RegisterFS refuse an up file with a "-- key: value"
+// comment among its leading comments whose key it doesn't recognise, such
+// as "-- min-app-version:", which would otherwise be read as an ordinary
+// comment and its setting silently dropped. Other comments in that form,
+// such as "-- TODO: ...", must then come after the first statement.
+func (r *Registry) SetStrictHeaders(strict bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.strictHeaders = strict
+}
+
+// RegisterFS discovers migrations stored as pairs of files in dir, such as
+// 001_create_users.up.sql and 001_create_users.down.sql, and registers them
+// in name order. The migration name is the file name without the suffix.
+// Other files are ignored. Headers among the comments an up file begins
+// with set the migration's metadata: "-- squashes:" listing migration names,
+// as moog squash writes, sets its Squashes, and "-- min app version:" its
+// MinAppVersion. If any up file lacks a down file or vice versa, or has an
+// unrecognised header with SetStrictHeaders, nothing is registered and an
+// error naming the files is returned.
+func (r *Registry) RegisterFS(fsys fs.FS, dir string) error {
+	r.mu.RLock()
+	strictHeaders := r.strictHeaders
+	r.mu.RUnlock()
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return fmt.Errorf("error reading migrations directory '%s': %w", dir, err)
+	}
+
+	ups := map[string]string{}
+	downs := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, upSuffix):
+			ups[strings.TrimSuffix(name, upSuffix)] = path.Join(dir, name)
+		case strings.HasSuffix(name, downSuffix):
+			downs[strings.TrimSuffix(name, downSuffix)] = path.Join(dir, name)
+		}
+	}
+
+	unpaired := []string{}
+	for name, file := range ups {
+		if _, ok := downs[name]; !ok {
+			unpaired = append(unpaired, fmt.Sprintf("%s has no matching %s%s", file, name, downSuffix))
+		}
+	}
+	for name, file := range downs {
+		if _, ok := ups[name]; !ok {
+			unpaired = append(unpaired, fmt.Sprintf("%s has no matching %s%s", file, name, upSuffix))
+		}
+	}
+	if len(unpaired) > 0 {
+		sort.Strings(unpaired)
+		return fmt.Errorf("unpaired migration files in '%s': %s", dir, strings.Join(unpaired, "; "))
+	}
+
+	names := make([]string, 0, len(ups))
+	for name := range ups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	migrations := make([]Migration, 0, len(names))
+	for _, name := range names {
+		up, err := fs.ReadFile(fsys, ups[name])
+		if err != nil {
+			return fmt.Errorf("error reading migration file: %w", err)
+		}
+		down, err := fs.ReadFile(fsys, downs[name])
+		if err != nil {
+			return fmt.Errorf("error reading migration file: %w", err)
+		}
+		fm, err := parseFrontMatter(string(up), strictHeaders)
+		if err != nil {
+			return fmt.Errorf("error reading migration file '%s': %w", ups[name], err)
+		}
+		migrations = append(migrations, Migration{
+			Name:          name,
+			Up:            string(up),
+			Down:          string(down),
+			Squashes:      fm.squashes,
+			MinAppVersion: fm.minAppVersion,
+		})
+	}
+
+	for _, m := range migrations {
+		r.register(ups[m.Name], m)
+	}
+	return nil
+}
+
+// reHeader matches a "-- key: value" comment among the leading comments of
+// an up file
+var reHeader = regexp.MustCompile(`^--\s*([A-Za-z][A-Za-z0-9 _-]*?)\s*:(.*)$`)
+
+// frontMatter is the settings read from the headers of an up file: a
+// "-- squashes:" comment listing migration names, as moog squash writes, and
+// a "-- min app version:" comment
+type frontMatter struct {
+	squashes      []string
+	minAppVersion string
+}
+
+// parseFrontMatter reads the headers among the leading comments and blank
+// lines of up. The first header with a key wins. With strict set, a header
+// with an unrecognised key, such as a typo, is an error rather than an
+// ordinary comment.
+func parseFrontMatter(up string, strict bool) (frontMatter, error) {
+	var fm frontMatter
+	seen := map[string]bool{}
+	for _, line := range strings.Split(up, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		match := reHeader.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		key, value := strings.ToLower(match[1]), strings.TrimSpace(match[2])
+		if seen[key] {
+			continue
+		}
+		switch key {
+		case "squashes":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					fm.squashes = append(fm.squashes, name)
+				}
+			}
+		case "min app version":
+			fm.minAppVersion = value
+		default:
+			if strict {
+				return frontMatter{}, fmt.Errorf("unrecognised header '%s'", line)
+			}
+		}
+		seen[key] = true
+	}
+	return fm, nil
+}
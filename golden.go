@@ -0,0 +1,142 @@
+package moogration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ErrGoldenMismatch is returned by CompareGolden when the rendered migrations
+// differ from the golden file
+var ErrGoldenMismatch = errors.New("rendered migrations differ from the golden file")
+
+// RenderMigrations writes the default registry's migrations as they would be
+// run. See Migrator.Render.
+func RenderMigrations(w io.Writer) error {
+	return defaultMigrator(nil, nil).Render(w)
+}
+
+// CompareGolden compares the default registry's rendered migrations with a
+// golden file. See Migrator.CompareGolden.
+func CompareGolden(path string, update bool) error {
+	return defaultMigrator(nil, nil).CompareGolden(path, update)
+}
+
+// Render writes every registered migration, sorted by name, as the SQL the
+// Migrator would run: statements are split for its dialect and rewritten by
+// its online DDL policy. The output is deterministic, so it can be committed
+// and diffed in code review.
+func (mg *Migrator) Render(w io.Writer) error {
+	migrations := mg.registry.snapshot()
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Name < migrations[j].Name
+	})
+
+	for _, m := range migrations {
+		header := fmt.Sprintf("-- migration: %s\n", m.Name)
+		if m.Group != "" {
+			header += fmt.Sprintf("-- group: %s\n", m.Group)
+		}
+		if m.NoTransaction {
+			header += "-- no transaction\n"
+		}
+		if m.SkipReplication {
+			header += "-- skip replication\n"
+		}
+		if m.ForeignKeysOff {
+			header += "-- foreign keys off\n"
+		}
+		if len(m.Squashes) > 0 {
+			header += fmt.Sprintf("-- squashes: %s\n", strings.Join(m.Squashes, ", "))
+		}
+		if m.MinAppVersion != "" {
+			header += fmt.Sprintf("-- min app version: %s\n", m.MinAppVersion)
+		}
+		_, err := io.WriteString(w, header)
+		if err != nil {
+			return err
+		}
+		for _, down := range []bool{false, true} {
+			body, err := mg.render(m, down)
+			if err != nil {
+				return fmt.Errorf("error rendering migration '%s' (%s): %w", m.Name, strings.ToUpper(direction(down)), err)
+			}
+			_, err = fmt.Fprintf(w, "-- %s\n%s\n", direction(down), body)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// render returns the statements of m in one direction, one per line
+func (mg *Migrator) render(m Migration, down bool) (string, error) {
+	if m.fn(down) != nil {
+		return "-- (Go function)", nil
+	}
+	statements := []string{}
+	for _, stmt := range splitSQL(m.query(down), mg.driver) {
+		stmt, _, err := mg.applyOnlineDDL(m, stmt)
+		if err != nil {
+			return "", err
+		}
+		statements = append(statements, stmt+";")
+	}
+	if len(statements) == 0 {
+		return "-- (empty)", nil
+	}
+	return strings.Join(statements, "\n"), nil
+}
+
+// CompareGolden renders the registered migrations and compares them with the
+// golden file at path, returning ErrGoldenMismatch, with the first differing
+// line, if they differ. With update set, the golden file is (re)written
+// instead; tests typically wire this to an -update flag.
+func (mg *Migrator) CompareGolden(path string, update bool) error {
+	var rendered bytes.Buffer
+	err := mg.Render(&rendered)
+	if err != nil {
+		return err
+	}
+
+	if update {
+		err = os.WriteFile(path, rendered.Bytes(), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing golden file: %w", err)
+		}
+		return nil
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading golden file: %w", err)
+	}
+	if bytes.Equal(golden, rendered.Bytes()) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrGoldenMismatch, firstDifference(string(golden), rendered.String()))
+}
+
+// firstDifference describes the first line that differs between two texts
+func firstDifference(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("line %d: golden %q, rendered %q", i+1, w, g)
+		}
+	}
+	return "files differ"
+}
@@ -0,0 +1,137 @@
+package moogration
+
+import (
+	"context"
+	"time"
+)
+
+// MigrationEvent describes a migration to the hooks registered with
+// OnBeforeMigration and OnAfterMigration
+type MigrationEvent struct {
+	Migration Migration
+	// Direction is "up" or "down"
+	Direction string
+	Batch     int
+	// Duration, RowsAffected and Err are set after the migration has run.
+	// Err is set if it failed, including when the failure policy let the
+	// run continue past it.
+	Duration     time.Duration
+	RowsAffected int64
+	Err          error
+}
+
+// RunEvent describes a run to the hooks registered with OnBeforeRun and
+// OnAfterRun
+type RunEvent struct {
+	// Operation is "run" for RunLatest and "rollback" for Rollback
+	Operation string
+	// Direction is "up" or "down"
+	Direction string
+	// Result, Duration and Err are set after the run has finished
+	Result   Result
+	Duration time.Duration
+	Err      error
+}
+
+// BatchEvent describes a batch to the hooks registered with OnAfterBatch
+type BatchEvent struct {
+	// Operation is "run" for RunLatest and "rollback" for Rollback
+	Operation string
+	// Direction is "up" or "down"
+	Direction string
+	Batch     int
+	// Migrations are the migrations of the batch that were run
+	Migrations []MigrationResult
+	// Epoch is the SchemaEpoch after the batch
+	Epoch uint64
+}
+
+// hooks are the functions registered to be called around runs and migrations
+type hooks struct {
+	beforeMigrationFns []func(context.Context, MigrationEvent)
+	afterMigrationFns  []func(context.Context, MigrationEvent)
+	beforeRunFns       []func(context.Context, RunEvent)
+	afterRunFns        []func(context.Context, RunEvent)
+	afterBatchFns      []func(context.Context, BatchEvent)
+}
+
+// OnBeforeMigration registers fn to be called before each migration of
+// RunLatest, Rollback and Redo is run
+func (mg *Migrator) OnBeforeMigration(fn func(ctx context.Context, e MigrationEvent)) {
+	mg.hooks.beforeMigrationFns = append(mg.hooks.beforeMigrationFns, fn)
+}
+
+// OnAfterMigration registers fn to be called after each migration of
+// RunLatest, Rollback and Redo has run, or failed to. Migrations run on a
+// dual-write target don't call hooks.
+func (mg *Migrator) OnAfterMigration(fn func(ctx context.Context, e MigrationEvent)) {
+	mg.hooks.afterMigrationFns = append(mg.hooks.afterMigrationFns, fn)
+}
+
+// OnBeforeRun registers fn to be called when RunLatest or Rollback starts,
+// before the migration lock is taken. Dry runs don't call hooks.
+func (mg *Migrator) OnBeforeRun(fn func(ctx context.Context, e RunEvent)) {
+	mg.hooks.beforeRunFns = append(mg.hooks.beforeRunFns, fn)
+}
+
+// OnAfterRun registers fn to be called when RunLatest or Rollback finishes,
+// whether or not it succeeded. It is called once per run, after every
+// migration group.
+func (mg *Migrator) OnAfterRun(fn func(ctx context.Context, e RunEvent)) {
+	mg.hooks.afterRunFns = append(mg.hooks.afterRunFns, fn)
+}
+
+// OnAfterBatch registers fn to be called after RunLatest has run a batch of
+// migrations, or Rollback has rolled one back, and before the next batch is
+// rolled back. It isn't called for a batch that ran no migrations, or that
+// failed. It is the place to flush caches that can hold on to the old
+// schema, such as prepared statements; see DiscardAll and CloseIdleConns.
+func (mg *Migrator) OnAfterBatch(fn func(ctx context.Context, e BatchEvent)) {
+	mg.hooks.afterBatchFns = append(mg.hooks.afterBatchFns, fn)
+}
+
+func (h hooks) beforeMigration(ctx context.Context, e MigrationEvent) {
+	for _, fn := range h.beforeMigrationFns {
+		fn(ctx, e)
+	}
+}
+
+func (h hooks) afterMigration(ctx context.Context, e MigrationEvent) {
+	for _, fn := range h.afterMigrationFns {
+		fn(ctx, e)
+	}
+}
+
+// withRunHooks calls run between the before and after run hooks, in the
+// run's span if the Migrator has a Tracer
+func (mg *Migrator) withRunHooks(ctx context.Context, operation, direction string, run func(ctx context.Context) (Result, error)) (Result, error) {
+	if mg.dryRun {
+		return run(ctx)
+	}
+
+	event := RunEvent{Operation: operation, Direction: direction}
+	for _, fn := range mg.hooks.beforeRunFns {
+		fn(ctx, event)
+	}
+	spanCtx, span := mg.startSpan(ctx, "moogration."+operation, Attribute{AttrDirection, direction})
+	start := time.Now()
+	result, err := run(spanCtx)
+	event.Result, event.Duration, event.Err = result, time.Since(start), err
+	endSpan(span, err, Attribute{AttrApplied, len(result.Applied)}, Attribute{AttrSkipped, len(result.Skipped)})
+	for _, fn := range mg.hooks.afterRunFns {
+		fn(ctx, event)
+	}
+	return result, err
+}
+
+// afterBatch calls the after batch hooks for a batch that ran migrations
+func (mg *Migrator) afterBatch(ctx context.Context, operation string, down bool, batch int, migrations []MigrationResult) {
+	if len(migrations) == 0 {
+		return
+	}
+	event := BatchEvent{Operation: operation, Direction: direction(down), Batch: batch, Migrations: migrations}
+	event.Epoch = schemaEpoch.Add(1)
+	for _, fn := range mg.hooks.afterBatchFns {
+		fn(ctx, event)
+	}
+}
@@ -0,0 +1,144 @@
+package moogration
+
+import (
+	"sort"
+	"time"
+)
+
+// MigrationInfo is a read-only description of a migration, returned by the
+// inspection APIs in place of Migration so that consumers don't depend on its
+// internals and its SQL isn't exposed. Fields drawn from the tracking table
+// are only set by APIs that read a database, such as Status.
+type MigrationInfo struct {
+	Name        string
+	Description string
+	Tags        []string
+	Group       string
+	// Hash is the hash of the registered migration or, for a migration that
+	// is no longer registered, the hash recorded when it was applied
+	Hash string
+	// Labels are the migration's own labels or, from Status, those recorded
+	// when it was applied or that it would be applied with
+	Labels Labels
+	// Func is set if the migration runs Go functions rather than SQL
+	Func            bool
+	NoTransaction   bool
+	SkipReplication bool
+	ForeignKeysOff  bool
+	// Squashes names the migrations the migration consolidates
+	Squashes []string
+	// MinAppVersion is the oldest application version the migration allows
+	MinAppVersion string
+	// RegisteredAt is the file:line the migration was registered from
+	RegisteredAt string
+
+	// Registered is false for a migration recorded in the tracking table but
+	// missing from the registry
+	Registered bool
+	// Applied is false for a pending migration, in which case Batch and
+	// MigratedAt are zero
+	Applied    bool
+	Batch      int
+	MigratedAt time.Time
+	// Changed is set if the hash recorded when the migration was applied no
+	// longer matches its registered SQL
+	Changed bool
+	// Dirty is set if the migration failed partway under MarkDirty and
+	// hasn't been resolved with ResolveDirty
+	Dirty bool
+	// Duration is how long the migration took to apply, AppliedBy who
+	// applied it, and AppliedSQL the SQL it ran if recorded with
+	// WithRecordSQL. They are zero for migrations applied by earlier releases.
+	Duration   time.Duration
+	AppliedBy  string
+	AppliedSQL string
+}
+
+// State summarizes the migration's status as one of "unregistered",
+// "dirty", "changed", "applied" or "pending", in that order of precedence
+func (i MigrationInfo) State() string {
+	switch {
+	case !i.Registered:
+		return "unregistered"
+	case i.Dirty:
+		return "dirty"
+	case i.Changed:
+		return "changed"
+	case i.Applied:
+		return "applied"
+	default:
+		return "pending"
+	}
+}
+
+// DefaultRegistry returns the registry the package functions and Register
+// operate on
+func DefaultRegistry() *Registry {
+	return defaultRegistry
+}
+
+// Get returns a copy of the migration registered under name
+func (r *Registry) Get(name string) (*Migration, bool) {
+	for _, m := range r.snapshot() {
+		if m.Name == name {
+			return &m, true
+		}
+	}
+	return nil, false
+}
+
+// Info describes the migration registered under name
+func (r *Registry) Info(name string) (MigrationInfo, bool) {
+	m, ok := r.Get(name)
+	if !ok {
+		return MigrationInfo{}, false
+	}
+	return r.info(*m), true
+}
+
+// List describes the registered migrations, sorted by name
+func (r *Registry) List() []MigrationInfo {
+	migrations := r.snapshot()
+	infos := make([]MigrationInfo, 0, len(migrations))
+	for _, m := range migrations {
+		infos = append(infos, r.info(m))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Count returns the number of registered migrations
+func (r *Registry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.migrations)
+}
+
+func (r *Registry) info(m Migration) MigrationInfo {
+	var labels Labels
+	if m.Labels != nil {
+		labels = Labels{}
+		for k, v := range m.Labels {
+			labels[k] = v
+		}
+	}
+	registeredAt, _ := r.registeredAt(m.Name)
+	return MigrationInfo{
+		Name:            m.Name,
+		Description:     m.Description,
+		Tags:            append([]string(nil), m.Tags...),
+		Group:           m.Group,
+		Hash:            m.hash(),
+		Labels:          labels,
+		Func:            m.UpFunc != nil || m.DownFunc != nil,
+		NoTransaction:   m.NoTransaction,
+		SkipReplication: m.SkipReplication,
+		ForeignKeysOff:  m.ForeignKeysOff,
+		Squashes:        m.Squashes,
+		MinAppVersion:   m.MinAppVersion,
+		RegisteredAt:    registeredAt,
+		Registered:      true,
+	}
+}
@@ -0,0 +1,61 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrIntegrity is wrapped by the error of a ForeignKeysOff migration, or of a
+// run checked with WithIntegrityChecks, that left a foreign key violated or
+// the database failing PRAGMA integrity_check
+var ErrIntegrity = errors.New("integrity check failed")
+
+// WithIntegrityChecks runs PRAGMA foreign_key_check and integrity_check on
+// SQLite after each batch a run or rollback applies, failing it with an error
+// wrapping ErrIntegrity if they report a problem. The batch itself has been
+// committed by then; the check catches a broken table rebuild as soon as it
+// is applied in development, rather than when the data is next used.
+func WithIntegrityChecks() Option {
+	return func(m *Migrator) {
+		m.integrityChecks = true
+	}
+}
+
+// checkBatch runs the integrity checks after a batch, if enabled
+func (mg *Migrator) checkBatch(ctx context.Context, batch int) error {
+	if !mg.integrityChecks || mg.driver != sqlite {
+		return nil
+	}
+	err := checkIntegrity(ctx, mg.db)
+	if err != nil {
+		return fmt.Errorf("after batch %d: %w", batch, err)
+	}
+	return nil
+}
+
+// checkIntegrity checks that no foreign key is violated and the database
+// passes PRAGMA integrity_check
+func checkIntegrity(ctx context.Context, db DBTX) error {
+	var table, parent string
+	var rowid sql.NullInt64
+	var fk int
+	err := db.QueryRowContext(ctx, "PRAGMA foreign_key_check").Scan(&table, &rowid, &parent, &fk)
+	if err == nil {
+		return fmt.Errorf("%w: a row of %s references a missing row of %s", ErrIntegrity, table, parent)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error checking foreign keys: %w", err)
+	}
+
+	var result string
+	err = db.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return fmt.Errorf("error checking integrity: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%w: %s", ErrIntegrity, result)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+)
+
+// WithRunIsolated makes each run, rollback or other operation that changes
+// the database use a connection of its own, reserved from the pool for the operation and closed
+// afterwards rather than returned to the pool, along with the connection
+// holding the migration lock. No session state a migration changes, such as
+// variables set with SET or temporary tables, can then leak to the
+// application's queries.
+func WithRunIsolated() Option {
+	return func(m *Migrator) {
+		m.isolated = true
+	}
+}
+
+// isolatedSession calls fn with a Migrator bound to a connection reserved
+// from the Migrator's pool, and closes the connection afterwards
+func (mg *Migrator) isolatedSession(ctx context.Context, fn func(mg *Migrator) error) error {
+	conn, release, err := session(ctx, mg.db)
+	if err != nil {
+		return fmt.Errorf("error reserving connection for migrations: %w", err)
+	}
+	defer release(true)
+	sub := *mg
+	sub.db = conn
+	sub.pool = mg.db
+	return fn(&sub)
+}
+
+// discardSession marks the connection the Migrator is bound to for
+// discarding at the end of the operation, after a session setting couldn't
+// be restored, and logs why
+func (mg *Migrator) discardSession(reason string) {
+	if mg.discard != nil {
+		*mg.discard = true
+		reason += ", discarding connection"
+	}
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: %s", reason)
+	}
+}
@@ -0,0 +1,130 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels are key/value pairs, such as service, team or environment, used to
+// slice migration telemetry
+type Labels map[string]string
+
+// String formats the labels as space-separated key=value pairs, sorted by key
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + l[k]
+	}
+	return strings.Join(pairs, " ")
+}
+
+// WithLabels sets labels attached to every migration the Migrator runs. A
+// migration's own Labels take precedence over these.
+func WithLabels(labels Labels) Option {
+	return func(m *Migrator) {
+		m.labels = labels
+	}
+}
+
+// labelsFor merges the Migrator's labels with m's
+func (mg *Migrator) labelsFor(m Migration) Labels {
+	merged := Labels{}
+	for k, v := range mg.labels {
+		merged[k] = v
+	}
+	for k, v := range m.Labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// labelSuffix formats labels for the end of a log line
+func labelSuffix(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return " [" + labels.String() + "]"
+}
+
+// recordLabels stores the labels m was applied with, or deletes them when
+// it is rolled back
+func (mg *Migrator) recordLabels(ctx context.Context, db execer, m Migration, down bool) error {
+	labels := mg.labelsFor(m)
+	if len(labels) == 0 {
+		return nil
+	}
+	err := mg.createLabelTable(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, mg.stmt("DELETE FROM %s_label WHERE migration = ?"), m.Name)
+	if err != nil {
+		return fmt.Errorf("error deleting labels of migration '%s': %w", m.Name, err)
+	}
+	if down {
+		return nil
+	}
+
+	stmt := mg.stmt("INSERT INTO %s_label (migration, label_key, label_value) VALUES (?, ?, ?)")
+	for k, v := range labels {
+		_, err := db.ExecContext(ctx, stmt, m.Name, k, v)
+		if err != nil {
+			return fmt.Errorf("error recording label '%s' of migration '%s': %w", k, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// recordedLabels loads the labels of every applied migration, keyed by name
+func (mg *Migrator) recordedLabels(ctx context.Context) (map[string]Labels, error) {
+	recorded := map[string]Labels{}
+	exists, err := mg.hasTable(ctx, mg.table+"_label")
+	if err != nil || !exists {
+		return recorded, err
+	}
+
+	rows, err := mg.db.QueryContext(ctx, mg.stmt("SELECT migration, label_key, label_value FROM %s_label"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration labels: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, k, v string
+		err := rows.Scan(&name, &k, &v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load migration labels: %w", err)
+		}
+		if recorded[name] == nil {
+			recorded[name] = Labels{}
+		}
+		recorded[name][k] = v
+	}
+	return recorded, rows.Err()
+}
+
+func (mg *Migrator) createLabelTable(ctx context.Context, db execer) error {
+	var createLabelTableSQL string
+	switch mg.driver {
+	case mysql:
+		createLabelTableSQL = createLabelTableMySQL
+	case sqlite:
+		createLabelTableSQL = createLabelTableSQLite
+	case postgres:
+		createLabelTableSQL = createLabelTablePostgres
+	default:
+		return fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(createLabelTableSQL, mg.qualifiedTable()))
+	if err != nil {
+		return fmt.Errorf("error creating label table: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package moogration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrNotReady is returned by RunLatestOrWait when migrations are still
+// pending at the timeout
+var ErrNotReady = errors.New("migrations are still pending")
+
+// readyPollInterval is how often a replica waiting for another to migrate
+// checks whether it has finished
+const readyPollInterval = time.Second
+
+// RunLatestOrWait runs or waits for the migrations in the default registry.
+// See Migrator.RunLatestOrWait.
+func RunLatestOrWait(db DBTX, timeout time.Duration, logger *log.Logger) error {
+	return defaultMigrator(db, logger).RunLatestOrWaitContext(context.Background(), timeout)
+}
+
+// RunLatestOrWait is for fleets that migrate on boot: each replica calls it
+// at startup, they race for the migration lock, and the one that takes it
+// runs the pending migrations while the others poll until none are pending.
+// Every replica returns nil once the database is up to date, so it can be
+// used as a readiness signal. The replica that ran the migrations returns
+// their error if they failed; the others keep waiting, and return an error
+// wrapping ErrNotReady if migrations are still pending after timeout.
+func (mg *Migrator) RunLatestOrWait(timeout time.Duration) error {
+	return mg.RunLatestOrWaitContext(context.Background(), timeout)
+}
+
+// RunLatestOrWaitContext is like RunLatestOrWait, with a context
+func (mg *Migrator) RunLatestOrWaitContext(ctx context.Context, timeout time.Duration) error {
+	leader := *mg
+	leader.lock = true
+	leader.lockSkip = true
+	result, err := leader.RunLatestReportContext(ctx, false, false)
+	if err != nil || !result.Locked {
+		return err
+	}
+
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: another instance is running migrations, waiting up to %s", timeout)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		plan, err := mg.PlanLatestContext(ctx, false)
+		if err != nil {
+			return err
+		}
+		if len(plan) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: %d migrations after %s, starting with '%s'", ErrNotReady, len(plan), timeout, plan[0].Name)
+		}
+		err = sleep(ctx, readyPollInterval)
+		if err != nil {
+			return err
+		}
+	}
+}
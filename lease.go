@@ -0,0 +1,152 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// WithLockLease makes the instance holding the lock renew a lease of d while
+// it runs, so a holder that has crashed, or hung, can be told apart from one
+// that is busy: an instance waiting for the lock takes it over once the
+// holder's lease has gone unrenewed for d. The takeover is recorded in the
+// audit log. It implies WithLock.
+//
+// On SQLite, the lock row of a crashed process is deleted. MySQL and
+// PostgreSQL release the lock of a session that ends, so a stale lease there
+// means the holder's connection outlived it, and the takeover ends that
+// session with KILL or pg_terminate_backend, which needs the privilege to do
+// so. Choose a lease longer than any pause in the holder's process.
+func WithLockLease(d time.Duration) Option {
+	return func(m *Migrator) {
+		m.lock = true
+		m.lockLease = d
+	}
+}
+
+// WithStealLock takes the lock over from its holder at once, whether or not
+// its lease has expired, for when an operator knows the holder is gone. The
+// takeover is recorded in the audit log. It implies WithLock.
+func WithStealLock() Option {
+	return func(m *Migrator) {
+		m.lock = true
+		m.lockSteal = true
+	}
+}
+
+// stale reports whether the holder's lease has gone unrenewed past its
+// duration. A holder without a lease is never stale.
+func (h LockHolder) stale(now time.Time) bool {
+	return h.Lease > 0 && now.Sub(h.HeartbeatAt) > h.Lease
+}
+
+// heartbeat renews the lease of the lock holder until the returned func is
+// called, if a lease is configured. Renewals run on a connection of their
+// own, outside the migrations' transactions, so other instances see them.
+// On SQLite, where a migration's transaction blocks every other writer, a
+// renewal that finds the database locked is skipped; the migration renews
+// the lease itself as it commits.
+func (mg *Migrator) heartbeat() (stop func()) {
+	if mg.lockLease <= 0 {
+		return func() {}
+	}
+
+	db := mg.db
+	if mg.pool != nil {
+		db = mg.pool
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(mg.lockLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := mg.renewLease(context.Background(), db)
+				if err != nil && mg.logger != nil && !(mg.driver == sqlite && IsTransient(err)) {
+					mg.logger.Printf("migrate :: failed to renew lease of lock '%s': %s", mg.lockName(), err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		// the lease mustn't be renewed after the lock is released
+		<-stopped
+	}
+}
+
+// renewLease records a heartbeat of the lock holder through db, if a lease
+// is configured. Only this process's record is renewed, so a holder whose
+// lock was taken over can't renew its successor's lease.
+func (mg *Migrator) renewLease(ctx context.Context, db execer) error {
+	if mg.lockLease <= 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	_, err := db.ExecContext(ctx, mg.stmt("UPDATE %s_lock_holder SET heartbeat_at = ? WHERE id = 1 AND host = ? AND pid = ?"),
+		time.Now().UnixMilli(), host, os.Getpid())
+	return err
+}
+
+// takeOver breaks the migration lock held by holder, which may be nil if the
+// holder is unknown, so it can be acquired. A known holder's record is first
+// cleared as it was observed: of several instances that saw the same stale
+// holder, only the first breaks the lock, and none breaks it once the holder
+// has renewed its lease or another instance has acquired it. The others lose
+// the race and keep waiting.
+func (mg *Migrator) takeOver(ctx context.Context, holder *LockHolder) error {
+	if holder != nil {
+		res, err := mg.db.ExecContext(ctx, mg.stmt("DELETE FROM %s_lock_holder WHERE id = 1 AND host = ? AND pid = ? AND acquired_at = ? AND heartbeat_at = ?"),
+			holder.Host, holder.PID, holder.AcquiredAt.Unix(), holder.HeartbeatAt.UnixMilli())
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if mg.logger != nil {
+				mg.logger.Printf("migrate :: lock '%s' changed hands before it could be taken over, waiting", mg.lockName())
+			}
+			return nil
+		}
+	}
+
+	description := describeHolder(&LockedError{Holder: holder})
+	if mg.lockSteal {
+		mg.audit("stealing migration lock '%s' from %s", mg.lockName(), description)
+	} else {
+		mg.audit("taking over migration lock '%s' from %s, whose lease of %s expired at %s",
+			mg.lockName(), description, holder.Lease, holder.HeartbeatAt.Add(holder.Lease).Format(time.RFC3339))
+	}
+
+	switch {
+	case mg.rowLock():
+		_, err := mg.db.ExecContext(ctx, mg.stmt("DELETE FROM %s_lock WHERE id = 1"))
+		return err
+	case mg.driver == mysql:
+		var id sql.NullInt64
+		err := mg.db.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?)", mg.lockName()).Scan(&id)
+		if err != nil || !id.Valid {
+			return err
+		}
+		// KILL takes no placeholders
+		_, err = mg.db.ExecContext(ctx, fmt.Sprintf("KILL %d", id.Int64))
+		return err
+	default:
+		// a bigint advisory lock key is split across classid and objid
+		key := uint64(mg.lockKey())
+		_, err := mg.db.ExecContext(ctx, `SELECT pg_terminate_backend(pid) FROM pg_locks
+			WHERE locktype = 'advisory' AND classid = $1 AND objid = $2 AND objsubid = 1 AND granted`,
+			int64(key>>32), int64(key&0xffffffff))
+		return err
+	}
+}
@@ -0,0 +1,321 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned when another instance holds the migration lock for
+// longer than the timeout set with WithLock. The error returned is a
+// *LockedError, which matches ErrLocked with errors.Is.
+var ErrLocked = errors.New("migrations are locked by another instance")
+
+// LockedError reports which instance holds the migration lock
+type LockedError struct {
+	// Holder is nil if the instance holding the lock didn't record itself,
+	// such as one running an older release
+	Holder *LockHolder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return ErrLocked.Error()
+	}
+	return fmt.Sprintf("migrations are locked by %s", e.Holder)
+}
+
+// Is makes a *LockedError match ErrLocked
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// LockHolder identifies the instance holding the migration lock, as recorded
+// in a table named after the migration table with a "_lock_holder" suffix
+type LockHolder struct {
+	Host       string
+	PID        int
+	AcquiredAt time.Time
+	// HeartbeatAt is when the holder last renewed its lease, which is zero
+	// if it was started without WithLockLease
+	HeartbeatAt time.Time
+	Lease       time.Duration
+}
+
+func (h LockHolder) String() string {
+	return fmt.Sprintf("%s (pid %d) since %s", h.Host, h.PID, h.AcquiredAt.Format(time.RFC3339))
+}
+
+const (
+	// lockPollInterval is how often a busy lock is retried
+	lockPollInterval = 250 * time.Millisecond
+	// defaultLockReportInterval is how often a wait for the lock is logged
+	defaultLockReportInterval = 10 * time.Second
+)
+
+// WithLock makes runs and rollbacks hold a lock on the database, so that when
+// several instances start at once only one applies migrations. The others wait
+// up to timeout for the lock, then return ErrLocked. MySQL uses GET_LOCK,
+// PostgreSQL a session advisory lock and SQLite a row in a table named after
+// the migration table with a "_lock" suffix.
+func WithLock(timeout time.Duration) Option {
+	return func(m *Migrator) {
+		m.lock = true
+		m.lockTimeout = timeout
+	}
+}
+
+// WithLockReportInterval sets how often an instance waiting for the lock
+// logs that it is still waiting, and who holds it; every 10 seconds by
+// default
+func WithLockReportInterval(d time.Duration) Option {
+	return func(m *Migrator) {
+		m.lockReportInterval = d
+	}
+}
+
+// WithLockSkip makes an instance that finds the lock held return without
+// running anything, rather than waiting for it. It implies WithLock.
+func WithLockSkip() Option {
+	return func(m *Migrator) {
+		m.lock = true
+		m.lockSkip = true
+	}
+}
+
+// withLock calls fn while holding the migration lock, if locking is
+// enabled. fn is passed the Migrator to run with, which on SQLite or with
+// WithRunIsolated is bound to a single connection; see sqliteSession and
+// isolatedSession. It returns the error generating the audit migrations, if
+// any, without calling fn.
+func (mg *Migrator) withLock(ctx context.Context, fn func(mg *Migrator) error) error {
+	if mg.auditErr != nil {
+		return mg.auditErr
+	}
+	err := mg.waitForDB(ctx)
+	if err != nil {
+		return err
+	}
+	if mg.driver == sqlite {
+		return mg.sqliteSession(ctx, func(mg *Migrator) error {
+			return mg.holdLock(ctx, fn)
+		})
+	}
+	if mg.isolated {
+		return mg.holdLock(ctx, func(mg *Migrator) error {
+			return mg.isolatedSession(ctx, fn)
+		})
+	}
+	return mg.holdLock(ctx, fn)
+}
+
+// holdLock calls fn while holding the migration lock, if locking is enabled
+func (mg *Migrator) holdLock(ctx context.Context, fn func(mg *Migrator) error) error {
+	if !mg.lock {
+		return fn(mg)
+	}
+
+	unlock, err := mg.acquireLock(ctx)
+	if errors.Is(err, ErrLocked) && mg.lockSkip {
+		if mg.logger != nil {
+			mg.logger.Printf("migrate :: lock '%s' is held by %s, skipping", mg.lockName(), describeHolder(err))
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return fn(mg)
+}
+
+// lockName identifies the lock guarding the migration table
+func (mg *Migrator) lockName() string {
+	return "moogration:" + mg.qualifiedTable()
+}
+
+// lockKey maps the lock name to a PostgreSQL advisory lock key
+func (mg *Migrator) lockKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(mg.lockName()))
+	return int64(h.Sum64())
+}
+
+// acquireLock polls for the migration lock until it is acquired, the timeout
+// passes or ctx is done. The returned func releases the lock.
+func (mg *Migrator) acquireLock(ctx context.Context) (func(), error) {
+	conn, release := mg.db, func(bool) {}
+	if !mg.rowLock() {
+		// MySQL and PostgreSQL locks belong to the session that took them
+		var err error
+		conn, release, err = session(ctx, mg.db)
+		if err != nil {
+			return nil, fmt.Errorf("error reserving connection for migration lock: %w", err)
+		}
+	}
+
+	start := time.Now()
+	deadline := start.Add(mg.lockTimeout)
+	var lastReport time.Time
+	tookOver := false
+	for {
+		ok, err := mg.tryLock(ctx, conn)
+		if err != nil {
+			release(false)
+			return nil, fmt.Errorf("error acquiring migration lock '%s': %w", mg.lockName(), err)
+		}
+		if ok {
+			acquiredAt := mg.recordLockHolder(ctx)
+			stopHeartbeat := mg.heartbeat()
+			return func() {
+				stopHeartbeat()
+				mg.releaseLock(conn, release, acquiredAt)
+			}, nil
+		}
+
+		holder := mg.lockHolder(ctx)
+		if !tookOver && (mg.lockSteal || holder != nil && holder.stale(time.Now())) {
+			// a single attempt, so a takeover that fails falls back to waiting
+			tookOver = true
+			err = mg.takeOver(ctx, holder)
+			if err != nil {
+				release(false)
+				return nil, fmt.Errorf("error taking over migration lock '%s': %w", mg.lockName(), err)
+			}
+			continue
+		}
+		if mg.lockSkip || !time.Now().Before(deadline) {
+			release(false)
+			return nil, &LockedError{Holder: holder}
+		}
+		if mg.logger != nil && time.Since(lastReport) >= mg.reportInterval() {
+			description := describeHolder(&LockedError{Holder: holder})
+			if lastReport.IsZero() {
+				mg.logger.Printf("migrate :: lock '%s' is held by %s, waiting up to %s", mg.lockName(), description, mg.lockTimeout)
+			} else {
+				mg.logger.Printf("migrate :: still waiting for lock '%s' held by %s after %s", mg.lockName(), description, time.Since(start).Round(time.Second))
+			}
+			lastReport = time.Now()
+		}
+		err = sleep(ctx, lockPollInterval)
+		if err != nil {
+			release(false)
+			return nil, err
+		}
+	}
+}
+
+func (mg *Migrator) reportInterval() time.Duration {
+	if mg.lockReportInterval > 0 {
+		return mg.lockReportInterval
+	}
+	return defaultLockReportInterval
+}
+
+// describeHolder names the lock holder of a *LockedError for logging
+func describeHolder(err error) string {
+	var locked *LockedError
+	if errors.As(err, &locked) && locked.Holder != nil {
+		return locked.Holder.String()
+	}
+	return "another instance"
+}
+
+// recordLockHolder records this instance as the lock holder, and returns the
+// time it was recorded as acquiring the lock, or 0 if it couldn't be. The
+// record is only informational, so failing to write it doesn't fail the run.
+func (mg *Migrator) recordLockHolder(ctx context.Context) (acquiredAt int64) {
+	host, _ := os.Hostname()
+	now := time.Now()
+	_, err := mg.db.ExecContext(ctx, mg.stmt(createLockHolderTableSQL))
+	if err == nil {
+		_, err = mg.db.ExecContext(ctx, mg.stmt("DELETE FROM %s_lock_holder WHERE id = 1"))
+	}
+	if err == nil {
+		_, err = mg.db.ExecContext(ctx, mg.stmt("INSERT INTO %s_lock_holder (id, host, pid, acquired_at, heartbeat_at, lease_ms) VALUES (1, ?, ?, ?, ?, ?)"),
+			host, os.Getpid(), now.Unix(), now.UnixMilli(), mg.lockLease.Milliseconds())
+	}
+	if err != nil {
+		mg.audit("failed to record holder of migration lock '%s': %s", mg.lockName(), err)
+		return 0
+	}
+	return now.Unix()
+}
+
+// lockHolder returns the recorded lock holder, or nil if there is none
+func (mg *Migrator) lockHolder(ctx context.Context) *LockHolder {
+	var holder LockHolder
+	var acquiredAt, heartbeatAt, lease int64
+	err := mg.db.QueryRowContext(ctx, mg.stmt("SELECT host, pid, acquired_at, heartbeat_at, lease_ms FROM %s_lock_holder WHERE id = 1")).
+		Scan(&holder.Host, &holder.PID, &acquiredAt, &heartbeatAt, &lease)
+	if err != nil {
+		return nil
+	}
+	holder.AcquiredAt = time.Unix(acquiredAt, 0)
+	holder.HeartbeatAt = time.UnixMilli(heartbeatAt)
+	holder.Lease = time.Duration(lease) * time.Millisecond
+	return &holder
+}
+
+// tryLock makes a single attempt to take the migration lock
+func (mg *Migrator) tryLock(ctx context.Context, conn DBTX) (bool, error) {
+	switch {
+	case mg.rowLock():
+		return mg.tryRowLock(ctx)
+	case mg.driver == mysql:
+		var acquired sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", mg.lockName()).Scan(&acquired)
+		return acquired.Int64 == 1, err
+	default:
+		var acquired bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", mg.lockKey()).Scan(&acquired)
+		return acquired, err
+	}
+}
+
+// releaseLock releases the migration lock. It runs after the migrations
+// themselves, so it ignores the run's context. A session lock that cannot be
+// released is dropped along with its connection. acquiredAt is when the
+// holder record was written, or 0 if there is none: if the record is no
+// longer this instance's, a row lock was taken over and belongs to another
+// instance now, so it is left alone.
+func (mg *Migrator) releaseLock(conn DBTX, release func(discard bool), acquiredAt int64) {
+	ctx := context.Background()
+	// the record is cleared while the lock is still held, so it can't remove
+	// the record of the next holder
+	ours := true
+	if acquiredAt != 0 {
+		host, _ := os.Hostname()
+		res, err := mg.db.ExecContext(ctx, mg.stmt("DELETE FROM %s_lock_holder WHERE id = 1 AND host = ? AND pid = ? AND acquired_at = ?"),
+			host, os.Getpid(), acquiredAt)
+		var n int64
+		if err == nil {
+			n, err = res.RowsAffected()
+		}
+		if err != nil {
+			mg.audit("failed to clear holder of migration lock '%s': %s", mg.lockName(), err)
+		}
+		ours = err != nil || n > 0
+	}
+
+	var err error
+	switch {
+	case mg.rowLock() && !ours:
+		mg.audit("migration lock '%s' was taken over by another instance while held, leaving it", mg.lockName())
+	case mg.rowLock():
+		_, err = mg.db.ExecContext(ctx, mg.stmt("DELETE FROM %s_lock WHERE id = 1"))
+	case mg.driver == mysql:
+		_, err = conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", mg.lockName())
+	default:
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", mg.lockKey())
+	}
+	if err != nil {
+		mg.audit("failed to release migration lock '%s': %s", mg.lockName(), err)
+	}
+	release(err != nil || mg.isolated)
+}
@@ -0,0 +1,120 @@
+package moogration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// ManifestEntry fingerprints a single migration
+type ManifestEntry struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// Manifest is a fingerprint of a migration set, sorted by name. A release can
+// export the manifest of its registry so the next release applies only the
+// migrations added since, after checking the earlier ones were not rewritten.
+type Manifest []ManifestEntry
+
+// NewManifest fingerprints the provided migrations
+func NewManifest(migrations []Migration) Manifest {
+	manifest := make(Manifest, len(migrations))
+	for i, m := range migrations {
+		manifest[i] = ManifestEntry{Name: m.Name, Hash: m.computeHash()}
+	}
+	sort.Slice(manifest, func(i, j int) bool {
+		return manifest[i].Name < manifest[j].Name
+	})
+	return manifest
+}
+
+// RegisteredManifest fingerprints the registered migrations
+func RegisteredManifest() Manifest {
+	return NewManifest(defaultRegistry.snapshot())
+}
+
+// Manifest fingerprints the Migrator's registered migrations
+func (mg *Migrator) Manifest() Manifest {
+	return NewManifest(mg.registry.snapshot())
+}
+
+// ReadManifest decodes a manifest previously written with Write
+func ReadManifest(r io.Reader) (Manifest, error) {
+	manifest := Manifest{}
+	err := json.NewDecoder(r).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding migration manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// Write encodes the manifest as JSON
+func (m Manifest) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(m)
+}
+
+// Delta returns the migrations in the provided set that are not in the
+// manifest, sorted by name. It returns an error unless the manifest is an
+// unchanged prefix of the set: every manifest entry must be present, in the
+// same position, with the same hash.
+func (m Manifest) Delta(migrations []Migration) ([]Migration, error) {
+	current := cloneMigrations(migrations)
+	sort.Slice(current, func(i, j int) bool {
+		return current[i].Name < current[j].Name
+	})
+
+	for i, entry := range m {
+		if i >= len(current) {
+			return nil, fmt.Errorf("migration '%s' from the previous manifest is missing", entry.Name)
+		}
+		if current[i].Name != entry.Name {
+			return nil, fmt.Errorf("migration order diverges from the previous manifest at position %d: expected '%s', found '%s'", i, entry.Name, current[i].Name)
+		}
+		if !current[i].matchesHash(entry.Hash) {
+			return nil, fmt.Errorf("migration '%s' has been rewritten since the previous manifest", entry.Name)
+		}
+	}
+
+	return current[len(m):], nil
+}
+
+// ApplyDelta runs the registered migrations added since the previous manifest
+// was exported, after validating that the migrations it lists are unchanged
+func ApplyDelta(db DBTX, previous Manifest, force bool, logger *log.Logger) error {
+	return defaultMigrator(db, logger).ApplyDeltaContext(context.Background(), previous, force)
+}
+
+// ApplyDelta runs the migrations registered with the Migrator that were added
+// since the previous manifest, after validating that the migrations it lists
+// are unchanged
+func (mg *Migrator) ApplyDelta(previous Manifest, force bool) error {
+	return mg.ApplyDeltaContext(context.Background(), previous, force)
+}
+
+// ApplyDeltaContext is like ApplyDelta, with a context
+func (mg *Migrator) ApplyDeltaContext(ctx context.Context, previous Manifest, force bool) (err error) {
+	if err := mg.refuseDryRun("ApplyDelta"); err != nil {
+		return err
+	}
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+
+	delta, err := previous.Delta(mg.registry.snapshot())
+	if err != nil {
+		return err
+	}
+
+	if mg.logger != nil {
+		mg.logger.Printf("%d migrations added since previous manifest", len(delta))
+	}
+
+	return mg.withLock(ctx, func(mg *Migrator) error {
+		return mg.runLatest(ctx, delta, false, force, state)
+	})
+}
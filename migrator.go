@@ -0,0 +1,283 @@
+package moogration
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const defaultTableName = "migration"
+
+// selectedTable and selectedSchema are the defaults for new Migrators, set
+// with SetTableName and SetSchema
+var (
+	selectedTable  = defaultTableName
+	selectedSchema string
+)
+
+// SetTableName sets the name of the table migration statuses are tracked in,
+// for the package functions and Migrators created afterwards. The default is
+// "migration".
+func SetTableName(name string) {
+	selectedTable = name
+}
+
+// SetSchema sets the schema (on SQLite, the attached database) the tracking
+// table is kept in, for the package functions and Migrators created
+// afterwards. By default the connection's current schema is used.
+func SetSchema(schema string) {
+	selectedSchema = schema
+}
+
+// Migrator runs a registry of migrations against a single database. Each
+// Migrator owns its registry, tracking table and dialect, so several
+// independent migration sets can be managed in one process.
+type Migrator struct {
+	db       DBTX
+	registry *Registry
+	table    string
+	schema   string
+	driver   driver
+	dialect  Dialect
+	logger   *log.Logger
+	groups   map[string]GroupConfig
+
+	strict           bool
+	downConfirmation string
+	confirm          ConfirmFunc
+	protectedEnvs    []string
+
+	pause    time.Duration
+	interval time.Duration
+
+	lock        bool
+	lockTimeout time.Duration
+	lockSkip    bool
+
+	lockReportInterval time.Duration
+	lockLease          time.Duration
+	lockSteal          bool
+	minimalPermissions bool
+
+	busyTimeout     time.Duration
+	wal             bool
+	integrityChecks bool
+
+	// isolated is set by WithRunIsolated, and discard, on a Migrator bound to
+	// a connection reserved for an operation, discards it afterwards
+	isolated bool
+	discard  *bool
+	// pool, on a Migrator bound to a reserved connection, is the handle the
+	// connection was reserved from
+	pool DBTX
+
+	dualWrite DBTX
+
+	dryRun   bool
+	rehearse bool
+
+	constraintPrecheck bool
+	permissionPrecheck bool
+	onlineDDL          OnlineDDLPolicy
+	osc                *OSCConfig
+	labels             Labels
+
+	migrationTimeout time.Duration
+	slowWarning      time.Duration
+	visibility       *visibility
+	failurePolicy    FailurePolicy
+
+	appliedBy  string
+	recordSQL  bool
+	appVersion string
+
+	hooks   hooks
+	tracer  Tracer
+	approve Approver
+	retry   *RetryPolicy
+
+	auditTables []AuditTable
+	// auditErr is the error generating the audit migrations, returned by
+	// runs
+	auditErr error
+
+	includeTags []string
+	excludeTags []string
+
+	// shadow is set on the Migrator ValidateShadow runs, the only one that
+	// loads fixtures
+	shadow      bool
+	fixtures    []Fixture
+	fixtureSeed int64
+}
+
+// Option configures a Migrator
+type Option func(*Migrator)
+
+// New returns a Migrator for db with an empty registry. Unless configured
+// otherwise, it uses the dialect selected with UseSQLite, UseMySQL or
+// UsePostgres and tracks migrations in the table set with SetTableName and
+// SetSchema, "migration" by default. Strict mode is enabled if MOOGRATION_ENV
+// is "production".
+func New(db DBTX, opts ...Option) *Migrator {
+	m := &Migrator{
+		db:       db,
+		registry: NewRegistry(),
+		table:    selectedTable,
+		schema:   selectedSchema,
+		driver:   selectedDriver,
+		dialect:  selectedDialect,
+		strict:   strictFromEnv(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.registerAudit()
+	return m
+}
+
+// WithRegistry makes the Migrator run the migrations of an existing registry
+func WithRegistry(r *Registry) Option {
+	return func(m *Migrator) {
+		m.registry = r
+	}
+}
+
+// WithTableName sets the name of the table migration statuses are tracked in
+func WithTableName(name string) Option {
+	return func(m *Migrator) {
+		m.table = name
+	}
+}
+
+// WithSchema keeps the tracking table in schema (on SQLite, the attached
+// database) rather than the connection's current schema
+func WithSchema(schema string) Option {
+	return func(m *Migrator) {
+		m.schema = schema
+	}
+}
+
+// WithSQLite configures the Migrator for SQLite
+func WithSQLite() Option {
+	return func(m *Migrator) {
+		m.driver = sqlite
+		m.dialect = nil
+	}
+}
+
+// WithMySQL configures the Migrator for MySQL
+func WithMySQL() Option {
+	return func(m *Migrator) {
+		m.driver = mysql
+		m.dialect = nil
+	}
+}
+
+// WithPostgres configures the Migrator for PostgreSQL
+func WithPostgres() Option {
+	return func(m *Migrator) {
+		m.driver = postgres
+		m.dialect = nil
+	}
+}
+
+// WithDialect configures the Migrator for a dialect other than the built-in
+// ones; see Dialect. It needn't be registered with RegisterDialect.
+func WithDialect(d Dialect) Option {
+	return func(m *Migrator) {
+		m.driver = driver(d.Base())
+		m.dialect = d
+	}
+}
+
+// WithLogger logs migration progress to logger. A nil logger silences logging.
+func WithLogger(logger *log.Logger) Option {
+	return func(m *Migrator) {
+		m.logger = logger
+	}
+}
+
+// GroupConfig routes a group of migrations to its own connection and
+// tracking table. Zero fields fall back to the Migrator's configuration.
+type GroupConfig struct {
+	// DB is the connection the group's migrations run on, e.g. one opened as
+	// the owning team's database role
+	DB DBTX
+	// TableName is the table the group's migration statuses are tracked in
+	TableName string
+}
+
+// WithGroup configures how migrations whose Group is name are run
+func WithGroup(name string, conf GroupConfig) Option {
+	return func(m *Migrator) {
+		if m.groups == nil {
+			m.groups = map[string]GroupConfig{}
+		}
+		m.groups[name] = conf
+	}
+}
+
+// forGroup returns a Migrator for the named group's configuration, running
+// the provided migrations
+func (mg *Migrator) forGroup(name string, migrations []Migration) *Migrator {
+	sub := *mg
+	sub.groups = nil
+	sub.registry = registryOf(migrations)
+	conf := mg.groups[name]
+	if conf.DB != nil {
+		sub.db = conf.DB
+	}
+	if conf.TableName != "" {
+		sub.table = conf.TableName
+	}
+	return &sub
+}
+
+// eachGroup partitions the registry by group and calls fn with a Migrator
+// for each group in turn: ungrouped migrations first, then groups by name
+func (mg *Migrator) eachGroup(fn func(sub *Migrator) error) error {
+	partitions := map[string][]Migration{}
+	for _, m := range mg.registry.snapshot() {
+		partitions[m.Group] = append(partitions[m.Group], m)
+	}
+
+	names := make([]string, 0, len(partitions))
+	for name := range partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := fn(mg.forGroup(name, partitions[name]))
+		if err != nil {
+			if name != "" {
+				err = fmt.Errorf("migration group '%s': %w", name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultMigrator backs the package-level functions, which operate on the
+// default registry
+func defaultMigrator(db DBTX, logger *log.Logger) *Migrator {
+	return New(db, WithRegistry(defaultRegistry), WithLogger(logger))
+}
+
+// Registry returns the Migrator's registry
+func (mg *Migrator) Registry() *Registry {
+	return mg.registry
+}
+
+// Register adds migrations to the Migrator's registry
+func (mg *Migrator) Register(m ...Migration) {
+	mg.registry.register(callerLocation(), m...)
+}
+
+// Include merges the migrations of other registries into the Migrator's registry
+func (mg *Migrator) Include(others ...*Registry) error {
+	return mg.registry.Include(others...)
+}
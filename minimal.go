@@ -0,0 +1,50 @@
+package moogration
+
+import "context"
+
+// WithMinimalPermissions runs with no more than the grants a constrained
+// runner has, such as a serverless function on a managed database: CREATE,
+// ALTER, DROP and DML on its own schema. The migration lock is a row in a
+// table next to the tracking table, <table>_lock, rather than a MySQL or
+// PostgreSQL advisory lock, which some proxies and managed databases don't
+// support; no connection is reserved for a session of its own; and
+// capability detection doesn't probe for advisory locks. Migrations with
+// SkipReplication fail, as they need both. moogration never creates
+// databases or schemas, in any mode.
+//
+// A runner that dies holding a row lock can't release it, as a session lock
+// would be. Set a lease with WithLockLease so another runner takes it over
+// once the lease expires; without one, it stays locked until WithStealLock
+// is used.
+func WithMinimalPermissions() Option {
+	return func(m *Migrator) {
+		m.minimalPermissions = true
+	}
+}
+
+// rowLock reports whether the migration lock is a row in the lock table
+// rather than a session lock
+func (mg *Migrator) rowLock() bool {
+	return mg.driver == sqlite || mg.minimalPermissions || mg.dialect != nil && mg.dialect.LockStrategy() == LockTable
+}
+
+// tryRowLock makes a single attempt to insert the lock row
+func (mg *Migrator) tryRowLock(ctx context.Context) (bool, error) {
+	_, err := mg.db.ExecContext(ctx, mg.stmt(createLockTableSQL))
+	if err != nil {
+		return false, err
+	}
+	insert := "INSERT OR IGNORE INTO %s_lock (id) VALUES (1)"
+	switch mg.driver {
+	case mysql:
+		insert = "INSERT IGNORE INTO %s_lock (id) VALUES (1)"
+	case postgres:
+		insert = "INSERT INTO %s_lock (id) VALUES (1) ON CONFLICT DO NOTHING"
+	}
+	res, err := mg.db.ExecContext(ctx, mg.stmt(insert))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
@@ -1,12 +1,16 @@
 package moogration
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -16,149 +20,382 @@ type Migration struct {
 	Up   string
 	Down string
 	Name string
-}
+	// Description says what the migration does, for documentation and admin
+	// tools. It is not hashed.
+	Description string
+	// Tags categorize the migration, e.g. by the environments it is for. A run
+	// can be limited to or exclude tags with WithTags and WithoutTags. They
+	// are not hashed.
+	Tags []string
+	// Template makes Up and Down text/templates, expanded when the migration
+	// is registered with the snippets defined on its registry. The expanded
+	// SQL is what is run and hashed.
+	Template bool
+	// Group optionally assigns the migration to a group configured on the
+	// Migrator with WithGroup
+	Group string
+	// NoTransaction runs the migration outside a transaction even where the
+	// dialect supports transactional DDL, for statements such as
+	// CREATE INDEX CONCURRENTLY that cannot run inside one
+	NoTransaction bool
+	// SkipReplication runs the migration with binary logging disabled for its
+	// session (MySQL only), e.g. for an index built on a single replica. Each
+	// such run is audit logged.
+	SkipReplication bool
+	// Estimate is the expected running time of the migration, for runbooks
+	Estimate time.Duration
+	// Timeout cancels the migration if it runs longer, overriding the
+	// timeout set with WithMigrationTimeout
+	Timeout time.Duration
+	// ManualRollback describes the steps an operator must take to undo a
+	// migration that has no Down SQL, for runbooks
+	ManualRollback string
+	// FollowUps are scheduled when the migration is applied, to be run by
+	// RunDueFollowUps once they are due
+	FollowUps []FollowUp
+	// Labels are attached to the migration's log lines and audit events and
+	// recorded when it is applied, alongside those set with WithLabels
+	Labels Labels
+	// Repeatable migrations are run again, by their Up, whenever their hash
+	// changes, instead of being reported as changed, and run after the other
+	// migrations of a run. Their Up must be idempotent, e.g. by dropping what
+	// it creates first.
+	Repeatable bool
+	// AllowTableCopy exempts the migration from the online DDL policy set
+	// with WithOnlineDDL, for ALTERs that can only run by copying the table
+	AllowTableCopy bool
+	// ForeignKeysOff runs the migration with foreign key enforcement turned
+	// off (SQLite only), as rebuilding a table others reference requires; see
+	// RebuildTable. Before it commits, PRAGMA foreign_key_check and
+	// integrity_check must pass, or it fails with an error wrapping
+	// ErrIntegrity.
+	ForeignKeysOff bool
+	// Squashes names the migrations this one consolidates, as generated by
+	// Squash. On a database they are applied to, it is recorded as applied
+	// without being run and their tracking rows are archived. It is not
+	// hashed.
+	Squashes []string
+	// MinAppVersion is the oldest application version that understands the
+	// schema after the migration, such as "1.4.0". A run given the running
+	// application's version with WithAppVersion refuses to apply it from an
+	// older one. It is not hashed.
+	MinAppVersion string
 
-var registeredMigrations = []Migration{}
+	// UpFunc and DownFunc define a migration in Go, for backfills and data
+	// transformations that can't be expressed as SQL. Where set, they run
+	// instead of the SQL of their direction, always inside a transaction, which
+	// also records the migration's status.
+	UpFunc   func(ctx context.Context, tx *sql.Tx) error
+	DownFunc func(ctx context.Context, tx *sql.Tx) error
+	// Version is hashed along with the SQL. Change it when the code of a Go
+	// migration changes, as the code itself is not hashed.
+	Version string
 
-// Register registers a migration to be run by RunLatest
-func Register(m ...Migration) {
-	registeredMigrations = append(registeredMigrations, m...)
+	// digest caches hash(). It is computed when the migration is registered or
+	// passed to RunLatestFrom, RollbackFrom or NewBundle, and cleared by SetUp
+	// and SetDown.
+	digest string
 }
 
-func RegisteredMigrations() []Migration {
-	return registeredMigrations
+// SetUp replaces the migration's up SQL, invalidating its cached hash
+func (m *Migration) SetUp(up string) {
+	m.Up = up
+	m.digest = ""
 }
 
-type driver string
+// SetDown replaces the migration's down SQL, invalidating its cached hash
+func (m *Migration) SetDown(down string) {
+	m.Down = down
+	m.digest = ""
+}
 
-const (
-	sqlite driver = "sqlite"
-	mysql  driver = "mysql"
-)
+func (mg *Migrator) createMigrationTable(ctx context.Context) error {
+	return mg.createTrackingTable(ctx, mg.qualifiedTable())
+}
 
-var selectedDriver driver
-
-// UseSQLite sets the package's mode to SQLite
-func UseSQLite() {
-	selectedDriver = sqlite
-}
-
-// UseMySQL sets the package's mode to MySQL
-func UseMySQL() {
-	selectedDriver = mysql
-}
-
-// this table tracks migratipn statuses
-const createMigrationTableMySQL = `
-	CREATE TABLE IF NOT EXISTS migration (
-		id int NOT NULL AUTO_INCREMENT PRIMARY KEY,
-		name VARCHAR(255),
-		batch int NOT NULL,
-		sql_hash VARCHAR(255),
-		migrated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-`
-
-const createMigrationTableSQLite = `
-	CREATE TABLE IF NOT EXISTS migration (
-		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-		name TEXT,
-		batch INTEGER NOT NULL,
-		sql_hash TEXT,
-		migrated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-`
-
-func createMigrationTable(db *sql.DB) error {
-	var createMigrationTableSQL string
-	switch selectedDriver {
-	case mysql:
-		createMigrationTableSQL = createMigrationTableMySQL
-	case sqlite:
-		createMigrationTableSQL = createMigrationTableSQLite
-	default:
-		return fmt.Errorf("configured driver unknown: \"%s\"", selectedDriver)
+// createTrackingTable creates a table with the tracking table's structure
+func (mg *Migrator) createTrackingTable(ctx context.Context, name string) error {
+	return mg.createTrackingTableOn(ctx, mg.db, name)
+}
+
+// createTrackingTableOn creates a tracking table through db, which may be a
+// transaction
+func (mg *Migrator) createTrackingTableOn(ctx context.Context, db DBTX, name string) error {
+	create, err := mg.trackingTableSQL(name)
+	if err != nil {
+		return err
 	}
-	_, err := db.Exec(createMigrationTableSQL)
+	_, err = db.ExecContext(ctx, create)
 	if err != nil {
 		// wrap error with some context
 		err = fmt.Errorf("error running create migration table migration: %w", err)
 		return err
 	}
+	err = mg.upgradeTrackingTable(ctx, db, name)
+	if err != nil {
+		return fmt.Errorf("error upgrading migration table: %w", err)
+	}
 
 	return nil
 }
 
+// trackingTableSQL returns the statement creating a tracking table
+func (mg *Migrator) trackingTableSQL(name string) (string, error) {
+	switch {
+	case mg.dialect != nil:
+		return mg.dialect.TrackingTableSQL(name), nil
+	case mg.driver == mysql:
+		return fmt.Sprintf(createMigrationTableMySQL, name), nil
+	case mg.driver == sqlite:
+		return fmt.Sprintf(createMigrationTableSQLite, name), nil
+	case mg.driver == postgres:
+		return fmt.Sprintf(createMigrationTablePostgres, name), nil
+	default:
+		return "", fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+}
+
+// hashPrefix names the algorithm of a stored hash. Hashes recorded before
+// SHA-256 was adopted are bare MD5 hex digests.
+const hashPrefix = "sha256:"
+
 // hashes are stored to safety check that migrations have not been edited
 // since they were run
 func (m Migration) hash() string {
-	data := []byte(m.Up + m.Down)
-	hash := md5.Sum(data)
+	if m.digest != "" {
+		return m.digest
+	}
+	return m.computeHash()
+}
+
+func (m Migration) computeHash() string {
+	hash := sha256.Sum256([]byte(m.Up + m.Down + m.Version))
+	return hashPrefix + hex.EncodeToString(hash[:])
+}
+
+// legacyHash is the MD5 digest recorded by earlier versions
+func (m Migration) legacyHash() string {
+	hash := md5.Sum([]byte(m.Up + m.Down + m.Version))
 	return hex.EncodeToString(hash[:])
 }
 
-func (m Migration) migrationStatus(db *sql.DB) (hasRun, hasChanged bool) {
+// reapplies reports whether m is repeatable and has changed since the stored
+// hash was recorded, so its Up should run again
+func (m Migration) reapplies(stored string) bool {
+	return m.Repeatable && !m.matchesHash(stored)
+}
+
+// sortForRun sorts migrations by name, descending for a down run, with
+// repeatable migrations after the others on the way up and before them on
+// the way down
+func sortForRun(migrations []Migration, down bool) {
+	sort.Slice(migrations, func(i, j int) bool {
+		if migrations[i].Repeatable != migrations[j].Repeatable {
+			return migrations[j].Repeatable != down
+		}
+		if down {
+			return migrations[i].Name > migrations[j].Name
+		}
+		return migrations[i].Name < migrations[j].Name
+	})
+}
+
+// planRun sorts migrations to run in the given direction and selects them by
+// tag. It returns those selected, those of them the run applies or rolls
+// back given the hashes of the applied migrations, and those excluded by
+// tags.
+func (mg *Migrator) planRun(migrations []Migration, applied map[string]string, down bool) (selected, pending, excluded []Migration) {
+	sortForRun(migrations, down)
+	selected, excluded = mg.selectTagged(migrations)
+	pending = []Migration{}
+	for _, m := range selected {
+		hash, hasRun := applied[m.Name]
+		if down && hasRun || !down && (!hasRun || m.reapplies(hash)) {
+			pending = append(pending, m)
+		}
+	}
+	return selected, pending, excluded
+}
+
+// matchesHash reports whether a stored hash, of either algorithm, was
+// recorded for the migration as it is now
+func (m Migration) matchesHash(stored string) bool {
+	if strings.HasPrefix(stored, hashPrefix) {
+		return stored == m.hash()
+	}
+	return stored == m.legacyHash()
+}
+
+func (mg *Migrator) migrationStatus(ctx context.Context, m Migration) (hasRun, hasChanged bool, err error) {
 	dbMigration := Migration{}
 	var dbHash string
-	query := "SELECT name, sql_hash FROM migration WHERE name = ?"
-	migration := db.QueryRow(query, m.Name)
+	query := mg.stmt("SELECT name, sql_hash FROM %s WHERE name = ?")
+	migration := mg.db.QueryRowContext(ctx, query, m.Name)
 
-	err := migration.Scan(&dbMigration.Name, &dbHash)
+	err = migration.Scan(&dbMigration.Name, &dbHash)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// hasRun defaults to false, hasChanged is vacuously false
-			return
+			return false, false, nil
 		}
-		panic(err)
+		err = fmt.Errorf("error checking status of migration '%s': %w", m.Name, err)
+		return false, false, err
 	}
 
 	// if no ErrNoRows, the migration has run
 	hasRun = true
 
 	// check if migration has changed since run
-	if dbHash != m.hash() {
+	if !m.matchesHash(dbHash) {
 		hasChanged = true
 	}
 	return
 }
 
-func (m Migration) setMigrationStatus(down bool, db *sql.DB, batch int) {
+// appliedHashes prefetches the stored hash of every migration that has run,
+// keyed by migration name, so a run needs one query instead of one per migration
+func (mg *Migrator) appliedHashes(ctx context.Context) (map[string]string, error) {
+	hashes := map[string]string{}
+	rows, err := mg.db.QueryContext(ctx, mg.stmt("SELECT name, sql_hash FROM %s"))
+	if err != nil {
+		return hashes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, sqlHash string
+		err := rows.Scan(&name, &sqlHash)
+		if err != nil {
+			return hashes, err
+		}
+		hashes[name] = sqlHash
+	}
+
+	return hashes, rows.Err()
+}
+
+// upgradeHashes re-records the MD5 hashes of unchanged registered migrations
+// as SHA-256, updating applied to match. Changed migrations keep their MD5
+// hashes, so they are still reported as changed.
+func (mg *Migrator) upgradeHashes(ctx context.Context, applied map[string]string) error {
+	stmt := mg.stmt("UPDATE %s SET sql_hash = ? WHERE name = ? AND sql_hash = ?")
+	for _, m := range mg.registry.snapshot() {
+		stored, hasRun := applied[m.Name]
+		if !hasRun || strings.HasPrefix(stored, hashPrefix) || !m.matchesHash(stored) {
+			continue
+		}
+		_, err := mg.db.ExecContext(ctx, stmt, m.hash(), m.Name, stored)
+		if err != nil {
+			return fmt.Errorf("error upgrading hash of migration '%s': %w", m.Name, err)
+		}
+		applied[m.Name] = m.hash()
+	}
+	return nil
+}
+
+// setMigrationStatus records m as applied or rolled back. took is how long
+// the migration ran for.
+func (mg *Migrator) setMigrationStatus(ctx context.Context, db execer, m Migration, down bool, batch int, took time.Duration) error {
 	if down {
-		stmt := "DELETE FROM migration WHERE name = ?"
-		_, err := db.Exec(stmt, m.Name)
+		stmt := mg.stmt("DELETE FROM %s WHERE name = ?")
+		_, err := db.ExecContext(ctx, stmt, m.Name)
 		if err != nil {
 			err = fmt.Errorf("error deleting migration record for migration '%s': %w", m.Name, err)
-			panic(err)
+			return err
+		}
+		err = mg.recordLabels(ctx, db, m, down)
+		if err != nil {
+			return err
+		}
+		return mg.scheduleFollowUps(ctx, db, m, down)
+	}
+	if m.Repeatable {
+		// replace the record of a previous application
+		err := mg.setMigrationStatus(ctx, db, m, true, batch, took)
+		if err != nil {
+			return err
 		}
-		return
 	}
-	stmt := "INSERT INTO migration (name, sql_hash, batch) VALUES (?, ?, ?)"
-	_, err := db.Exec(stmt, m.Name, m.hash(), batch)
+	stmt := mg.stmt("INSERT INTO %s (name, sql_hash, batch, duration_ms, applied_by, applied_sql) VALUES (?, ?, ?, ?, ?, ?)")
+	_, err := db.ExecContext(ctx, stmt, m.Name, m.hash(), batch, took.Milliseconds(), mg.applier(), mg.appliedSQL(m))
 	if err != nil {
 		err = fmt.Errorf("error inserting migration record for migration '%s': %w", m.Name, err)
-		panic(err)
+		return err
+	}
+	err = mg.recordLabels(ctx, db, m, down)
+	if err != nil {
+		return err
 	}
+	return mg.scheduleFollowUps(ctx, db, m, down)
 }
 
-// run a migration on the provided connection
-func (m Migration) run(down bool, db *sql.DB, logger *log.Logger) error {
+// query returns the SQL run in the given direction
+func (m Migration) query(down bool) string {
+	if down {
+		return m.Down
+	}
+	return m.Up
+}
+
+// fn returns the Go function run in the given direction, if any
+func (m Migration) fn(down bool) func(ctx context.Context, tx *sql.Tx) error {
 	if down {
+		return m.DownFunc
+	}
+	return m.UpFunc
+}
+
+// execer is satisfied by *sql.DB, *sql.Tx and *sql.Conn
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// run a migration on the provided connection
+func (m Migration) run(ctx context.Context, down bool, db execer, mg *Migrator) error {
+	logger := mg.logger
+	if fn := m.fn(down); fn != nil {
 		if logger != nil {
-			logger.Printf("migrate :: DOWN :: %s", m.Name)
+			logger.Printf("migrate :: %s :: %s (Go)%s", strings.ToUpper(direction(down)), m.Name, labelSuffix(mg.labelsFor(m)))
 		}
-		_, err := db.Exec(m.Down)
+		tx, ok := db.(*sql.Tx)
+		if !ok {
+			return fmt.Errorf("error running migration '%s' (%s): Go migrations must run in a transaction", m.Name, strings.ToUpper(direction(down)))
+		}
+		err := fn(ctx, tx)
 		if err != nil {
-			err = fmt.Errorf("error running migration '%s' (DOWN): %w", m.Name, err)
-			return err
+			return fmt.Errorf("error running migration '%s' (%s): %w", m.Name, strings.ToUpper(direction(down)), err)
 		}
-	} else {
+		return nil
+	}
+
+	if strings.TrimSpace(m.query(down)) == "" {
+		// nothing to run, though the status is still recorded
 		if logger != nil {
-			logger.Printf("migrate :: UP :: %s", m.Name)
+			logger.Printf("migrate :: %s :: %s (empty)%s", strings.ToUpper(direction(down)), m.Name, labelSuffix(mg.labelsFor(m)))
+		}
+		return nil
+	}
+
+	if logger != nil {
+		logger.Printf("migrate :: %s :: %s%s", strings.ToUpper(direction(down)), m.Name, labelSuffix(mg.labelsFor(m)))
+	}
+	// statements are executed one at a time, as not every connection accepts
+	// several in one Exec
+	stmts := splitSQL(m.query(down), mg.driver)
+	for i, stmt := range stmts {
+		stmt, rewritten, err := mg.applyOnlineDDL(m, stmt)
+		if err != nil {
+			return fmt.Errorf("error running migration '%s' (%s): %w: %s", m.Name, strings.ToUpper(direction(down)), err, stmt)
+		}
+		_, err = db.ExecContext(ctx, stmt)
+		if err != nil && rewritten && isTableCopyError(err) {
+			err = fmt.Errorf("%w: %w", err, ErrTableCopy)
 		}
-		_, err := db.Exec(m.Up)
 		if err != nil {
-			err = fmt.Errorf("error running migration '%s' (UP): %w", m.Name, err)
-			return err
+			if len(stmts) > 1 {
+				return fmt.Errorf("error running migration '%s' (%s), statement %d of %d: %w", m.Name, strings.ToUpper(direction(down)), i+1, len(stmts), err)
+			}
+			return fmt.Errorf("error running migration '%s' (%s): %w", m.Name, strings.ToUpper(direction(down)), err)
 		}
 	}
 
@@ -166,28 +403,23 @@ func (m Migration) run(down bool, db *sql.DB, logger *log.Logger) error {
 }
 
 // get the most recently run batch number
-func latestBatch(db *sql.DB) (int, error) {
-	batch := 0
-	sqlSelectLatestBatch := `SELECT MAX(batch) FROM migration`
-	row := db.QueryRow(sqlSelectLatestBatch)
-	err := row.Scan(&batch)
-	// if no migrations have run, latestBatch = 0
+func (mg *Migrator) latestBatch(ctx context.Context) (int, error) {
+	// MAX is NULL if no migrations have run, making the latest batch 0
+	var batch sql.NullInt64
+	err := mg.db.QueryRowContext(ctx, mg.stmt(`SELECT MAX(batch) FROM %s`)).Scan(&batch)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			batch = 0
-			err = nil
-		} else {
-			return 0, err
-		}
+		return 0, err
 	}
-	return batch, err
+	return int(batch.Int64), nil
 }
 
-// allBatches returns a slice of integer migration batch numbers, sorted descending
-func allBatches(db *sql.DB) ([]int, error) {
-	sqlSelectBatches := "SELECT DISTINCT batch FROM migration ORDER BY batch DESC"
+// allBatches returns a slice of integer migration batch numbers, sorted
+// descending. Batch 0, of baselined migrations, isn't included, as it can't
+// be rolled back.
+func (mg *Migrator) allBatches(ctx context.Context) ([]int, error) {
+	sqlSelectBatches := mg.stmt("SELECT DISTINCT batch FROM %s WHERE batch > 0 ORDER BY batch DESC")
 	batches := []int{}
-	rows, err := db.Query(sqlSelectBatches)
+	rows, err := mg.db.QueryContext(ctx, sqlSelectBatches)
 	if err != nil {
 		return batches, err
 	}
@@ -202,113 +434,491 @@ func allBatches(db *sql.DB) ([]int, error) {
 		batches = append(batches, batch)
 	}
 
-	return batches, nil
+	return batches, rows.Err()
 }
 
-// rollback a single identified migration batch. This function is intentionally left unexported,
-// because migrations should not be rolled back out of order
-func rollbackOneBatch(db *sql.DB, batchID int, force bool, logger *log.Logger) error {
-	sqlGetMigrations := `SELECT name, sql_hash FROM migration WHERE batch = ?`
-	rows, err := db.Query(sqlGetMigrations, batchID)
+// checkBatchCount returns ErrBatchOutOfRange unless numBatches is between one
+// and the number of applied batches
+func checkBatchCount(numBatches, applied int) error {
+	if numBatches < 1 || numBatches > applied {
+		return fmt.Errorf("%w: asked to roll back %d batches, %d applied", ErrBatchOutOfRange, numBatches, applied)
+	}
+	return nil
+}
+
+// batchRecord is the name and stored hash of an applied migration
+type batchRecord struct{ name, sqlHash string }
+
+// sortForRollback sorts a batch's records in the order sortForRun gives a
+// rollback, rather than the table's
+func sortForRollback(records []batchRecord, registered map[string]Migration) {
+	sort.Slice(records, func(i, j int) bool {
+		ri, rj := registered[records[i].name].Repeatable, registered[records[j].name].Repeatable
+		if ri != rj {
+			return ri
+		}
+		return records[i].name > records[j].name
+	})
+}
+
+// batchRecords reads the whole of a batch, so the result set doesn't hold a
+// connection (or, for SQLite, a read lock) while its migrations run
+func (mg *Migrator) batchRecords(ctx context.Context, batchID int) ([]batchRecord, error) {
+	sqlGetMigrations := mg.stmt(`SELECT name, sql_hash FROM %s WHERE batch = ?`)
+	rows, err := mg.db.QueryContext(ctx, sqlGetMigrations, batchID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
+	records := []batchRecord{}
 	for rows.Next() {
-		var name, sqlHash string
-		err := rows.Scan(&name, &sqlHash)
+		var r batchRecord
+		err := rows.Scan(&r.name, &r.sqlHash)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
 
-		migrationFound := false
+// rollback a single identified migration batch. This function is intentionally left unexported,
+// because migrations should not be rolled back out of order. The batch's
+// migrations are rolled back in the reverse of the order they ran in, and the
+// first failure stops the rollback with the batch partly rolled back.
+func (mg *Migrator) rollbackOneBatch(ctx context.Context, migrations []Migration, batchID int, force bool, caps Capabilities, state *runState) error {
+	state.set("", "rollback")
+	records, err := mg.batchRecords(ctx, batchID)
+	if err != nil {
+		return err
+	}
 
-		for _, migration := range registeredMigrations {
-			if migration.Name == name {
-				migrationFound = true
-				// validate that hash hasn't changed, permitting force
-				if force || migration.hash() == sqlHash {
-					// run down migration
-					err = migration.run(true, db, logger)
-					if err != nil {
-						panic(err)
-					}
+	registered := map[string]Migration{}
+	for _, m := range migrations {
+		registered[m.Name] = m
+	}
+	sortForRollback(records, registered)
 
-					migration.setMigrationStatus(true, db, batchID)
-				} else {
-					err := fmt.Errorf("previously run migration '%s' has changed since run", migration.Name)
-					panic(err)
-				}
+	for i, r := range records {
+		migration, ok := registered[r.name]
+		if !ok {
+			if mg.logger != nil {
+				mg.logger.Printf("could not roll back migration %s: not found", r.name)
 			}
+			if state.result != nil {
+				state.result.Skipped = append(state.result.Skipped, SkippedMigration{Name: r.name, Reason: "not registered"})
+			}
+			continue
 		}
 
-		if !migrationFound {
-			log.Printf("could not roll back migration %s: not found\n", name)
+		state.set(migration.Name, "down")
+		// validate that hash hasn't changed, permitting force
+		if !force && !migration.Repeatable && !migration.matchesHash(r.sqlHash) {
+			err = fmt.Errorf("previously run migration '%s' has changed since run", migration.Name)
+			return stoppedRollback(batchID, records[i:], err)
+		}
+		// run down migration and delete its status record
+		err = mg.execute(ctx, migration, true, batchID, caps, state)
+		if mg.skipFailure(migration, err, state) {
+			continue
+		}
+		if err != nil {
+			return stoppedRollback(batchID, records[i:], err)
 		}
 	}
 
 	return nil
 }
 
-// Rollback rolls the last n batches of migrations
-func Rollback(db *sql.DB, numBatches int, force bool, logger *log.Logger) error {
-	batches, err := allBatches(db)
+// stoppedRollback describes a rollback of a batch stopped by err, with
+// remaining still applied, from the migration that failed on
+func stoppedRollback(batchID int, remaining []batchRecord, err error) error {
+	names := make([]string, len(remaining))
+	for i, r := range remaining {
+		names[i] = r.name
+	}
+	return fmt.Errorf("rollback of batch %d stopped at '%s', leaving %s applied: %w", batchID, names[0], strings.Join(names, ", "), err)
+}
+
+// ErrBatchOutOfRange is returned by Rollback when asked to roll back fewer than
+// one batch, or more batches than have been applied
+var ErrBatchOutOfRange = errors.New("number of batches to roll back is out of range")
+
+// Rollback rolls back the last n batches of migrations, running each
+// migration's down and deleting its status record. Rolling back 1 undoes the
+// most recent batch.
+func Rollback(db DBTX, numBatches int, force bool, logger *log.Logger) error {
+	return RollbackContext(context.Background(), db, numBatches, force, logger)
+}
+
+// RollbackContext is like Rollback, but stops at the next statement once ctx
+// is done
+func RollbackContext(ctx context.Context, db DBTX, numBatches int, force bool, logger *log.Logger) error {
+	return defaultMigrator(db, logger).RollbackContext(ctx, numBatches, force)
+}
+
+// RollbackFrom rolls back the last n batches using the provided migration set
+// instead of the registry, e.g. the slice produced by moogration-gen.
+func RollbackFrom(db DBTX, migrations []Migration, numBatches int, force bool, logger *log.Logger) error {
+	return New(db, WithRegistry(registryOf(migrations)), WithLogger(logger)).Rollback(numBatches, force)
+}
+
+// Rollback rolls back the last n batches of migrations, running each
+// migration's down and deleting its status record. If groups are configured,
+// each group's last n batches are rolled back. It returns
+// ErrBatchOutOfRange, without rolling anything back, if n is less than one or
+// more than the number of applied batches.
+func (mg *Migrator) Rollback(numBatches int, force bool) error {
+	return mg.RollbackContext(context.Background(), numBatches, force)
+}
+
+// RollbackContext is like Rollback, but stops at the next statement once ctx
+// is done
+func (mg *Migrator) RollbackContext(ctx context.Context, numBatches int, force bool) error {
+	_, err := mg.RollbackReportContext(ctx, numBatches, force)
+	return err
+}
+
+// RollbackReportContext is like RollbackReport, with a context
+func (mg *Migrator) RollbackReportContext(ctx context.Context, numBatches int, force bool) (Result, error) {
+	return mg.withRunHooks(ctx, "rollback", "down", func(ctx context.Context) (Result, error) {
+		return mg.rollbackReport(ctx, numBatches, force)
+	})
+}
+
+func (mg *Migrator) rollbackReport(ctx context.Context, numBatches int, force bool) (result Result, err error) {
+	if len(mg.groups) > 0 {
+		result = Result{Applied: []MigrationResult{}, Skipped: []SkippedMigration{}}
+		err = mg.eachGroup(func(sub *Migrator) error {
+			subResult, err := sub.rollbackReport(ctx, numBatches, force)
+			result.merge(subResult)
+			return err
+		})
+		return result, err
+	}
+
+	state := mg.newRunState()
+	if mg.dryRun {
+		plan, err := mg.PlanRollbackContext(ctx, numBatches, force)
+		logPlan(mg.logger, plan)
+		return *state.result, err
+	}
+	if mg.dualWrite != nil {
+		return *state.result, ErrDualWriteRollback
+	}
+
+	defer recoverPanic(&err, state)
+	locked := true
+	err = mg.withLock(ctx, func(mg *Migrator) error {
+		locked = false
+		return mg.rollback(ctx, numBatches, force, state)
+	})
+	state.result.Locked = locked && err == nil
+	return *state.result, err
+}
+
+func (mg *Migrator) rollback(ctx context.Context, numBatches int, force bool, state *runState) error {
+	err := mg.guard(ctx, true, force)
+	if err != nil {
+		return err
+	}
+	err = mg.confirmDown(ctx, force, func() ([]Migration, error) {
+		plan, err := mg.PlanRollbackContext(ctx, numBatches, force)
+		return mg.plannedMigrations(plan), err
+	})
+	if err != nil {
+		return err
+	}
+	err = mg.dropStaleScratch(ctx)
+	if err != nil {
+		return err
+	}
+	err = mg.checkDirty(ctx)
+	if err != nil {
+		return err
+	}
+
+	var batches []int
+	err = mg.withRetry(ctx, "reading the tracking table", func() (err error) {
+		batches, err = mg.allBatches(ctx)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	for i := 0; i < numBatches; i++ {
-		batch := batches[i]
-		err := rollbackOneBatch(db, batch, force, logger)
+	caps, err := mg.DetectCapabilitiesContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = checkBatchCount(numBatches, len(batches))
+	if err != nil {
+		return err
+	}
+
+	var plan []PlannedMigration
+	if mg.approve != nil {
+		plan, err = mg.PlanRollbackContext(ctx, numBatches, force)
+		if err != nil {
+			return err
+		}
+	}
+
+	migrations := mg.registry.snapshot()
+	for _, batch := range batches[:numBatches] {
+		var before int
+		if state.result != nil {
+			before = len(state.result.Applied)
+		}
+		if mg.approve != nil {
+			batchPlan := []PlannedMigration{}
+			for _, p := range plan {
+				if p.Batch == batch {
+					batchPlan = append(batchPlan, p)
+				}
+			}
+			err := mg.requestApproval(ctx, "rollback", true, batch, batchPlan)
+			if err != nil {
+				return err
+			}
+		}
+		err := mg.rollbackOneBatch(ctx, migrations, batch, force, caps, state)
 		if err != nil {
 			return err
 		}
-		if selectedDriver == sqlite {
-			time.Sleep(time.Second)
+		err = mg.checkBatch(ctx, batch)
+		if err != nil {
+			return err
+		}
+		if state.result != nil {
+			mg.afterBatch(ctx, "rollback", true, batch, state.result.Applied[before:])
+		}
+		if mg.driver == sqlite {
+			err = sleep(ctx, time.Second)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	return nil
+	return state.failed()
 }
 
 // RunLatest runs all migrations that have not been run since the last migration
-func RunLatest(db *sql.DB, down, force bool, logger *log.Logger) {
-	err := createMigrationTable(db)
-	if err != nil {
-		panic(err)
-	}
+func RunLatest(db DBTX, down, force bool, logger *log.Logger) error {
+	return RunLatestContext(context.Background(), db, down, force, logger)
+}
 
-	lastBatch, err := latestBatch(db)
+// RunLatestContext is like RunLatest, but stops at the next statement once ctx
+// is done. A migration interrupted by ctx is rolled back where the dialect
+// supports transactional DDL. On MySQL and Postgres, with db a pool such as
+// *sql.DB, the statement running when ctx is done is also cancelled on the
+// server; see WithMigrationTimeout.
+func RunLatestContext(ctx context.Context, db DBTX, down, force bool, logger *log.Logger) error {
+	return defaultMigrator(db, logger).RunLatestContext(ctx, down, force)
+}
+
+// MustRunLatest is like RunLatest but panics if an error occurs, for callers
+// that treat a failed migration as fatal
+func MustRunLatest(db DBTX, down, force bool, logger *log.Logger) {
+	err := RunLatest(db, down, force, logger)
 	if err != nil {
-		err := fmt.Errorf("failed to determine last-run batch number: %w", err)
 		panic(err)
 	}
+}
 
-	currentBatch := lastBatch + 1
+// RunLatestFrom behaves like RunLatest, but runs the provided migration set
+// instead of the registry. The slice is not modified.
+func RunLatestFrom(db DBTX, migrations []Migration, down, force bool, logger *log.Logger) error {
+	return New(db, WithRegistry(registryOf(migrations)), WithLogger(logger)).RunLatest(down, force)
+}
 
-	// sort migrations to run in order of creation
-	sort.Slice(registeredMigrations, func(i, j int) bool {
-		// if running down migrations, sort descending
-		if down {
-			return registeredMigrations[i].Name > registeredMigrations[j].Name
+// RunLatest runs all registered migrations that have not been run. If groups
+// are configured, each group runs on its own connection and tracking table:
+// ungrouped migrations first, then each group in name order.
+func (mg *Migrator) RunLatest(down, force bool) error {
+	return mg.RunLatestContext(context.Background(), down, force)
+}
+
+// RunLatestContext is like RunLatest, but stops at the next statement once ctx
+// is done. On MySQL and Postgres, with a pool, the statement running when ctx
+// is done is also cancelled on the server; see WithMigrationTimeout.
+func (mg *Migrator) RunLatestContext(ctx context.Context, down, force bool) error {
+	_, err := mg.RunLatestReportContext(ctx, down, force)
+	return err
+}
+
+// RunLatestReportContext is like RunLatestReport, with a context
+func (mg *Migrator) RunLatestReportContext(ctx context.Context, down, force bool) (Result, error) {
+	return mg.withRunHooks(ctx, "run", direction(down), func(ctx context.Context) (Result, error) {
+		return mg.runLatestReport(ctx, down, force)
+	})
+}
+
+func (mg *Migrator) runLatestReport(ctx context.Context, down, force bool) (result Result, err error) {
+	if len(mg.groups) > 0 {
+		result = Result{Applied: []MigrationResult{}, Skipped: []SkippedMigration{}}
+		err = mg.eachGroup(func(sub *Migrator) error {
+			subResult, err := sub.runLatestReport(ctx, down, force)
+			result.merge(subResult)
+			return err
+		})
+		return result, err
+	}
+
+	state := mg.newRunState()
+	if mg.dryRun {
+		plan, err := mg.PlanLatestContext(ctx, down)
+		logPlan(mg.logger, plan)
+		return *state.result, err
+	}
+	if mg.rehearse && !down {
+		err = mg.runRehearsal(ctx, force)
+		if err != nil {
+			return *state.result, err
 		}
-		return registeredMigrations[i].Name < registeredMigrations[j].Name
+	}
 
+	defer recoverPanic(&err, state)
+	locked := true
+	err = mg.withLock(ctx, func(mg *Migrator) error {
+		locked = false
+		return mg.runLatest(ctx, mg.registry.snapshot(), down, force, state)
 	})
+	state.result.Locked = locked && err == nil
+	return *state.result, err
+}
+
+func (mg *Migrator) runLatest(ctx context.Context, migrations []Migration, down, force bool, state *runState) error {
+	logger := mg.logger
+
+	state.set("", "setup")
+	var primary *runTarget
+	err := mg.withRetry(ctx, "reading the tracking table", func() (err error) {
+		primary, err = mg.prepareTarget(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	targets := []*runTarget{primary}
+	if mg.dualWrite != nil {
+		mirror := mg.mirror()
+		var target *runTarget
+		err := mg.withRetry(ctx, "reading the dual-write tracking table", func() (err error) {
+			target, err = mirror.prepareTarget(ctx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("dual-write target: %w", err)
+		}
+		targets = append(targets, target)
+	}
+
+	err = mg.guard(ctx, down, force)
+	if err != nil {
+		return err
+	}
+	err = mg.dropStaleScratch(ctx)
+	if err != nil {
+		return err
+	}
+	err = mg.checkDirty(ctx)
+	if err != nil {
+		return err
+	}
+
+	migrations, pending, excluded := mg.planRun(migrations, primary.applied, down)
+	for _, m := range excluded {
+		if logger != nil {
+			logger.Printf("migrate :: skipping %s: excluded by tags", m.Name)
+		}
+		if state.result != nil {
+			state.result.Skipped = append(state.result.Skipped, SkippedMigration{Name: m.Name, Reason: "excluded by tags"})
+		}
+	}
 
 	if logger != nil {
-		logger.Printf("%d registered migrations", len(registeredMigrations))
+		logger.Printf("%d registered migrations", len(migrations))
+	}
+
+	if down {
+		err = mg.confirmDown(ctx, force, func() ([]Migration, error) {
+			return pending, nil
+		})
+	} else {
+		err = mg.checkAppVersion(pending)
+	}
+	if err != nil {
+		return err
+	}
+
+	if mg.permissionPrecheck {
+		state.set("", "permission precheck")
+		pending := []Migration{}
+		for _, m := range migrations {
+			if _, hasRun := primary.applied[m.Name]; hasRun == down {
+				pending = append(pending, m)
+			}
+		}
+		missing, err := mg.missingPrivileges(ctx, pending, down)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return &PermissionError{Missing: missing}
+		}
+	}
+
+	if mg.approve != nil {
+		plan := make([]PlannedMigration, len(pending))
+		for i, m := range pending {
+			plan[i] = PlannedMigration{Name: m.Name, Direction: direction(down), Batch: primary.batch, SQL: m.query(down)}
+		}
+		err = mg.requestApproval(ctx, "run", down, primary.batch, plan)
+		if err != nil {
+			return err
+		}
 	}
 
-	for _, m := range registeredMigrations {
+	var before, ran int
+	if state.result != nil {
+		before = len(state.result.Applied)
+	}
+	for _, m := range migrations {
 		// check if migration has been run or changed
-		hasRun, hasChanged := m.migrationStatus(db)
-		if hasRun && !down {
+		dbHash, hasRun := primary.applied[m.Name]
+		err := checkDiverged(m, targets)
+		if err != nil {
+			return err
+		}
+		hasChanged := hasRun && !m.matchesHash(dbHash)
+		if hasRun && !down && !m.reapplies(dbHash) {
 			continue
 		}
 
-		if hasChanged {
+		if !hasRun && !down && len(m.Squashes) > 0 {
+			adopt, err := mg.checkSquash(m, primary.applied)
+			if err != nil {
+				return err
+			}
+			if adopt {
+				for _, t := range targets {
+					err = t.mg.adoptSquash(ctx, m, t.batch)
+					if err != nil {
+						return err
+					}
+				}
+				if state.result != nil {
+					state.result.Skipped = append(state.result.Skipped, SkippedMigration{Name: m.Name, Reason: "recorded as applied: the migrations it squashes are applied"})
+				}
+				continue
+			}
+		}
+
+		if hasChanged && !m.Repeatable {
 			if !force {
 				if logger != nil {
 					logger.Printf("WARNING: migration '%s' has changed since last run - migrations should not be edited for live databases!", m.Name)
@@ -316,16 +926,314 @@ func RunLatest(db *sql.DB, down, force bool, logger *log.Logger) {
 			}
 		}
 
-		err := m.run(down, db, logger)
+		err = mg.execute(ctx, m, down, primary.batch, primary.caps, state)
+		if mg.skipFailure(m, err, state) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ran++
+		for _, t := range targets[1:] {
+			// the primary's run state has already paced this migration
+			err = t.mg.execute(ctx, m, down, t.batch, t.caps, &runState{})
+			if err != nil {
+				return fmt.Errorf("dual-write target: %w", err)
+			}
+		}
+	}
+
+	if ran > 0 {
+		err = mg.checkBatch(ctx, primary.batch)
 		if err != nil {
-			if force {
-				if logger != nil {
-					logger.Printf("ERROR: migration '%s' failed. '%s'", m.Name, err.Error())
+			return err
+		}
+	}
+	if state.result != nil {
+		mg.afterBatch(ctx, "run", down, primary.batch, state.result.Applied[before:])
+	}
+	return state.failed()
+}
+
+// runTarget is the state of one database a run applies migrations to
+type runTarget struct {
+	mg      *Migrator
+	batch   int
+	caps    Capabilities
+	applied map[string]string
+}
+
+// prepareTarget creates the Migrator's tracking table if needed and loads
+// what a run needs to know about its database
+func (mg *Migrator) prepareTarget(ctx context.Context) (*runTarget, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lastBatch, err := mg.latestBatch(ctx)
+	if err != nil {
+		err := fmt.Errorf("failed to determine last-run batch number: %w", err)
+		return nil, err
+	}
+
+	caps, err := mg.DetectCapabilitiesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		err := fmt.Errorf("failed to load migration statuses: %w", err)
+		return nil, err
+	}
+	err = mg.upgradeHashes(ctx, applied)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runTarget{mg: mg, batch: lastBatch + 1, caps: caps, applied: applied}, nil
+}
+
+// execute runs a migration and records its new status. Where the dialect
+// supports transactional DDL, both happen in one transaction, so a failed
+// migration leaves neither partial schema changes nor a status record.
+// A failed migration's error is a *migrationFailure.
+func (mg *Migrator) execute(ctx context.Context, m Migration, down bool, batch int, caps Capabilities, state *runState) error {
+	if state.throttle != nil {
+		err := state.throttle.wait(ctx, mg)
+		if err != nil {
+			return err
+		}
+	}
+	state.set(m.Name, direction(down))
+
+	if mg.shadow && !down {
+		err := mg.loadFixtures(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mg.constraintPrecheck && !down {
+		err := mg.precheckConstraints(ctx, m)
+		if err != nil {
+			return err
+		}
+	}
+
+	event := MigrationEvent{Migration: m, Direction: direction(down), Batch: batch}
+	mg.hooks.beforeMigration(ctx, event)
+	spanCtx, span := mg.startSpan(ctx, m.Name,
+		Attribute{AttrMigrationName, m.Name},
+		Attribute{AttrDirection, direction(down)},
+		Attribute{AttrBatch, batch},
+	)
+	migrationCtx, scratch := mg.withScratch(spanCtx)
+	stopWarning := mg.warnWhileRunning(m, down)
+	start := time.Now()
+	var rows int64
+	var runErr, err error
+	mg.withRetry(ctx, fmt.Sprintf("migration '%s'", m.Name), func() error {
+		rows, runErr, err = mg.apply(migrationCtx, m, down, batch, caps, state)
+		if errors.As(err, new(*notApplied)) {
+			return err
+		}
+		return nil
+	})
+	event.Duration = time.Since(start)
+	stopWarning()
+	if dropErr := mg.dropScratch(ctx, scratch); dropErr != nil && err == nil {
+		err = dropErr
+	}
+	event.RowsAffected = rows
+	event.Err = err
+	if err == nil {
+		event.Err = runErr
+	}
+	endSpan(span, event.Err, Attribute{AttrRowsAffected, rows})
+	mg.hooks.afterMigration(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	if state.result != nil {
+		mr := MigrationResult{
+			Name:         m.Name,
+			Direction:    direction(down),
+			Batch:        batch,
+			Duration:     event.Duration,
+			RowsAffected: rows,
+			Err:          runErr,
+		}
+		if runErr == nil || errors.Is(runErr, ErrDirty) {
+			state.result.Applied = append(state.result.Applied, mr)
+		} else {
+			state.result.Failed = &mr
+		}
+	}
+	if runErr != nil {
+		return runErr
+	}
+	return mg.checkVisible(ctx, m, down)
+}
+
+// apply runs a migration and records its status, in a transaction if the
+// dialect and migration allow it. A failed migration is returned as runErr,
+// without its status recorded, unless MarkDirty records it as dirty because
+// it didn't run in a transaction. rows is the number of
+// rows affected by the statements of a SQL migration.
+func (mg *Migrator) apply(ctx context.Context, m Migration, down bool, batch int, caps Capabilities, state *runState) (rows int64, runErr error, err error) {
+	var db DBTX = mg.db
+	var tx *sql.Tx
+	if m.ForeignKeysOff && mg.driver == sqlite {
+		// foreign keys can only be turned off outside a transaction
+		restore, err := mg.foreignKeysOff(ctx)
+		if err != nil {
+			return 0, nil, &notApplied{fmt.Errorf("migration '%s': %w", m.Name, err)}
+		}
+		defer restore()
+	}
+
+	// the timeout bounds the migration's own statements, so it can still be
+	// recorded as dirty. stop cancels runCtx, so it is deferred before the
+	// transaction's rollback to run after it.
+	runCtx, stop := mg.runContext(ctx, m)
+	defer stop()
+	transactional := caps.TransactionalDDL && !m.NoTransaction || m.fn(down) != nil
+	if transactional && !m.SkipReplication {
+		tx, err = begin(ctx, mg.db)
+		if err != nil {
+			return 0, nil, &notApplied{fmt.Errorf("error starting transaction for migration '%s': %w", m.Name, err)}
+		}
+		if tx != nil {
+			db = tx
+			// rolls back if the migration panics; a no-op once committed
+			defer tx.Rollback()
+		}
+	}
+	if tx == nil && !m.SkipReplication && mg.cancelsStatements() {
+		// pinned, so the statement running when runCtx is cancelled can be
+		// cancelled on the server
+		conn, release, err := session(ctx, mg.db)
+		if err != nil {
+			return 0, nil, &notApplied{fmt.Errorf("error reserving connection for migration '%s': %w", m.Name, err)}
+		}
+		defer release(false)
+		db = conn
+	}
+	if !m.SkipReplication {
+		err = mg.watchSession(runCtx, db)
+		if err != nil {
+			return 0, nil, &notApplied{fmt.Errorf("migration '%s': %w", m.Name, err)}
+		}
+	}
+
+	start := time.Now()
+	err = func() (err error) {
+		// a panic fails the migration like an error, so it is rolled back or
+		// recorded as dirty
+		defer recoverPanic(&err, state)
+		if m.SkipReplication {
+			return mg.runWithoutReplication(runCtx, m, down)
+		}
+		if m.fn(down) != nil {
+			return m.run(runCtx, down, db, mg)
+		}
+		counter := &rowCounter{execer: db}
+		defer func() { rows = counter.rows }()
+		return m.run(runCtx, down, counter, mg)
+	}()
+	endSession(runCtx)
+	if err == nil && m.ForeignKeysOff && mg.driver == sqlite {
+		err = checkIntegrity(runCtx, db)
+		if err != nil {
+			err = fmt.Errorf("error running migration '%s' (%s): %w", m.Name, strings.ToUpper(direction(down)), err)
+		}
+	}
+	if err != nil && errors.Is(context.Cause(runCtx), context.DeadlineExceeded) && ctx.Err() == nil {
+		err = fmt.Errorf("%w: %w after %s", err, ErrMigrationTimeout, mg.timeout(m))
+	}
+	if err != nil {
+		partial := tx == nil
+		if tx != nil {
+			tx.Rollback()
+		}
+		// a panic leaves a migration outside a transaction in an unknown
+		// state, whatever the failure policy
+		var panicked *PanicError
+		if partial && (mg.failurePolicy == MarkDirty || errors.As(err, &panicked)) {
+			dirtyErr := mg.markDirty(ctx, m, down, batch)
+			if dirtyErr != nil {
+				return 0, nil, fmt.Errorf("%w (%w)", err, dirtyErr)
+			}
+			err = fmt.Errorf("%w: %w", err, ErrDirty)
+		}
+		return rows, &migrationFailure{err: err}, nil
+	}
+
+	state.set(m.Name, "status update")
+	took := time.Since(start)
+	if tx != nil {
+		err = mg.setMigrationStatus(ctx, db, m, down, batch, took)
+		if err == nil && mg.driver == sqlite {
+			// the heartbeat can't be written while the transaction holds the
+			// database, so the lease is renewed as the migration commits. A
+			// failed statement doesn't abort a SQLite transaction.
+			leaseErr := mg.renewLease(ctx, db)
+			if leaseErr != nil && mg.logger != nil {
+				mg.logger.Printf("migrate :: failed to renew lease of lock '%s': %s", mg.lockName(), leaseErr)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, nil, &notApplied{err}
+		}
+	} else {
+		attempted := false
+		err = mg.withRetry(ctx, fmt.Sprintf("recording migration '%s'", m.Name), func() error {
+			if attempted && !down {
+				// a failed attempt may have written the record, labels or
+				// follow-ups before failing, or the record may have reached
+				// the database before its connection was lost. Clearing them
+				// first keeps a retry from duplicating them.
+				err := mg.setMigrationStatus(ctx, db, m, true, batch, took)
+				if err != nil {
+					return err
 				}
-			} else {
-				panic(err)
 			}
+			attempted = true
+			return mg.setMigrationStatus(ctx, db, m, down, batch, took)
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if tx != nil {
+		err = tx.Commit()
+		if err != nil {
+			return 0, nil, fmt.Errorf("error committing migration '%s': %w", m.Name, err)
 		}
-		m.setMigrationStatus(down, db, currentBatch)
 	}
+	return rows, runErr, nil
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func direction(down bool) string {
+	if down {
+		return "down"
+	}
+	return "up"
 }
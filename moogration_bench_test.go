@@ -0,0 +1,165 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+/*
+Benchmarks are run at several registry sizes so planner overhead can be
+tracked as a migration set grows:
+
+	go test -run '^$' -bench . -benchmem
+
+Each benchmark reports ns/migration alongside the standard metrics.
+*/
+
+var benchmarkSizes = []int{10, 100, 1000, 10000}
+
+// generate n numbered migrations each creating its own table
+func benchmarkMigrations(n int) []Migration {
+	migrations := make([]Migration, n)
+	for i := range migrations {
+		table := fmt.Sprintf("bench_table_%05d", i)
+		migrations[i] = Migration{
+			Name: fmt.Sprintf("%05d_create_%s", i, table),
+			Up: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				string TEXT
+			);`, table),
+			Down: fmt.Sprintf(`DROP TABLE IF EXISTS %s;`, table),
+		}
+	}
+	return migrations
+}
+
+// swap in a registry for the duration of a benchmark
+func withRegistry(b *testing.B, migrations []Migration) {
+	previous := defaultRegistry
+	defaultRegistry = NewRegistry()
+	defaultRegistry.migrations = migrations
+	b.Cleanup(func() {
+		defaultRegistry = previous
+	})
+}
+
+func getBenchSQLiteDB(b *testing.B) *sql.DB {
+	UseSQLite()
+	conn, err := sql.Open("sqlite", filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal("failed opening benchmark database", err)
+	}
+	b.Cleanup(func() { conn.Close() })
+
+	err = New(conn).createMigrationTable(context.Background())
+	if err != nil {
+		b.Fatal("failed creating migration table", err)
+	}
+	return conn
+}
+
+func reportPerMigration(b *testing.B, n int) {
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/migration")
+}
+
+func BenchmarkRegister(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		migrations := benchmarkMigrations(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			withRegistry(b, nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				defaultRegistry = NewRegistry()
+				for _, m := range migrations {
+					Register(m)
+				}
+			}
+			reportPerMigration(b, n)
+		})
+	}
+}
+
+func BenchmarkHash(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 16, 1 << 20} {
+		m := Migration{
+			Name: "001_large_migration",
+			Up:   strings.Repeat("x", size),
+			Down: strings.Repeat("y", size),
+		}
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.SetBytes(int64(2 * size))
+			for i := 0; i < b.N; i++ {
+				_ = m.hash()
+			}
+		})
+	}
+}
+
+func BenchmarkStatusPrefetch(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			db := getBenchSQLiteDB(b)
+			withRegistry(b, benchmarkMigrations(n))
+			err := RunLatest(db, false, false, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := New(db).appliedHashes(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportPerMigration(b, n)
+		})
+	}
+}
+
+// replaying an up-to-date registry measures pure planner overhead
+func BenchmarkRunLatestNoop(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			db := getBenchSQLiteDB(b)
+			withRegistry(b, benchmarkMigrations(n))
+			err := RunLatest(db, false, false, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := RunLatest(db, false, false, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportPerMigration(b, n)
+		})
+	}
+}
+
+func BenchmarkFullReplay(b *testing.B) {
+	for _, n := range benchmarkSizes[:3] {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			withRegistry(b, benchmarkMigrations(n))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db := getBenchSQLiteDB(b)
+				b.StartTimer()
+				err := RunLatest(db, false, false, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportPerMigration(b, n)
+		})
+	}
+}
@@ -1,13 +1,17 @@
 package moogration
 
 import (
+	"bytes"
+	"context"
 	"log"
+	"strings"
 	"testing"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 func TestMigrationStatus(t *testing.T) {
+	withEmptyRegistry(t)
 	db, teardown := getTestMySQLDB(t)
 	defer teardown()
 
@@ -21,35 +25,40 @@ func TestMigrationStatus(t *testing.T) {
 		Down: `DROP TABLE IF EXISTS test_table;`,
 	}
 
-	hasRun, hasChanged := testMigration.migrationStatus(db)
+	hasRun, hasChanged, err := New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, false, hasRun)
 	assertEquals(t, false, hasChanged)
 
 	Register(testMigration)
-	RunLatest(db, false, false, log.Default())
+	assertOk(t, RunLatest(db, false, false, log.Default()))
 
-	hasRun, hasChanged = testMigration.migrationStatus(db)
+	hasRun, hasChanged, err = New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, true, hasRun)
 	assertEquals(t, false, hasChanged)
 
 	// alter migration, check that hasChanged flips
 	testMigration.Down = "DROP TABLE test_table;"
 
-	hasRun, hasChanged = testMigration.migrationStatus(db)
+	hasRun, hasChanged, err = New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, true, hasRun)
 	assertEquals(t, true, hasChanged)
 
 	// run down migration
-	RunLatest(db, true, false, log.Default())
-	hasRun, hasChanged = testMigration.migrationStatus(db)
+	assertOk(t, RunLatest(db, true, false, log.Default()))
+	hasRun, hasChanged, err = New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, false, hasRun)
 	assertEquals(t, false, hasChanged)
 }
 
 func TestMySQLMigrationLatestBatch(t *testing.T) {
+	withEmptyRegistry(t)
 	db, teardown := getTestMySQLDB(t)
 	defer teardown()
-	initialLatestBatch, err := latestBatch(db)
+	initialLatestBatch, err := New(db).latestBatch(context.Background())
 	assertOk(t, err)
 	assertEquals(t, 0, initialLatestBatch)
 
@@ -65,14 +74,15 @@ func TestMySQLMigrationLatestBatch(t *testing.T) {
 
 	Register(testMigration)
 
-	RunLatest(db, false, false, log.Default())
+	assertOk(t, RunLatest(db, false, false, log.Default()))
 
-	afterLatestBatch, err := latestBatch(db)
+	afterLatestBatch, err := New(db).latestBatch(context.Background())
 	assertOk(t, err)
 	assertEquals(t, 1, afterLatestBatch)
 }
 
 func TestMySQLRollback(t *testing.T) {
+	withEmptyRegistry(t)
 	db, teardown := getTestMySQLDB(t)
 	defer teardown()
 
@@ -97,23 +107,44 @@ func TestMySQLRollback(t *testing.T) {
 	}
 
 	Register(testMigration1)
-	RunLatest(db, false, false, log.Default())
+	assertOk(t, RunLatest(db, false, false, log.Default()))
 
 	Register(testMigration2)
-	RunLatest(db, false, false, log.Default())
+	assertOk(t, RunLatest(db, false, false, log.Default()))
 
 	// rollback 1
 	err := Rollback(db, 1, false, log.Default())
 	assertOk(t, err)
 
-	currentBatch, err := latestBatch(db)
+	currentBatch, err := New(db).latestBatch(context.Background())
 	assertOk(t, err)
 
 	assertEquals(t, 1, currentBatch)
 
-	hasRun2, _ := testMigration2.migrationStatus(db)
+	hasRun2, _, err := New(db).migrationStatus(context.Background(), testMigration2)
+	assertOk(t, err)
 	assertEquals(t, false, hasRun2)
 
-	hasRun1, _ := testMigration1.migrationStatus(db)
+	hasRun1, _, err := New(db).migrationStatus(context.Background(), testMigration1)
+	assertOk(t, err)
 	assertEquals(t, true, hasRun1)
 }
+
+func TestMySQLGenerateScript(t *testing.T) {
+	withEmptyRegistry(t)
+	db, teardown := getTestMySQLDB(t)
+	defer teardown()
+
+	trigger := "CREATE TRIGGER script_note_upper BEFORE INSERT ON script_note FOR EACH ROW\nBEGIN\n\tSET NEW.note = UPPER(NEW.note);\nEND"
+	m := New(db, WithMySQL())
+	m.Register(Migration{
+		Name: "001_create_script_note",
+		Up:   "CREATE TABLE script_note (id INT AUTO_INCREMENT PRIMARY KEY, note VARCHAR(255));\nDELIMITER //\n" + trigger + " //\nDELIMITER ;\n",
+		Down: `DROP TABLE script_note;`,
+	})
+
+	// the trigger's body keeps its semicolons for the mysql client
+	var script bytes.Buffer
+	assertOk(t, m.GenerateScript(&script, ScriptOptions{}))
+	assertEquals(t, true, strings.Contains(script.String(), "-- migration: 001_create_script_note\nCREATE TABLE script_note (id INT AUTO_INCREMENT PRIMARY KEY, note VARCHAR(255));\nDELIMITER $$\n"+trigger+" $$\nDELIMITER ;\n"))
+}
@@ -15,12 +15,23 @@ object structure
 */
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"database/sql"
+	sqldriver "database/sql/driver"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -47,7 +58,7 @@ func getTestSQLiteDB(t *testing.T, name string) (*sql.DB, func()) {
 		t.FailNow()
 	}
 
-	err = createMigrationTable(conn)
+	err = New(conn).createMigrationTable(context.Background())
 	if err != nil {
 		t.Log("failed creating migration table", err)
 		t.FailNow()
@@ -68,6 +79,7 @@ func getTestSQLiteDB(t *testing.T, name string) (*sql.DB, func()) {
 }
 
 func TestSQLiteMigrationStatus(t *testing.T) {
+	withEmptyRegistry(t)
 	db, teardown := getTestSQLiteDB(t, "migration_status_test")
 	defer teardown()
 
@@ -80,35 +92,40 @@ func TestSQLiteMigrationStatus(t *testing.T) {
 		Down: `DROP TABLE IF EXISTS test_table;`,
 	}
 
-	hasRun, hasChanged := testMigration.migrationStatus(db)
+	hasRun, hasChanged, err := New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, false, hasRun)
 	assertEquals(t, false, hasChanged)
 
 	Register(testMigration)
-	RunLatest(db, false, false, log.Default())
+	assertOk(t, RunLatest(db, false, false, log.Default()))
 
-	hasRun, hasChanged = testMigration.migrationStatus(db)
+	hasRun, hasChanged, err = New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, true, hasRun)
 	assertEquals(t, false, hasChanged)
 
 	// alter migration, check that hasChanged flips
 	testMigration.Down = "DROP TABLE test_table;"
 
-	hasRun, hasChanged = testMigration.migrationStatus(db)
+	hasRun, hasChanged, err = New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, true, hasRun)
 	assertEquals(t, true, hasChanged)
 
 	// run down migration
-	RunLatest(db, true, false, log.Default())
-	hasRun, hasChanged = testMigration.migrationStatus(db)
+	assertOk(t, RunLatest(db, true, false, log.Default()))
+	hasRun, hasChanged, err = New(db).migrationStatus(context.Background(), testMigration)
+	assertOk(t, err)
 	assertEquals(t, false, hasRun)
 	assertEquals(t, false, hasChanged)
 }
 
 func TestMigrationLatestBatch(t *testing.T) {
+	withEmptyRegistry(t)
 	db, teardown := getTestSQLiteDB(t, "latest_batch_test")
 	defer teardown()
-	initialLatestBatch, err := latestBatch(db)
+	initialLatestBatch, err := New(db).latestBatch(context.Background())
 	assertOk(t, err)
 	assertEquals(t, 0, initialLatestBatch)
 
@@ -123,14 +140,15 @@ func TestMigrationLatestBatch(t *testing.T) {
 
 	Register(testMigration)
 
-	RunLatest(db, false, false, log.Default())
+	assertOk(t, RunLatest(db, false, false, log.Default()))
 
-	afterLatestBatch, err := latestBatch(db)
+	afterLatestBatch, err := New(db).latestBatch(context.Background())
 	assertOk(t, err)
 	assertEquals(t, 1, afterLatestBatch)
 }
 
 func TestSQLiteRollback(t *testing.T) {
+	withEmptyRegistry(t)
 	db, teardown := getTestSQLiteDB(t, "rollback_test")
 	defer teardown()
 
@@ -152,22 +170,3236 @@ func TestSQLiteRollback(t *testing.T) {
 		Down: `DROP TABLE IF EXISTS test_table2;`,
 	}
 
-	Register(testMigration1, testMigration2)
-
-	RunLatest(db, false, false, log.Default())
+	// Rollback(db, 1) rolls back exactly the latest batch, so the
+	// migrations run in separate batches for it to leave the first applied
+	Register(testMigration1)
+	assertOk(t, RunLatest(db, false, false, log.Default()))
+	Register(testMigration2)
+	assertOk(t, RunLatest(db, false, false, log.Default()))
 
 	// rollback 1
 	err := Rollback(db, 1, false, log.Default())
 	assertOk(t, err)
 
-	currentBatch, err := latestBatch(db)
+	currentBatch, err := New(db).latestBatch(context.Background())
 	assertOk(t, err)
 
 	assertEquals(t, 1, currentBatch)
 
-	hasRun2, _ := testMigration2.migrationStatus(db)
+	hasRun2, _, err := New(db).migrationStatus(context.Background(), testMigration2)
+	assertOk(t, err)
 	assertEquals(t, false, hasRun2)
 
-	hasRun1, _ := testMigration1.migrationStatus(db)
+	hasRun1, _, err := New(db).migrationStatus(context.Background(), testMigration1)
+	assertOk(t, err)
 	assertEquals(t, true, hasRun1)
 }
+
+func TestSQLiteVerifyComplete(t *testing.T) {
+	withEmptyRegistry(t)
+	db, teardown := getTestSQLiteDB(t, "verify_complete_test")
+	defer teardown()
+
+	testMigration1 := Migration{
+		Name: "001_test_migration1",
+		Up:   `CREATE TABLE IF NOT EXISTS test_table1 (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS test_table1;`,
+	}
+	testMigration2 := Migration{
+		Name: "002_test_migration2",
+		Up:   `CREATE TABLE IF NOT EXISTS test_table2 (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS test_table2;`,
+	}
+
+	MustRegister(testMigration1, testMigration2)
+	assertOk(t, RunLatest(db, false, false, nil))
+	assertOk(t, VerifyComplete(db, 2))
+
+	err := VerifyComplete(db, 3)
+	assertEquals(t, true, err != nil)
+
+	// simulate a migration package that is no longer imported
+	defaultRegistry.migrations = defaultRegistry.migrations[:1]
+	err = VerifyComplete(db, 1)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, true, strings.Contains(err.Error(), "002_test_migration2"))
+}
+
+func TestSQLiteDetectCapabilities(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "capabilities_test")
+	defer teardown()
+
+	caps, err := DetectCapabilities(db)
+	assertOk(t, err)
+	assertEquals(t, true, caps.MultiStatements)
+	assertEquals(t, true, caps.TransactionalDDL)
+	assertEquals(t, false, caps.AdvisoryLocks)
+}
+
+func TestSQLiteIndependentMigrators(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "independent_migrators_test")
+	defer teardown()
+
+	app := New(db, WithSQLite(), WithTableName("app_migration"))
+	app.Register(Migration{
+		Name: "001_create_app_table",
+		Up:   `CREATE TABLE IF NOT EXISTS app_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS app_table;`,
+	})
+
+	audit := New(db, WithSQLite(), WithTableName("audit_migration"))
+	audit.Register(Migration{
+		Name: "001_create_audit_table",
+		Up:   `CREATE TABLE IF NOT EXISTS audit_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS audit_table;`,
+	})
+
+	assertOk(t, app.RunLatest(false, false))
+	assertOk(t, audit.RunLatest(false, false))
+
+	appApplied, err := app.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(appApplied))
+	_, ok := appApplied["001_create_app_table"]
+	assertEquals(t, true, ok)
+
+	auditApplied, err := audit.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(auditApplied))
+	_, ok = auditApplied["001_create_audit_table"]
+	assertEquals(t, true, ok)
+}
+
+func TestSQLiteGroupRouting(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "group_routing_test")
+	defer teardown()
+
+	m := New(db, WithSQLite(), WithGroup("billing", GroupConfig{TableName: "billing_migration"}))
+	m.Register(
+		Migration{
+			Name: "001_create_app_table",
+			Up:   `CREATE TABLE IF NOT EXISTS app_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+			Down: `DROP TABLE IF EXISTS app_table;`,
+		},
+		Migration{
+			Name:  "002_create_invoice_table",
+			Group: "billing",
+			Up:    `CREATE TABLE IF NOT EXISTS invoice_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+			Down:  `DROP TABLE IF EXISTS invoice_table;`,
+		},
+	)
+	assertOk(t, m.RunLatest(false, false))
+
+	appApplied, err := New(db, WithSQLite()).appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(appApplied))
+
+	billingApplied, err := New(db, WithSQLite(), WithTableName("billing_migration")).appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(billingApplied))
+	_, ok := billingApplied["002_create_invoice_table"]
+	assertEquals(t, true, ok)
+}
+
+func TestSQLiteTransactionalMigration(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "transactional_migration_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_half_applied",
+		Up: `CREATE TABLE half_applied (id INTEGER PRIMARY KEY AUTOINCREMENT);
+			INSERT INTO missing_table (id) VALUES (1);`,
+		Down: `DROP TABLE IF EXISTS half_applied;`,
+	})
+	err := m.RunLatest(false, false)
+	assertEquals(t, true, err != nil)
+
+	// neither the table nor a status record should remain
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'half_applied'`).Scan(&count)
+	assertOk(t, err)
+	assertEquals(t, 0, count)
+
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 0, len(applied))
+}
+
+func TestSQLiteStrictMode(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "strict_mode_test")
+	defer teardown()
+
+	testMigration := Migration{
+		Name: "001_create_strict_table",
+		Up:   `CREATE TABLE IF NOT EXISTS strict_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS strict_table;`,
+	}
+
+	m := New(db, WithSQLite(), WithStrict())
+	m.Register(testMigration)
+
+	assertEquals(t, ErrStrictForce, m.RunLatest(false, true))
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, ErrStrictDown, m.RunLatest(true, false))
+	assertEquals(t, ErrStrictDown, m.Rollback(1, false))
+
+	confirmed := New(db, WithSQLite(), WithStrict(), WithDownConfirmation(testMigration.Name))
+	confirmed.Register(testMigration)
+	assertOk(t, confirmed.RunLatest(true, false))
+
+	skipping := New(db, WithSQLite(), WithStrict(), WithFailurePolicy(SkipAndContinue))
+	skipping.Register(testMigration)
+	assertEquals(t, ErrStrictSkip, skipping.RunLatest(false, false))
+
+	// operations that rewrite the tracking table without running migrations
+	// are refused
+	operations := map[string]func() error{
+		"RepairHashes": func() error { _, err := m.RepairHashes(); return err },
+		"Baseline":     func() error { _, err := m.Baseline(testMigration.Name); return err },
+		"Prune":        func() error { _, err := m.Prune(0); return err },
+		"Squash":       func() error { _, err := m.Squash("002_squashed"); return err },
+		"LoadSchema":   func() error { return m.LoadSchema(strings.NewReader(dumpHeader + "sqlite\n")) },
+		"ResolveDirty": func() error { return m.ResolveDirty(testMigration.Name, true) },
+	}
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			assertEquals(t, true, errors.Is(operation(), ErrStrict))
+		})
+	}
+}
+
+func TestSQLiteRunLatestContextCancelled(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "context_cancelled_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_create_cancelled_table",
+		Up:   `CREATE TABLE IF NOT EXISTS cancelled_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS cancelled_table;`,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := m.RunLatestContext(ctx, false, false)
+	assertEquals(t, true, errors.Is(err, context.Canceled))
+
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 0, len(applied))
+}
+
+func TestSQLiteLock(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "lock_test")
+	defer teardown()
+
+	testMigration := Migration{
+		Name: "001_create_locked_table",
+		Up:   `CREATE TABLE IF NOT EXISTS locked_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS locked_table;`,
+	}
+
+	holder := New(db, WithSQLite(), WithLock(0))
+	unlock, err := holder.acquireLock(context.Background())
+	assertOk(t, err)
+
+	var logs bytes.Buffer
+	waiting := New(db, WithSQLite(), WithLock(400*time.Millisecond), WithLockReportInterval(100*time.Millisecond), WithLogger(log.New(&logs, "", 0)))
+	waiting.Register(testMigration)
+	err = waiting.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrLocked))
+	var locked *LockedError
+	assertEquals(t, true, errors.As(err, &locked))
+	host, _ := os.Hostname()
+	assertEquals(t, host, locked.Holder.Host)
+	assertEquals(t, os.Getpid(), locked.Holder.PID)
+	assertEquals(t, true, strings.Contains(logs.String(), "is held by "+host))
+	assertEquals(t, true, strings.Contains(logs.String(), "still waiting for lock"))
+
+	skipping := New(db, WithSQLite(), WithLockSkip())
+	skipping.Register(testMigration)
+	assertOk(t, skipping.RunLatest(false, false))
+	applied, err := skipping.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 0, len(applied))
+
+	unlock()
+	assertOk(t, waiting.RunLatest(false, false))
+	applied, err = waiting.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(applied))
+}
+
+func TestSQLiteDualWrite(t *testing.T) {
+	primary, teardownPrimary := getTestSQLiteDB(t, "dual_write_primary_test")
+	defer teardownPrimary()
+	target, teardownTarget := getTestSQLiteDB(t, "dual_write_target_test")
+	defer teardownTarget()
+
+	testMigration1 := Migration{
+		Name: "001_create_dual_table",
+		Up:   `CREATE TABLE IF NOT EXISTS dual_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS dual_table;`,
+	}
+	testMigration2 := Migration{
+		Name: "002_create_other_dual_table",
+		Up:   `CREATE TABLE IF NOT EXISTS other_dual_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS other_dual_table;`,
+	}
+
+	m := New(primary, WithSQLite(), WithDualWrite(target))
+	m.Register(testMigration1)
+	assertOk(t, m.RunLatest(false, false))
+
+	targetApplied, err := New(target, WithSQLite()).appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(targetApplied))
+	assertEquals(t, ErrDualWriteRollback, m.Rollback(1, false))
+
+	// apply the next migration to the primary alone, so the two diverge
+	alone := New(primary, WithSQLite())
+	alone.Register(testMigration1, testMigration2)
+	assertOk(t, alone.RunLatest(false, false))
+
+	m.Register(testMigration2)
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrDiverged))
+}
+
+func TestSQLiteCheck(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "check_test")
+	defer teardown()
+
+	testMigration := Migration{
+		Name: "001_create_checked_table",
+		Up:   `CREATE TABLE IF NOT EXISTS checked_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS checked_table;`,
+	}
+	applied := New(db, WithSQLite())
+	applied.Register(testMigration, Migration{Name: "002_removed", Up: `SELECT 1;`, Down: `SELECT 1;`})
+	assertOk(t, applied.RunLatest(false, false))
+
+	edited := testMigration
+	edited.SetUp(`CREATE TABLE IF NOT EXISTS checked_table (id INTEGER PRIMARY KEY);`)
+	m := New(db, WithSQLite())
+	m.Register(edited)
+
+	findings, err := m.Check()
+	assertOk(t, err)
+	assertEquals(t, 2, len(findings))
+	assertEquals(t, SeverityError, findings[0].Severity)
+	assertEquals(t, true, strings.HasSuffix(findings[0].File, "moogration_sqlite_test.go"))
+	assertEquals(t, true, findings[0].Line > 0)
+	assertEquals(t, SeverityWarning, findings[1].Severity)
+	assertEquals(t, "002_removed", findings[1].Migration)
+}
+
+func TestSQLiteMigrateTo(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "migrate_to_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	for _, name := range []string{"001_first", "002_second", "003_third", "004_fourth"} {
+		m.Register(Migration{
+			Name: name,
+			Up:   fmt.Sprintf(`CREATE TABLE IF NOT EXISTS t%s (id INTEGER PRIMARY KEY AUTOINCREMENT);`, name),
+			Down: fmt.Sprintf(`DROP TABLE IF EXISTS t%s;`, name),
+		})
+	}
+
+	assertEquals(t, true, m.MigrateTo("005_missing") != nil)
+
+	assertOk(t, m.MigrateTo("002_second"))
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 2, len(applied))
+
+	assertOk(t, m.MigrateTo("004_fourth"))
+	applied, err = m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 4, len(applied))
+
+	assertOk(t, m.MigrateTo("001_first"))
+	applied, err = m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(applied))
+	_, ok := applied["001_first"]
+	assertEquals(t, true, ok)
+}
+
+func TestSQLiteRollbackRunbook(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "runbook_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_create_runbook_table",
+		Up:   `CREATE TABLE IF NOT EXISTS runbook_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS runbook_table;`,
+	})
+	assertOk(t, m.RunLatest(false, false))
+
+	m.Register(Migration{
+		Name:     "002_add_runbook_column",
+		Up:       `ALTER TABLE runbook_table ADD COLUMN note TEXT;`,
+		Down:     `ALTER TABLE runbook_table DROP COLUMN note;`,
+		Estimate: 2 * time.Second,
+	}, Migration{
+		Name:           "003_purge_runbook_rows",
+		Up:             `DELETE FROM runbook_table;`,
+		ManualRollback: "Restore runbook_table from the pre-deploy backup.",
+	})
+
+	rb, err := m.RollbackRunbook()
+	assertOk(t, err)
+	assertEquals(t, 2, rb.Batch)
+	assertEquals(t, "001_create_runbook_table", rb.Previous)
+	assertEquals(t, 2, len(rb.Steps))
+	assertEquals(t, "003_purge_runbook_rows", rb.Steps[0].Migration)
+	assertEquals(t, true, rb.Steps[0].Irreversible)
+	assertEquals(t, false, rb.Steps[1].Irreversible)
+
+	var buf strings.Builder
+	assertOk(t, rb.WriteMarkdown(&buf))
+	assertEquals(t, true, strings.Contains(buf.String(), "Restore runbook_table from the pre-deploy backup."))
+	assertEquals(t, true, strings.Contains(buf.String(), "ALTER TABLE runbook_table DROP COLUMN note;"))
+}
+
+func TestSQLiteStatus(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "status_test")
+	defer teardown()
+
+	testMigration1 := Migration{
+		Name: "001_create_status_table",
+		Up:   `CREATE TABLE IF NOT EXISTS status_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS status_table;`,
+	}
+	testMigration2 := Migration{
+		Name: "002_add_status_column",
+		Up:   `ALTER TABLE status_table ADD COLUMN note TEXT;`,
+		Down: `ALTER TABLE status_table DROP COLUMN note;`,
+	}
+	applied := New(db, WithSQLite())
+	applied.Register(testMigration1, Migration{Name: "000_removed", Up: `SELECT 1;`, Down: `SELECT 1;`})
+	assertOk(t, applied.RunLatest(false, false))
+
+	edited := testMigration1
+	edited.SetDown(`DROP TABLE status_table;`)
+	m := New(db, WithSQLite())
+	m.Register(edited, testMigration2)
+
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, 3, len(statuses))
+
+	assertEquals(t, "000_removed", statuses[0].Name)
+	assertEquals(t, false, statuses[0].Registered)
+	assertEquals(t, true, statuses[0].Applied)
+
+	assertEquals(t, true, statuses[1].Applied)
+	assertEquals(t, 1, statuses[1].Batch)
+	assertEquals(t, false, statuses[1].MigratedAt.IsZero())
+	assertEquals(t, true, statuses[1].Changed)
+
+	assertEquals(t, false, statuses[2].Applied)
+	assertEquals(t, true, statuses[2].Registered)
+
+	// the recorded hash of an unregistered migration, and the registered
+	// hash otherwise
+	assertEquals(t, Migration{Up: `SELECT 1;`, Down: `SELECT 1;`}.hash(), statuses[0].Hash)
+	assertEquals(t, edited.hash(), statuses[1].Hash)
+}
+
+func TestSQLiteBlastRadius(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "blast_radius_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_create_accounts",
+		Up:   `CREATE TABLE IF NOT EXISTS accounts (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS accounts;`,
+	})
+	assertOk(t, m.RunLatest(false, false))
+
+	m.Register(Migration{
+		Name: "002_add_account_email",
+		Up:   `ALTER TABLE accounts ADD COLUMN email TEXT; CREATE TABLE audit (id INTEGER PRIMARY KEY);`,
+		Down: `ALTER TABLE accounts DROP COLUMN email; DROP TABLE audit;`,
+	})
+
+	impacts, err := m.BlastRadius([]string{"accounts"})
+	assertOk(t, err)
+	assertEquals(t, 2, len(impacts))
+	assertEquals(t, "002_add_account_email", impacts[0].Migration)
+	assertEquals(t, RiskHigh, impacts[0].Risk)
+	assertEquals(t, RiskLow, impacts[1].Risk)
+	assertEquals(t, 1, len(HighRisk(impacts)))
+}
+
+func TestSQLitePlan(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "plan_test")
+	defer teardown()
+	_, err := db.Exec("DROP TABLE migration")
+	assertOk(t, err)
+
+	testMigration1 := Migration{
+		Name: "001_create_plan_table",
+		Up:   `CREATE TABLE IF NOT EXISTS plan_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS plan_table;`,
+	}
+	testMigration2 := Migration{
+		Name: "002_add_plan_column",
+		Up:   `ALTER TABLE plan_table ADD COLUMN note TEXT;`,
+		Down: `ALTER TABLE plan_table DROP COLUMN note;`,
+	}
+
+	dry := New(db, WithSQLite(), WithDryRun())
+	dry.Register(testMigration1, testMigration2)
+	plan, err := dry.PlanLatest(false)
+	assertOk(t, err)
+	assertEquals(t, 2, len(plan))
+	assertEquals(t, "001_create_plan_table", plan[0].Name)
+	assertEquals(t, testMigration1.Up, plan[0].SQL)
+
+	// a dry run writes nothing, not even the tracking table
+	assertOk(t, dry.RunLatest(false, false))
+	exists, err := dry.tableExists(context.Background())
+	assertOk(t, err)
+	assertEquals(t, false, exists)
+
+	m := New(db, WithSQLite())
+	m.Register(testMigration1)
+	assertOk(t, m.RunLatest(false, false))
+	m.Register(testMigration2)
+	assertOk(t, m.RunLatest(false, false))
+
+	plan, err = m.PlanRollback(1, false)
+	assertOk(t, err)
+	assertEquals(t, 1, len(plan))
+	assertEquals(t, "002_add_plan_column", plan[0].Name)
+	assertEquals(t, "down", plan[0].Direction)
+	assertEquals(t, 2, plan[0].Batch)
+
+	assertOk(t, dry.Rollback(1, false))
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 2, len(applied))
+}
+
+func TestSQLiteConstraintPrecheck(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "constraint_precheck_test")
+	defer teardown()
+
+	m := New(db, WithSQLite(), WithConstraintPrecheck())
+	m.Register(Migration{
+		Name: "001_create_members",
+		Up: `CREATE TABLE IF NOT EXISTS members (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT);
+			INSERT INTO members (email) VALUES ('a@example.com'), ('a@example.com'), ('b@example.com');`,
+		Down: `DROP TABLE IF EXISTS members;`,
+	})
+	assertOk(t, m.RunLatest(false, false))
+
+	m.Register(Migration{
+		Name: "002_unique_member_email",
+		Up:   `CREATE UNIQUE INDEX members_email ON members (email);`,
+		Down: `DROP INDEX members_email;`,
+	})
+
+	checks, err := m.PrecheckConstraints()
+	assertOk(t, err)
+	assertEquals(t, 1, len(checks))
+	assertOk(t, checks[0].Err)
+	assertEquals(t, int64(2), checks[0].Violations)
+
+	err = m.RunLatest(false, false)
+	var violation *ConstraintViolationError
+	assertEquals(t, true, errors.As(err, &violation))
+	assertEquals(t, "002_unique_member_email", violation.Checks[0].Migration)
+}
+
+func TestSQLiteGoMigration(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "go_migration_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_create_names",
+		Up: `CREATE TABLE IF NOT EXISTS names (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, upper TEXT);
+			INSERT INTO names (name) VALUES ('ada'), ('grace');`,
+		Down: `DROP TABLE IF EXISTS names;`,
+	}, Migration{
+		Name:    "002_backfill_upper",
+		Version: "1",
+		UpFunc: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `UPDATE names SET upper = UPPER(name)`)
+			return err
+		},
+		DownFunc: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `UPDATE names SET upper = NULL`)
+			return err
+		},
+	}, Migration{
+		Name:    "003_failing_backfill",
+		Version: "1",
+		UpFunc: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `UPDATE names SET name = 'changed'`)
+			if err != nil {
+				return err
+			}
+			return errors.New("backfill failed")
+		},
+	})
+
+	err := m.RunLatest(false, false)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, true, strings.Contains(err.Error(), "backfill failed"))
+
+	var upper string
+	assertOk(t, db.QueryRow(`SELECT upper FROM names WHERE name = 'ada'`).Scan(&upper))
+	assertEquals(t, "ADA", upper)
+
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Applied)
+	assertEquals(t, false, statuses[2].Applied)
+
+	// bumping the version marks the Go migration as changed
+	bumped := New(db, WithSQLite())
+	bumped.Register(Migration{Name: "002_backfill_upper", Version: "2", UpFunc: m.registry.migrations[1].UpFunc})
+	statuses, err = bumped.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Changed)
+}
+
+func TestSQLiteRedo(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "redo_test")
+	defer teardown()
+
+	testMigration1 := Migration{
+		Name: "001_create_redo_table",
+		Up:   `CREATE TABLE IF NOT EXISTS redo_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS redo_table;`,
+	}
+	testMigration2 := Migration{
+		Name: "002_create_other_redo_table",
+		Up:   `CREATE TABLE IF NOT EXISTS other_redo_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS other_redo_table;`,
+	}
+	m := New(db, WithSQLite())
+	m.Register(testMigration1, testMigration2)
+	assertOk(t, m.RunLatest(false, false))
+
+	// edit the first migration during development
+	edited := testMigration1
+	edited.SetUp(`CREATE TABLE IF NOT EXISTS redo_table (id INTEGER PRIMARY KEY AUTOINCREMENT, note TEXT);`)
+	dev := New(db, WithSQLite())
+	dev.Register(edited, testMigration2)
+
+	assertEquals(t, true, dev.RollbackMigration("001_create_redo_table", false) != nil)
+	// strict mode refuses to accept the edit
+	strict := New(db, WithSQLite(), WithStrict())
+	strict.Register(edited, testMigration2)
+	assertEquals(t, true, errors.Is(strict.Redo("001_create_redo_table"), ErrStrict))
+	statuses, err := strict.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Changed)
+
+	assertOk(t, dev.Redo("001_create_redo_table"))
+
+	statuses, err = dev.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied)
+	assertEquals(t, false, statuses[0].Changed)
+	assertEquals(t, 1, statuses[0].Batch)
+	_, err = db.Exec(`INSERT INTO redo_table (note) VALUES ('redone')`)
+	assertOk(t, err)
+
+	assertOk(t, dev.RollbackMigration("001_create_redo_table", false))
+	statuses, err = dev.Status()
+	assertOk(t, err)
+	assertEquals(t, false, statuses[0].Applied)
+	assertEquals(t, true, statuses[1].Applied)
+}
+
+func TestSQLiteFollowUps(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "follow_ups_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_rename_legacy_column",
+		Up: `CREATE TABLE IF NOT EXISTS follow_table (id INTEGER PRIMARY KEY AUTOINCREMENT, legacy TEXT, current TEXT);
+			CREATE TABLE IF NOT EXISTS follow_log (note TEXT);`,
+		Down: `DROP TABLE IF EXISTS follow_table; DROP TABLE IF EXISTS follow_log;`,
+		FollowUps: []FollowUp{
+			{Name: "log", SQL: `INSERT INTO follow_log (note) VALUES ('ran')`},
+			{Name: "drop_legacy", SQL: `ALTER TABLE follow_table DROP COLUMN legacy`, After: 7 * 24 * time.Hour},
+		},
+	})
+	assertOk(t, m.RunLatest(false, false))
+
+	pending, err := m.PendingFollowUps()
+	assertOk(t, err)
+	assertEquals(t, 2, len(pending))
+
+	assertOk(t, m.RunDueFollowUps())
+	assertOk(t, m.RunDueFollowUps())
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM follow_log`).Scan(&count))
+	assertEquals(t, 1, count)
+
+	pending, err = m.PendingFollowUps()
+	assertOk(t, err)
+	assertEquals(t, 1, len(pending))
+	assertEquals(t, "drop_legacy", pending[0].Name)
+
+	// rolling back cancels follow-ups that haven't run
+	assertOk(t, m.Rollback(1, false))
+	pending, err = m.PendingFollowUps()
+	assertOk(t, err)
+	assertEquals(t, 0, len(pending))
+}
+
+func TestSQLiteTableNameAndSchema(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "table_schema_test")
+	defer teardown()
+
+	SetTableName("schema_migrations")
+	SetSchema("main")
+	defer SetTableName(defaultTableName)
+	defer SetSchema("")
+
+	m := New(db, WithSQLite())
+	assertEquals(t, "main.schema_migrations", m.qualifiedTable())
+	m.Register(Migration{
+		Name: "001_create_schema_table",
+		Up:   `CREATE TABLE IF NOT EXISTS schema_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS schema_table;`,
+	})
+	assertOk(t, m.RunLatest(false, false))
+
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&count))
+	assertEquals(t, 1, count)
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, 0, count)
+
+	exists, err := m.tableExists(context.Background())
+	assertOk(t, err)
+	assertEquals(t, true, exists)
+}
+
+func TestSQLitePrune(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "prune_test")
+	defer teardown()
+
+	kept := Migration{
+		Name: "002_kept",
+		Up:   `CREATE TABLE IF NOT EXISTS kept_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS kept_table;`,
+	}
+	old := New(db, WithSQLite())
+	old.Register(Migration{Name: "001_squashed", Up: `SELECT 1;`, Down: `SELECT 1;`}, kept)
+	assertOk(t, old.RunLatest(false, false))
+
+	m := New(db, WithSQLite())
+	m.Register(kept)
+
+	// nothing is old enough yet
+	n, err := m.Prune(time.Hour)
+	assertOk(t, err)
+	assertEquals(t, 0, n)
+
+	n, err = m.Prune(-time.Hour)
+	assertOk(t, err)
+	assertEquals(t, 1, n)
+
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, 1, len(statuses))
+	assertEquals(t, "002_kept", statuses[0].Name)
+
+	var archived string
+	assertOk(t, db.QueryRow(`SELECT name FROM migration_archive`).Scan(&archived))
+	assertEquals(t, "001_squashed", archived)
+}
+
+func TestSQLiteDoctor(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "doctor_test")
+	defer teardown()
+
+	kept := Migration{
+		Name: "001_kept",
+		Up:   `CREATE TABLE IF NOT EXISTS kept_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS kept_table;`,
+	}
+	old := New(db, WithSQLite())
+	old.Register(kept, Migration{Name: "002_removed", Up: `SELECT 1;`, Down: `SELECT 1;`})
+	assertOk(t, old.RunLatest(false, false))
+
+	m := New(db, WithSQLite())
+	m.Register(kept)
+
+	failed := map[string]Diagnostic{}
+	for _, d := range m.Doctor() {
+		if !d.OK {
+			failed[d.Check] = d
+		}
+	}
+	assertEquals(t, 1, len(failed))
+	drift, ok := failed["drift"]
+	assertEquals(t, true, ok)
+	assertEquals(t, "applied but not registered: 002_removed", drift.Detail)
+
+	// the permissions check cleans up after itself
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'migration_doctor'`).Scan(&count))
+	assertEquals(t, 0, count)
+}
+
+func TestSQLiteMultiStatementMigration(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "split_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_counted_posts",
+		Up: `
+			CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT);
+			CREATE TABLE post_count (n INTEGER);
+			INSERT INTO post_count (n) VALUES (0);
+			-- keep the count current; the trigger body has its own semicolons
+			CREATE TRIGGER post_counted AFTER INSERT ON post BEGIN
+				UPDATE post_count SET n = n + 1;
+			END;
+			INSERT INTO post (title) VALUES ('first; with a semicolon');
+		`,
+		Down: `DROP TRIGGER post_counted; DROP TABLE post_count; DROP TABLE post;`,
+	})
+	assertOk(t, m.RunLatest(false, false))
+
+	var n int
+	assertOk(t, db.QueryRow(`SELECT n FROM post_count`).Scan(&n))
+	assertEquals(t, 1, n)
+
+	assertOk(t, m.Rollback(1, false))
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name IN ('post', 'post_count', 'post_counted')`).Scan(&count))
+	assertEquals(t, 0, count)
+}
+
+func TestSQLiteVerifyAndRepairHashes(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "verify_test")
+	defer teardown()
+
+	original := Migration{Name: "001_edited", Up: `SELECT 1;`, Down: `SELECT 1;`}
+	untouched := Migration{Name: "002_untouched", Up: `SELECT 2;`, Down: `SELECT 2;`}
+	old := New(db, WithSQLite())
+	old.Register(original, untouched, Migration{Name: "003_removed", Up: `SELECT 3;`, Down: `SELECT 3;`})
+	assertOk(t, old.RunLatest(false, false))
+
+	edited := original
+	edited.Up = `SELECT 1 AS one;`
+	m := New(db, WithSQLite())
+	m.Register(edited, untouched, Migration{Name: "004_pending", Up: `SELECT 4;`, Down: `SELECT 4;`})
+
+	report, err := m.Verify()
+	assertOk(t, err)
+	assertEquals(t, false, report.OK())
+	assertEquals(t, "002_untouched", strings.Join(report.Verified, ","))
+	assertEquals(t, 1, len(report.Changed))
+	assertEquals(t, "001_edited", report.Changed[0].Name)
+	assertEquals(t, original.hash(), report.Changed[0].Stored)
+	assertEquals(t, edited.hash(), report.Changed[0].Current)
+	assertEquals(t, "003_removed", strings.Join(report.Unregistered, ","))
+	assertEquals(t, "004_pending", strings.Join(report.Pending, ","))
+
+	_, err = m.RepairHashes("004_pending")
+	assertEquals(t, true, err != nil)
+
+	repaired, err := m.RepairHashes("001_edited")
+	assertOk(t, err)
+	assertEquals(t, 1, len(repaired))
+
+	report, err = m.Verify()
+	assertOk(t, err)
+	assertEquals(t, true, report.OK())
+	assertEquals(t, "001_edited,002_untouched", strings.Join(report.Verified, ","))
+}
+
+func TestSQLiteLegacyHashUpgrade(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "hash_upgrade_test")
+	defer teardown()
+
+	unchanged := Migration{Name: "001_unchanged", Up: `SELECT 1;`, Down: `SELECT 1;`}
+	changed := Migration{Name: "002_changed", Up: `SELECT 2;`, Down: `SELECT 2;`}
+	// rows as recorded by versions that hashed with MD5
+	_, err := db.Exec(`INSERT INTO migration (name, batch, sql_hash) VALUES (?, 1, ?), (?, 1, ?)`,
+		unchanged.Name, unchanged.legacyHash(), changed.Name, changed.legacyHash())
+	assertOk(t, err)
+
+	recorded := changed.legacyHash()
+	changed.Up = `SELECT 2 AS two;`
+	m := New(db, WithSQLite())
+	m.Register(unchanged, changed)
+
+	report, err := m.Verify()
+	assertOk(t, err)
+	assertEquals(t, "001_unchanged", strings.Join(report.Verified, ","))
+	assertEquals(t, 1, len(report.Changed))
+
+	assertOk(t, m.RunLatest(false, false))
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, unchanged.hash(), applied[unchanged.Name])
+	assertEquals(t, true, strings.HasPrefix(applied[unchanged.Name], "sha256:"))
+	// an edited migration keeps its old hash, so the edit is still detected
+	assertEquals(t, recorded, applied[changed.Name])
+}
+
+func TestSQLiteEditedCopyHash(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "edited_copy_test")
+	defer teardown()
+
+	r := NewRegistry()
+	r.Register(Migration{Name: "001_create_bin", Up: `CREATE TABLE bin (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE bin;`})
+
+	// a copy handed out by the registry carries its cached hash, which is
+	// recomputed once the copy is edited and passed back in
+	copies := r.Migrations()
+	copies[0].Up = `CREATE TABLE bin (id INTEGER PRIMARY KEY, label TEXT);`
+	assertOk(t, RunLatestFrom(db, copies, false, false, nil))
+	applied, err := New(db, WithSQLite()).appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, copies[0].computeHash(), applied["001_create_bin"])
+
+	bundle, err := NewBundle(copies)
+	assertOk(t, err)
+	_, err = bundle.Registry()
+	assertOk(t, err)
+}
+
+func TestSQLiteLabels(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "labels_test")
+	defer teardown()
+
+	var buf bytes.Buffer
+	m := New(db, WithSQLite(), WithLogger(log.New(&buf, "", 0)), WithLabels(Labels{"service": "billing", "team": "payments"}))
+	m.Register(Migration{Name: "001_labeled", Up: `SELECT 1;`, Down: `SELECT 1;`, Labels: Labels{"team": "platform"}})
+	assertOk(t, m.RunLatest(false, false))
+	m.Register(Migration{Name: "002_pending", Up: `SELECT 2;`, Down: `SELECT 2;`})
+	assertEquals(t, true, strings.Contains(buf.String(), "migrate :: UP :: 001_labeled [service=billing team=platform]"))
+
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, "service=billing team=platform", statuses[0].Labels.String())
+	assertEquals(t, "service=billing team=payments", statuses[1].Labels.String())
+
+	assertOk(t, m.Rollback(1, false))
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration_label`).Scan(&count))
+	assertEquals(t, 0, count)
+}
+
+func TestSQLiteRunAllInTx(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "tx_test")
+	defer teardown()
+	_, err := db.Exec(`DROP TABLE migration`)
+	assertOk(t, err)
+
+	m := New(nil, WithSQLite(), WithoutTags("dev"))
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_seed_post", Up: `INSERT INTO post (id) VALUES (1);`, Down: `DELETE FROM post;`},
+		Migration{Name: "003_seed_dev_post", Up: `INSERT INTO post (id) VALUES (2);`, Down: `DELETE FROM post WHERE id = 2;`, Tags: []string{"dev"}},
+	)
+
+	tx, err := db.Begin()
+	assertOk(t, err)
+	assertOk(t, m.RunAllInTx(tx))
+
+	// the dev-only migration is excluded by tags
+	var count int
+	assertOk(t, tx.QueryRow(`SELECT COUNT(*) FROM post`).Scan(&count))
+	assertEquals(t, 1, count)
+	assertOk(t, tx.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, 2, count)
+
+	// running again in the same transaction finds nothing pending
+	assertOk(t, m.RunAllInTx(tx))
+	assertOk(t, tx.Rollback())
+
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name IN ('post', 'migration')`).Scan(&count))
+	assertEquals(t, 0, count)
+
+	tx, err = db.Begin()
+	assertOk(t, err)
+	defer tx.Rollback()
+	assertEquals(t, ErrNoTransactionalDDL, New(nil, WithMySQL()).RunAllInTx(tx))
+}
+
+func TestSQLiteRunReport(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "report_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE comment;`},
+	)
+
+	result, err := m.RunLatestReport(false, false)
+	assertOk(t, err)
+	assertEquals(t, 2, len(result.Applied))
+	assertEquals(t, "001_create_post", result.Applied[0].Name)
+	assertEquals(t, "up", result.Applied[0].Direction)
+	assertEquals(t, 1, result.Applied[1].Batch)
+
+	// nothing pending
+	result, err = m.RunLatestReport(false, false)
+	assertOk(t, err)
+	assertEquals(t, 0, len(result.Applied))
+
+	// a record no longer registered is skipped by rollback
+	_, err = db.Exec(`INSERT INTO migration (name, batch, sql_hash) VALUES ('003_removed', 1, '')`)
+	assertOk(t, err)
+	result, err = m.RollbackReport(1, false)
+	assertOk(t, err)
+	assertEquals(t, 2, len(result.Applied))
+	assertEquals(t, "down", result.Applied[0].Direction)
+	assertEquals(t, 1, len(result.Skipped))
+	assertEquals(t, "003_removed", result.Skipped[0].Name)
+
+	var summary bytes.Buffer
+	assertOk(t, result.WriteSummary(&summary))
+	if !strings.Contains(summary.String(), "2 migrations run") || !strings.Contains(summary.String(), "skip 003_removed: not registered") {
+		t.Fatalf("unexpected summary:\n%s", summary.String())
+	}
+}
+
+func TestSQLiteHooks(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "hooks_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_broken", Up: `CREATE TABLE;`, Down: `SELECT 1;`},
+	)
+
+	events := []string{}
+	m.OnBeforeRun(func(ctx context.Context, e RunEvent) {
+		events = append(events, fmt.Sprintf("before %s %s", e.Operation, e.Direction))
+	})
+	m.OnBeforeMigration(func(ctx context.Context, e MigrationEvent) {
+		events = append(events, fmt.Sprintf("before %s %s %d", e.Migration.Name, e.Direction, e.Batch))
+	})
+	m.OnAfterMigration(func(ctx context.Context, e MigrationEvent) {
+		events = append(events, fmt.Sprintf("after %s %s failed=%t", e.Migration.Name, e.Direction, e.Err != nil))
+	})
+	m.OnAfterRun(func(ctx context.Context, e RunEvent) {
+		events = append(events, fmt.Sprintf("after %s %s applied=%d failed=%t", e.Operation, e.Direction, len(e.Result.Applied), e.Err != nil))
+	})
+
+	err := m.RunLatest(false, false)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, strings.Join([]string{
+		"before run up",
+		"before 001_create_post up 1",
+		"after 001_create_post up failed=false",
+		"before 002_broken up 1",
+		"after 002_broken up failed=true",
+		"after run up applied=1 failed=true",
+	}, "\n"), strings.Join(events, "\n"))
+
+	events = events[:0]
+	assertOk(t, m.Rollback(1, false))
+	assertEquals(t, strings.Join([]string{
+		"before rollback down",
+		"before 001_create_post down 1",
+		"after 001_create_post down failed=false",
+		"after rollback down applied=1 failed=false",
+	}, "\n"), strings.Join(events, "\n"))
+}
+
+func TestSQLiteRollbackBatchRange(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "rollback_range_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`})
+	assertOk(t, m.RunLatest(false, false))
+	m.Register(Migration{Name: "002_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE comment;`})
+	assertOk(t, m.RunLatest(false, false))
+
+	for _, n := range []int{0, -1, 3} {
+		err := m.Rollback(n, false)
+		assertEquals(t, true, errors.Is(err, ErrBatchOutOfRange))
+		_, err = m.PlanRollback(n, false)
+		assertEquals(t, true, errors.Is(err, ErrBatchOutOfRange))
+	}
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, 2, count)
+
+	// 1 rolls back exactly the latest batch, deleting its status records
+	assertOk(t, m.Rollback(1, false))
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied)
+	assertEquals(t, false, statuses[1].Applied)
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, 1, count)
+
+	assertOk(t, m.Rollback(1, false))
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, 0, count)
+	assertEquals(t, true, errors.Is(m.Rollback(1, false), ErrBatchOutOfRange))
+}
+
+func TestSQLiteRollbackAllAndFresh(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "fresh_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	// nothing applied yet
+	assertOk(t, m.RollbackAll(false))
+
+	m.Register(Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`})
+	assertOk(t, m.RunLatest(false, false))
+	m.Register(Migration{Name: "002_seed_post", Up: `INSERT INTO post (id) VALUES (1);`, Down: `SELECT 1;`})
+	assertOk(t, m.RunLatest(false, false))
+	_, err := db.Exec(`INSERT INTO post (id) VALUES (2)`)
+	assertOk(t, err)
+
+	assertOk(t, m.Fresh(false))
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM post`).Scan(&count))
+	assertEquals(t, 1, count)
+	batches, err := m.allBatches(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(batches))
+
+	assertOk(t, m.RollbackAll(false))
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, 0, count)
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'post'`).Scan(&count))
+	assertEquals(t, 0, count)
+}
+
+func TestSQLiteAuditTriggers(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "audit_trigger_test")
+	defer teardown()
+
+	createPost := Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT);`, Down: `DROP TABLE post;`}
+	m := New(db, WithSQLite(), WithAudit(AuditTable{Name: "post", Columns: []string{"id", "title"}}))
+	m.Register(createPost)
+	// the repeatable audit migration runs after the table is created
+	assertOk(t, m.RunLatest(false, false))
+
+	_, err := db.Exec(`INSERT INTO post (id, title) VALUES (1, 'hello')`)
+	assertOk(t, err)
+	_, err = db.Exec(`UPDATE post SET title = 'hi' WHERE id = 1`)
+	assertOk(t, err)
+	var data string
+	assertOk(t, db.QueryRow(`SELECT row_data FROM post_history WHERE operation = 'UPDATE'`).Scan(&data))
+	assertEquals(t, `{"id":1,"title":"hi"}`, data)
+
+	// changing the columns re-applies the audit migration
+	m = New(db, WithSQLite(), WithAudit(AuditTable{Name: "post", Columns: []string{"id"}}))
+	m.Register(createPost)
+	report, err := m.Verify()
+	assertOk(t, err)
+	assertEquals(t, true, report.OK())
+	assertEquals(t, "audit_post", strings.Join(report.Pending, ","))
+	assertOk(t, m.RunLatest(false, false))
+
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration WHERE name = 'audit_post'`).Scan(&count))
+	assertEquals(t, 1, count)
+	_, err = db.Exec(`DELETE FROM post WHERE id = 1`)
+	assertOk(t, err)
+	assertOk(t, db.QueryRow(`SELECT row_data FROM post_history WHERE operation = 'DELETE'`).Scan(&data))
+	assertEquals(t, `{"id":1}`, data)
+
+	// rolling back drops the triggers and keeps the history
+	assertOk(t, m.Rollback(1, false))
+	_, err = db.Exec(`INSERT INTO post (id, title) VALUES (2, 'again')`)
+	assertOk(t, err)
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM post_history`).Scan(&count))
+	assertEquals(t, 3, count)
+
+	// a misconfigured table fails the run rather than New
+	m = New(db, WithSQLite(), WithAudit(AuditTable{Name: "comment"}))
+	err = m.RunLatest(false, false)
+	assertEquals(t, "audit table 'comment' needs Columns on sqlite", fmt.Sprint(err))
+}
+
+func TestSQLiteTags(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "tags_test")
+	defer teardown()
+
+	migrations := []Migration{
+		{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		{Name: "002_index_post", Up: `CREATE INDEX post_id ON post (id);`, Down: `DROP INDEX post_id;`, Tags: []string{"prod"}},
+		{Name: "003_fixture_post", Up: `INSERT INTO post (id) VALUES (1);`, Down: `DELETE FROM post;`, Tags: []string{"dev", "test"}},
+	}
+	m := New(db, WithSQLite(), WithTags("test"), WithoutTags("dev"))
+	m.Register(migrations...)
+	result, err := m.RunLatestReport(false, false)
+	assertOk(t, err)
+	assertEquals(t, 1, len(result.Applied))
+	assertEquals(t, "001_create_post", result.Applied[0].Name)
+	assertEquals(t, 2, len(result.Skipped))
+	assertEquals(t, "excluded by tags", result.Skipped[0].Reason)
+
+	m = New(db, WithSQLite(), WithTags("prod"))
+	m.Register(migrations...)
+	plan, err := m.PlanLatest(false)
+	assertOk(t, err)
+	assertEquals(t, 1, len(plan))
+	assertEquals(t, "002_index_post", plan[0].Name)
+
+	assertEquals(t, true, New(nil, WithTags("dev")).selected(migrations[2]))
+	assertEquals(t, true, New(nil).selected(migrations[2]))
+	assertEquals(t, true, New(nil, WithoutTags("dev")).selected(migrations[0]))
+}
+
+func TestSQLiteDBTXTransaction(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "dbtx_test")
+	defer teardown()
+
+	tx, err := db.Begin()
+	assertOk(t, err)
+	m := New(tx, WithSQLite(), WithLock(time.Second))
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{
+			Name: "002_seed_post",
+			UpFunc: func(ctx context.Context, tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `INSERT INTO post (id) VALUES (1)`)
+				return err
+			},
+			DownFunc: func(ctx context.Context, tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `DELETE FROM post`)
+				return err
+			},
+		},
+	)
+	assertOk(t, m.RunLatest(false, false))
+
+	var count int
+	assertOk(t, tx.QueryRow(`SELECT COUNT(*) FROM post`).Scan(&count))
+	assertEquals(t, 1, count)
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Applied)
+	assertEquals(t, true, m.Doctor()[0].OK)
+
+	assertOk(t, tx.Rollback())
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'post'`).Scan(&count))
+	assertEquals(t, 0, count)
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, 0, count)
+}
+
+type testSpanKey struct{}
+
+// testSpan records the spans started by testTracer
+type testSpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) { s.err = err }
+func (s *testSpan) End()                  { s.ended = true }
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &testSpan{name: name, attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(testSpanKey{}).(*testSpan); ok {
+		span.parent = parent.name
+	}
+	span.SetAttributes(attrs...)
+	tr.spans = append(tr.spans, span)
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func TestSQLiteTracing(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "tracing_test")
+	defer teardown()
+
+	tracer := &testTracer{}
+	m := New(db, WithSQLite(), WithTracer(tracer))
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY); INSERT INTO post (id) VALUES (1), (2);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_broken", Up: `CREATE TABLE;`, Down: `SELECT 1;`},
+	)
+
+	result, err := m.RunLatestReport(false, false)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, int64(2), result.Applied[0].RowsAffected)
+	assertEquals(t, 3, len(tracer.spans))
+
+	run, post, broken := tracer.spans[0], tracer.spans[1], tracer.spans[2]
+	assertEquals(t, "moogration.run", run.name)
+	assertEquals(t, "", run.parent)
+	assertEquals(t, "up", run.attrs[AttrDirection])
+	assertEquals(t, 1, run.attrs[AttrApplied])
+	assertEquals(t, true, run.err != nil && run.ended)
+
+	assertEquals(t, "001_create_post", post.name)
+	assertEquals(t, "moogration.run", post.parent)
+	assertEquals(t, "001_create_post", post.attrs[AttrMigrationName])
+	assertEquals(t, 1, post.attrs[AttrBatch])
+	assertEquals[interface{}](t, int64(2), post.attrs[AttrRowsAffected])
+	assertEquals(t, true, post.err == nil && post.ended)
+	assertEquals(t, true, broken.err != nil && broken.ended)
+
+	tracer.spans = nil
+	assertOk(t, m.Rollback(1, false))
+	assertEquals(t, 2, len(tracer.spans))
+	assertEquals(t, "moogration.rollback", tracer.spans[0].name)
+	assertEquals(t, "down", tracer.spans[1].attrs[AttrDirection])
+	assertEquals(t, "moogration.rollback", tracer.spans[1].parent)
+}
+
+func TestSQLiteScratchTables(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "scratch_test")
+	defer teardown()
+	ctx := context.Background()
+
+	// left behind by a crashed run, along with a table the prefix only
+	// matches as a LIKE pattern
+	_, err := db.Exec(`CREATE TABLE migration_scratch_stale (id INT); CREATE TABLE migrationXscratch_kept (id INT);`)
+	assertOk(t, err)
+
+	_, err = ScratchTable(ctx, db, "ids", "id INT")
+	assertEquals(t, true, errors.Is(err, ErrNoScratch))
+
+	tables := func() []string {
+		rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE '%scratch%' ORDER BY name`)
+		assertOk(t, err)
+		defer rows.Close()
+		names := []string{}
+		for rows.Next() {
+			var name string
+			assertOk(t, rows.Scan(&name))
+			names = append(names, name)
+		}
+		return names
+	}
+
+	// a run without the lock leaves them, as another run may be using them
+	assertOk(t, New(db, WithSQLite()).RunLatest(false, false))
+	assertEquals(t, "migrationXscratch_kept,migration_scratch_stale", strings.Join(tables(), ","))
+
+	m := New(db, WithSQLite(), WithLock(time.Second))
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY); INSERT INTO post (id) VALUES (1), (2);`, Down: `DROP TABLE post;`},
+		Migration{
+			Name: "002_backfill",
+			UpFunc: func(ctx context.Context, tx *sql.Tx) error {
+				table, err := ScratchTable(ctx, tx, "ids", "id INT PRIMARY KEY")
+				if err != nil {
+					return err
+				}
+				assertEquals(t, "migration_scratch_ids", table)
+				_, err = tx.ExecContext(ctx, "INSERT INTO "+table+" SELECT id FROM post")
+				return err
+			},
+			DownFunc: func(ctx context.Context, tx *sql.Tx) error {
+				_, err := ScratchTable(ctx, tx, "ids", "id INT")
+				if err != nil {
+					return err
+				}
+				return errors.New("down failed")
+			},
+		},
+	)
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, "migrationXscratch_kept", strings.Join(tables(), ","))
+
+	err = m.Rollback(1, false)
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "down failed"))
+	assertEquals(t, "migrationXscratch_kept", strings.Join(tables(), ","))
+}
+
+func TestSQLiteStaleLock(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "stale_lock_test")
+	defer teardown()
+	ctx := context.Background()
+
+	testMigration := Migration{
+		Name: "001_create_leased_table",
+		Up:   `CREATE TABLE IF NOT EXISTS leased_table (id INTEGER PRIMARY KEY AUTOINCREMENT);`,
+		Down: `DROP TABLE IF EXISTS leased_table;`,
+	}
+
+	// a holder renews its lease while it runs, and clears its record
+	leased := New(db, WithSQLite(), WithLockLease(150*time.Millisecond))
+	leased.recordLockHolder(ctx)
+	stop := leased.heartbeat()
+	time.Sleep(250 * time.Millisecond)
+	stop()
+	holder := leased.lockHolder(ctx)
+	assertEquals(t, 150*time.Millisecond, holder.Lease)
+	assertEquals(t, true, holder.HeartbeatAt.After(holder.AcquiredAt))
+	assertEquals(t, false, holder.stale(time.Now()))
+	unlock, err := leased.acquireLock(ctx)
+	assertOk(t, err)
+	unlock()
+	assertEquals(t, true, leased.lockHolder(ctx) == nil)
+
+	// a holder that crashed without releasing the lock
+	crash := func(m *Migrator) {
+		ok, err := m.tryLock(ctx, db)
+		assertOk(t, err)
+		assertEquals(t, true, ok)
+		m.recordLockHolder(ctx)
+		_, err = db.Exec("UPDATE migration_lock_holder SET heartbeat_at = ?", time.Now().Add(-time.Minute).UnixMilli())
+		assertOk(t, err)
+	}
+
+	var logs bytes.Buffer
+	crash(leased)
+	waiting := New(db, WithSQLite(), WithLock(0), WithLogger(log.New(&logs, "", 0)))
+	waiting.Register(testMigration)
+	assertOk(t, waiting.RunLatest(false, false))
+	assertEquals(t, true, strings.Contains(logs.String(), "AUDIT: taking over migration lock 'moogration:migration'"))
+	applied, err := waiting.appliedHashes(ctx)
+	assertOk(t, err)
+	assertEquals(t, 1, len(applied))
+
+	// without a lease, a holder is never stale, but its lock can be stolen
+	crash(New(db, WithSQLite()))
+	assertEquals(t, true, errors.Is(waiting.RunLatest(false, false), ErrLocked))
+
+	logs.Reset()
+	stealing := New(db, WithSQLite(), WithStealLock(), WithLogger(log.New(&logs, "", 0)))
+	stealing.Register(testMigration)
+	assertOk(t, stealing.RunLatest(false, false))
+	assertEquals(t, true, strings.Contains(logs.String(), "AUDIT: stealing migration lock"))
+}
+
+func TestSQLiteBaseline(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "baseline_test")
+	defer teardown()
+
+	// the schema of the first two migrations already exists
+	_, err := db.Exec(`CREATE TABLE user (id INTEGER PRIMARY KEY); CREATE TABLE post (id INTEGER PRIMARY KEY);`)
+	assertOk(t, err)
+
+	m := New(db, WithSQLite())
+	m.Register(
+		Migration{Name: "001_create_user", Up: `CREATE TABLE user (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE user;`},
+		Migration{Name: "002_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{Name: "003_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE comment;`},
+	)
+
+	_, err = m.Baseline("004_unknown")
+	assertEquals(t, true, err != nil)
+
+	baselined, err := m.Baseline("002_create_post")
+	assertOk(t, err)
+	assertEquals(t, "001_create_user,002_create_post", strings.Join(baselined, ","))
+	baselined, err = m.Baseline("002_create_post")
+	assertOk(t, err)
+	assertEquals(t, 0, len(baselined))
+
+	result, err := m.RunLatestReport(false, false)
+	assertOk(t, err)
+	assertEquals(t, 1, len(result.Applied))
+	assertEquals(t, "003_create_comment", result.Applied[0].Name)
+	assertEquals(t, 1, result.Applied[0].Batch)
+
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, 0, statuses[0].Batch)
+	assertEquals(t, false, statuses[0].Changed)
+
+	// baselined migrations aren't rolled back
+	assertOk(t, m.RollbackAll(false))
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 2, len(applied))
+	_, err = db.Exec(`SELECT id FROM post`)
+	assertOk(t, err)
+}
+
+func TestSQLiteRunLatestOrWait(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "run_or_wait_test")
+	defer teardown()
+
+	newReplica := func() *Migrator {
+		m := New(db, WithSQLite())
+		m.Register(Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`})
+		return m
+	}
+
+	// another replica holds the lock and never finishes
+	holder := New(db, WithSQLite(), WithLock(0))
+	unlock, err := holder.acquireLock(context.Background())
+	assertOk(t, err)
+	err = newReplica().RunLatestOrWait(0)
+	assertEquals(t, true, errors.Is(err, ErrNotReady))
+	assertEquals(t, true, strings.Contains(err.Error(), "starting with '001_create_post'"))
+
+	// the follower is ready once the holder has migrated
+	waited := make(chan error)
+	go func() {
+		waited <- newReplica().RunLatestOrWait(10 * time.Second)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// the holder's run, inside its lock
+	leader := newReplica()
+	assertOk(t, leader.runLatest(context.Background(), leader.registry.migrations, false, false, leader.newRunState()))
+	unlock()
+	assertOk(t, <-waited)
+
+	// with nothing holding the lock, a replica runs the migrations itself
+	assertOk(t, newReplica().Rollback(1, false))
+	assertOk(t, newReplica().RunLatestOrWait(0))
+	applied, err := holder.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(applied))
+}
+
+func TestSQLiteMigrationTimeout(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "migration_timeout_test")
+	defer teardown()
+
+	var logs bytes.Buffer
+	m := New(db, WithSQLite(), WithMigrationTimeout(time.Minute), WithSlowMigrationWarning(50*time.Millisecond), WithLogger(log.New(&logs, "", 0)))
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{
+			Name:    "002_hang",
+			Up:      `WITH RECURSIVE forever(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM forever) SELECT COUNT(*) FROM forever;`,
+			Down:    `SELECT 1;`,
+			Timeout: 300 * time.Millisecond,
+		},
+	)
+
+	start := time.Now()
+	err := m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrMigrationTimeout))
+	assertEquals(t, true, time.Since(start) < 10*time.Second)
+	assertEquals(t, true, strings.Contains(logs.String(), "WARNING :: UP :: 002_hang still running after"))
+
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(applied))
+}
+
+func TestSQLiteReadYourWrites(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "read_your_writes_test")
+	defer teardown()
+	// a replica that never catches up
+	stale, teardownStale := getTestSQLiteDB(t, "read_your_writes_stale_test")
+	defer teardownStale()
+
+	testMigration := Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`}
+
+	m := New(db, WithSQLite(), WithReadYourWrites(time.Second))
+	m.Register(testMigration)
+	assertOk(t, m.RunLatest(false, false))
+	assertOk(t, m.Rollback(1, false))
+
+	m = New(db, WithSQLite(), WithReadYourWrites(100*time.Millisecond, db, stale))
+	m.Register(testMigration)
+	err := m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrNotVisible))
+	assertEquals(t, true, strings.Contains(err.Error(), "migration '001_create_post' (up) on reader 2 after 100ms: status not yet recorded"))
+
+	// the migration itself was applied
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 1, len(applied))
+}
+
+func TestSQLiteValidateShadow(t *testing.T) {
+	createPost := Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`}
+
+	db, teardown := getTestSQLiteDB(t, "shadow_ok_test")
+	defer teardown()
+	m := New(nil, WithMySQL())
+	m.Register(createPost, Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`})
+	findings, err := m.ValidateShadow(db, WithSQLite())
+	assertOk(t, err)
+	assertEquals(t, 0, len(findings))
+
+	db, teardown = getTestSQLiteDB(t, "shadow_down_test")
+	defer teardown()
+	m = New(nil, WithSQLite())
+	m.Register(createPost, Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tags;`})
+	findings, err = m.ValidateShadow(db)
+	assertOk(t, err)
+	assertEquals(t, 1, len(findings))
+	assertEquals(t, "002_create_tag", findings[0].Migration)
+	assertEquals(t, true, strings.HasPrefix(findings[0].Message, "Down failed on the shadow database: "))
+	assertEquals(t, true, strings.HasSuffix(findings[0].File, "moogration_sqlite_test.go"))
+
+	// a Down that doesn't undo its Up
+	db, teardown = getTestSQLiteDB(t, "shadow_undo_test")
+	defer teardown()
+	m = New(nil, WithSQLite())
+	m.Register(createPost, Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `SELECT 1;`})
+	findings, err = m.ValidateShadow(db)
+	assertOk(t, err)
+	assertEquals(t, 1, len(findings))
+	assertEquals(t, true, strings.HasPrefix(findings[0].Message, "Up after Down failed on the shadow database: "))
+	assertEquals(t, true, strings.Contains(findings[0].Message, "already exists"))
+}
+
+func TestSQLiteAfterBatch(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "after_batch_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	events := []string{}
+	epoch := SchemaEpoch()
+	m.OnAfterBatch(func(ctx context.Context, e BatchEvent) {
+		epoch++
+		assertEquals(t, epoch, e.Epoch)
+		assertEquals(t, epoch, SchemaEpoch())
+		names := []string{}
+		for _, r := range e.Migrations {
+			names = append(names, r.Name)
+		}
+		events = append(events, fmt.Sprintf("%s %s %d %s", e.Operation, e.Direction, e.Batch, strings.Join(names, ",")))
+	})
+	m.OnAfterBatch(CloseIdleConns(db, 2))
+
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`},
+	)
+	assertOk(t, m.RunLatest(false, false))
+	// only the connection the run held is returned to the pool afterwards
+	assertEquals(t, 1, db.Stats().Idle)
+	// a run with nothing to do has no batch
+	assertOk(t, m.RunLatest(false, false))
+	m.Register(Migration{Name: "003_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE comment;`})
+	assertOk(t, m.RunLatest(false, false))
+	assertOk(t, m.Rollback(2, false))
+
+	assertEquals(t, strings.Join([]string{
+		"run up 1 001_create_post,002_create_tag",
+		"run up 2 003_create_comment",
+		"rollback down 2 003_create_comment",
+		"rollback down 1 002_create_tag,001_create_post",
+	}, "\n"), strings.Join(events, "\n"))
+}
+
+func TestSQLiteFailurePolicy(t *testing.T) {
+	migrations := []Migration{
+		{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY); CREATE TABLE;`, Down: `DROP TABLE tag;`, NoTransaction: true},
+		{Name: "003_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE comment;`},
+	}
+	count := func(db *sql.DB) int {
+		var count int
+		assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+		return count
+	}
+
+	// force no longer records a failed migration
+	db, teardown := getTestSQLiteDB(t, "failure_stop_test")
+	defer teardown()
+	m := New(db, WithSQLite())
+	m.Register(migrations...)
+	err := m.RunLatest(false, true)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, 1, count(db))
+
+	db, teardown = getTestSQLiteDB(t, "failure_skip_test")
+	defer teardown()
+	m = New(db, WithSQLite(), WithFailurePolicy(SkipAndContinue))
+	m.Register(migrations...)
+	result, err := m.RunLatestReport(false, false)
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "1 migrations failed: "))
+	assertEquals(t, 2, len(result.Applied))
+	assertEquals(t, "003_create_comment", result.Applied[1].Name)
+	assertEquals(t, 1, len(result.Skipped))
+	assertEquals(t, "002_create_tag", result.Skipped[0].Name)
+	assertEquals(t, true, strings.HasPrefix(result.Skipped[0].Reason, "failed: "))
+	assertEquals(t, 2, count(db))
+
+	// a tracking table created by an earlier release gains the dirty column
+	db, teardown = getTestSQLiteDB(t, "failure_dirty_test")
+	defer teardown()
+	_, err = db.Exec(`DROP TABLE migration`)
+	assertOk(t, err)
+	_, err = db.Exec(`CREATE TABLE migration (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, name TEXT, batch INTEGER NOT NULL, sql_hash TEXT, migrated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`)
+	assertOk(t, err)
+	m = New(db, WithSQLite(), WithFailurePolicy(MarkDirty))
+	m.Register(migrations...)
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Dirty)
+	assertEquals(t, false, statuses[2].Applied)
+
+	// later runs are refused until the migration is resolved
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+	assertEquals(t, true, strings.Contains(err.Error(), "'002_create_tag' failed partway"))
+	err = m.Rollback(1, false)
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+
+	// the tag table was created by hand, completing the migration
+	assertOk(t, m.ResolveDirty("002_create_tag", true))
+	assertEquals(t, true, m.ResolveDirty("002_create_tag", true) != nil)
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, 3, count(db))
+}
+
+func TestSQLiteMinimalPermissions(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "minimal_permissions_test")
+	defer teardown()
+	// a single connection, so nothing may reserve a second one
+	db.SetMaxOpenConns(1)
+
+	m := New(db, WithSQLite(), WithMinimalPermissions(), WithLock(time.Second), WithReadYourWrites(time.Second))
+	m.Register(Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`})
+	assertOk(t, m.RunLatest(false, false))
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration_lock`).Scan(&count))
+	assertEquals(t, 0, count)
+
+	m.Register(Migration{Name: "002_backfill", Up: `UPDATE post SET id = id;`, Down: `SELECT 1;`, SkipReplication: true})
+	err := m.RunLatest(false, false)
+	assertEquals(t, true, strings.Contains(err.Error(), "unavailable with WithMinimalPermissions"))
+
+	assertEquals(t, true, New(nil, WithMySQL(), WithMinimalPermissions()).rowLock())
+	assertEquals(t, false, New(nil, WithMySQL()).rowLock())
+}
+
+func TestSQLiteAppliedBy(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "applied_by_test")
+	defer teardown()
+
+	// a tracking table created by an earlier release gains the new columns
+	_, err := db.Exec(`DROP TABLE migration`)
+	assertOk(t, err)
+	_, err = db.Exec(`CREATE TABLE migration (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, name TEXT, batch INTEGER NOT NULL, sql_hash TEXT, migrated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`)
+	assertOk(t, err)
+	_, err = db.Exec(`INSERT INTO migration (name, batch, sql_hash) VALUES ('000_old', 1, '')`)
+	assertOk(t, err)
+
+	m := New(db, WithSQLite(), WithAppliedBy("ci@deploy"), WithRecordSQL())
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_seed_post", UpFunc: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO post (id) VALUES (1)`)
+			return err
+		}, Down: `DELETE FROM post;`},
+	)
+	assertOk(t, m.RunLatest(false, false))
+
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, 3, len(statuses))
+	assertEquals(t, "", statuses[0].AppliedBy)
+	assertEquals(t, time.Duration(0), statuses[0].Duration)
+	assertEquals(t, "ci@deploy", statuses[1].AppliedBy)
+	assertEquals(t, `CREATE TABLE post (id INTEGER PRIMARY KEY);`, statuses[1].AppliedSQL)
+	assertEquals(t, "ci@deploy", statuses[2].AppliedBy)
+	assertEquals(t, "", statuses[2].AppliedSQL)
+
+	// without the options, the OS user and host are recorded and no SQL
+	db, teardown = getTestSQLiteDB(t, "applied_by_default_test")
+	defer teardown()
+	m = New(db, WithSQLite())
+	m.Register(Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`})
+	assertOk(t, m.RunLatest(false, false))
+	statuses, err = m.Status()
+	assertOk(t, err)
+	assertEquals(t, m.applier(), statuses[0].AppliedBy)
+	assertEquals(t, true, strings.Contains(statuses[0].AppliedBy, "@"))
+	assertEquals(t, "", statuses[0].AppliedSQL)
+}
+
+func TestSQLiteSession(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "session_test")
+	defer teardown()
+	other, err := sql.Open("sqlite", "session_test")
+	assertOk(t, err)
+	defer other.Close()
+
+	// concurrent runs against one file, through separate pools, don't fail
+	// with "database is locked"
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		handle := db
+		if i%2 == 1 {
+			handle = other
+		}
+		wg.Add(1)
+		go func(i int, handle *sql.DB) {
+			defer wg.Done()
+			m := New(handle, WithSQLite(), WithWAL())
+			m.Register(Migration{
+				Name: fmt.Sprintf("%03d_create_table", i),
+				Up:   fmt.Sprintf(`CREATE TABLE t%d (id INTEGER PRIMARY KEY); INSERT INTO t%d (id) VALUES (1);`, i, i),
+				Down: fmt.Sprintf(`DROP TABLE t%d;`, i),
+			})
+			errs[i] = m.RunLatest(false, false)
+		}(i, handle)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assertOk(t, err)
+	}
+	var count int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration`).Scan(&count))
+	assertEquals(t, len(errs), count)
+
+	// the connection's own settings are restored after a run
+	db, teardown = getTestSQLiteDB(t, "session_restore_test")
+	defer teardown()
+	db.SetMaxOpenConns(1)
+	conn, err := db.Conn(context.Background())
+	assertOk(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(context.Background(), `PRAGMA busy_timeout = 10`)
+	assertOk(t, err)
+	m := New(conn, WithSQLite(), WithWAL(), WithBusyTimeout(time.Second))
+	m.Register(Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`})
+	assertOk(t, m.RunLatest(false, false))
+	var timeout int
+	var mode string
+	assertOk(t, conn.QueryRowContext(context.Background(), `PRAGMA busy_timeout`).Scan(&timeout))
+	assertOk(t, conn.QueryRowContext(context.Background(), `PRAGMA journal_mode`).Scan(&mode))
+	assertEquals(t, 10, timeout)
+	assertEquals(t, "delete", mode)
+}
+
+func TestSQLiteRebuildTable(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "rebuild_test")
+	defer teardown()
+	db.SetMaxOpenConns(1)
+	_, err := db.Exec(`PRAGMA foreign_keys = ON`)
+	assertOk(t, err)
+
+	schema := Migration{
+		Name: "001_create_author",
+		Up: `CREATE TABLE author (id INTEGER PRIMARY KEY, name TEXT, legacy TEXT);
+			CREATE INDEX author_name ON author (name);
+			CREATE VIEW author_names AS SELECT name FROM author;
+			CREATE TABLE post (id INTEGER PRIMARY KEY, author_id INTEGER REFERENCES author (id) ON DELETE CASCADE);
+			INSERT INTO author (id, name, legacy) VALUES (1, 'ann', 'x'), (2, 'bob', 'y');
+			INSERT INTO post (author_id) VALUES (1), (2);`,
+		Down: `DROP TABLE post; DROP VIEW author_names; DROP TABLE author;`,
+	}
+	rebuild := Migration{
+		Name:     "002_drop_legacy",
+		UpFunc:   RebuildTable("author", `CREATE TABLE author (id INTEGER PRIMARY KEY, name TEXT NOT NULL)`),
+		DownFunc: RebuildTable("author", `CREATE TABLE author (id INTEGER PRIMARY KEY, name TEXT, legacy TEXT)`),
+	}
+	count := func(query string) int {
+		var n int
+		assertOk(t, db.QueryRow(query).Scan(&n))
+		return n
+	}
+
+	// a referenced table isn't dropped with foreign keys enforced
+	m := New(db, WithSQLite())
+	m.Register(schema, rebuild)
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "set ForeignKeysOff"))
+	assertEquals(t, 2, count(`SELECT COUNT(*) FROM post`))
+
+	rebuild.ForeignKeysOff = true
+	m = New(db, WithSQLite())
+	m.Register(schema, rebuild)
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, 2, count(`SELECT COUNT(*) FROM post`))
+	assertEquals(t, 2, count(`SELECT COUNT(*) FROM author_names`))
+	assertEquals(t, 0, count(`SELECT COUNT(*) FROM pragma_table_info('author') WHERE name = 'legacy'`))
+	assertEquals(t, 1, count(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'author_name' AND tbl_name = 'author'`))
+	assertEquals(t, 1, count(`PRAGMA foreign_keys`))
+
+	assertOk(t, m.Rollback(1, false))
+	assertEquals(t, 1, count(`SELECT COUNT(*) FROM pragma_table_info('author') WHERE name = 'legacy'`))
+	assertEquals(t, 2, count(`SELECT COUNT(*) FROM post`))
+	assertOk(t, m.RunLatest(false, false))
+
+	// a migration leaving a foreign key violated is rolled back
+	m.Register(Migration{Name: "003_delete_authors", Up: `DELETE FROM author;`, Down: ``, ForeignKeysOff: true})
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrIntegrity))
+	assertEquals(t, 2, count(`SELECT COUNT(*) FROM author`))
+	assertEquals(t, 1, count(`PRAGMA foreign_keys`))
+}
+
+func TestSQLiteTrackingVersion(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "tracking_version_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	version, err := m.TrackingVersion()
+	assertOk(t, err)
+	assertEquals(t, LatestTrackingVersion, version)
+
+	_, err = db.Exec(`DROP TABLE migration`)
+	assertOk(t, err)
+	version, err = m.TrackingVersion()
+	assertOk(t, err)
+	assertEquals(t, 0, version)
+
+	// a table from the first release is detected, then upgraded when used
+	_, err = db.Exec(`CREATE TABLE migration (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, name TEXT, batch INTEGER NOT NULL, sql_hash TEXT, migrated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`)
+	assertOk(t, err)
+	version, err = m.TrackingVersion()
+	assertOk(t, err)
+	assertEquals(t, 1, version)
+
+	var logs bytes.Buffer
+	m = New(db, WithSQLite(), WithLogger(log.New(&logs, "", 0)))
+	_, err = m.Status()
+	assertOk(t, err)
+	version, err = m.TrackingVersion()
+	assertOk(t, err)
+	assertEquals(t, LatestTrackingVersion, version)
+	assertEquals(t, fmt.Sprintf("migrate :: upgraded tracking table migration from version 1 to %d\n", LatestTrackingVersion), logs.String())
+
+	// a current table isn't altered again
+	logs.Reset()
+	_, err = m.Status()
+	assertOk(t, err)
+	assertEquals(t, "", logs.String())
+}
+
+func TestSQLiteIntegrityChecks(t *testing.T) {
+	migrations := []Migration{
+		{
+			Name: "001_create_author",
+			Up: `CREATE TABLE author (id INTEGER PRIMARY KEY);
+				CREATE TABLE post (id INTEGER PRIMARY KEY, author_id INTEGER REFERENCES author (id));
+				INSERT INTO author (id) VALUES (1);
+				INSERT INTO post (author_id) VALUES (1);`,
+			Down: `DROP TABLE post; DROP TABLE author;`,
+		},
+		// foreign keys aren't enforced on the test connection
+		{Name: "002_delete_authors", Up: `DELETE FROM author;`, Down: `INSERT INTO author (id) VALUES (1);`},
+	}
+
+	db, teardown := getTestSQLiteDB(t, "integrity_unchecked_test")
+	defer teardown()
+	m := New(db, WithSQLite())
+	m.Register(migrations...)
+	assertOk(t, m.RunLatest(false, false))
+
+	db, teardown = getTestSQLiteDB(t, "integrity_checked_test")
+	defer teardown()
+	m = New(db, WithSQLite(), WithIntegrityChecks())
+	m.Register(migrations...)
+	err := m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrIntegrity))
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "after batch 1: "))
+	// the batch was committed before the check
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 2, len(applied))
+
+	// a rollback restoring the rows passes
+	assertOk(t, m.RollbackMigration("002_delete_authors", false))
+	assertOk(t, m.Rollback(1, false))
+}
+
+func TestSQLiteRollbackBatchOrder(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "rollback_order_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		// each down depends on the later migration having been rolled back
+		Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY, post_id INTEGER);`, Down: `DROP TABLE tag; SELECT COUNT(*) FROM post;`},
+		Migration{Name: "003_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `SELECT COUNT(*) FROM tag; DROP TABLE missing;`},
+		Migration{Name: "004_create_vote", Up: `CREATE TABLE vote (id INTEGER PRIMARY KEY);`, Down: `SELECT COUNT(*) FROM comment; DROP TABLE vote;`},
+	)
+	assertOk(t, m.RunLatest(false, false))
+	// shuffle the table's order, which rollback mustn't rely on
+	_, err := db.Exec(`UPDATE migration SET id = id + 10 WHERE name IN ('001_create_post', '003_create_comment')`)
+	assertOk(t, err)
+
+	result, err := m.RollbackReport(1, false)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "rollback of batch 1 stopped at '003_create_comment', leaving 003_create_comment, 002_create_tag, 001_create_post applied: "))
+	assertEquals(t, 1, len(result.Applied))
+	assertEquals(t, "004_create_vote", result.Applied[0].Name)
+
+	applied, err := m.appliedHashes(context.Background())
+	assertOk(t, err)
+	assertEquals(t, 3, len(applied))
+	_, ok := applied["004_create_vote"]
+	assertEquals(t, false, ok)
+}
+
+func TestSQLiteRunIsolated(t *testing.T) {
+	migrations := []Migration{
+		{Name: "001_create_scratch", Up: `CREATE TEMP TABLE scratch (id INTEGER); CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`, NoTransaction: true},
+	}
+	scratch := func(db *sql.DB) int {
+		var n int
+		assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM sqlite_temp_master WHERE name = 'scratch'`).Scan(&n))
+		return n
+	}
+
+	// the pool's one connection keeps the migration's temporary table
+	db, teardown := getTestSQLiteDB(t, "isolated_shared_test")
+	defer teardown()
+	db.SetMaxOpenConns(1)
+	m := New(db, WithSQLite())
+	m.Register(migrations...)
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, 1, db.Stats().OpenConnections)
+	assertEquals(t, 1, scratch(db))
+
+	db, teardown = getTestSQLiteDB(t, "isolated_test")
+	defer teardown()
+	db.SetMaxOpenConns(1)
+	m = New(db, WithSQLite(), WithRunIsolated())
+	m.Register(migrations...)
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, 0, db.Stats().OpenConnections)
+	assertEquals(t, 0, scratch(db))
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied)
+}
+
+func TestSQLiteFaultInjector(t *testing.T) {
+	_, teardown := getTestSQLiteDB(t, "faults_test")
+	defer teardown()
+	faults := NewFaultInjector()
+	db, err := faults.Open("sqlite", "faults_test")
+	assertOk(t, err)
+	defer db.Close()
+
+	migrations := []Migration{
+		{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY); CREATE TABLE tag_post (tag_id INTEGER);`, Down: `DROP TABLE tag_post; DROP TABLE tag;`, NoTransaction: true},
+	}
+
+	// the second statement of a migration outside a transaction fails
+	faults.Inject(Fault{Match: "CREATE TABLE tag", Statement: 2})
+	m := New(db, WithSQLite(), WithFailurePolicy(MarkDirty))
+	m.Register(migrations...)
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrInjected))
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Dirty)
+	assertEquals(t, true, faults.Statements() > 0)
+
+	// the table was created before the failure, so the migration is
+	// completed by hand
+	faults.Reset()
+	_, err = db.Exec(`CREATE TABLE tag_post (tag_id INTEGER)`)
+	assertOk(t, err)
+	assertOk(t, m.ResolveDirty("002_create_tag", true))
+
+	// a dropped connection fails the migration it was running
+	m.Register(Migration{Name: "003_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE comment;`})
+	faults.Inject(Fault{Match: "CREATE TABLE comment", DropConnection: true})
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, sqldriver.ErrBadConn))
+	faults.Reset()
+	assertOk(t, m.RunLatest(false, false))
+
+	// a slow statement trips the migration timeout
+	m = New(db, WithSQLite(), WithMigrationTimeout(50*time.Millisecond))
+	m.Register(migrations...)
+	m.Register(Migration{Name: "004_create_vote", Up: `CREATE TABLE vote (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE vote;`})
+	faults.Inject(Fault{Match: "CREATE TABLE vote", Delay: time.Second})
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrMigrationTimeout))
+}
+
+func TestSQLiteDirtyDirection(t *testing.T) {
+	_, teardown := getTestSQLiteDB(t, "dirty_direction_test")
+	defer teardown()
+	faults := NewFaultInjector()
+	db, err := faults.Open("sqlite", "dirty_direction_test")
+	assertOk(t, err)
+	defer db.Close()
+	count := func(name string) int {
+		var n int
+		assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM migration WHERE name = ?`, name).Scan(&n))
+		return n
+	}
+
+	view := Migration{Name: "001_shelf_view", Up: `DROP VIEW IF EXISTS shelf_view; CREATE VIEW shelf_view AS SELECT 1 AS id;`, Down: `DROP VIEW shelf_view;`, Repeatable: true, NoTransaction: true}
+	tag := Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY); CREATE TABLE tag_post (tag_id INTEGER);`, Down: `DROP TABLE tag_post; DROP TABLE tag;`, NoTransaction: true}
+	m := New(db, WithSQLite(), WithFailurePolicy(MarkDirty))
+	m.Register(view, tag)
+	assertOk(t, m.RunLatest(false, false))
+
+	// a failed re-run of a repeatable migration replaces its record
+	view.Up = `DROP VIEW IF EXISTS shelf_view; CREATE VIEW shelf_view AS SELECT 2 AS id;`
+	m = New(db, WithSQLite(), WithFailurePolicy(MarkDirty))
+	m.Register(view, tag)
+	faults.Inject(Fault{Match: "CREATE VIEW", Statement: 1})
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+	faults.Reset()
+	assertEquals(t, 1, count(view.Name))
+	// an undone up is deleted, so it runs again
+	assertOk(t, m.ResolveDirty(view.Name, false))
+	assertEquals(t, 0, count(view.Name))
+	assertOk(t, m.RunLatest(false, false))
+
+	// a failed down keeps its record
+	faults.Inject(Fault{Match: "DROP TABLE tag", Statement: 2})
+	err = m.RunLatest(true, false)
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+	faults.Reset()
+	assertEquals(t, 1, count(tag.Name))
+	assertEquals(t, true, errors.Is(m.RunLatest(false, false), ErrDirty))
+
+	// the tag table was dropped by hand, completing the down, so the
+	// migration is no longer applied
+	_, err = db.Exec(`DROP TABLE tag`)
+	assertOk(t, err)
+	assertOk(t, m.ResolveDirty(tag.Name, true))
+	assertEquals(t, 0, count(tag.Name))
+}
+
+func TestSQLiteSquash(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "squash_test")
+	defer teardown()
+	fresh, teardownFresh := getTestSQLiteDB(t, "squash_fresh_test")
+	defer teardownFresh()
+
+	originals := []Migration{
+		{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT);`, Down: `DROP TABLE post;`},
+		{Name: "002_index_post", Up: `CREATE INDEX post_title ON post (title); CREATE VIEW titles AS SELECT title FROM post;`, Down: `DROP VIEW titles; DROP INDEX post_title;`},
+	}
+	m := New(db, WithSQLite())
+	m.Register(originals...)
+	_, err := m.Squash("003_squashed")
+	assertEquals(t, true, err != nil)
+	assertOk(t, m.RunLatest(false, false))
+
+	squashed, err := m.Squash("003_squashed")
+	assertOk(t, err)
+	assertEquals(t, "001_create_post,002_index_post", strings.Join(squashed.Squashes, ","))
+	assertEquals(t, true, strings.Contains(squashed.Up, "CREATE INDEX post_title"))
+	assertEquals(t, false, strings.Contains(squashed.Up, "migration"))
+	assertEquals(t, "DROP VIEW \"titles\";\nDROP TABLE \"post\";\n", squashed.Down)
+
+	// registered alongside its originals, it is refused
+	m.Register(squashed)
+	assertEquals(t, true, m.RunLatest(false, false) != nil)
+
+	next := Migration{Name: "004_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`}
+	for _, d := range []*sql.DB{db, fresh} {
+		m := New(d, WithSQLite())
+		m.Register(squashed, next)
+		result, err := m.RunLatestReport(false, false)
+		assertOk(t, err)
+		statuses, err := m.Status()
+		assertOk(t, err)
+		assertEquals(t, 2, len(statuses))
+		assertEquals(t, true, statuses[0].Applied && statuses[1].Applied)
+		_, err = d.Exec(`INSERT INTO post (title) VALUES ('a')`)
+		assertOk(t, err)
+
+		var archived int
+		d.QueryRow(`SELECT COUNT(*) FROM migration_archive`).Scan(&archived)
+		if d == db {
+			// recorded, not run
+			assertEquals(t, 1, len(result.Applied))
+			assertEquals(t, 2, archived)
+		} else {
+			assertEquals(t, 2, len(result.Applied))
+			assertEquals(t, 0, archived)
+		}
+	}
+
+	// a database with only some of the originals applied is refused
+	partial := New(fresh, WithSQLite(), WithTableName("partial_migration"))
+	partial.Register(originals[0])
+	_, err = partial.Baseline("001_create_post")
+	assertOk(t, err)
+	partial = New(fresh, WithSQLite(), WithTableName("partial_migration"))
+	partial.Register(squashed)
+	err = partial.RunLatest(false, false)
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "only 1 are applied"))
+}
+
+func TestSQLiteFixtures(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "fixtures_test")
+	defer teardown()
+
+	accounts := Fixture{
+		Table:  "account",
+		Rows:   2500,
+		Before: "002_backfill_status",
+		Columns: []FixtureColumn{
+			{"id", Sequence(1)},
+			{"email", Emails("example.com")},
+			{"status", Nullable(0.5, OneOf("active", "closed"))},
+		},
+	}
+	m := New(nil, WithSQLite(), WithFixtures(42, accounts))
+	m.Register(
+		Migration{Name: "001_create_account", Up: `CREATE TABLE account (id INTEGER PRIMARY KEY, email TEXT NOT NULL UNIQUE, status TEXT);`, Down: `DROP TABLE account;`},
+		Migration{Name: "002_backfill_status", Up: `UPDATE account SET status = 'active' WHERE status IS NULL;`, Down: `SELECT 1;`},
+	)
+	findings, err := m.ValidateShadow(db)
+	assertOk(t, err)
+	assertEquals(t, 0, len(findings))
+
+	var rows, missing int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*), COUNT(*) - COUNT(status) FROM account`).Scan(&rows, &missing))
+	assertEquals(t, 2500, rows)
+	assertEquals(t, 0, missing)
+
+	// other runs don't load fixtures
+	other, teardownOther := getTestSQLiteDB(t, "fixtures_run_test")
+	defer teardownOther()
+	run := New(other, WithSQLite(), WithFixtures(42, accounts))
+	run.Register(m.registry.Migrations()...)
+	assertOk(t, run.RunLatest(false, false))
+	assertOk(t, other.QueryRow(`SELECT COUNT(*) FROM account`).Scan(&rows))
+	assertEquals(t, 0, rows)
+}
+
+func TestSQLiteDumpSchema(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "dump_test")
+	defer teardown()
+	loaded, teardownLoaded := getTestSQLiteDB(t, "dump_load_test")
+	defer teardownLoaded()
+
+	migrations := []Migration{
+		{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT, updated INTEGER);`, Down: `DROP TABLE post;`},
+		{Name: "002_post_trigger", Up: `CREATE TRIGGER post_touch AFTER UPDATE OF title ON post BEGIN UPDATE post SET updated = 1 WHERE id = NEW.id; END;`, Down: `DROP TRIGGER post_touch;`,
+			Labels: Labels{"ticket": "DB-7"}, FollowUps: []FollowUp{{Name: "analyze", SQL: `ANALYZE post;`, After: time.Hour}}},
+	}
+	m := New(db, WithSQLite(), WithRecordSQL())
+	m.Register(migrations...)
+	assertOk(t, m.RunLatest(false, false))
+
+	var dump bytes.Buffer
+	assertOk(t, m.DumpSchema(&dump))
+	assertEquals(t, true, strings.HasPrefix(dump.String(), "-- moogration schema dump: sqlite\n"))
+
+	l := New(loaded, WithSQLite())
+	l.Register(migrations...)
+	l.Register(Migration{Name: "003_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`})
+	assertOk(t, l.LoadSchema(bytes.NewReader(dump.Bytes())))
+	statuses, err := l.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied && statuses[1].Applied)
+	assertEquals(t, false, statuses[1].Changed)
+	assertEquals(t, migrations[1].Up, statuses[1].AppliedSQL)
+	assertEquals(t, false, statuses[2].Applied)
+	// as did the labels and follow-ups recorded with the migrations
+	assertEquals(t, "DB-7", statuses[1].Labels["ticket"])
+	pending, err := l.PendingFollowUps()
+	assertOk(t, err)
+	assertEquals(t, 1, len(pending))
+
+	// the trigger came across, and later migrations run as usual
+	_, err = loaded.Exec(`INSERT INTO post (id, title) VALUES (1, 'a'); UPDATE post SET title = 'b'`)
+	assertOk(t, err)
+	var updated int
+	assertOk(t, loaded.QueryRow(`SELECT updated FROM post`).Scan(&updated))
+	assertEquals(t, 1, updated)
+	assertOk(t, l.RunLatest(false, false))
+
+	err = l.LoadSchema(bytes.NewReader(dump.Bytes()))
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "3 migrations are already applied"))
+	err = New(loaded, WithMySQL()).LoadSchema(bytes.NewReader(dump.Bytes()))
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "from sqlite into mysql"))
+}
+
+func TestSQLiteRehearsal(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "rehearsal_test")
+	defer teardown()
+
+	m := New(db, WithSQLite(), WithRehearsal())
+	m.Register(Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT);`, Down: `DROP TABLE post;`})
+	assertOk(t, m.RunLatest(false, false))
+	_, err := db.Exec(`INSERT INTO post (title) VALUES ('a')`)
+	assertOk(t, err)
+
+	// a run that would fail partway doesn't start on the target
+	m.Register(
+		Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`},
+		Migration{Name: "003_alter_missing", Up: `ALTER TABLE missing ADD COLUMN x INTEGER;`, Down: `SELECT 1;`},
+	)
+	result, err := m.RunLatestReport(false, false)
+	assertEquals(t, true, errors.Is(err, ErrRehearsal))
+	assertEquals(t, true, strings.Contains(err.Error(), "003_alter_missing"))
+	assertEquals(t, 0, len(result.Applied))
+	exists, err := m.hasTable(context.Background(), "tag")
+	assertOk(t, err)
+	assertEquals(t, false, exists)
+
+	m = New(db, WithSQLite(), WithRehearsal())
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`},
+	)
+	result, err = m.RunLatestReport(false, false)
+	assertOk(t, err)
+	assertEquals(t, 1, len(result.Applied))
+	var posts int
+	assertOk(t, db.QueryRow(`SELECT COUNT(*) FROM post`).Scan(&posts))
+	assertEquals(t, 1, posts)
+}
+
+// numberedSQLite is SQLite with numbered placeholders and, for the test,
+// without transactional DDL
+type numberedSQLite struct{}
+
+func (numberedSQLite) Name() string { return "numbered-sqlite" }
+func (numberedSQLite) Base() string { return "sqlite" }
+func (numberedSQLite) TrackingTableSQL(table string) string {
+	return fmt.Sprintf(createMigrationTableSQLite, table)
+}
+func (numberedSQLite) Placeholder(n int) string   { return fmt.Sprintf("?%d", n) }
+func (numberedSQLite) LockStrategy() LockStrategy { return LockTable }
+func (numberedSQLite) TransactionalDDL() bool     { return false }
+
+func TestSQLiteDialect(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "dialect_test")
+	defer teardown()
+
+	assertEquals(t, true, RegisterDialect(sqliteNamed("mysql")) != nil)
+	assertOk(t, RegisterDialect(numberedSQLite{}))
+	assertEquals(t, true, RegisterDialect(numberedSQLite{}) != nil)
+	d, ok := LookupDialect("numbered-sqlite")
+	assertEquals(t, true, ok)
+
+	m := New(db, WithDialect(d), WithLock(time.Second))
+	assertEquals(t, `SELECT name FROM migration WHERE name = ?1 AND batch = ?2`, m.stmt("SELECT name FROM %s WHERE name = ? AND batch = ?"))
+	caps, err := m.DetectCapabilities()
+	assertOk(t, err)
+	assertEquals(t, false, caps.TransactionalDDL)
+
+	m.Register(
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		Migration{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY); CREATE TABLE post (id INTEGER);`, Down: `DROP TABLE tag;`},
+	)
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, err != nil)
+	// without a transaction, the statement before the failure stays applied
+	exists, err := m.hasTable(context.Background(), "tag")
+	assertOk(t, err)
+	assertEquals(t, true, exists)
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied)
+	assertEquals(t, false, statuses[1].Applied)
+}
+
+// sqliteNamed is a dialect based on SQLite, under any name
+type sqliteNamed string
+
+func (d sqliteNamed) Name() string { return string(d) }
+func (sqliteNamed) Base() string   { return "sqlite" }
+func (sqliteNamed) TrackingTableSQL(table string) string {
+	return fmt.Sprintf(createMigrationTableSQLite, table)
+}
+func (sqliteNamed) Placeholder(n int) string   { return "?" }
+func (sqliteNamed) LockStrategy() LockStrategy { return LockTable }
+func (sqliteNamed) TransactionalDDL() bool     { return true }
+
+func TestSQLiteConfirmDown(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "confirm_test")
+	defer teardown()
+	migrations := []Migration{
+		{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`},
+	}
+
+	var asked []string
+	confirmed := false
+	m := New(db, WithSQLite(), WithConfirm(func(plan []Migration) bool {
+		asked = nil
+		for _, m := range plan {
+			asked = append(asked, m.Name)
+		}
+		return confirmed
+	}))
+	m.Register(migrations...)
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, 0, len(asked))
+
+	err := m.Rollback(1, false)
+	assertEquals(t, true, errors.Is(err, ErrNotConfirmed))
+	assertEquals(t, 2, len(asked))
+	err = m.RollbackMigration("002_create_tag", false)
+	assertEquals(t, true, errors.Is(err, ErrNotConfirmed))
+	assertEquals(t, "002_create_tag", strings.Join(asked, ","))
+	err = m.RunLatest(true, false)
+	assertEquals(t, true, errors.Is(err, ErrNotConfirmed))
+	assertEquals(t, "002_create_tag,001_create_post", strings.Join(asked, ","))
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied && statuses[1].Applied)
+
+	confirmed = true
+	assertOk(t, m.RollbackMigration("002_create_tag", false))
+
+	// a protected environment needs force
+	t.Setenv(EnvVar, "staging")
+	m = New(db, WithSQLite(), WithProtectedEnvironments("staging", "production"))
+	m.Register(migrations...)
+	assertOk(t, m.RunLatest(false, false))
+	err = m.Rollback(1, false)
+	assertEquals(t, true, errors.Is(err, ErrProtectedEnvironment))
+	assertEquals(t, true, errors.Is(m.Redo("002_create_tag"), ErrProtectedEnvironment))
+	assertOk(t, m.RunLatest(true, true))
+
+	t.Setenv(EnvVar, "development")
+	assertOk(t, m.RunLatest(false, false))
+	assertOk(t, m.Rollback(1, false))
+}
+
+func TestSQLiteCheckCompatibility(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "compat_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_create_accounts",
+		Up:   `CREATE TABLE accounts (id INTEGER PRIMARY KEY, email TEXT, legacy_name TEXT); CREATE TABLE sessions (id INTEGER PRIMARY KEY);`,
+		Down: `DROP TABLE accounts; DROP TABLE sessions;`,
+	})
+	assertOk(t, m.RunLatest(false, false))
+
+	m.Register(Migration{
+		Name: "002_drop_legacy_name",
+		Up:   `ALTER TABLE accounts DROP COLUMN legacy_name; ALTER TABLE accounts ADD COLUMN plan TEXT NOT NULL;`,
+		Down: `ALTER TABLE accounts DROP COLUMN plan; ALTER TABLE accounts ADD COLUMN legacy_name TEXT;`,
+	}, Migration{
+		Name: "003_rebuild_sessions",
+		Up:   `DROP TABLE sessions; CREATE TABLE sessions (id INTEGER PRIMARY KEY, token TEXT);`,
+		Down: `SELECT 1;`,
+	})
+
+	queries, err := ReadQueries(strings.NewReader(`
+-- queries of the deployed release
+SELECT id, email FROM accounts WHERE id = ?;
+SELECT a.legacy_name FROM accounts a JOIN sessions s ON s.id = a.id;
+2024-05-01T10:00:00.000000Z	   12 Query	INSERT INTO accounts (id, email) VALUES (1, 'legacy_name@example.com')
+2024-05-01T10:00:01.000000Z	   12 Query	INSERT INTO accounts (id, email) VALUES (1, 'legacy_name@example.com')
+`))
+	assertOk(t, err)
+	assertEquals(t, 3, len(queries))
+
+	breakages, err := m.CheckCompatibility(queries)
+	assertOk(t, err)
+	assertEquals(t, 2, len(breakages))
+	assertEquals(t, "002_drop_legacy_name", breakages[0].Migration)
+	assertEquals(t, "legacy_name", breakages[0].Column)
+	assertEquals(t, queries[1], breakages[0].Query)
+	// the literal mentioning legacy_name isn't a use of the column, but the
+	// insert omits the new NOT NULL column
+	assertEquals(t, "plan", breakages[1].Column)
+	assertEquals(t, queries[2], breakages[1].Query)
+
+	// applied migrations aren't checked
+	assertOk(t, m.RunLatest(false, false))
+	breakages, err = m.CheckCompatibility(queries)
+	assertOk(t, err)
+	assertEquals(t, 0, len(breakages))
+}
+
+func TestSQLiteResultJSON(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "result_json_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_create_invoice",
+		Up:   `CREATE TABLE invoice (id INTEGER PRIMARY KEY);`,
+		Down: `DROP TABLE invoice;`,
+	}, Migration{
+		Name: "002_broken",
+		Up:   `CREATE TABLE invoice (id INTEGER PRIMARY KEY);`,
+		Down: `SELECT 1;`,
+	})
+
+	result, runErr := m.RunLatestReport(false, false)
+	assertEquals(t, true, runErr != nil)
+	assertEquals(t, 1, len(result.Applied))
+	assertEquals(t, "002_broken", result.Failed.Name)
+
+	var out bytes.Buffer
+	assertOk(t, result.WriteJSON(&out, runErr))
+	var decoded struct {
+		OK         bool
+		Error      string
+		Migrations []struct {
+			Name       string
+			Direction  string
+			Batch      int
+			DurationMS int64 `json:"duration_ms"`
+			Status     string
+			Error      string
+		}
+	}
+	assertOk(t, json.Unmarshal(out.Bytes(), &decoded))
+	assertEquals(t, false, decoded.OK)
+	assertEquals(t, runErr.Error(), decoded.Error)
+	assertEquals(t, 2, len(decoded.Migrations))
+	assertEquals(t, "001_create_invoice", decoded.Migrations[0].Name)
+	assertEquals(t, "up", decoded.Migrations[0].Direction)
+	assertEquals(t, 1, decoded.Migrations[0].Batch)
+	assertEquals(t, "ok", decoded.Migrations[0].Status)
+	assertEquals(t, "failed", decoded.Migrations[1].Status)
+	assertEquals(t, true, decoded.Migrations[1].Error != "")
+
+	statuses, err := m.Status()
+	assertOk(t, err)
+	out.Reset()
+	assertOk(t, WriteStatusJSON(&out, statuses))
+	var decodedStatuses []struct {
+		Name   string
+		Status string
+		Batch  int
+	}
+	assertOk(t, json.Unmarshal(out.Bytes(), &decodedStatuses))
+	assertEquals(t, 2, len(decodedStatuses))
+	assertEquals(t, "applied", decodedStatuses[0].Status)
+	assertEquals(t, 1, decodedStatuses[0].Batch)
+	assertEquals(t, "pending", decodedStatuses[1].Status)
+}
+
+func TestSQLiteMinAppVersion(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "min_app_version_test")
+	defer teardown()
+
+	migrations := []Migration{{
+		Name: "001_create_order",
+		Up:   `CREATE TABLE "order" (id INTEGER PRIMARY KEY);`,
+		Down: `DROP TABLE "order";`,
+	}, {
+		Name:          "002_add_order_status",
+		Up:            `ALTER TABLE "order" ADD COLUMN status TEXT;`,
+		Down:          `ALTER TABLE "order" DROP COLUMN status;`,
+		MinAppVersion: "2.1.0",
+	}}
+
+	old := New(db, WithSQLite(), WithAppVersion("2.0.9"))
+	old.Register(migrations...)
+	err := old.RunLatestOrWait(time.Second)
+	assertEquals(t, true, errors.Is(err, ErrAppVersion))
+	// nothing ran
+	statuses, err := old.Status()
+	assertOk(t, err)
+	assertEquals(t, false, statuses[0].Applied)
+
+	// without a version, MinAppVersion isn't checked
+	unversioned := New(db, WithSQLite())
+	unversioned.Register(migrations[0])
+	assertOk(t, unversioned.RunLatest(false, false))
+
+	current := New(db, WithSQLite(), WithAppVersion("v2.1.0"))
+	current.Register(migrations...)
+	assertOk(t, current.RunLatestOrWait(time.Second))
+	statuses, err = current.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Applied)
+	assertEquals(t, "2.1.0", statuses[1].MinAppVersion)
+
+	// applied migrations don't stop an older replica booting
+	assertOk(t, old.RunLatestOrWait(time.Second))
+}
+
+func TestSQLiteBatchApproval(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "batch_approval_test")
+	defer teardown()
+
+	defer func(interval time.Duration) { webhookPollInterval = interval }(webhookPollInterval)
+	webhookPollInterval = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	requests := []BatchApproval{}
+	decision := `{"approved": true}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req BatchApproval
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req)
+		// the first submission of each batch is pending
+		if len(requests) == 1 || requests[len(requests)-2].ID != req.ID {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte(decision))
+	}))
+	defer server.Close()
+
+	m := New(db, WithSQLite(), WithBatchApproval(WebhookApprover(server.URL, nil)))
+	m.Register(Migration{
+		Name: "001_create_shipment",
+		Up:   `CREATE TABLE shipment (id INTEGER PRIMARY KEY);`,
+		Down: `DROP TABLE shipment;`,
+	}, Migration{
+		Name: "002_add_shipment_carrier",
+		Up:   `ALTER TABLE shipment ADD COLUMN carrier TEXT;`,
+		Down: `ALTER TABLE shipment DROP COLUMN carrier;`,
+	})
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, 2, len(requests))
+	assertEquals(t, requests[0].ID, requests[1].ID)
+	assertEquals(t, "run", requests[0].Operation)
+	assertEquals(t, "up", requests[0].Direction)
+	assertEquals(t, 1, requests[0].Batch)
+	assertEquals(t, 2, len(requests[0].Plan))
+	assertEquals(t, "002_add_shipment_carrier", requests[0].Plan[1].Name)
+
+	// nothing pending, nothing to approve
+	assertOk(t, m.RunLatest(false, false))
+	assertEquals(t, 2, len(requests))
+
+	decision = `{"approved": false, "reason": "change freeze"}`
+	err := m.Rollback(1, false)
+	assertEquals(t, true, errors.Is(err, ErrBatchRejected))
+	assertEquals(t, true, strings.Contains(err.Error(), "change freeze"))
+	assertEquals(t, "rollback", requests[len(requests)-1].Operation)
+	assertEquals(t, "001_create_shipment", requests[len(requests)-1].Plan[1].Name)
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied && statuses[1].Applied)
+}
+
+func TestSQLiteFleet(t *testing.T) {
+	fleet := NewFleet(2, WithSQLite())
+	fleet.Register(Migration{
+		Name: "001_create_note",
+		Up:   `CREATE TABLE note (id INTEGER PRIMARY KEY);`,
+		Down: `DROP TABLE note;`,
+	}, Migration{
+		Name: "002_add_note_body",
+		Up:   `ALTER TABLE note ADD COLUMN body TEXT;`,
+		Down: `ALTER TABLE note DROP COLUMN body;`,
+	})
+
+	dbs := map[string]*sql.DB{}
+	for _, tenant := range []string{"acme", "globex", "initech"} {
+		db, teardown := getTestSQLiteDB(t, "fleet_"+tenant+"_test")
+		defer teardown()
+		dbs[tenant] = db
+		fleet.Add(tenant, db)
+	}
+	// globex already has a conflicting column
+	_, err := dbs["globex"].Exec(`CREATE TABLE note (id INTEGER PRIMARY KEY, body TEXT)`)
+	assertOk(t, err)
+
+	err = fleet.RunLatest(false)
+	var fleetErr *FleetError
+	assertEquals(t, true, errors.As(err, &fleetErr))
+	assertEquals(t, 3, fleetErr.Total)
+	assertEquals(t, 1, len(fleetErr.Failed))
+	assertEquals(t, "globex", fleetErr.Failed[0].Tenant)
+
+	results := fleet.Results()
+	assertEquals(t, 3, len(results))
+	assertEquals(t, "acme", results[0].Tenant)
+	assertEquals(t, true, results[0].Ran)
+	assertEquals(t, 2, len(results[0].Result.Applied))
+	assertEquals(t, true, results[1].Err != nil)
+	assertEquals(t, 2, len(results[2].Result.Applied))
+
+	// repair globex and resume: only it is run
+	_, err = dbs["globex"].Exec(`DROP TABLE note`)
+	assertOk(t, err)
+	assertOk(t, fleet.Resume(false))
+	results = fleet.Results()
+	assertEquals(t, 2, len(results[1].Result.Applied))
+	assertEquals(t, nil, results[1].Err)
+	assertEquals(t, 2, len(results[0].Result.Applied))
+
+	globex, ok := fleet.Migrator("globex")
+	assertEquals(t, true, ok)
+	statuses, err := globex.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Applied)
+}
+
+func TestSQLiteBundle(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "bundle_test")
+	defer teardown()
+
+	control := New(db, WithSQLite())
+	control.Register(Migration{
+		Name:        "001_create_region",
+		Up:          `CREATE TABLE region (id INTEGER PRIMARY KEY);`,
+		Down:        `DROP TABLE region;`,
+		Description: "regions",
+		Timeout:     time.Minute,
+		Labels:      Labels{"team": "geo"},
+		FollowUps:   []FollowUp{{Name: "analyze", SQL: `ANALYZE region;`, After: time.Hour}},
+	}, Migration{
+		Name:          "002_add_region_code",
+		Up:            `ALTER TABLE region ADD COLUMN code TEXT;`,
+		Down:          `ALTER TABLE region DROP COLUMN code;`,
+		MinAppVersion: "1.2.0",
+	})
+	bundle, err := control.Bundle()
+	assertOk(t, err)
+
+	var wire bytes.Buffer
+	assertOk(t, JSONCodec.EncodeBundle(&wire, bundle))
+	received, err := JSONCodec.DecodeBundle(&wire)
+	assertOk(t, err)
+	assertEquals(t, bundle.Digest, received.Digest)
+
+	registry, err := received.Registry()
+	assertOk(t, err)
+	first, ok := registry.Get("001_create_region")
+	assertEquals(t, true, ok)
+	assertEquals(t, time.Minute, first.Timeout)
+	assertEquals(t, time.Hour, first.FollowUps[0].After)
+	assertEquals(t, "geo", first.Labels["team"])
+	assertEquals(t, fmt.Sprint(control.Manifest()), fmt.Sprint(New(db, WithRegistry(registry)).Manifest()))
+
+	// the agent runs the bundle and reports back
+	agent := New(db, WithSQLite(), WithRegistry(registry))
+	result, err := agent.RunLatestReport(false, false)
+	assertOk(t, err)
+	report := NewReport(result, err)
+	report.Bundle = received.Digest
+	wire.Reset()
+	assertOk(t, JSONCodec.EncodeReport(&wire, report))
+	got, err := JSONCodec.DecodeReport(&wire)
+	assertOk(t, err)
+	assertEquals(t, bundle.Digest, got.Bundle)
+	assertEquals(t, true, got.OK)
+	assertEquals(t, 2, len(got.Migrations))
+	assertEquals(t, "002_add_region_code", got.Migrations[1].Name)
+
+	// a migration edited in transit is refused
+	tampered := received
+	tampered.Migrations = append([]BundledMigration(nil), received.Migrations...)
+	tampered.Migrations[0].Up = `DROP TABLE region;`
+	_, err = tampered.Registry()
+	assertEquals(t, true, err != nil)
+
+	// as is one whose metadata was, such as the SQL of a follow-up
+	tampered.Migrations = append([]BundledMigration(nil), received.Migrations...)
+	tampered.Migrations[0].FollowUps = []BundledFollowUp{{Name: "analyze", SQL: `DROP TABLE region;`}}
+	_, err = tampered.Registry()
+	assertEquals(t, true, err != nil)
+
+	// an edit that recomputes the hashes and digest is only caught by the
+	// signature
+	public, private, err := ed25519.GenerateKey(nil)
+	assertOk(t, err)
+	signed := bundle
+	signed.Sign(private)
+	assertOk(t, signed.Verify(public))
+	tampered = signed
+	tampered.Migrations = append([]BundledMigration(nil), signed.Migrations...)
+	tampered.Migrations[1].MinAppVersion = ""
+	tampered.Digest = tampered.digest()
+	_, err = tampered.Registry()
+	assertOk(t, err)
+	assertEquals(t, true, tampered.Verify(public) != nil)
+	assertEquals(t, true, bundle.Verify(public) != nil)
+
+	_, err = NewBundle([]Migration{{Name: "003_backfill", UpFunc: func(ctx context.Context, tx *sql.Tx) error { return nil }}})
+	assertEquals(t, true, err != nil)
+}
+
+func TestSQLiteAgent(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "agent_test")
+	defer teardown()
+
+	control := New(db, WithSQLite())
+	control.Register(Migration{
+		Name: "001_create_depot",
+		Up:   `CREATE TABLE depot (id INTEGER PRIMARY KEY);`,
+		Down: `DROP TABLE depot;`,
+	})
+	bundle, err := control.Bundle()
+	assertOk(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	polls := 0
+	reports := []Report{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Query().Get("target") != "eu-west" {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			polls++
+			if polls == 1 {
+				// nothing approved yet
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			JSONCodec.EncodeBundle(w, bundle)
+		case http.MethodPost:
+			report, err := JSONCodec.DecodeReport(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reports = append(reports, report)
+			if len(reports) == 2 {
+				cancel()
+			}
+		}
+	}))
+	defer server.Close()
+
+	agent := New(db, WithSQLite())
+	err = agent.RunAgent(ctx, AgentConfig{URL: server.URL, Target: "eu-west", Interval: 10 * time.Millisecond})
+	assertEquals(t, context.Canceled, err)
+
+	assertEquals(t, 2, len(reports))
+	assertEquals(t, bundle.Digest, reports[0].Bundle)
+	assertEquals(t, true, reports[0].OK)
+	assertEquals(t, 1, len(reports[0].Migrations))
+	assertEquals(t, "001_create_depot", reports[0].Migrations[0].Name)
+	// the plan served again isn't run again, and its report is resent
+	assertEquals(t, 1, len(reports[1].Migrations))
+
+	statuses, err := control.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied)
+
+	// a failed plan is reported, and fails a single poll
+	control.Register(Migration{
+		Name: "002_create_depot_again",
+		Up:   `CREATE TABLE depot (id INTEGER PRIMARY KEY);`,
+		Down: `DROP TABLE depot;`,
+	})
+	bundle, err = control.Bundle()
+	assertOk(t, err)
+	err = agent.PollAgent(context.Background(), AgentConfig{URL: server.URL, Target: "eu-west"})
+	if err == nil {
+		t.Fatal("expected a failed plan to fail the poll")
+	}
+	assertEquals(t, 3, len(reports))
+	assertEquals(t, false, reports[2].OK)
+
+	// with a public key, an unsigned plan is refused without being run
+	public, private, err := ed25519.GenerateKey(nil)
+	assertOk(t, err)
+	signedConf := AgentConfig{URL: server.URL, Target: "eu-west", PublicKey: public}
+	err = agent.PollAgent(context.Background(), signedConf)
+	if err == nil {
+		t.Fatal("expected an unsigned plan to be refused")
+	}
+	assertEquals(t, 3, len(reports))
+	mu.Lock()
+	bundle.Sign(private)
+	mu.Unlock()
+	err = agent.PollAgent(context.Background(), signedConf)
+	if err == nil {
+		t.Fatal("expected the signed plan to fail")
+	}
+	assertEquals(t, 4, len(reports))
+}
+
+func TestSQLiteRetry(t *testing.T) {
+	_, teardown := getTestSQLiteDB(t, "retry_test")
+	defer teardown()
+	faults := NewFaultInjector()
+	db, err := faults.Open("sqlite", "retry_test")
+	assertOk(t, err)
+	defer db.Close()
+
+	migrations := []Migration{
+		{Name: "001_create_crate", Up: `CREATE TABLE crate (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE crate;`},
+		{Name: "002_create_pallet", Up: `CREATE TABLE pallet (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE pallet;`, NoTransaction: true},
+	}
+	locked := errors.New("database is locked")
+
+	// without retries, a transient error fails the run
+	faults.Inject(Fault{Match: "SELECT name, sql_hash", Statement: 1, Err: locked})
+	m := New(db, WithSQLite())
+	m.Register(migrations...)
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, locked))
+	faults.Reset()
+
+	// the tracking table read, the transactional migration whose status
+	// record failed, and the status record of the other are each retried
+	faults.Inject(
+		Fault{Match: "SELECT name, sql_hash", Statement: 1, Err: locked},
+		Fault{Match: "INSERT INTO migration (", Statement: 1, Err: locked},
+		Fault{Match: "INSERT INTO migration (", Statement: 3, Err: locked},
+	)
+	var logged bytes.Buffer
+	m = New(db, WithSQLite(), WithLogger(log.New(&logged, "", 0)),
+		WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	m.Register(migrations...)
+	result, err := m.RunLatestReport(false, false)
+	assertOk(t, err)
+	assertEquals(t, 2, len(result.Applied))
+	assertEquals(t, 3, strings.Count(logged.String(), "retrying"))
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[0].Applied)
+	assertEquals(t, true, statuses[1].Applied)
+	faults.Reset()
+
+	// errors that aren't transient, and attempts past the limit, aren't
+	// retried
+	m.Register(Migration{Name: "003_create_box", Up: `CREATE TABLE box (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE box;`})
+	faults.Inject(Fault{Match: "INSERT INTO migration ("})
+	logged.Reset()
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrInjected))
+	assertEquals(t, 0, strings.Count(logged.String(), "retrying"))
+	faults.Reset()
+	faults.Inject(Fault{Match: "INSERT INTO migration (", Err: locked})
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, locked))
+	assertEquals(t, 2, strings.Count(logged.String(), "retrying"))
+
+	assertEquals(t, true, IsTransient(sqldriver.ErrBadConn))
+	assertEquals(t, true, IsTransient(errors.New("Error 1213 (40001): Deadlock found when trying to get lock")))
+	assertEquals(t, false, IsTransient(context.Canceled))
+	assertEquals(t, false, IsTransient(ErrInjected))
+}
+
+func TestSQLiteRetryRecordsOnce(t *testing.T) {
+	_, teardown := getTestSQLiteDB(t, "retry_once_test")
+	defer teardown()
+	faults := NewFaultInjector()
+	db, err := faults.Open("sqlite", "retry_once_test")
+	assertOk(t, err)
+	defer db.Close()
+
+	// the labels insert fails once, after the tracking row was written
+	faults.Inject(Fault{Match: "INSERT INTO migration_label", Statement: 1, Err: errors.New("database is locked")})
+	m := New(db, WithSQLite(), WithLabels(Labels{"team": "fulfilment"}),
+		WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	m.Register(Migration{
+		Name:          "001_create_crate",
+		Up:            `CREATE TABLE crate (id INTEGER PRIMARY KEY);`,
+		Down:          `DROP TABLE crate;`,
+		NoTransaction: true,
+		FollowUps:     []FollowUp{{Name: "analyze", SQL: `ANALYZE crate`}},
+	})
+	assertOk(t, m.RunLatest(false, false))
+	faults.Reset()
+
+	count := func(query string) int {
+		var n int
+		assertOk(t, db.QueryRow(query).Scan(&n))
+		return n
+	}
+	assertEquals(t, 1, count(`SELECT COUNT(*) FROM migration WHERE name = '001_create_crate'`))
+	assertEquals(t, 1, count(`SELECT COUNT(*) FROM migration_label WHERE migration = '001_create_crate'`))
+	assertEquals(t, 1, count(`SELECT COUNT(*) FROM migration_followup WHERE migration = '001_create_crate'`))
+}
+
+func TestSQLiteGenerateScript(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "script_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{Name: "001_create_ledger", Up: `CREATE TABLE ledger (id INTEGER PRIMARY KEY, memo TEXT);`, Down: `DROP TABLE ledger;`})
+
+	// the tracking table is created by the script on a new database
+	_, err := db.Exec(`DROP TABLE migration`)
+	assertOk(t, err)
+	var script bytes.Buffer
+	assertOk(t, m.GenerateScript(&script, ScriptOptions{}))
+	assertEquals(t, true, strings.HasPrefix(script.String(), "-- moogration script: sqlite\n-- batch 1, 1 migrations\n\nBEGIN;\n\nCREATE TABLE IF NOT EXISTS"))
+	exists, err := m.tableExists(context.Background())
+	assertOk(t, err)
+	assertEquals(t, false, exists)
+	assertOk(t, m.RunLatest(false, false))
+
+	m.Register(
+		Migration{Name: "002_seed_ledger", Up: `INSERT INTO ledger (memo) VALUES ('who''s paying? $1');`, Down: `DELETE FROM ledger;`, Labels: map[string]string{"ticket": "DBA-12"}},
+		Migration{Name: "003_index_ledger", Up: `CREATE INDEX ledger_memo ON ledger (memo);`, Down: `DROP INDEX ledger_memo;`},
+	)
+	script.Reset()
+	assertOk(t, m.GenerateScript(&script, ScriptOptions{AppliedBy: "dba"}))
+	assertEquals(t, true, strings.Contains(script.String(), "-- batch 2, 2 migrations"))
+	assertEquals(t, true, strings.Contains(script.String(), "-- migration: 002_seed_ledger\nINSERT INTO ledger (memo) VALUES ('who''s paying? $1');\n"))
+	seed, _ := m.registry.Get("002_seed_ledger")
+	assertEquals(t, true, strings.Contains(script.String(), "'002_seed_ledger', '"+seed.hash()+"', 2, 0, 'dba', NULL"))
+	assertEquals(t, true, strings.HasSuffix(script.String(), "COMMIT;\n"))
+
+	// generating the script writes nothing, and Verify confirms it was run
+	report, err := m.Verify()
+	assertOk(t, err)
+	assertEquals(t, "002_seed_ledger,003_index_ledger", strings.Join(report.Pending, ","))
+	_, err = db.Exec(script.String())
+	assertOk(t, err)
+	report, err = m.Verify()
+	assertOk(t, err)
+	assertEquals(t, 0, len(report.Pending))
+	assertEquals(t, 3, len(report.Verified))
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, 2, statuses[2].Batch)
+
+	m.Register(Migration{Name: "004_go", UpFunc: func(ctx context.Context, tx *sql.Tx) error { return nil }})
+	err = m.GenerateScript(&script, ScriptOptions{})
+	assertEquals(t, true, err != nil)
+}
+
+func TestSQLitePanicRollsBack(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "panic_tx_test")
+	defer teardown()
+
+	m := New(db, WithSQLite())
+	m.Register(Migration{
+		Name: "001_panic",
+		UpFunc: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `CREATE TABLE shelf (id INTEGER PRIMARY KEY)`)
+			assertOk(t, err)
+			panic("boom")
+		},
+	})
+
+	// the panicking migration's transaction is rolled back before the
+	// session is released, so the run returns instead of hanging
+	done := make(chan error, 1)
+	go func() { done <- m.RunLatest(false, false) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("run hung after a migration panicked")
+	}
+	var panicErr *PanicError
+	assertEquals(t, true, errors.As(err, &panicErr))
+	assertEquals(t, "001_panic", panicErr.Migration)
+	exists, err := m.hasTable(context.Background(), "shelf")
+	assertOk(t, err)
+	assertEquals(t, false, exists)
+}
+
+// panicWriter panics when written a line containing match
+type panicWriter struct {
+	match string
+}
+
+func (w panicWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), w.match) {
+		panic("boom")
+	}
+	return len(p), nil
+}
+
+func TestSQLitePanicMarksDirty(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "panic_dirty_test")
+	defer teardown()
+
+	// a panic outside a transaction marks the migration dirty even when the
+	// policy would skip an ordinary failure
+	migrations := []Migration{
+		{Name: "001_create_post", Up: `CREATE TABLE post (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE post;`},
+		{Name: "002_create_tag", Up: `CREATE TABLE tag (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE tag;`, NoTransaction: true},
+		{Name: "003_create_comment", Up: `CREATE TABLE comment (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE comment;`},
+	}
+	m := New(db, WithSQLite(), WithFailurePolicy(SkipAndContinue), WithLogger(log.New(panicWriter{match: "002_create_tag"}, "", 0)))
+	m.Register(migrations...)
+	err := m.RunLatest(false, false)
+	var panicErr *PanicError
+	assertEquals(t, true, errors.As(err, &panicErr))
+	assertEquals(t, "002_create_tag", panicErr.Migration)
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+
+	m = New(db, WithSQLite())
+	m.Register(migrations...)
+	statuses, err := m.Status()
+	assertOk(t, err)
+	assertEquals(t, true, statuses[1].Dirty)
+	assertEquals(t, false, statuses[2].Applied)
+	err = m.RunLatest(false, false)
+	assertEquals(t, true, errors.Is(err, ErrDirty))
+}
+
+func TestSQLiteHeartbeatVisible(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "heartbeat_test")
+	defer teardown()
+	faults := NewFaultInjector()
+	slow, err := faults.Open("sqlite", "heartbeat_test")
+	assertOk(t, err)
+	defer slow.Close()
+
+	lease := 300 * time.Millisecond
+	faults.Inject(Fault{Match: "CREATE TABLE kiln", Delay: 4 * lease})
+	m := New(slow, WithSQLite(), WithLockLease(lease))
+	m.Register(Migration{Name: "001_create_kiln", Up: `CREATE TABLE kiln (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE kiln;`})
+	done := make(chan error, 1)
+	go func() { done <- m.RunLatest(false, false) }()
+
+	// another connection sees the lease renewed while the migration runs
+	time.Sleep(2 * lease)
+	deadline := time.Now().Add(2 * lease)
+	for {
+		var heartbeatAt int64
+		err := db.QueryRow(`SELECT heartbeat_at FROM migration_lock_holder WHERE id = 1`).Scan(&heartbeatAt)
+		assertOk(t, err)
+		age := time.Since(time.UnixMilli(heartbeatAt))
+		if age < lease {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("heartbeat is %s old while the migration runs, past its lease of %s", age, lease)
+		}
+		time.Sleep(lease / 10)
+	}
+	assertOk(t, <-done)
+}
+
+func TestSQLiteTakeOverRace(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "takeover_race_test")
+	defer teardown()
+	ctx := context.Background()
+
+	// a holder whose lease expired a minute ago
+	crashed := New(db, WithSQLite(), WithLockLease(time.Second))
+	ok, err := crashed.tryLock(ctx, db)
+	assertOk(t, err)
+	assertEquals(t, true, ok)
+	crashed.recordLockHolder(ctx)
+	past := time.Now().Add(-time.Minute)
+	_, err = db.Exec("UPDATE migration_lock_holder SET acquired_at = ?, heartbeat_at = ?", past.Unix(), past.UnixMilli())
+	assertOk(t, err)
+
+	// two waiters see the same stale holder; the first takes the lock over
+	first := New(db, WithSQLite(), WithLockLease(time.Second))
+	second := New(db, WithSQLite(), WithLockLease(time.Second))
+	stale := first.lockHolder(ctx)
+	assertEquals(t, true, stale.stale(time.Now()))
+	assertOk(t, first.takeOver(ctx, stale))
+	ok, err = first.tryLock(ctx, db)
+	assertOk(t, err)
+	assertEquals(t, true, ok)
+	acquiredAt := first.recordLockHolder(ctx)
+
+	// the second loses the race, and leaves the first's lock alone
+	assertOk(t, second.takeOver(ctx, stale))
+	ok, err = second.tryLock(ctx, db)
+	assertOk(t, err)
+	assertEquals(t, false, ok)
+
+	// the crashed holder, coming back, doesn't release its successor's lock
+	crashed.releaseLock(db, func(bool) {}, past.Unix())
+	ok, err = second.tryLock(ctx, db)
+	assertOk(t, err)
+	assertEquals(t, false, ok)
+	assertEquals(t, true, first.lockHolder(ctx) != nil)
+
+	first.releaseLock(db, func(bool) {}, acquiredAt)
+	ok, err = second.tryLock(ctx, db)
+	assertOk(t, err)
+	assertEquals(t, true, ok)
+}
+
+func TestSQLiteDryRunRefusesWrites(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "dry_run_writes_test")
+	defer teardown()
+
+	migrations := []Migration{
+		{Name: "001_create_till", Up: `CREATE TABLE till (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE till;`},
+		{Name: "002_create_drawer", Up: `CREATE TABLE drawer (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE drawer;`},
+	}
+	m := New(db, WithSQLite())
+	m.Register(migrations[0])
+	assertOk(t, m.RunLatest(false, false))
+	records := func() string {
+		rows, err := db.Query(`SELECT name, sql_hash, batch FROM migration ORDER BY id`)
+		assertOk(t, err)
+		defer rows.Close()
+		var b strings.Builder
+		for rows.Next() {
+			var name, hash string
+			var batch int
+			assertOk(t, rows.Scan(&name, &hash, &batch))
+			fmt.Fprintf(&b, "%s %s %d;", name, hash, batch)
+		}
+		return b.String()
+	}
+	before := records()
+
+	dry := New(db, WithSQLite(), WithDryRun())
+	dry.Register(migrations...)
+	tx, err := db.Begin()
+	assertOk(t, err)
+	defer tx.Rollback()
+	operations := map[string]func() error{
+		"MigrateTo":         func() error { return dry.MigrateTo("002_create_drawer") },
+		"Redo":              func() error { return dry.Redo("001_create_till") },
+		"RollbackMigration": func() error { return dry.RollbackMigration("001_create_till", false) },
+		"Baseline":          func() error { _, err := dry.Baseline("002_create_drawer"); return err },
+		"RunDueFollowUps":   func() error { return dry.RunDueFollowUps() },
+		"Prune":             func() error { _, err := dry.Prune(0); return err },
+		"RepairHashes":      func() error { _, err := dry.RepairHashes(); return err },
+		"Squash":            func() error { _, err := dry.Squash("003_squashed"); return err },
+		"ResolveDirty":      func() error { return dry.ResolveDirty("001_create_till", true) },
+		"ApplyDelta":        func() error { return dry.ApplyDelta(NewManifest(migrations[:1]), false) },
+		"LoadSchema":        func() error { return dry.LoadSchema(strings.NewReader(dumpHeader + "sqlite\n")) },
+		"RunAllInTx":        func() error { return dry.RunAllInTx(tx) },
+	}
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			assertEquals(t, true, errors.Is(operation(), ErrDryRun))
+			assertEquals(t, before, records())
+		})
+	}
+}
+
+func TestSQLiteLatestBatchErrors(t *testing.T) {
+	db, teardown := getTestSQLiteDB(t, "latest_batch_test")
+	defer teardown()
+	ctx := context.Background()
+
+	m := New(db, WithSQLite())
+	batch, err := m.latestBatch(ctx)
+	assertOk(t, err)
+	assertEquals(t, 0, batch)
+
+	m.Register(Migration{Name: "001_create_bin", Up: `CREATE TABLE bin (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE bin;`})
+	assertOk(t, m.RunLatest(false, false))
+	batch, err = m.latestBatch(ctx)
+	assertOk(t, err)
+	assertEquals(t, 1, batch)
+
+	// a failed query is an error, not batch 0
+	missing := New(db, WithSQLite(), WithTableName("no_such_table"))
+	_, err = missing.latestBatch(ctx)
+	assertEquals(t, true, err != nil)
+}
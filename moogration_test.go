@@ -0,0 +1,819 @@
+package moogration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// swap in an empty registry for the duration of a test
+func withEmptyRegistry(t *testing.T) {
+	previous := defaultRegistry
+	defaultRegistry = NewRegistry()
+	t.Cleanup(func() {
+		defaultRegistry = previous
+	})
+}
+
+func TestMigrationHashCache(t *testing.T) {
+	withEmptyRegistry(t)
+
+	m := Migration{
+		Name: "001_test_migration",
+		Up:   "CREATE TABLE test_table (id INTEGER);",
+		Down: "DROP TABLE test_table;",
+	}
+	Register(m)
+
+	registered := &defaultRegistry.migrations[0]
+	assertEquals(t, m.hash(), registered.digest)
+
+	registered.SetDown("DROP TABLE IF EXISTS test_table;")
+	assertEquals(t, "", registered.digest)
+	assertEquals(t, registered.computeHash(), registered.hash())
+	assertEquals(t, false, m.hash() == registered.hash())
+}
+
+func TestMustRegisterDuplicate(t *testing.T) {
+	withEmptyRegistry(t)
+
+	m := Migration{Name: "001_test_migration", Up: "SELECT 1;", Down: "SELECT 1;"}
+	MustRegister(m)
+
+	defer func() {
+		r := recover()
+		msg := fmt.Sprint(r)
+		assertEquals(t, true, strings.Contains(msg, "'001_test_migration'"))
+		assertEquals(t, true, strings.Contains(msg, "moogration_test.go"))
+		assertEquals(t, 1, len(defaultRegistry.migrations))
+	}()
+	func() {
+		// as is a name repeated within one call, which registers nothing
+		defer func() {
+			assertEquals(t, true, strings.Contains(fmt.Sprint(recover()), "'002_test_migration' registered twice"))
+		}()
+		other := Migration{Name: "002_test_migration", Up: "SELECT 2;", Down: "SELECT 2;"}
+		MustRegister(other, other)
+	}()
+	MustRegister(m)
+}
+
+func TestManifestDelta(t *testing.T) {
+	m1 := Migration{Name: "001_test_migration1", Up: "SELECT 1;", Down: "SELECT 1;"}
+	m2 := Migration{Name: "002_test_migration2", Up: "SELECT 2;", Down: "SELECT 2;"}
+	m3 := Migration{Name: "003_test_migration3", Up: "SELECT 3;", Down: "SELECT 3;"}
+
+	previous := NewManifest([]Migration{m2, m1})
+
+	var buf bytes.Buffer
+	assertOk(t, previous.Write(&buf))
+	decoded, err := ReadManifest(&buf)
+	assertOk(t, err)
+
+	delta, err := decoded.Delta([]Migration{m3, m1, m2})
+	assertOk(t, err)
+	assertEquals(t, 1, len(delta))
+	assertEquals(t, m3.Name, delta[0].Name)
+
+	// an early migration was rewritten
+	rewritten := m1
+	rewritten.SetUp("SELECT 10;")
+	_, err = decoded.Delta([]Migration{rewritten, m2, m3})
+	assertEquals(t, true, err != nil)
+
+	// a migration was inserted before the end of the previous set
+	inserted := Migration{Name: "001a_test_migration", Up: "SELECT 4;", Down: "SELECT 4;"}
+	_, err = decoded.Delta([]Migration{m1, inserted, m2, m3})
+	assertEquals(t, true, err != nil)
+
+	// a migration was removed
+	_, err = decoded.Delta([]Migration{m1})
+	assertEquals(t, true, err != nil)
+}
+
+func TestRegistryInclude(t *testing.T) {
+	billing := NewRegistry()
+	billing.Register(
+		Migration{Name: "002_create_invoices", Up: "CREATE TABLE invoices (id int);", Down: "DROP TABLE invoices;"},
+		Migration{Name: "001_create_users", Up: "CREATE TABLE users (id int);", Down: "DROP TABLE users;"},
+	)
+
+	auth := NewRegistry()
+	auth.Register(
+		Migration{Name: "001_create_users", Up: "CREATE TABLE users (id int);", Down: "DROP TABLE users;"},
+		Migration{Name: "003_create_sessions", Up: "CREATE TABLE sessions (id int);", Down: "DROP TABLE sessions;"},
+	)
+
+	app := NewRegistry()
+	assertOk(t, app.Include(billing, auth))
+
+	migrations := app.Migrations()
+	assertEquals(t, 3, len(migrations))
+	assertEquals(t, "001_create_users", migrations[0].Name)
+	assertEquals(t, "002_create_invoices", migrations[1].Name)
+	assertEquals(t, "003_create_sessions", migrations[2].Name)
+
+	conflicting := NewRegistry()
+	conflicting.Register(Migration{Name: "001_create_users", Up: "CREATE TABLE users (id bigint);", Down: "DROP TABLE users;"})
+	err := app.Include(conflicting)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, true, strings.Contains(err.Error(), "moogration_test.go"))
+	assertEquals(t, 3, len(app.Migrations()))
+}
+
+func TestRebind(t *testing.T) {
+	query := "INSERT INTO migration (name, sql_hash, batch) VALUES (?, ?, ?)"
+	assertEquals(t, query, mysql.rebind(query))
+	assertEquals(t, query, sqlite.rebind(query))
+	assertEquals(t, "INSERT INTO migration (name, sql_hash, batch) VALUES ($1, $2, $3)", postgres.rebind(query))
+}
+
+func TestRegisterFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/002_create_posts.up.sql":   {Data: []byte("CREATE TABLE posts (id int);")},
+		"migrations/002_create_posts.down.sql": {Data: []byte("DROP TABLE posts;")},
+		"migrations/001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id int);")},
+		"migrations/001_create_users.down.sql": {Data: []byte("DROP TABLE users;")},
+		"migrations/README.md":                 {Data: []byte("not a migration")},
+	}
+
+	r := NewRegistry()
+	assertOk(t, r.RegisterFS(fsys, "migrations"))
+
+	migrations := r.Migrations()
+	assertEquals(t, 2, len(migrations))
+	assertEquals(t, "001_create_users", migrations[0].Name)
+	assertEquals(t, "CREATE TABLE users (id int);", migrations[0].Up)
+	assertEquals(t, "DROP TABLE users;", migrations[0].Down)
+	assertEquals(t, "002_create_posts", migrations[1].Name)
+
+	delete(fsys, "migrations/002_create_posts.down.sql")
+	r = NewRegistry()
+	err := r.RegisterFS(fsys, "migrations")
+	assertEquals(t, true, err != nil)
+	assertEquals(t, true, strings.Contains(err.Error(), "002_create_posts.up.sql"))
+	assertEquals(t, 0, len(r.Migrations()))
+
+	// headers may follow a blank line, and a typo is only reported in
+	// strict mode
+	fsys["migrations/002_create_posts.down.sql"] = &fstest.MapFile{Data: []byte("DROP TABLE posts;")}
+	fsys["migrations/002_create_posts.up.sql"] = &fstest.MapFile{Data: []byte("-- create posts\n\n-- squashes: 000_a, 000_b\n-- min-app-version: 1.2.0\nCREATE TABLE posts (id int);")}
+	r = NewRegistry()
+	assertOk(t, r.RegisterFS(fsys, "migrations"))
+	posts, _ := r.Get("002_create_posts")
+	assertEquals(t, "000_a,000_b", strings.Join(posts.Squashes, ","))
+	assertEquals(t, "", posts.MinAppVersion)
+	r = NewRegistry()
+	r.SetStrictHeaders(true)
+	err = r.RegisterFS(fsys, "migrations")
+	assertEquals(t, true, err != nil)
+	assertEquals(t, true, strings.Contains(err.Error(), "min-app-version"))
+	assertEquals(t, 0, len(r.Migrations()))
+}
+
+func FuzzSplitSQL(f *testing.F) {
+	f.Add("CREATE TABLE t (id int); INSERT INTO t VALUES ('a;b');")
+	f.Add("DELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; END //\nDELIMITER ;\n")
+	f.Add("CREATE TRIGGER tr AFTER INSERT ON t BEGIN UPDATE t SET n = CASE WHEN n > 1 THEN 1 END; END;")
+	f.Add("DO $$ BEGIN PERFORM 1; END $$; SELECT $1::int; -- c\n/* c */ /*! x */")
+	f.Fuzz(func(t *testing.T, sql string) {
+		for _, d := range []driver{"", mysql, sqlite, postgres} {
+			for _, stmt := range splitSQL(sql, d) {
+				if stmt == "" || stmt != strings.TrimSpace(stmt) {
+					t.Fatalf("%s: statement %q isn't trimmed", d, stmt)
+				}
+			}
+		}
+	})
+}
+
+func FuzzFrontMatter(f *testing.F) {
+	f.Add("-- squashes: 001_a, 002_b\n-- min app version: 1.2.0\nCREATE TABLE t (id int);")
+	f.Add("\n-- note\n\n-- Squashes:001_a,,\n-- min-app-version: 1\nSELECT 1;")
+	f.Add("--squashes:\n--: x\n-- a: b")
+	f.Fuzz(func(t *testing.T, up string) {
+		fm, err := parseFrontMatter(up, false)
+		if err != nil {
+			t.Fatalf("lenient parse failed: %s", err)
+		}
+		for _, name := range fm.squashes {
+			if name == "" || name != strings.TrimSpace(name) || strings.Contains(name, ",") {
+				t.Fatalf("squashed name %q isn't a trimmed name", name)
+			}
+		}
+		strict, err := parseFrontMatter(up, true)
+		if err == nil && (strings.Join(strict.squashes, ",") != strings.Join(fm.squashes, ",") || strict.minAppVersion != fm.minAppVersion) {
+			t.Fatalf("strict parse read %+v, lenient %+v", strict, fm)
+		}
+	})
+}
+
+func FuzzNextName(f *testing.F) {
+	f.Add(0, "create users", "001_a\n20240115120000_b")
+	f.Add(1, "Add Index", "0009_a\n0002_b\nx")
+	f.Add(2, "  ", "20240115120100_a\n99999999999999999999_b")
+	f.Add(1, "x", "9223372036854775807_a")
+	f.Add(2, "x", "99991231235959_a")
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	f.Fuzz(func(t *testing.T, strategy int, description, existing string) {
+		s := NameStrategy(strategy % 3)
+		if s < 0 {
+			s = -s
+		}
+		names := strings.Split(existing, "\n")
+		name := s.nextName(description, names, now)
+		if nameStrategy(name) == AnyNames {
+			t.Fatalf("%s name %q has no prefix", s, name)
+		}
+		for _, existing := range names {
+			if name == existing {
+				t.Fatalf("%s name %q already exists", s, name)
+			}
+		}
+	})
+}
+
+func TestThrottle(t *testing.T) {
+	m := New(nil, WithPause(20*time.Millisecond))
+	state := m.newRunState()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assertOk(t, state.throttle.wait(context.Background(), m))
+	}
+	assertEquals(t, true, time.Since(start) >= 40*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := state.throttle.wait(ctx, m)
+	assertEquals(t, true, errors.Is(err, context.Canceled))
+
+	m = New(nil, WithMaxPerMinute(60*50))
+	assertEquals(t, 20*time.Millisecond, m.interval)
+}
+
+func TestWriteGitHubAnnotations(t *testing.T) {
+	t.Setenv("GITHUB_WORKSPACE", "/src/app")
+	findings := []Finding{
+		{Severity: SeverityError, Migration: "001_users", File: "/src/app/migrations/users.go", Line: 12, Message: "changed,\nsince applied"},
+		{Severity: SeverityWarning, Migration: "002_posts", Message: "not registered"},
+	}
+
+	var buf bytes.Buffer
+	assertOk(t, WriteGitHubAnnotations(&buf, findings))
+	expected := "::error title=moogration%3A 001_users,file=migrations/users.go,line=12::changed,%0Asince applied\n" +
+		"::warning title=moogration%3A 002_posts::not registered\n"
+	assertEquals(t, expected, buf.String())
+}
+
+func TestAnalyzeStatement(t *testing.T) {
+	stmts := splitStatements(`
+		-- comments and quoted semicolons don't split statements
+		ALTER TABLE posts ADD COLUMN slug VARCHAR(255), DROP COLUMN legacy;
+		CREATE INDEX idx_posts_slug ON posts (slug, created_at DESC);
+		UPDATE posts SET title = 'a;b' WHERE id = 1;
+		DELETE FROM sessions;
+	`)
+	assertEquals(t, 4, len(stmts))
+
+	alter := analyzeStatement(stmts[0])
+	assertEquals(t, "ALTER TABLE", alter.Operation)
+	assertEquals(t, "posts", alter.Table)
+	assertEquals(t, "slug,legacy", strings.Join(alter.Columns, ","))
+	assertEquals(t, RiskHigh, alter.Risk)
+
+	index := analyzeStatement(stmts[1])
+	assertEquals(t, "idx_posts_slug", index.Index)
+	assertEquals(t, "slug,created_at", strings.Join(index.Columns, ","))
+
+	update := analyzeStatement(stmts[2])
+	assertEquals(t, "title", strings.Join(update.Columns, ","))
+	assertEquals(t, RiskLow, update.Risk)
+
+	del := analyzeStatement(stmts[3])
+	assertEquals(t, "sessions", del.Table)
+	assertEquals(t, RiskHigh, del.Risk)
+}
+
+func TestConstraintChecks(t *testing.T) {
+	checks := constraintChecks(Migration{
+		Name: "001_constraints",
+		Up: `ALTER TABLE posts ALTER COLUMN title SET NOT NULL, ADD CONSTRAINT posts_slug_key UNIQUE (slug);
+			ALTER TABLE comments ADD CONSTRAINT comments_post_fk FOREIGN KEY (post_id) REFERENCES posts (id);
+			CREATE UNIQUE INDEX users_email ON users (email);
+			ALTER TABLE users ADD COLUMN age INT NOT NULL DEFAULT 0;`,
+	})
+	assertEquals(t, 4, len(checks))
+	assertEquals(t, "SELECT COUNT(*) FROM posts WHERE title IS NULL", checks[0].Query)
+	assertEquals(t, "UNIQUE", checks[1].Constraint)
+	assertEquals(t, "slug", checks[1].Columns[0])
+	assertEquals(t, "SELECT COUNT(*) FROM comments child WHERE child.post_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM posts parent WHERE parent.id = child.post_id)", checks[2].Query)
+	assertEquals(t, "users", checks[3].Table)
+}
+
+func TestValidateLater(t *testing.T) {
+	add, validate, err := ValidateLater(Migration{
+		Name: "004_add_post_author_fk",
+		Up: `ALTER TABLE posts ADD CONSTRAINT posts_author_fk FOREIGN KEY (author_id) REFERENCES users (id),
+				ADD CONSTRAINT posts_title_check CHECK (length(title) > 0);
+			CREATE INDEX posts_author_id ON posts (author_id);`,
+		Down: `ALTER TABLE posts DROP CONSTRAINT posts_author_fk, DROP CONSTRAINT posts_title_check;`,
+	})
+	assertOk(t, err)
+	assertEquals(t, "ALTER TABLE posts ADD CONSTRAINT posts_author_fk FOREIGN KEY (author_id) REFERENCES users (id) NOT VALID, "+
+		"ADD CONSTRAINT posts_title_check CHECK (length(title) > 0) NOT VALID;\nCREATE INDEX posts_author_id ON posts (author_id);", add.Up)
+	assertEquals(t, add.computeHash(), add.hash())
+	assertEquals(t, "004_add_post_author_fk_validate", validate.Name)
+	assertEquals(t, "ALTER TABLE posts VALIDATE CONSTRAINT posts_author_fk;\nALTER TABLE posts VALIDATE CONSTRAINT posts_title_check;", validate.Up)
+
+	_, _, err = ValidateLater(Migration{Name: "005_no_constraints", Up: `CREATE TABLE t (id INT);`})
+	assertEquals(t, true, err != nil)
+}
+
+func TestSplitSQL(t *testing.T) {
+	cases := []struct {
+		name     string
+		driver   driver
+		sql      string
+		expected []string
+	}{
+		{
+			name:     "literals and comments",
+			driver:   mysql,
+			sql:      "INSERT INTO t VALUES ('a;b', 'it\\'s;'); -- trailing; comment\n# hash; comment\nSELECT \"x;\" /* c; */ FROM `t;`;",
+			expected: []string{"INSERT INTO t VALUES ('a;b', 'it\\'s;')", "SELECT \"x;\"   FROM `t;`"},
+		},
+		{
+			name:     "executable comments are kept",
+			driver:   mysql,
+			sql:      "/*!40101 SET NAMES utf8 */; SELECT /*+ MAX_EXECUTION_TIME(1) */ 1;",
+			expected: []string{"/*!40101 SET NAMES utf8 */", "SELECT /*+ MAX_EXECUTION_TIME(1) */ 1"},
+		},
+		{
+			name:   "delimiter",
+			driver: mysql,
+			sql: "DELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END //\n" +
+				"delimiter ;\nSELECT 3;",
+			expected: []string{"CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END", "SELECT 3"},
+		},
+		{
+			name:   "trigger block",
+			driver: sqlite,
+			sql: `CREATE TRIGGER tr AFTER INSERT ON t BEGIN
+				UPDATE t SET n = CASE WHEN n > 1 THEN 1 ELSE 0 END;
+				DELETE FROM u;
+			END;
+			BEGIN TRANSACTION; SELECT 'C:\';`,
+			expected: []string{
+				"CREATE TRIGGER tr AFTER INSERT ON t BEGIN\n\t\t\t\tUPDATE t SET n = CASE WHEN n > 1 THEN 1 ELSE 0 END;\n\t\t\t\tDELETE FROM u;\n\t\t\tEND",
+				"BEGIN TRANSACTION",
+				"SELECT 'C:\\'",
+			},
+		},
+		{
+			name:   "dollar quotes",
+			driver: postgres,
+			sql: "CREATE FUNCTION f() RETURNS int AS $body$ BEGIN RETURN 1; END; $body$ LANGUAGE plpgsql;\n" +
+				"DO $$ BEGIN PERFORM 1; END $$; SELECT $1::int;",
+			expected: []string{
+				"CREATE FUNCTION f() RETURNS int AS $body$ BEGIN RETURN 1; END; $body$ LANGUAGE plpgsql",
+				"DO $$ BEGIN PERFORM 1; END $$",
+				"SELECT $1::int",
+			},
+		},
+		{
+			name:   "procedure control flow",
+			driver: mysql,
+			sql: "DELIMITER $$\nCREATE PROCEDURE p() BEGIN IF 1 THEN SELECT 1; END IF; CASE 1 WHEN 1 THEN SELECT 2; END CASE; END$$\n" +
+				"DELIMITER ;\nCREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN SET NEW.a = 1; SET NEW.b = 2; END; SELECT 1;",
+			expected: []string{
+				"CREATE PROCEDURE p() BEGIN IF 1 THEN SELECT 1; END IF; CASE 1 WHEN 1 THEN SELECT 2; END CASE; END",
+				"CREATE TRIGGER tr BEFORE INSERT ON t FOR EACH ROW BEGIN SET NEW.a = 1; SET NEW.b = 2; END",
+				"SELECT 1",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stmts := splitSQL(c.sql, c.driver)
+			assertEquals(t, strings.Join(c.expected, "\n--\n"), strings.Join(stmts, "\n--\n"))
+		})
+	}
+}
+
+func TestRequiredPrivileges(t *testing.T) {
+	describe := func(stmt string) string {
+		descriptions := []string{}
+		for _, r := range requiredPrivileges(stmt) {
+			descriptions = append(descriptions, r.privilege+" "+r.table)
+		}
+		return strings.Join(descriptions, ",")
+	}
+	assertEquals(t, "CREATE posts", describe("CREATE TABLE IF NOT EXISTS posts (id int)"))
+	assertEquals(t, "ALTER app.posts", describe("ALTER TABLE app.posts ADD COLUMN slug text"))
+	assertEquals(t, "INDEX posts", describe("CREATE INDEX idx_slug ON posts (slug)"))
+	assertEquals(t, "DROP posts", describe("DROP TABLE posts"))
+	assertEquals(t, "ALTER posts,DROP posts", describe("RENAME TABLE posts TO articles"))
+	assertEquals(t, "", describe("INSERT INTO posts VALUES (1)"))
+
+	schema, table := splitTableName("`app`.`posts`")
+	assertEquals(t, "app", schema)
+	assertEquals(t, "posts", table)
+}
+
+func TestOnlineDDLPolicy(t *testing.T) {
+	m := Migration{Name: "001_alter"}
+	apply := func(mg *Migrator, m Migration, stmt string) (string, error) {
+		result, _, err := mg.applyOnlineDDL(m, stmt)
+		return result, err
+	}
+
+	appending := New(nil, WithMySQL(), WithOnlineDDL(OnlineDDLAppend))
+	stmt, err := apply(appending, m, "ALTER TABLE post ADD COLUMN lock_id INT")
+	assertOk(t, err)
+	assertEquals(t, "ALTER TABLE post ADD COLUMN lock_id INT, ALGORITHM=INPLACE, LOCK=NONE", stmt)
+
+	stmt, err = apply(appending, m, "ALTER TABLE post ADD COLUMN slug TEXT, ALGORITHM=INSTANT")
+	assertOk(t, err)
+	assertEquals(t, "ALTER TABLE post ADD COLUMN slug TEXT, ALGORITHM=INSTANT, LOCK=NONE", stmt)
+
+	stmt, err = apply(appending, m, "CREATE TABLE post (id INT)")
+	assertOk(t, err)
+	assertEquals(t, "CREATE TABLE post (id INT)", stmt)
+
+	_, err = apply(appending, m, "ALTER TABLE post MODIFY title TEXT, ALGORITHM=COPY")
+	assertEquals(t, true, errors.Is(err, ErrTableCopy))
+
+	allowed := Migration{Name: "002_copy", AllowTableCopy: true}
+	stmt, err = apply(appending, allowed, "ALTER TABLE post MODIFY title TEXT, ALGORITHM=COPY")
+	assertOk(t, err)
+	assertEquals(t, "ALTER TABLE post MODIFY title TEXT, ALGORITHM=COPY", stmt)
+
+	requiring := New(nil, WithMySQL(), WithOnlineDDL(OnlineDDLRequire))
+	_, err = apply(requiring, m, "ALTER TABLE post ADD COLUMN slug TEXT")
+	assertEquals(t, true, errors.Is(err, ErrOnlineDDLRequired))
+	_, err = apply(requiring, m, "ALTER TABLE post ADD COLUMN slug TEXT, ALGORITHM=INPLACE, LOCK=NONE")
+	assertOk(t, err)
+
+	// strict mode appends by default, and other dialects are untouched
+	assertEquals(t, OnlineDDLAppend, New(nil, WithMySQL(), WithStrict()).onlineDDLPolicy())
+	assertEquals(t, OnlineDDLOff, New(nil, WithMySQL()).onlineDDLPolicy())
+	stmt, err = apply(New(nil, WithSQLite(), WithOnlineDDL(OnlineDDLRequire)), m, "ALTER TABLE post ADD COLUMN slug TEXT")
+	assertOk(t, err)
+	assertEquals(t, "ALTER TABLE post ADD COLUMN slug TEXT", stmt)
+}
+
+func TestOSCCommand(t *testing.T) {
+	pt := OSCConfig{Tool: PTOnlineSchemaChange, Host: "db1", Port: 3306, DefaultsFile: "/etc/my.cnf", Args: []string{"--max-load", "Threads_running=50"}}
+	path, args := pt.command("app", "post", "ADD COLUMN slug TEXT")
+	assertEquals(t, "pt-online-schema-change", path)
+	assertEquals(t, "--dry-run|--alter|ADD COLUMN slug TEXT|F=/etc/my.cnf,h=db1,P=3306,D=app,t=post|--max-load|Threads_running=50", strings.Join(args, "|"))
+
+	ghost := OSCConfig{Tool: GhOst, Path: "/usr/local/bin/gh-ost", User: "migrator"}
+	path, args = ghost.command("app", "post", "ADD COLUMN slug TEXT")
+	assertEquals(t, "/usr/local/bin/gh-ost", path)
+	assertEquals(t, "--database=app|--table=post|--alter=ADD COLUMN slug TEXT|--user=migrator", strings.Join(args, "|"))
+
+	warnings := oscWarnings("Operation, tries, wait:\n  copy_rows, 10, 0.25\n# WARNING: the table has no primary key\nDry run complete.\n")
+	assertEquals(t, "# WARNING: the table has no primary key", strings.Join(warnings, "|"))
+}
+
+func TestCompareGolden(t *testing.T) {
+	mg := New(nil, WithMySQL(), WithOnlineDDL(OnlineDDLAppend))
+	mg.Register(
+		Migration{Name: "002_add_slug", Up: `ALTER TABLE post ADD COLUMN slug TEXT; UPDATE post SET slug = id;`, Down: `ALTER TABLE post DROP COLUMN slug;`},
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INT);`, Down: `DROP TABLE post;`},
+	)
+
+	var rendered bytes.Buffer
+	assertOk(t, mg.Render(&rendered))
+	assertEquals(t, `-- migration: 001_create_post
+-- up
+CREATE TABLE post (id INT);
+-- down
+DROP TABLE post;
+-- migration: 002_add_slug
+-- up
+ALTER TABLE post ADD COLUMN slug TEXT, ALGORITHM=INPLACE, LOCK=NONE;
+UPDATE post SET slug = id;
+-- down
+ALTER TABLE post DROP COLUMN slug, ALGORITHM=INPLACE, LOCK=NONE;
+`, rendered.String())
+
+	path := t.TempDir() + "/migrations.golden"
+	assertOk(t, mg.CompareGolden(path, true))
+	assertOk(t, mg.CompareGolden(path, false))
+
+	mg.Register(Migration{Name: "003_drop_post", Up: `DROP TABLE post;`})
+	err := mg.CompareGolden(path, false)
+	assertEquals(t, true, errors.Is(err, ErrGoldenMismatch))
+	assertEquals(t, true, strings.Contains(err.Error(), `line 12: golden "", rendered "-- migration: 003_drop_post"`))
+}
+
+func TestRegistryIntrospection(t *testing.T) {
+	r := NewRegistry()
+	r.Register(
+		Migration{Name: "002_add_slug", Up: `ALTER TABLE post ADD COLUMN slug TEXT;`, Labels: Labels{"team": "content"}},
+		Migration{Name: "001_create_post", Up: `CREATE TABLE post (id INT);`, Down: `DROP TABLE post;`, NoTransaction: true, Description: "Posts", Tags: []string{"content"}},
+	)
+	assertEquals(t, 2, r.Count())
+
+	m, ok := r.Get("001_create_post")
+	assertEquals(t, true, ok)
+	assertEquals(t, `DROP TABLE post;`, m.Down)
+	_, ok = r.Get("003_missing")
+	assertEquals(t, false, ok)
+
+	// Get returns a copy
+	m.Down = ``
+	m, _ = r.Get("001_create_post")
+	assertEquals(t, `DROP TABLE post;`, m.Down)
+
+	infos := r.List()
+	assertEquals(t, 2, len(infos))
+	assertEquals(t, "001_create_post", infos[0].Name)
+	assertEquals(t, true, infos[0].NoTransaction)
+	assertEquals(t, m.hash(), infos[0].Hash)
+	assertEquals(t, true, strings.Contains(infos[0].RegisteredAt, "moogration_test.go:"))
+	assertEquals(t, "team=content", infos[1].Labels.String())
+
+	info, ok := r.Info("001_create_post")
+	assertEquals(t, true, ok)
+	assertEquals(t, "Posts", info.Description)
+	assertEquals(t, "content", strings.Join(info.Tags, ","))
+	assertEquals(t, true, info.Registered)
+	assertEquals(t, false, info.Applied)
+}
+
+func TestSnippets(t *testing.T) {
+	r := NewRegistry()
+	assertOk(t, r.DefineSnippet("timestamps", "created_at TIMESTAMP NOT NULL, updated_at TIMESTAMP NOT NULL"))
+	assertOk(t, r.DefineSnippet("drop", "DROP TABLE {{ . }};"))
+	assertEquals(t, true, r.DefineSnippet("broken", "{{ template ") != nil)
+
+	r.Register(Migration{
+		Name:     "001_create_post",
+		Up:       `CREATE TABLE post (id INT, {{ template "timestamps" }});`,
+		Down:     `{{ template "drop" "post" }}`,
+		Template: true,
+	})
+	m, _ := r.Get("001_create_post")
+	assertEquals(t, `CREATE TABLE post (id INT, created_at TIMESTAMP NOT NULL, updated_at TIMESTAMP NOT NULL);`, m.Up)
+	assertEquals(t, `DROP TABLE post;`, m.Down)
+	assertEquals(t, Migration{Up: m.Up, Down: m.Down}.hash(), m.hash())
+
+	// without Template, braces are left alone
+	r.Register(Migration{Name: "002_literal", Up: `SELECT '{{ x }}';`})
+	m, _ = r.Get("002_literal")
+	assertEquals(t, `SELECT '{{ x }}';`, m.Up)
+
+	defer func() {
+		recovered := fmt.Sprint(recover())
+		assertEquals(t, true, strings.Contains(recovered, `migration '003_unknown'`))
+		assertEquals(t, true, strings.Contains(recovered, `template "soft_delete" not defined`))
+	}()
+	r.Register(Migration{Name: "003_unknown", Up: `{{ template "soft_delete" }}`, Template: true})
+}
+
+func TestAuditMigration(t *testing.T) {
+	m, err := auditMigration(postgres, AuditTable{Name: "post"})
+	assertOk(t, err)
+	assertEquals(t, true, m.Repeatable)
+	assertEquals(t, true, strings.Contains(m.Up, "to_jsonb(NEW)"))
+	// history table, function, drop and create trigger
+	assertEquals(t, 4, len(splitSQL(m.Up, postgres)))
+
+	m, err = auditMigration(mysql, AuditTable{Name: "post", Columns: []string{"id", "title"}})
+	assertOk(t, err)
+	assertEquals(t, true, strings.Contains(m.Up, "JSON_OBJECT('id', OLD.id, 'title', OLD.title)"))
+	assertEquals(t, 7, len(splitSQL(m.Up, mysql)))
+	assertEquals(t, 3, len(splitSQL(m.Down, mysql)))
+
+	_, err = auditMigration(mysql, AuditTable{Name: "post"})
+	assertEquals(t, true, err != nil)
+}
+
+func TestDefineConventions(t *testing.T) {
+	mg := New(nil, WithMySQL())
+	assertOk(t, mg.DefineConventions(Conventions{DeletedAt: "removed_at"}))
+	mg.Register(Migration{
+		Name:     "001_create_post",
+		Up:       `CREATE TABLE post (id INT, {{ template "timestamps" }}, {{ template "soft_delete" }}); {{ template "soft_delete_index" "post" }}`,
+		Template: true,
+	})
+	m, _ := mg.Registry().Get("001_create_post")
+	assertEquals(t, "CREATE TABLE post (id INT, "+
+		"created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, "+
+		"updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, "+
+		"removed_at TIMESTAMP NULL); CREATE INDEX post_removed_at ON post (removed_at);", m.Up)
+
+	mg = New(nil, WithPostgres())
+	assertOk(t, mg.DefineConventions(Conventions{}))
+	mg.Register(Migration{Name: "001_create_post", Up: `{{ template "timestamps" }} {{ template "timestamp_indexes" "post" }}`, Template: true})
+	m, _ = mg.Registry().Get("001_create_post")
+	assertEquals(t, "created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP, updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP "+
+		"CREATE INDEX post_created_at ON post (created_at);", m.Up)
+}
+
+func TestValidateForeignKeyOrder(t *testing.T) {
+	r := NewRegistry()
+	r.Register(Migration{Name: "001_create_user", Up: `CREATE TABLE user (id INT PRIMARY KEY, manager_id INT REFERENCES user (id));`, Down: `DROP TABLE IF EXISTS user;`})
+	r.Register(Migration{Name: "002_create_post", Up: `CREATE TABLE post (id INT, category_id INT REFERENCES category (id), author_id INT REFERENCES user (id));`, Down: `DROP TABLE IF EXISTS post;`})
+	r.Register(Migration{Name: "003_create_category", Up: "CREATE TABLE `category` (id INT, account_id INT REFERENCES account (id));", Down: `DROP TABLE IF EXISTS category;`})
+	r.Register(Migration{Name: "004_link_comment", Up: `ALTER TABLE post ADD CONSTRAINT post_comment_fk FOREIGN KEY (comment_id) REFERENCES "public"."comment" (id);`, Down: `ALTER TABLE post DROP CONSTRAINT post_comment_fk;`})
+	r.Register(Migration{Name: "005_create_comment", Up: `CREATE TABLE IF NOT EXISTS public.comment (id INT);`, Down: `DROP TABLE IF EXISTS public.comment;`})
+
+	findings := r.Validate()
+	assertEquals(t, 2, len(findings))
+	assertEquals(t, "002_create_post", findings[0].Migration)
+	assertEquals(t, SeverityError, findings[0].Severity)
+	assertEquals(t, "migration '002_create_post' references table 'category', which is created by the later migration '003_create_category'", findings[0].Message)
+	assertEquals(t, true, strings.HasSuffix(findings[0].File, "moogration_test.go"))
+	assertEquals(t, "004_link_comment", findings[1].Migration)
+	assertEquals(t, true, strings.Contains(findings[1].Message, "'comment'"))
+}
+
+func TestNextName(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	assertEquals(t, "001_create_users", SequentialNames.nextName("Create Users", nil, now))
+	assertEquals(t, "0010_add_index", SequentialNames.nextName("add index", []string{"0009_create_users", "0002_create_posts"}, now))
+	assertEquals(t, "20240115120000_create_users", TimestampNames.nextName("create users", nil, now))
+	// never before the latest existing timestamp, such as one from a clock
+	// running ahead
+	assertEquals(t, "20240115120101_add_index", TimestampNames.nextName("add index", []string{"20240115120100_create_users"}, now))
+	assertEquals(t, "20240115120000_add_index", AnyNames.nextName("add index", []string{"001_create_users", "20230101000000_create_posts"}, now))
+	assertEquals(t, "002_add_index", AnyNames.nextName("add index", []string{"001_create_users"}, now))
+}
+
+func TestValidateNames(t *testing.T) {
+	r := NewRegistry()
+	r.Register(
+		Migration{Name: "001_create_user", Up: `CREATE TABLE user (id INT);`, Down: `DROP TABLE IF EXISTS user;`},
+		Migration{Name: "002_create_post", Up: `CREATE TABLE post (id INT);`, Down: `DROP TABLE IF EXISTS post;`},
+		Migration{Name: "20240115120000_create_comment", Up: `CREATE TABLE comment (id INT);`, Down: `DROP TABLE IF EXISTS comment;`},
+		Migration{Name: "002_create_post", Up: `CREATE TABLE post (id INT);`, Down: `DROP TABLE IF EXISTS post;`},
+	)
+	findings := r.Validate()
+	assertEquals(t, 2, len(findings))
+	assertEquals(t, SeverityError, findings[0].Severity)
+	assertEquals(t, "migration name '002_create_post' is registered more than once", findings[0].Message)
+	assertEquals(t, SeverityWarning, findings[1].Severity)
+	assertEquals(t, "migration name '20240115120000_create_comment' doesn't follow the sequential naming convention", findings[1].Message)
+
+	r = NewRegistry()
+	r.SetNameStrategy(TimestampNames)
+	r.Register(
+		Migration{Name: "20240115120000_create_user", Up: `CREATE TABLE user (id INT);`, Down: `DROP TABLE IF EXISTS user;`},
+		Migration{Name: "create_post", Up: `CREATE TABLE post (id INT);`, Down: `DROP TABLE IF EXISTS post;`},
+	)
+	findings = r.Validate()
+	assertEquals(t, 1, len(findings))
+	assertEquals(t, "create_post", findings[0].Migration)
+}
+
+func TestValidateMigrations(t *testing.T) {
+	r := NewRegistry()
+	r.Register(
+		Migration{Name: "10_create_user", Up: `CREATE TABLE user (id INT);`, Down: `DROP TABLE user;`},
+		Migration{Name: "11_seed_user", Up: `INSERT INTO user (id) VALUES (1);`, ManualRollback: "users may have been added since"},
+		Migration{Name: "12_create_post", Up: `CREATE TABLE post (id INT);`},
+		Migration{Name: "13_noop", Up: ` -- nothing yet
+`, Down: `DROP VIEW IF EXISTS post_view; DROP INDEX post_idx;`},
+		Migration{Name: "9_add_user_index", Up: `CREATE INDEX user_idx ON user (id);`, Down: `DROP INDEX user_idx;`},
+	)
+	messages := []string{}
+	for _, f := range r.Validate() {
+		messages = append(messages, fmt.Sprintf("%s: %s", f.Severity, f.Message))
+	}
+	assertEquals(t, strings.Join([]string{
+		"warning: migration '10_create_user' drops a table in its Down without IF EXISTS",
+		"warning: migration '12_create_post' has an empty Down; set ManualRollback if it can't be rolled back",
+		"error: migration '13_noop' has an empty Up",
+		"warning: migration name '9_add_user_index' sorts after a higher number, so it runs later than its number suggests; pad numbers to the same width",
+	}, "\n"), strings.Join(messages, "\n"))
+}
+
+func TestRegistryConcurrentRegister(t *testing.T) {
+	r := NewRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.Register(Migration{Name: fmt.Sprintf("%03d_plugin", i), Up: `SELECT 1;`, Tags: []string{"plugin"}})
+			r.Migrations()
+		}(i)
+	}
+	wg.Wait()
+
+	migrations := r.Migrations()
+	assertEquals(t, 20, len(migrations))
+	assertEquals(t, "000_plugin", migrations[0].Name)
+	assertEquals(t, "019_plugin", migrations[19].Name)
+
+	// the snapshot can be changed without changing the registry
+	migrations[0].Name = "changed"
+	migrations[1].Tags[0] = "changed"
+	migrations = r.Migrations()
+	assertEquals(t, "000_plugin", migrations[0].Name)
+	assertEquals(t, "plugin", migrations[1].Tags[0])
+}
+
+func TestLatestTrackingVersion(t *testing.T) {
+	assertEquals(t, 1+len(trackingColumns), LatestTrackingVersion)
+	all := map[string]bool{}
+	for _, c := range trackingColumns {
+		all[c.name] = true
+	}
+	assertEquals(t, LatestTrackingVersion, trackingVersion(all))
+	assertEquals(t, 1, trackingVersion(map[string]bool{"name": true}))
+}
+
+func TestFixtureGenerate(t *testing.T) {
+	f := Fixture{
+		Table: "account",
+		Rows:  100,
+		Columns: []FixtureColumn{
+			{"id", Sequence(1)},
+			{"name", Words(1, 3)},
+			{"age", IntRange(18, 90)},
+			{"created_at", TimeRange(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+			{"note", Nullable(0.3, Words(2, 2))},
+		},
+	}
+	rows := f.Generate(7)
+	assertEquals(t, 100, len(rows))
+	assertEquals(t, int64(100), rows[99][0].(int64))
+	assertEquals(t, fmt.Sprint(rows), fmt.Sprint(f.Generate(7)))
+	assertEquals(t, false, fmt.Sprint(rows) == fmt.Sprint(f.Generate(8)))
+
+	// a fixture's rows don't depend on the others
+	other := f
+	other.Table = "other_account"
+	assertEquals(t, false, fmt.Sprint(rows) == fmt.Sprint(other.Generate(7)))
+	for _, row := range rows {
+		age := row[2].(int64)
+		assertEquals(t, true, age >= 18 && age <= 90)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.4.2", "1.4.2", 0},
+		{"v1.4", "1.4.0", 0},
+		{"1.10.0", "1.9.3", 1},
+		{"1.4.2", "2", -1},
+		{"1.5.0-rc.1", "1.5.0", -1},
+		{"1.5.0-rc.2", "1.5.0-rc.1", 1},
+		{"1.5.0+build.7", "1.5.0", 0},
+	}
+	for _, test := range tests {
+		got, err := compareVersions(test.a, test.b)
+		assertOk(t, err)
+		if got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+	_, err := compareVersions("1.x", "1.0")
+	assertEquals(t, true, err != nil)
+}
+
+func TestRunContextStop(t *testing.T) {
+	m := New(nil, WithMigrationTimeout(time.Hour))
+	ctx, stop := m.runContext(context.Background(), Migration{Name: "001_slow"})
+	assertOk(t, ctx.Err())
+
+	// stopping releases the context without reporting a timeout
+	stop()
+	assertEquals(t, context.Canceled, ctx.Err())
+	assertEquals(t, false, errors.Is(context.Cause(ctx), context.DeadlineExceeded))
+}
+
+func TestOwnsTable(t *testing.T) {
+	m := New(nil, WithSQLite())
+	for table, owned := range map[string]bool{
+		"migration":              true,
+		"migration_lock":         true,
+		"migration_lock_holder":  true,
+		"MIGRATION_FOLLOWUP":     true,
+		"migration_label":        true,
+		"migration_archive":      true,
+		"migration_scratch_ids":  true,
+		"migration_jobs":         false,
+		"migration_lock_history": false,
+		"post":                   false,
+	} {
+		assertEquals(t, owned, m.ownsTable(table, false))
+	}
+	assertEquals(t, false, m.ownsTable("migration", true))
+}
@@ -0,0 +1,167 @@
+package moogration
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// NameStrategy is the convention migration names are prefixed by, so they
+// sort in the order they were written
+type NameStrategy int
+
+const (
+	// AnyNames accepts either convention, but Validate warns if a registry
+	// mixes them
+	AnyNames NameStrategy = iota
+	// SequentialNames prefixes names with a zero-padded number, such as
+	// 001_create_users. Migrations written on two branches at once get the
+	// same number, so they conflict when merged.
+	SequentialNames
+	// TimestampNames prefixes names with the UTC time they were created, such
+	// as 20240115120000_create_users, so branches rarely conflict
+	TimestampNames
+)
+
+// timestampLayout is the layout of a TimestampNames prefix
+const timestampLayout = "20060102150405"
+
+var reNamePrefix = regexp.MustCompile(`^(\d+)_`)
+
+func (s NameStrategy) String() string {
+	switch s {
+	case SequentialNames:
+		return "sequential"
+	case TimestampNames:
+		return "timestamp"
+	default:
+		return "any"
+	}
+}
+
+// SetNameStrategy sets the naming convention Validate checks the default
+// registry against
+func SetNameStrategy(s NameStrategy) {
+	defaultRegistry.SetNameStrategy(s)
+}
+
+// SetNameStrategy sets the naming convention Validate checks the registry's
+// migration names against
+func (r *Registry) SetNameStrategy(s NameStrategy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = s
+}
+
+// NextName returns a name for a new migration with a description such as
+// "create users", which is lowercased with spaces replaced by underscores.
+// SequentialNames numbers it after the highest number among existing names,
+// keeping their width. TimestampNames prefixes the current UTC time, or a
+// second after the latest timestamp among existing names if that is later.
+// AnyNames follows the convention of the latest existing name, or
+// SequentialNames if there are none.
+func (s NameStrategy) NextName(description string, existing []string) string {
+	return s.nextName(description, existing, time.Now())
+}
+
+func (s NameStrategy) nextName(description string, existing []string, now time.Time) string {
+	description = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(description)), " ", "_")
+	if s == AnyNames {
+		s = SequentialNames
+		latest := ""
+		for _, name := range existing {
+			if nameStrategy(name) != AnyNames && name > latest {
+				latest = name
+			}
+		}
+		if latest != "" {
+			s = nameStrategy(latest)
+		}
+	}
+
+	if s == TimestampNames {
+		next := now.UTC().Truncate(time.Second)
+		for _, name := range existing {
+			if nameStrategy(name) != TimestampNames {
+				continue
+			}
+			t, _ := time.Parse(timestampLayout, reNamePrefix.FindStringSubmatch(name)[1])
+			if !t.Before(next) {
+				next = t.Add(time.Second)
+			}
+		}
+		return next.Format(timestampLayout) + "_" + description
+	}
+
+	// prefixes are compared as digit strings, as they may not fit an int
+	latest, width := "", 3
+	for _, name := range existing {
+		if nameStrategy(name) != SequentialNames {
+			continue
+		}
+		prefix := reNamePrefix.FindStringSubmatch(name)[1]
+		n := strings.TrimLeft(prefix, "0")
+		if len(n) > len(latest) || len(n) == len(latest) && n > latest {
+			latest, width = n, len(prefix)
+		}
+	}
+	next := incrementDigits(latest)
+	if len(next) < width {
+		next = strings.Repeat("0", width-len(next)) + next
+	}
+	return next + "_" + description
+}
+
+// incrementDigits adds one to the decimal number digits, which is zero if
+// empty
+func incrementDigits(digits string) string {
+	b := []byte(digits)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < '9' {
+			b[i]++
+			return string(b)
+		}
+		b[i] = '0'
+	}
+	return "1" + string(b)
+}
+
+// nameStrategy returns the convention name follows, or AnyNames if it has no
+// numeric prefix
+func nameStrategy(name string) NameStrategy {
+	match := reNamePrefix.FindStringSubmatch(name)
+	if match == nil {
+		return AnyNames
+	}
+	if len(match[1]) == len(timestampLayout) {
+		if _, err := time.Parse(timestampLayout, match[1]); err == nil {
+			return TimestampNames
+		}
+	}
+	return SequentialNames
+}
+
+// expectedNames returns the convention the names of migrations should
+// follow: the registry's, or without one the convention most of them follow
+// if they mix both, so the minority is reported. It returns AnyNames if there
+// is nothing to report.
+func (r *Registry) expectedNames(migrations []Migration) NameStrategy {
+	r.mu.RLock()
+	names := r.names
+	r.mu.RUnlock()
+	if names != AnyNames {
+		return names
+	}
+	counts := map[NameStrategy]int{}
+	for _, m := range migrations {
+		counts[nameStrategy(m.Name)]++
+	}
+	switch {
+	case counts[SequentialNames] == 0 || counts[TimestampNames] == 0:
+		return AnyNames
+	case counts[TimestampNames] > counts[SequentialNames]:
+		return TimestampNames
+	default:
+		return SequentialNames
+	}
+}
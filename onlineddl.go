@@ -0,0 +1,97 @@
+package moogration
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// OnlineDDLPolicy controls how ALTER TABLE statements are made to run
+// without copying or locking the table on MySQL
+type OnlineDDLPolicy string
+
+const (
+	// OnlineDDLOff runs ALTER TABLE statements as written
+	OnlineDDLOff OnlineDDLPolicy = "off"
+	// OnlineDDLAppend appends ALGORITHM=INPLACE and LOCK=NONE to ALTER TABLE
+	// statements that don't specify them
+	OnlineDDLAppend OnlineDDLPolicy = "append"
+	// OnlineDDLRequire refuses ALTER TABLE statements that don't specify an
+	// in-place or instant algorithm and LOCK=NONE
+	OnlineDDLRequire OnlineDDLPolicy = "require"
+)
+
+var (
+	// ErrTableCopy is returned when an ALTER TABLE can only run by copying the
+	// table, or asks to, and the migration doesn't set AllowTableCopy
+	ErrTableCopy = errors.New("ALTER TABLE requires a table copy (set AllowTableCopy on the migration to permit it)")
+	// ErrOnlineDDLRequired is returned under OnlineDDLRequire when an ALTER
+	// TABLE doesn't specify its algorithm and lock
+	ErrOnlineDDLRequired = errors.New("ALTER TABLE must specify ALGORITHM=INPLACE or INSTANT and LOCK=NONE")
+)
+
+// WithOnlineDDL sets the policy applied to ALTER TABLE statements on MySQL.
+// In strict mode the default is OnlineDDLAppend, otherwise OnlineDDLOff. A
+// migration that sets AllowTableCopy is exempt.
+func WithOnlineDDL(policy OnlineDDLPolicy) Option {
+	return func(m *Migrator) {
+		m.onlineDDL = policy
+	}
+}
+
+var (
+	reAlgorithm = regexp.MustCompile(`(?i)\bALGORITHM\s*=?\s*(DEFAULT|INSTANT|INPLACE|COPY)\b`)
+	reLock      = regexp.MustCompile(`(?i)\bLOCK\s*=?\s*(DEFAULT|NONE|SHARED|EXCLUSIVE)\b`)
+	rePartition = regexp.MustCompile(`(?i)\bPARTITION\b`)
+)
+
+// onlineDDLPolicy is the policy in effect
+func (mg *Migrator) onlineDDLPolicy() OnlineDDLPolicy {
+	if mg.onlineDDL != "" {
+		return mg.onlineDDL
+	}
+	if mg.strict {
+		return OnlineDDLAppend
+	}
+	return OnlineDDLOff
+}
+
+// applyOnlineDDL rewrites or checks a statement of m according to the online
+// DDL policy. rewritten is set if ALGORITHM or LOCK was appended.
+func (mg *Migrator) applyOnlineDDL(m Migration, stmt string) (result string, rewritten bool, err error) {
+	policy := mg.onlineDDLPolicy()
+	if mg.driver != mysql || policy == OnlineDDLOff || m.AllowTableCopy || !reAlterTable.MatchString(stmt) {
+		return stmt, false, nil
+	}
+	if rePartition.MatchString(stmt) {
+		// partition clauses must come last, and don't take these options
+		return stmt, false, nil
+	}
+
+	algorithm := reAlgorithm.FindStringSubmatch(stmt)
+	if algorithm != nil && strings.EqualFold(algorithm[1], "COPY") {
+		return stmt, false, ErrTableCopy
+	}
+	lock := reLock.FindStringSubmatch(stmt)
+	if algorithm != nil && lock != nil {
+		return stmt, false, nil
+	}
+	if policy == OnlineDDLRequire {
+		return stmt, false, ErrOnlineDDLRequired
+	}
+
+	if algorithm == nil {
+		stmt += ", ALGORITHM=INPLACE"
+	}
+	if lock == nil {
+		stmt += ", LOCK=NONE"
+	}
+	return stmt, true, nil
+}
+
+// isTableCopyError reports whether MySQL refused an in-place ALTER
+func isTableCopyError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "ALGORITHM=INPLACE is not supported") ||
+		strings.Contains(msg, "LOCK=NONE is not supported")
+}
@@ -0,0 +1,224 @@
+package moogration
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// OnlineSchemaTool is an external online schema change tool for MySQL
+type OnlineSchemaTool string
+
+const (
+	PTOnlineSchemaChange OnlineSchemaTool = "pt-online-schema-change"
+	GhOst                OnlineSchemaTool = "gh-ost"
+)
+
+// OSCConfig configures dry runs of an online schema change tool. The tool
+// connects to the database itself, so it needs its own connection details.
+type OSCConfig struct {
+	Tool OnlineSchemaTool
+	// Path is the tool's executable, by default its name looked up in PATH
+	Path string
+	Host string
+	Port int
+	User string
+	// Password is passed on the tool's command line, where other local users
+	// may see it. Prefer DefaultsFile.
+	Password string
+	// DefaultsFile is a MySQL option file holding the connection's
+	// credentials
+	DefaultsFile string
+	// MinRows is the estimated row count from which a table is large enough
+	// to analyze
+	MinRows int64
+	// Args are appended to the tool's arguments
+	Args []string
+}
+
+// OSCReport is the outcome of a dry run of an ALTER TABLE statement
+type OSCReport struct {
+	Migration string
+	Table     string
+	Statement string
+	// Rows is the table's estimated row count
+	Rows int64
+	// Output is everything the tool printed
+	Output string
+	// Warnings are the lines of Output reporting warnings or errors
+	Warnings []string
+	// Err is set if the tool failed, in which case the ALTER would likely
+	// fail too
+	Err error
+}
+
+// runCommand runs an external command, returning its combined output
+var runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// WithOSCAnalysis makes PlanLatest, and dry runs, run each ALTER TABLE of a
+// pending migration on a large table through an online schema change tool in
+// dry-run mode, and attach its warnings to the planned migration.
+func WithOSCAnalysis(config OSCConfig) Option {
+	return func(m *Migrator) {
+		m.osc = &config
+	}
+}
+
+// AnalyzeOnlineSchemaChanges dry-runs the ALTERs of the migrations in the
+// default registry pending on db. See Migrator.AnalyzeOnlineSchemaChanges.
+func AnalyzeOnlineSchemaChanges(db DBTX, config OSCConfig) ([]OSCReport, error) {
+	return defaultMigrator(db, nil).AnalyzeOnlineSchemaChangesContext(context.Background(), config)
+}
+
+// AnalyzeOnlineSchemaChanges runs each ALTER TABLE statement of the pending
+// migrations on a table with at least config.MinRows estimated rows through
+// pt-online-schema-change --dry-run, or gh-ost without --execute. Neither
+// changes the table. It is MySQL only, and returns a report per statement
+// analyzed.
+func (mg *Migrator) AnalyzeOnlineSchemaChanges(config OSCConfig) ([]OSCReport, error) {
+	return mg.AnalyzeOnlineSchemaChangesContext(context.Background(), config)
+}
+
+// AnalyzeOnlineSchemaChangesContext is like AnalyzeOnlineSchemaChanges, with
+// a context
+func (mg *Migrator) AnalyzeOnlineSchemaChangesContext(ctx context.Context, config OSCConfig) ([]OSCReport, error) {
+	applied := map[string]string{}
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		applied, err = mg.appliedHashes(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+		}
+	}
+
+	reports := []OSCReport{}
+	for _, m := range mg.registry.Migrations() {
+		if _, hasRun := applied[m.Name]; hasRun {
+			continue
+		}
+		migrationReports, err := mg.analyzeOSC(ctx, m, config)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, migrationReports...)
+	}
+	return reports, nil
+}
+
+// analyzeOSC dry-runs the ALTERs of a single migration
+func (mg *Migrator) analyzeOSC(ctx context.Context, m Migration, config OSCConfig) ([]OSCReport, error) {
+	if mg.driver != mysql {
+		return nil, fmt.Errorf("online schema change analysis requires MySQL, not %s", mg.driver)
+	}
+
+	reports := []OSCReport{}
+	for _, stmt := range splitSQL(m.Up, mg.driver) {
+		match := reAlterTable.FindStringSubmatch(stmt)
+		if match == nil {
+			continue
+		}
+		schema, table := splitTableName(match[1])
+
+		var rows sql.NullInt64
+		query := "SELECT TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND TABLE_NAME = ?"
+		err := mg.db.QueryRowContext(ctx, query, schema, table).Scan(&rows)
+		if err == sql.ErrNoRows {
+			// created by an earlier pending migration, so empty
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error estimating rows of %s for migration '%s': %w", table, m.Name, err)
+		}
+		if rows.Int64 < config.MinRows {
+			continue
+		}
+
+		if schema == "" {
+			err = mg.db.QueryRowContext(ctx, "SELECT DATABASE()").Scan(&schema)
+			if err != nil {
+				return nil, err
+			}
+		}
+		report := OSCReport{Migration: m.Name, Table: table, Statement: stmt, Rows: rows.Int64}
+		path, args := config.command(schema, table, match[2])
+		output, err := runCommand(ctx, path, args...)
+		report.Output = string(output)
+		report.Warnings = oscWarnings(report.Output)
+		if err != nil {
+			report.Err = fmt.Errorf("%s dry run failed: %w", config.Tool, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// command builds the tool's dry-run invocation
+func (c OSCConfig) command(schema, table, alter string) (string, []string) {
+	path := c.Path
+	if path == "" {
+		path = string(c.Tool)
+	}
+
+	var args []string
+	if c.Tool == GhOst {
+		args = []string{"--database=" + schema, "--table=" + table, "--alter=" + alter}
+		if c.Host != "" {
+			args = append(args, "--host="+c.Host)
+		}
+		if c.Port != 0 {
+			args = append(args, "--port="+strconv.Itoa(c.Port))
+		}
+		if c.User != "" {
+			args = append(args, "--user="+c.User)
+		}
+		if c.Password != "" {
+			args = append(args, "--password="+c.Password)
+		}
+		if c.DefaultsFile != "" {
+			args = append(args, "--conf="+c.DefaultsFile)
+		}
+	} else {
+		dsn := []string{}
+		if c.DefaultsFile != "" {
+			dsn = append(dsn, "F="+c.DefaultsFile)
+		}
+		if c.Host != "" {
+			dsn = append(dsn, "h="+c.Host)
+		}
+		if c.Port != 0 {
+			dsn = append(dsn, "P="+strconv.Itoa(c.Port))
+		}
+		if c.User != "" {
+			dsn = append(dsn, "u="+c.User)
+		}
+		if c.Password != "" {
+			dsn = append(dsn, "p="+c.Password)
+		}
+		dsn = append(dsn, "D="+schema, "t="+table)
+		args = []string{"--dry-run", "--alter", alter, strings.Join(dsn, ",")}
+	}
+	return path, append(args, c.Args...)
+}
+
+// oscWarnings picks the lines of a tool's output that report problems
+func oscWarnings(output string) []string {
+	warnings := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "warn") || strings.Contains(lower, "error") || strings.Contains(lower, "fatal") {
+			warnings = append(warnings, line)
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,255 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// MissingPrivilege is a privilege a pending migration needs that the
+// connected user lacks
+type MissingPrivilege struct {
+	Migration string
+	// Privilege is a grantable privilege such as "ALTER", or "OWNER" where
+	// PostgreSQL requires ownership of the table
+	Privilege string
+	// Object is the table, or for privileges granted on a schema, the schema
+	Object string
+}
+
+// PermissionError is returned by a run with WithPermissionPrecheck when the
+// connected user lacks privileges pending migrations need
+type PermissionError struct {
+	Missing []MissingPrivilege
+}
+
+func (e *PermissionError) Error() string {
+	descriptions := make([]string, len(e.Missing))
+	for i, p := range e.Missing {
+		descriptions[i] = fmt.Sprintf("%s on %s (migration '%s')", p.Privilege, p.Object, p.Migration)
+	}
+	return fmt.Sprintf("connected user lacks privileges needed by pending migrations: %s", strings.Join(descriptions, "; "))
+}
+
+// WithPermissionPrecheck makes a run check that the connected user holds the
+// CREATE, ALTER, DROP and INDEX privileges the pending migrations need before
+// running any of them. If any are missing, nothing is run and a
+// *PermissionError listing them is returned, rather than the batch failing
+// part way through.
+func WithPermissionPrecheck() Option {
+	return func(m *Migrator) {
+		m.permissionPrecheck = true
+	}
+}
+
+// CheckPermissions returns the privileges the connected user lacks to run
+// the migrations in the default registry pending on db. See
+// Migrator.CheckPermissions.
+func CheckPermissions(db DBTX) ([]MissingPrivilege, error) {
+	return defaultMigrator(db, nil).CheckPermissionsContext(context.Background())
+}
+
+// CheckPermissions returns the privileges the connected user lacks to run
+// the pending migrations, without running any. Required privileges are
+// inferred from the statements of each migration, so Go migrations and
+// unrecognized statements are not checked. On MySQL, global, schema and
+// table grants are considered; on PostgreSQL, CREATE on the schema for new
+// tables and ownership of existing tables for other changes. SQLite has no
+// privileges, so nothing is ever missing.
+func (mg *Migrator) CheckPermissions() ([]MissingPrivilege, error) {
+	return mg.CheckPermissionsContext(context.Background())
+}
+
+// CheckPermissionsContext is like CheckPermissions, with a context
+func (mg *Migrator) CheckPermissionsContext(ctx context.Context) ([]MissingPrivilege, error) {
+	applied := map[string]string{}
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		applied, err = mg.appliedHashes(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+		}
+	}
+
+	pending := []Migration{}
+	for _, m := range mg.registry.Migrations() {
+		if _, hasRun := applied[m.Name]; !hasRun {
+			pending = append(pending, m)
+		}
+	}
+	return mg.missingPrivileges(ctx, pending, false)
+}
+
+// requiredPrivilege is a privilege a statement needs on a table
+type requiredPrivilege struct {
+	privilege string
+	table     string
+}
+
+// requiredPrivileges infers the privileges stmt needs
+func requiredPrivileges(stmt string) []requiredPrivilege {
+	impact := analyzeStatement(stmt)
+	var privileges []string
+	switch impact.Operation {
+	case "CREATE TABLE":
+		privileges = []string{"CREATE"}
+	case "ALTER TABLE":
+		privileges = []string{"ALTER"}
+	case "DROP TABLE", "TRUNCATE":
+		privileges = []string{"DROP"}
+	case "CREATE INDEX", "DROP INDEX":
+		privileges = []string{"INDEX"}
+	case "RENAME TABLE":
+		privileges = []string{"ALTER", "DROP"}
+	}
+
+	required := make([]requiredPrivilege, len(privileges))
+	for i, p := range privileges {
+		required[i] = requiredPrivilege{privilege: p, table: impact.Table}
+	}
+	return required
+}
+
+// missingPrivileges checks the privileges needed to run migrations in the
+// given direction
+func (mg *Migrator) missingPrivileges(ctx context.Context, migrations []Migration, down bool) ([]MissingPrivilege, error) {
+	var lookup privilegeLookup
+	switch mg.driver {
+	case mysql:
+		lookup = &mysqlPrivileges{db: mg.db, granted: map[string]map[string]bool{}}
+	case postgres:
+		lookup = &postgresPrivileges{db: mg.db}
+	case sqlite:
+		return []MissingPrivilege{}, nil
+	default:
+		return nil, fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+
+	missing := []MissingPrivilege{}
+	reported := map[MissingPrivilege]bool{}
+	for _, m := range migrations {
+		for _, stmt := range splitSQL(m.query(down), mg.driver) {
+			for _, required := range requiredPrivileges(stmt) {
+				if required.table == "" {
+					continue
+				}
+				privilege, object, ok, err := lookup.has(ctx, required)
+				if err != nil {
+					return nil, fmt.Errorf("error checking %s privilege on %s for migration '%s': %w", required.privilege, required.table, m.Name, err)
+				}
+				p := MissingPrivilege{Migration: m.Name, Privilege: privilege, Object: object}
+				if !ok && !reported[p] {
+					reported[p] = true
+					missing = append(missing, p)
+				}
+			}
+		}
+	}
+	return missing, nil
+}
+
+// privilegeLookup checks a dialect's grants. has returns the privilege and
+// object actually checked, which may differ from those required.
+type privilegeLookup interface {
+	has(ctx context.Context, required requiredPrivilege) (privilege, object string, ok bool, err error)
+}
+
+// splitTableName splits an optionally schema-qualified table name
+func splitTableName(table string) (schema, name string) {
+	parts := strings.SplitN(table, ".", 2)
+	if len(parts) == 1 {
+		return "", unquote(parts[0])
+	}
+	return unquote(parts[0]), unquote(parts[1])
+}
+
+// mysqlPrivileges reads the current user's grants from information_schema
+type mysqlPrivileges struct {
+	db      DBTX
+	grantee string
+	schema  string
+	// granted caches privileges by schema and table
+	granted map[string]map[string]bool
+}
+
+func (p *mysqlPrivileges) has(ctx context.Context, required requiredPrivilege) (string, string, bool, error) {
+	if p.grantee == "" {
+		var user string
+		var schema sql.NullString
+		err := p.db.QueryRowContext(ctx, "SELECT CURRENT_USER(), DATABASE()").Scan(&user, &schema)
+		if err != nil {
+			return "", "", false, err
+		}
+		i := strings.LastIndex(user, "@")
+		if i < 0 {
+			return "", "", false, fmt.Errorf("unexpected CURRENT_USER() %q", user)
+		}
+		p.grantee = fmt.Sprintf("'%s'@'%s'", user[:i], user[i+1:])
+		p.schema = schema.String
+	}
+
+	schema, table := splitTableName(required.table)
+	if schema == "" {
+		schema = p.schema
+	}
+	key := schema + "." + table
+	granted, ok := p.granted[key]
+	if !ok {
+		rows, err := p.db.QueryContext(ctx, `
+			SELECT PRIVILEGE_TYPE FROM information_schema.USER_PRIVILEGES WHERE GRANTEE = ?
+			UNION SELECT PRIVILEGE_TYPE FROM information_schema.SCHEMA_PRIVILEGES WHERE GRANTEE = ? AND TABLE_SCHEMA = ?
+			UNION SELECT PRIVILEGE_TYPE FROM information_schema.TABLE_PRIVILEGES WHERE GRANTEE = ? AND TABLE_SCHEMA = ? AND TABLE_NAME = ?`,
+			p.grantee, p.grantee, schema, p.grantee, schema, table)
+		if err != nil {
+			return "", "", false, err
+		}
+		defer rows.Close()
+		granted = map[string]bool{}
+		for rows.Next() {
+			var privilege string
+			err := rows.Scan(&privilege)
+			if err != nil {
+				return "", "", false, err
+			}
+			granted[strings.ToUpper(privilege)] = true
+		}
+		if err := rows.Err(); err != nil {
+			return "", "", false, err
+		}
+		p.granted[key] = granted
+	}
+	return required.privilege, key, granted[required.privilege], nil
+}
+
+// postgresPrivileges checks schema CREATE privileges and table ownership
+type postgresPrivileges struct {
+	db DBTX
+}
+
+func (p *postgresPrivileges) has(ctx context.Context, required requiredPrivilege) (string, string, bool, error) {
+	schema, table := splitTableName(required.table)
+	if required.privilege == "CREATE" {
+		var ok bool
+		var object string
+		err := p.db.QueryRowContext(ctx,
+			"SELECT s, has_schema_privilege(s, 'CREATE') FROM (SELECT COALESCE(NULLIF($1::text, ''), current_schema()) AS s) AS target",
+			schema).Scan(&object, &ok)
+		return "CREATE", object, ok, err
+	}
+
+	// anything but creating a table needs ownership of it. A table that
+	// doesn't exist yet is created, and so owned, by an earlier migration.
+	qualified := table
+	if schema != "" {
+		qualified = schema + "." + table
+	}
+	var ok bool
+	err := p.db.QueryRowContext(ctx,
+		"SELECT COALESCE((SELECT pg_has_role(relowner, 'USAGE') FROM pg_class WHERE oid = to_regclass($1::text)), true)",
+		qualified).Scan(&ok)
+	return "OWNER", qualified, ok, err
+}
@@ -0,0 +1,242 @@
+package moogration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// PlannedMigration is a migration a run would execute
+type PlannedMigration struct {
+	Name string `json:"name"`
+	// Direction is "up" or "down"
+	Direction string `json:"direction"`
+	Batch     int    `json:"batch"`
+	SQL       string `json:"sql"`
+	// Warnings are raised by the online schema change tool set with
+	// WithOSCAnalysis
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// ErrDryRun is wrapped by the error of an operation that would write to the
+// database, called on a Migrator built with WithDryRun
+var ErrDryRun = errors.New("operation would write to the database in a dry run")
+
+// WithDryRun makes RunLatest and Rollback log the migrations they would run,
+// with their SQL, instead of running them. Nothing is written to the
+// database, including the tracking table. Every other operation that would
+// write to the database, such as MigrateTo, Redo or Baseline, returns an
+// error wrapping ErrDryRun instead.
+func WithDryRun() Option {
+	return func(m *Migrator) {
+		m.dryRun = true
+	}
+}
+
+// refuseDryRun returns an error wrapping ErrDryRun for an operation that
+// would write to the database, if the Migrator is in dry-run mode
+func (mg *Migrator) refuseDryRun(operation string) error {
+	if mg.dryRun {
+		return fmt.Errorf("%w: %s", ErrDryRun, operation)
+	}
+	return nil
+}
+
+// PlanLatest returns the migrations in the default registry that RunLatest
+// would run on db. See Migrator.PlanLatest.
+func PlanLatest(db DBTX, down bool) ([]PlannedMigration, error) {
+	return defaultMigrator(db, nil).PlanLatestContext(context.Background(), down)
+}
+
+// PlanRollback returns the migrations in the default registry that Rollback
+// would run on db. See Migrator.PlanRollback.
+func PlanRollback(db DBTX, numBatches int, force bool) ([]PlannedMigration, error) {
+	return defaultMigrator(db, nil).PlanRollbackContext(context.Background(), numBatches, force)
+}
+
+// PlanLatest returns the migrations RunLatest would run, in order, without
+// writing to the database
+func (mg *Migrator) PlanLatest(down bool) ([]PlannedMigration, error) {
+	return mg.PlanLatestContext(context.Background(), down)
+}
+
+// PlanLatestContext is like PlanLatest, with a context
+func (mg *Migrator) PlanLatestContext(ctx context.Context, down bool) ([]PlannedMigration, error) {
+	if len(mg.groups) > 0 {
+		plan := []PlannedMigration{}
+		err := mg.eachGroup(func(sub *Migrator) error {
+			subPlan, err := sub.PlanLatestContext(ctx, down)
+			plan = append(plan, subPlan...)
+			return err
+		})
+		return plan, err
+	}
+
+	applied := map[string]string{}
+	lastBatch := 0
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		applied, err = mg.appliedHashes(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+		}
+		lastBatch, err = mg.latestBatch(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine last-run batch number: %w", err)
+		}
+	}
+
+	migrations, _, _ := mg.planRun(mg.registry.snapshot(), applied, down)
+
+	plan := []PlannedMigration{}
+	for _, m := range migrations {
+		if hash, hasRun := applied[m.Name]; hasRun && !down && !m.reapplies(hash) {
+			continue
+		}
+		planned := PlannedMigration{
+			Name:      m.Name,
+			Direction: direction(down),
+			Batch:     lastBatch + 1,
+			SQL:       m.query(down),
+		}
+		if mg.osc != nil && !down {
+			reports, err := mg.analyzeOSC(ctx, m, *mg.osc)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range reports {
+				for _, w := range r.Warnings {
+					planned.Warnings = append(planned.Warnings, fmt.Sprintf("%s: %s", r.Table, w))
+				}
+				if r.Err != nil && len(r.Warnings) == 0 {
+					planned.Warnings = append(planned.Warnings, fmt.Sprintf("%s: %s", r.Table, r.Err))
+				}
+			}
+		}
+		plan = append(plan, planned)
+	}
+	return plan, nil
+}
+
+// PlanRollback returns the migrations Rollback would run, in order, without
+// writing to the database. Like Rollback, it fails if a migration to be
+// rolled back has changed since it was applied, unless force is set.
+func (mg *Migrator) PlanRollback(numBatches int, force bool) ([]PlannedMigration, error) {
+	return mg.PlanRollbackContext(context.Background(), numBatches, force)
+}
+
+// PlanRollbackContext is like PlanRollback, with a context
+func (mg *Migrator) PlanRollbackContext(ctx context.Context, numBatches int, force bool) ([]PlannedMigration, error) {
+	if len(mg.groups) > 0 {
+		plan := []PlannedMigration{}
+		err := mg.eachGroup(func(sub *Migrator) error {
+			subPlan, err := sub.PlanRollbackContext(ctx, numBatches, force)
+			plan = append(plan, subPlan...)
+			return err
+		})
+		return plan, err
+	}
+
+	plan := []PlannedMigration{}
+	exists, err := mg.tableExists(ctx)
+	if err != nil || !exists {
+		return plan, err
+	}
+
+	batches, err := mg.allBatches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = checkBatchCount(numBatches, len(batches))
+	if err != nil {
+		return nil, err
+	}
+
+	registered := map[string]Migration{}
+	for _, m := range mg.registry.snapshot() {
+		registered[m.Name] = m
+	}
+
+	for _, batch := range batches[:numBatches] {
+		records, err := mg.batchRecords(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		sortForRollback(records, registered)
+		for _, r := range records {
+			m, ok := registered[r.name]
+			if !ok {
+				continue
+			}
+			if !force && !m.Repeatable && !m.matchesHash(r.sqlHash) {
+				return nil, fmt.Errorf("previously run migration '%s' has changed since run", m.Name)
+			}
+			plan = append(plan, PlannedMigration{
+				Name:      m.Name,
+				Direction: direction(true),
+				Batch:     batch,
+				SQL:       m.Down,
+			})
+		}
+	}
+	return plan, nil
+}
+
+// tableExists reports whether the tracking table has been created, so plans
+// can be made without creating it
+func (mg *Migrator) tableExists(ctx context.Context) (bool, error) {
+	return mg.hasTable(ctx, mg.table)
+}
+
+// hasTable reports whether a table exists in the tracking table's schema
+func (mg *Migrator) hasTable(ctx context.Context, table string) (bool, error) {
+	var query string
+	args := []interface{}{table}
+	switch mg.driver {
+	case mysql:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+		if mg.schema != "" {
+			query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND table_name = ?"
+			args = []interface{}{mg.schema, table}
+		}
+	case postgres:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1"
+		if mg.schema != "" {
+			query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = $1 AND table_name = $2"
+			args = []interface{}{mg.schema, table}
+		}
+	case sqlite:
+		// a schema on SQLite names an attached database
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+		if mg.schema != "" {
+			query = fmt.Sprintf("SELECT COUNT(*) FROM %s.sqlite_master WHERE type = 'table' AND name = ?", mg.schema)
+		}
+	default:
+		return false, fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+
+	var count int
+	err := mg.db.QueryRowContext(ctx, query, args...).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking for table %s: %w", table, err)
+	}
+	return count > 0, nil
+}
+
+// logPlan logs the migrations a dry run would have run
+func logPlan(logger *log.Logger, plan []PlannedMigration) {
+	if logger == nil {
+		return
+	}
+	logger.Printf("dry run :: %d migrations would run", len(plan))
+	for _, p := range plan {
+		logger.Printf("dry run :: %s :: %s (batch %d)\n%s", p.Direction, p.Name, p.Batch, p.SQL)
+		for _, w := range p.Warnings {
+			logger.Printf("dry run :: %s :: WARNING :: %s", p.Name, w)
+		}
+	}
+}
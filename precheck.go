@@ -0,0 +1,231 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ConstraintCheck counts the rows that would violate a constraint added by a
+// migration
+type ConstraintCheck struct {
+	Migration string
+	Table     string
+	// Constraint is "NOT NULL", "UNIQUE" or "FOREIGN KEY"
+	Constraint string
+	Columns    []string
+	// Query counts the offending rows
+	Query      string
+	Violations int64
+	// Err is set if the query could not run, e.g. because the table is
+	// created by an earlier pending migration
+	Err error
+}
+
+// ConstraintViolationError is returned when a migration would add a
+// constraint that existing rows violate
+type ConstraintViolationError struct {
+	Checks []ConstraintCheck
+}
+
+func (e *ConstraintViolationError) Error() string {
+	descriptions := make([]string, len(e.Checks))
+	for i, c := range e.Checks {
+		descriptions[i] = fmt.Sprintf("%d rows of %s violate %s (%s)", c.Violations, c.Table, c.Constraint, strings.Join(c.Columns, ", "))
+	}
+	return fmt.Sprintf("migration '%s' adds constraints existing rows violate: %s", e.Checks[0].Migration, strings.Join(descriptions, "; "))
+}
+
+// WithConstraintPrecheck makes a run count the rows that violate each NOT
+// NULL, UNIQUE or FOREIGN KEY constraint a migration adds before running it.
+// A migration with violations is not run, and a *ConstraintViolationError
+// reporting the counts is returned, so the operator learns the ALTER will
+// fail without waiting for it (or for a long validation) to do so.
+func WithConstraintPrecheck() Option {
+	return func(m *Migrator) {
+		m.constraintPrecheck = true
+	}
+}
+
+// PrecheckConstraints counts the rows violating constraints added by the
+// migrations in the default registry pending on db. See
+// Migrator.PrecheckConstraints.
+func PrecheckConstraints(db DBTX) ([]ConstraintCheck, error) {
+	return defaultMigrator(db, nil).PrecheckConstraintsContext(context.Background())
+}
+
+// PrecheckConstraints counts the rows violating each constraint added by a
+// pending migration, without running any migration. Checks are made against
+// the current schema, so a check on a table that a pending migration creates
+// or alters first reports an Err or a stale count.
+func (mg *Migrator) PrecheckConstraints() ([]ConstraintCheck, error) {
+	return mg.PrecheckConstraintsContext(context.Background())
+}
+
+// PrecheckConstraintsContext is like PrecheckConstraints, with a context
+func (mg *Migrator) PrecheckConstraintsContext(ctx context.Context) ([]ConstraintCheck, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	checks := []ConstraintCheck{}
+	for _, m := range mg.registry.Migrations() {
+		if _, hasRun := applied[m.Name]; hasRun {
+			continue
+		}
+		for _, check := range constraintChecks(m) {
+			check.Err = mg.db.QueryRowContext(ctx, check.Query).Scan(&check.Violations)
+			checks = append(checks, check)
+		}
+	}
+	return checks, nil
+}
+
+// precheckConstraints returns a *ConstraintViolationError if existing rows
+// violate a constraint m adds
+func (mg *Migrator) precheckConstraints(ctx context.Context, m Migration) error {
+	violated := []ConstraintCheck{}
+	for _, check := range constraintChecks(m) {
+		err := mg.db.QueryRowContext(ctx, check.Query).Scan(&check.Violations)
+		if err != nil {
+			return fmt.Errorf("error checking %s constraint on %s for migration '%s': %w", check.Constraint, check.Table, m.Name, err)
+		}
+		if check.Violations > 0 {
+			violated = append(violated, check)
+		}
+	}
+	if len(violated) > 0 {
+		return &ConstraintViolationError{Checks: violated}
+	}
+	return nil
+}
+
+var (
+	reSetNotNull    = regexp.MustCompile(`(?is)^ALTER\s+(?:COLUMN\s+)?` + identifier + `\s+SET\s+NOT\s+NULL`)
+	reModifyNotNull = regexp.MustCompile(`(?is)^(?:MODIFY\s+(?:COLUMN\s+)?` + identifier + `|CHANGE\s+(?:COLUMN\s+)?` + identifier + `\s+` + identifier + `)\s.*\bNOT\s+NULL\b`)
+	reAddNotNull    = regexp.MustCompile(`(?is)^ADD\s+(?:COLUMN\s+)?(?:IF\s+NOT\s+EXISTS\s+)?` + identifier + `\s.*\bNOT\s+NULL\b`)
+	reDefault       = regexp.MustCompile(`(?is)\bDEFAULT\b`)
+	reAddUnique     = regexp.MustCompile(`(?is)^ADD\s+(?:CONSTRAINT\s+` + identifier + `\s+)?UNIQUE\s*(?:(?:KEY|INDEX)\s*)?(?:` + identifier + `\s*)?\(([^)]*)\)`)
+	reAddForeignKey = regexp.MustCompile(`(?is)^ADD\s+(?:CONSTRAINT\s+` + identifier + `\s+)?FOREIGN\s+KEY\s*(?:` + identifier + `\s*)?\(([^)]*)\)\s*REFERENCES\s+` + identifier + `\s*\(([^)]*)\)`)
+	reUniqueIndex   = regexp.MustCompile(`(?is)^CREATE\s+UNIQUE\s+INDEX\s+(?:CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?` + identifier + `\s+ON\s+` + identifier + `\s*(?:USING\s+\w+\s*)?\(([^)]*)\)`)
+)
+
+// constraintChecks builds a violation-counting query for each constraint m's
+// up SQL adds
+func constraintChecks(m Migration) []ConstraintCheck {
+	checks := []ConstraintCheck{}
+	for _, stmt := range splitStatements(m.Up) {
+		if match := reUniqueIndex.FindStringSubmatch(stmt); match != nil {
+			checks = append(checks, uniqueCheck(match[2], columnList(match[3])))
+			continue
+		}
+		match := reAlterTable.FindStringSubmatch(stmt)
+		if match == nil {
+			continue
+		}
+		table := match[1]
+		for _, action := range splitTopLevel(match[2]) {
+			action = strings.TrimSpace(action)
+			switch {
+			case reSetNotNull.MatchString(action):
+				checks = append(checks, notNullCheck(table, reSetNotNull.FindStringSubmatch(action)[1]))
+			case reModifyNotNull.MatchString(action):
+				sub := reModifyNotNull.FindStringSubmatch(action)
+				column := sub[1]
+				if column == "" {
+					column = sub[2]
+				}
+				checks = append(checks, notNullCheck(table, column))
+			case reAddNotNull.MatchString(action) && !reDefault.MatchString(action):
+				// a new NOT NULL column without a default can't be filled for
+				// existing rows, so every row violates it
+				column := reAddNotNull.FindStringSubmatch(action)[1]
+				checks = append(checks, ConstraintCheck{
+					Table:      unquote(table),
+					Constraint: "NOT NULL",
+					Columns:    []string{unquote(column)},
+					Query:      fmt.Sprintf("SELECT COUNT(*) FROM %s", table),
+				})
+			case reAddUnique.MatchString(action):
+				sub := reAddUnique.FindStringSubmatch(action)
+				checks = append(checks, uniqueCheck(table, columnList(sub[3])))
+			case reAddForeignKey.MatchString(action):
+				sub := reAddForeignKey.FindStringSubmatch(action)
+				checks = append(checks, foreignKeyCheck(table, columnList(sub[3]), sub[4], columnList(sub[5])))
+			}
+		}
+	}
+	for i := range checks {
+		checks[i].Migration = m.Name
+	}
+	return checks
+}
+
+func notNullCheck(table, column string) ConstraintCheck {
+	return ConstraintCheck{
+		Table:      unquote(table),
+		Constraint: "NOT NULL",
+		Columns:    []string{unquote(column)},
+		Query:      fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s IS NULL", table, column),
+	}
+}
+
+func uniqueCheck(table string, columns []string) ConstraintCheck {
+	cols := strings.Join(columns, ", ")
+	return ConstraintCheck{
+		Table:      unquote(table),
+		Constraint: "UNIQUE",
+		Columns:    unquoteAll(columns),
+		Query: fmt.Sprintf("SELECT COALESCE(SUM(n), 0) FROM (SELECT COUNT(*) AS n FROM %s WHERE %s GROUP BY %s HAVING COUNT(*) > 1) duplicates",
+			table, allNotNull("", columns), cols),
+	}
+}
+
+func foreignKeyCheck(table string, columns []string, parent string, parentColumns []string) ConstraintCheck {
+	joins := make([]string, len(columns))
+	for i := range columns {
+		if i < len(parentColumns) {
+			joins[i] = fmt.Sprintf("parent.%s = child.%s", parentColumns[i], columns[i])
+		}
+	}
+	return ConstraintCheck{
+		Table:      unquote(table),
+		Constraint: "FOREIGN KEY",
+		Columns:    unquoteAll(columns),
+		Query: fmt.Sprintf("SELECT COUNT(*) FROM %s child WHERE %s AND NOT EXISTS (SELECT 1 FROM %s parent WHERE %s)",
+			table, allNotNull("child.", columns), parent, strings.Join(joins, " AND ")),
+	}
+}
+
+// columnList splits a parenthesized column list, dropping sort orders
+func columnList(list string) []string {
+	columns := []string{}
+	for _, col := range strings.Split(list, ",") {
+		if fields := strings.Fields(col); len(fields) > 0 {
+			columns = append(columns, fields[0])
+		}
+	}
+	return columns
+}
+
+func allNotNull(prefix string, columns []string) string {
+	conditions := make([]string, len(columns))
+	for i, col := range columns {
+		conditions[i] = prefix + col + " IS NOT NULL"
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func unquoteAll(names []string) []string {
+	unquoted := make([]string, len(names))
+	for i, name := range names {
+		unquoted[i] = unquote(name)
+	}
+	return unquoted
+}
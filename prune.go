@@ -0,0 +1,101 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Prune archives obsolete tracking rows on db. See Migrator.Prune.
+func Prune(db DBTX, retention time.Duration) (int, error) {
+	return defaultMigrator(db, nil).PruneContext(context.Background(), retention)
+}
+
+// Prune keeps the tracking table small on long-lived installations by moving
+// rows of migrations that are no longer registered, such as those removed
+// after squashing, and were applied longer than retention ago into an archive
+// table named after the tracking table with an "_archive" suffix. Rows of
+// registered migrations are kept, as they record what has been applied; rows
+// of rolled-back migrations are already deleted by the rollback. It returns
+// the number of rows archived.
+func (mg *Migrator) Prune(retention time.Duration) (int, error) {
+	return mg.PruneContext(context.Background(), retention)
+}
+
+// PruneContext is like Prune, with a context
+func (mg *Migrator) PruneContext(ctx context.Context, retention time.Duration) (n int, err error) {
+	if err := mg.refuseDryRun("Prune"); err != nil {
+		return 0, err
+	}
+	if err := mg.refuseStrict("Prune"); err != nil {
+		return 0, err
+	}
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+	err = mg.withLock(ctx, func(mg *Migrator) error {
+		state.set("", "prune")
+		n, err = mg.prune(ctx, retention)
+		return err
+	})
+	return n, err
+}
+
+func (mg *Migrator) prune(ctx context.Context, retention time.Duration) (int, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = mg.createTrackingTable(ctx, mg.qualifiedTable()+"_archive")
+	if err != nil {
+		return 0, err
+	}
+
+	statuses, err := mg.StatusContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-retention)
+	obsolete := []MigrationStatus{}
+	for _, s := range statuses {
+		if !s.Registered && s.MigratedAt.Before(cutoff) {
+			obsolete = append(obsolete, s)
+		}
+	}
+	if len(obsolete) == 0 {
+		return 0, nil
+	}
+
+	var db DBTX = mg.db
+	tx, err := begin(ctx, mg.db)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction for pruning: %w", err)
+	}
+	if tx != nil {
+		db = tx
+	}
+	archive := mg.stmt("INSERT INTO %s_archive (name, batch, sql_hash, migrated_at, duration_ms, applied_by, applied_sql) SELECT name, batch, sql_hash, migrated_at, duration_ms, applied_by, applied_sql FROM %s WHERE name = ?")
+	remove := mg.stmt("DELETE FROM %s WHERE name = ?")
+	for _, s := range obsolete {
+		_, err := db.ExecContext(ctx, archive, s.Name)
+		if err == nil {
+			_, err = db.ExecContext(ctx, remove, s.Name)
+		}
+		if err != nil {
+			if tx != nil {
+				tx.Rollback()
+			}
+			return 0, fmt.Errorf("error archiving migration record for migration '%s': %w", s.Name, err)
+		}
+	}
+	if tx != nil {
+		err = tx.Commit()
+		if err != nil {
+			return 0, fmt.Errorf("error committing pruned migration records: %w", err)
+		}
+	}
+
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: archived %d obsolete migration records", len(obsolete))
+	}
+	return len(obsolete), nil
+}
@@ -0,0 +1,200 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RebuildTable returns a Go migration function that changes the definition of
+// a SQLite table by rebuilding it, for changes ALTER TABLE can't make there,
+// such as dropping a constraint or changing a column's type. create is the
+// table's new CREATE TABLE statement. The function creates it under a
+// temporary name, copies columns across (those named, or by default every
+// column both definitions share), drops the old table, renames the new one
+// into place, and recreates the table's indexes and triggers and the views
+// mentioning it.
+//
+// If another table's foreign key references the table, set ForeignKeysOff on
+// the migration, as dropping it with foreign keys enforced would delete or
+// cascade to the referencing rows; the function returns an error otherwise.
+func RebuildTable(table, create string, columns ...string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		create := strings.TrimSpace(create)
+		match := reCreateTable.FindStringSubmatchIndex(create)
+		if match == nil || !strings.EqualFold(unquote(create[match[2]:match[3]]), table) {
+			return fmt.Errorf("rebuilding table %s: expected a CREATE TABLE %s statement", table, table)
+		}
+		temp := table + "_moog_rebuild"
+		create = create[:match[2]] + quoteIdent(temp) + create[match[3]:]
+
+		err := checkUnreferenced(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		saved, err := dependentSchema(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		for _, s := range saved {
+			if s.kind == "view" {
+				_, err = tx.ExecContext(ctx, "DROP VIEW "+quoteIdent(s.name))
+				if err != nil {
+					return fmt.Errorf("rebuilding table %s: dropping view %s: %w", table, s.name, err)
+				}
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, create)
+		if err != nil {
+			return fmt.Errorf("rebuilding table %s: %w", table, err)
+		}
+		if len(columns) == 0 {
+			columns, err = sharedColumns(ctx, tx, table, temp)
+			if err != nil {
+				return err
+			}
+		}
+		quoted := make([]string, len(columns))
+		for i, c := range columns {
+			quoted[i] = quoteIdent(c)
+		}
+		list := strings.Join(quoted, ", ")
+		stmts := []string{
+			fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteIdent(temp), list, list, quoteIdent(table)),
+			"DROP TABLE " + quoteIdent(table),
+			fmt.Sprintf("ALTER TABLE %s RENAME TO %s", quoteIdent(temp), quoteIdent(table)),
+		}
+		for _, s := range saved {
+			stmts = append(stmts, s.sql)
+		}
+		for _, stmt := range stmts {
+			_, err := tx.ExecContext(ctx, stmt)
+			if err != nil {
+				return fmt.Errorf("rebuilding table %s: %w: %s", table, err, stmt)
+			}
+		}
+		return nil
+	}
+}
+
+// quoteIdent quotes a SQLite identifier
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// checkUnreferenced returns an error if foreign keys are enforced and
+// another table references table
+func checkUnreferenced(ctx context.Context, tx *sql.Tx, table string) error {
+	var enforced bool
+	err := tx.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enforced)
+	if err != nil {
+		return fmt.Errorf("rebuilding table %s: %w", table, err)
+	}
+	if !enforced {
+		return nil
+	}
+	var referencing string
+	err = tx.QueryRowContext(ctx, `SELECT m.name FROM sqlite_master m, pragma_foreign_key_list(m.name) f
+		WHERE m.type = 'table' AND m.name <> ? COLLATE NOCASE AND f."table" = ? COLLATE NOCASE LIMIT 1`, table, table).Scan(&referencing)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("rebuilding table %s: %w", table, err)
+	}
+	return fmt.Errorf("rebuilding table %s: it is referenced by a foreign key of %s; set ForeignKeysOff on the migration", table, referencing)
+}
+
+// schemaObject is an index, trigger or view saved to be recreated
+type schemaObject struct {
+	kind string
+	name string
+	sql  string
+}
+
+// dependentSchema returns the indexes and triggers of table, which are
+// dropped with it, and the views mentioning it, which would fail the rename
+func dependentSchema(ctx context.Context, tx *sql.Tx, table string) ([]schemaObject, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT type, name, sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND (type IN ('index', 'trigger') AND tbl_name = ? COLLATE NOCASE OR type = 'view')
+		ORDER BY CASE type WHEN 'index' THEN 0 WHEN 'trigger' THEN 1 ELSE 2 END, rowid`, table)
+	if err != nil {
+		return nil, fmt.Errorf("rebuilding table %s: %w", table, err)
+	}
+	defer rows.Close()
+	saved := []schemaObject{}
+	for rows.Next() {
+		var s schemaObject
+		err := rows.Scan(&s.kind, &s.name, &s.sql)
+		if err != nil {
+			return nil, fmt.Errorf("rebuilding table %s: %w", table, err)
+		}
+		if s.kind == "view" && !strings.Contains(strings.ToLower(s.sql), strings.ToLower(table)) {
+			continue
+		}
+		saved = append(saved, s)
+	}
+	return saved, rows.Err()
+}
+
+// sharedColumns returns the columns of to that from also has, in to's order
+func sharedColumns(ctx context.Context, tx *sql.Tx, from, to string) ([]string, error) {
+	existing := map[string]bool{}
+	columns := []string{}
+	for _, table := range []string{from, to} {
+		rows, err := tx.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+		if err != nil {
+			return nil, fmt.Errorf("rebuilding table %s: %w", from, err)
+		}
+		for rows.Next() {
+			var name string
+			err := rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("rebuilding table %s: %w", from, err)
+			}
+			if table == from {
+				existing[strings.ToLower(name)] = true
+			} else if existing[strings.ToLower(name)] {
+				columns = append(columns, name)
+			}
+		}
+		err = rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("rebuilding table %s: %w", from, err)
+		}
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("rebuilding table %s: the new definition shares no columns with it", from)
+	}
+	return columns, nil
+}
+
+// foreignKeysOff turns off foreign key enforcement on the Migrator's
+// connection for a ForeignKeysOff migration. The returned func turns it back
+// on if it was on.
+func (mg *Migrator) foreignKeysOff(ctx context.Context) (func(), error) {
+	var enforced bool
+	err := mg.db.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enforced)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SQLite foreign_keys: %w", err)
+	}
+	if !enforced {
+		return func() {}, nil
+	}
+	_, err = mg.db.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+	if err == nil {
+		err = mg.db.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enforced)
+	}
+	if err == nil && enforced {
+		// the pragma is a no-op inside a transaction
+		err = errors.New("foreign keys can't be turned off inside a transaction")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error turning off SQLite foreign keys: %w", err)
+	}
+	return mg.sqliteRestore(mg.db, "PRAGMA foreign_keys = ON"), nil
+}
@@ -0,0 +1,122 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// RollbackMigration rolls back a single migration in the default registry.
+// See Migrator.RollbackMigration.
+func RollbackMigration(db DBTX, name string, force bool, logger *log.Logger) error {
+	return defaultMigrator(db, logger).RollbackMigrationContext(context.Background(), name, force)
+}
+
+// Redo re-runs a single migration in the default registry. See Migrator.Redo.
+func Redo(db DBTX, name string, logger *log.Logger) error {
+	return defaultMigrator(db, logger).RedoContext(context.Background(), name)
+}
+
+// RollbackMigration runs the down of the applied migration name and deletes
+// its status record, regardless of its batch. Like Rollback, it fails if the
+// migration has changed since it was applied, unless force is set.
+func (mg *Migrator) RollbackMigration(name string, force bool) error {
+	return mg.RollbackMigrationContext(context.Background(), name, force)
+}
+
+// RollbackMigrationContext is like RollbackMigration, with a context
+func (mg *Migrator) RollbackMigrationContext(ctx context.Context, name string, force bool) error {
+	return mg.redo(ctx, name, force, false)
+}
+
+// Redo runs the down and then the up of the applied migration name, keeping
+// its batch. It is intended for development: the migration's current SQL is
+// run and its hash recorded even if it was edited since it was applied, so
+// later runs accept the edit without force. It is refused in strict mode.
+func (mg *Migrator) Redo(name string) error {
+	return mg.RedoContext(context.Background(), name)
+}
+
+// RedoContext is like Redo, with a context
+func (mg *Migrator) RedoContext(ctx context.Context, name string) error {
+	// it records an edited migration's hash, which strict mode forbids
+	if err := mg.refuseStrict("Redo"); err != nil {
+		return err
+	}
+	return mg.redo(ctx, name, true, true)
+}
+
+func (mg *Migrator) redo(ctx context.Context, name string, force, up bool) (err error) {
+	if err := mg.refuseDryRun("Redo and RollbackMigration"); err != nil {
+		return err
+	}
+	var m Migration
+	found := false
+	for _, registered := range mg.registry.snapshot() {
+		if registered.Name == name {
+			m, found = registered, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("migration '%s' is not registered", name)
+	}
+
+	if len(mg.groups) > 0 {
+		return mg.forGroup(m.Group, []Migration{m}).redo(ctx, name, force, up)
+	}
+	if mg.dualWrite != nil {
+		return ErrDualWriteRollback
+	}
+
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+	return mg.withLock(ctx, func(mg *Migrator) error {
+		state.set(name, "setup")
+		err := mg.guard(ctx, true, force && !up)
+		if err != nil {
+			return err
+		}
+		err = mg.dropStaleScratch(ctx)
+		if err != nil {
+			return err
+		}
+		err = mg.checkDirty(ctx)
+		if err != nil {
+			return err
+		}
+
+		var batch int
+		var hash string
+		err = mg.db.QueryRowContext(ctx, mg.stmt("SELECT batch, sql_hash FROM %s WHERE name = ?"), name).Scan(&batch, &hash)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("migration '%s' has not been run", name)
+		}
+		if err != nil {
+			return fmt.Errorf("error checking status of migration '%s': %w", name, err)
+		}
+		if !force && !m.matchesHash(hash) {
+			return fmt.Errorf("previously run migration '%s' has changed since run", name)
+		}
+		// Redo's down is forced to accept edits, which doesn't override a
+		// protected environment
+		err = mg.confirmDown(ctx, force && !up, func() ([]Migration, error) {
+			return []Migration{m}, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		caps, err := mg.DetectCapabilitiesContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = mg.execute(ctx, m, true, batch, caps, state)
+		if err != nil || !up {
+			return err
+		}
+		return mg.execute(ctx, m, false, batch, caps, state)
+	})
+}
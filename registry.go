@@ -0,0 +1,305 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Registry is a set of migrations. The package functions operate on a default
+// registry; libraries that ship their own migrations can expose a *Registry
+// for applications to Include alongside their own. A Registry is safe for
+// concurrent use, so migrations can be registered from parallel init work.
+type Registry struct {
+	mu         sync.RWMutex
+	migrations []Migration
+	// from records the file:line each migration name was registered from
+	from map[string]string
+	// snippets are the fragments defined with DefineSnippet
+	snippets *template.Template
+	// names is the naming convention set with SetNameStrategy
+	names NameStrategy
+	// strictHeaders is set with SetStrictHeaders
+	strictHeaders bool
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		migrations: []Migration{},
+		from:       map[string]string{},
+	}
+}
+
+var defaultRegistry = NewRegistry()
+
+// Register registers a migration to be run by RunLatest. Registered migrations
+// should not be edited in place; use SetUp or SetDown so the cached hash is
+// invalidated. Migrations with Template set are expanded when registered, and
+// Register panics if expansion fails.
+func Register(m ...Migration) {
+	defaultRegistry.register(callerLocation(), m...)
+}
+
+// MustRegister registers migrations like Register, but panics if a migration
+// with the same name has already been registered, naming both files. It is
+// intended for the one-package-per-migration pattern, where each package
+// registers itself in init() and is blank-imported by the application.
+func MustRegister(m ...Migration) {
+	defaultRegistry.mustRegister(callerLocation(), m...)
+}
+
+// Include adds the migrations of other registries to the default registry
+func Include(others ...*Registry) error {
+	return defaultRegistry.Include(others...)
+}
+
+// Registered returns a copy of the migrations in the default registry,
+// sorted by name. Changing it doesn't change the registry.
+func Registered() []Migration {
+	return defaultRegistry.Migrations()
+}
+
+// RegisteredMigrations returns a copy of the migrations in the default
+// registry, in the order they were registered.
+//
+// Deprecated: use Registered, which sorts them the way they run.
+func RegisteredMigrations() []Migration {
+	return defaultRegistry.snapshot()
+}
+
+// Register adds migrations to the registry
+func (r *Registry) Register(m ...Migration) {
+	r.register(callerLocation(), m...)
+}
+
+// MustRegister adds migrations to the registry, panicking on duplicate names
+func (r *Registry) MustRegister(m ...Migration) {
+	r.mustRegister(callerLocation(), m...)
+}
+
+// Migrations returns a copy of the registered migrations, sorted by name.
+// Changing it doesn't change the registry.
+func (r *Registry) Migrations() []Migration {
+	migrations := r.snapshot()
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Name < migrations[j].Name
+	})
+	return migrations
+}
+
+// Include merges the migrations of other registries into r. A migration
+// registered under the same name in more than one registry is included once
+// if its SQL is identical, and is otherwise a conflict: Include returns an
+// error naming both registration sites and leaves r unchanged.
+func (r *Registry) Include(others ...*Registry) error {
+	// others are copied before r is locked, as r may be among them
+	type included struct {
+		migrations []Migration
+		from       map[string]string
+	}
+	sources := make([]included, len(others))
+	for i, other := range others {
+		other.mu.RLock()
+		sources[i] = included{migrations: copyMigrations(other.migrations), from: make(map[string]string, len(other.from))}
+		for name, location := range other.from {
+			sources[i].from[name] = location
+		}
+		other.mu.RUnlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	known := make(map[string]Migration, len(r.migrations))
+	for _, m := range r.migrations {
+		known[m.Name] = m
+	}
+
+	merged := []Migration{}
+	mergedFrom := map[string]string{}
+	for _, other := range sources {
+		for _, m := range other.migrations {
+			if existing, ok := known[m.Name]; ok {
+				if existing.hash() != m.hash() {
+					previous := r.from[m.Name]
+					if p, ok := mergedFrom[m.Name]; ok {
+						previous = p
+					}
+					return fmt.Errorf("conflicting migration '%s' registered at %s and %s", m.Name, previous, other.from[m.Name])
+				}
+				continue
+			}
+			known[m.Name] = m
+			merged = append(merged, m)
+			mergedFrom[m.Name] = other.from[m.Name]
+		}
+	}
+
+	r.migrations = append(r.migrations, merged...)
+	for name, location := range mergedFrom {
+		r.from[name] = location
+	}
+	return nil
+}
+
+func (r *Registry) mustRegister(location string, m ...Migration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// names repeated within m are duplicates too
+	seen := make(map[string]bool, len(m))
+	for _, migration := range m {
+		if previous, ok := r.from[migration.Name]; ok {
+			panic(fmt.Sprintf("moogration: migration '%s' registered at %s was already registered at %s", migration.Name, location, previous))
+		}
+		if seen[migration.Name] {
+			panic(fmt.Sprintf("moogration: migration '%s' registered twice at %s", migration.Name, location))
+		}
+		seen[migration.Name] = true
+	}
+	r.registerLocked(location, m...)
+}
+
+func (r *Registry) register(location string, m ...Migration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registerLocked(location, m...)
+}
+
+// registerMissing adds the migrations whose names aren't registered yet,
+// checking and adding them under one lock, so Migrators sharing the registry
+// don't add the same one twice
+func (r *Registry) registerMissing(location string, m ...Migration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, migration := range m {
+		if _, ok := r.from[migration.Name]; !ok {
+			r.registerLocked(location, migration)
+		}
+	}
+}
+
+// registerLocked adds migrations to the registry, which must be locked
+func (r *Registry) registerLocked(location string, m ...Migration) {
+	for _, migration := range m {
+		migration, err := r.expand(migration)
+		if err != nil {
+			panic(fmt.Sprintf("moogration: migration '%s' registered at %s: %s", migration.Name, location, err))
+		}
+		migration.digest = migration.computeHash()
+		r.migrations = append(r.migrations, migration)
+		if _, ok := r.from[migration.Name]; !ok {
+			r.from[migration.Name] = location
+		}
+	}
+}
+
+// callerLocation returns the file:line of the caller of the exported function
+// calling it
+func callerLocation() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown location"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// VerifyComplete guards against missing blank imports: it returns an error if
+// the number of registered migrations differs from expectedCount, or if the
+// database records migrations that are not registered.
+func VerifyComplete(db DBTX, expectedCount int) error {
+	return defaultMigrator(db, nil).VerifyCompleteContext(context.Background(), expectedCount)
+}
+
+// VerifyComplete checks the Migrator's registry like the package-level
+// VerifyComplete
+func (mg *Migrator) VerifyComplete(expectedCount int) error {
+	return mg.VerifyCompleteContext(context.Background(), expectedCount)
+}
+
+// VerifyCompleteContext is like VerifyComplete, with a context
+func (mg *Migrator) VerifyCompleteContext(ctx context.Context, expectedCount int) error {
+	registeredMigrations := mg.registry.snapshot()
+	if len(registeredMigrations) != expectedCount {
+		return fmt.Errorf("expected %d registered migrations, found %d: check that every migration package is imported", expectedCount, len(registeredMigrations))
+	}
+
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	registered := make(map[string]bool, len(registeredMigrations))
+	for _, m := range registeredMigrations {
+		registered[m.Name] = true
+	}
+
+	missing := []string{}
+	for name := range applied {
+		if !registered[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("migrations %s have been run but are not registered: check that every migration package is imported", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// registryOf wraps a caller-supplied migration set in a registry
+func registryOf(migrations []Migration) *Registry {
+	r := NewRegistry()
+	r.migrations = cloneMigrations(migrations)
+	return r
+}
+
+// prepare a caller-supplied migration set for running without mutating it.
+// Hashes are always recomputed, as the caller may have edited the SQL of a
+// copy handed out with its hash cached.
+func cloneMigrations(migrations []Migration) []Migration {
+	clone := copyMigrations(migrations)
+	for i := range clone {
+		clone[i].digest = clone[i].computeHash()
+	}
+	return clone
+}
+
+// copyMigrations copies migrations, keeping their cached hashes
+func copyMigrations(migrations []Migration) []Migration {
+	clone := make([]Migration, len(migrations))
+	for i, m := range migrations {
+		m.Tags = append([]string(nil), m.Tags...)
+		m.FollowUps = append([]FollowUp(nil), m.FollowUps...)
+		if m.Labels != nil {
+			labels := make(Labels, len(m.Labels))
+			for k, v := range m.Labels {
+				labels[k] = v
+			}
+			m.Labels = labels
+		}
+		clone[i] = m
+	}
+	return clone
+}
+
+// snapshot returns a copy of the registered migrations, in the order they
+// were registered
+func (r *Registry) snapshot() []Migration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return copyMigrations(r.migrations)
+}
+
+// registeredAt returns the file:line a migration name was first registered
+// from
+func (r *Registry) registeredAt(name string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	from, ok := r.from[name]
+	return from, ok
+}
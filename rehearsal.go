@@ -0,0 +1,176 @@
+package moogration
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+// ErrRehearsal is wrapped by the error of a run whose rehearsal on a
+// schema-only clone failed, leaving the target untouched
+var ErrRehearsal = errors.New("rehearsal failed")
+
+// WithRehearsal makes each run rehearse first: the schema of the target
+// database, without its data, is cloned into a scratch database, the
+// pending migrations are applied there, and the run only proceeds to the
+// target if they all succeed. On SQLite the clone is an in-memory database,
+// for which the Migrator's handle must be a *sql.DB; on MySQL it is a
+// database named after the target's with a "_moog_rehearsal" suffix, which
+// the connection needs privileges to create and drop. PostgreSQL isn't
+// supported. The clone is dumped as by DumpSchema, so migrations that depend
+// on data, such as backfills, are only checked for valid SQL. The rehearsal
+// runs before the migration lock is taken, and rollbacks aren't rehearsed.
+func WithRehearsal() Option {
+	return func(m *Migrator) {
+		m.rehearse = true
+	}
+}
+
+// runRehearsal applies the pending migrations to a schema-only clone of the
+// Migrator's database
+func (mg *Migrator) runRehearsal(ctx context.Context, force bool) error {
+	var dump bytes.Buffer
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = mg.DumpSchemaContext(ctx, &dump)
+	} else {
+		// nothing applied yet, but the schema may have tables of its own
+		err = mg.dumpUntracked(ctx, &dump)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: cloning schema: %s", ErrRehearsal, err)
+	}
+
+	scratch, cleanup, err := mg.rehearsalDB(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: creating scratch database: %s", ErrRehearsal, err)
+	}
+	defer cleanup()
+
+	sub := mg.rehearsalMigrator(scratch)
+	err = sub.LoadSchemaContext(ctx, &dump)
+	if err != nil {
+		return fmt.Errorf("%w: loading schema: %s", ErrRehearsal, err)
+	}
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: rehearsing pending migrations on a schema-only clone")
+	}
+	result, err := sub.runLatestReport(ctx, false, force)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRehearsal, err)
+	}
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: rehearsal applied %d migrations", len(result.Applied))
+	}
+	return nil
+}
+
+// dumpUntracked writes a schema dump of a database without a tracking table
+func (mg *Migrator) dumpUntracked(ctx context.Context, dump *bytes.Buffer) error {
+	objects, err := mg.schemaObjects(ctx, false)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(dump, "%s%s\n\n", dumpHeader, mg.driver)
+	for _, o := range objects {
+		fmt.Fprintf(dump, "%s;\n\n", o.sql)
+	}
+	return nil
+}
+
+// rehearsalMigrator returns a Migrator running against scratch, without the
+// locking, hooks, extra targets or pacing of the Migrator it rehearses for
+func (mg *Migrator) rehearsalMigrator(scratch DBTX) *Migrator {
+	sub := *mg
+	sub.db = scratch
+	sub.schema = ""
+	sub.rehearse = false
+	sub.lock = false
+	sub.lockSkip = false
+	sub.dualWrite = nil
+	sub.dryRun = false
+	// the clone is scratch, loaded with LoadSchema; the run itself is
+	// still guarded on the Migrator's database
+	sub.strict = false
+	sub.pause = 0
+	sub.interval = 0
+	sub.hooks = hooks{}
+	sub.tracer = nil
+	sub.approve = nil
+	sub.visibility = nil
+	return &sub
+}
+
+// rehearsalDB creates an empty scratch database for a rehearsal. The
+// returned func drops it.
+func (mg *Migrator) rehearsalDB(ctx context.Context) (DBTX, func(), error) {
+	switch mg.driver {
+	case sqlite:
+		db, ok := mg.db.(*sql.DB)
+		if !ok {
+			return nil, nil, fmt.Errorf("rehearsing on SQLite needs a *sql.DB, not %T", mg.db)
+		}
+		scratch := sql.OpenDB(memoryConnector{db.Driver()})
+		// each connection to :memory: is a separate database
+		scratch.SetMaxOpenConns(1)
+		return scratch, func() { scratch.Close() }, nil
+	case mysql:
+		return mg.mysqlRehearsalDB(ctx)
+	default:
+		return nil, nil, fmt.Errorf("rehearsals are not supported on %s", mg.driver)
+	}
+}
+
+// memoryConnector opens in-memory databases with a SQLite driver
+type memoryConnector struct {
+	drv sqldriver.Driver
+}
+
+func (c memoryConnector) Connect(ctx context.Context) (sqldriver.Conn, error) {
+	return c.drv.Open(":memory:")
+}
+
+func (c memoryConnector) Driver() sqldriver.Driver {
+	return c.drv
+}
+
+// mysqlRehearsalDB creates a scratch MySQL database and returns a connection
+// reserved from the pool that uses it
+func (mg *Migrator) mysqlRehearsalDB(ctx context.Context) (DBTX, func(), error) {
+	conn, release, err := session(ctx, mg.db)
+	if err != nil {
+		return nil, nil, err
+	}
+	var current sql.NullString
+	err = conn.QueryRowContext(ctx, "SELECT DATABASE()").Scan(&current)
+	if err != nil {
+		release(false)
+		return nil, nil, err
+	}
+	target := current.String
+	if mg.schema != "" {
+		target = mg.schema
+	}
+	name := mysql.quote(target + "_moog_rehearsal")
+	for _, stmt := range []string{"DROP DATABASE IF EXISTS " + name, "CREATE DATABASE " + name, "USE " + name} {
+		_, err = conn.ExecContext(ctx, stmt)
+		if err != nil {
+			release(true)
+			return nil, nil, err
+		}
+	}
+	return conn, func() {
+		_, err := conn.ExecContext(context.Background(), "DROP DATABASE "+name)
+		if err != nil && mg.logger != nil {
+			mg.logger.Printf("migrate :: error dropping rehearsal database %s: %s", name, err)
+		}
+		// the connection's default database is gone
+		release(true)
+	}, nil
+}
@@ -0,0 +1,89 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// audit logs operations that warrant a record regardless of whether logging
+// is enabled
+func (mg *Migrator) audit(format string, args ...interface{}) {
+	mg.auditLabeled(mg.labels, format, args...)
+}
+
+// auditMigration is like audit, for an event concerning m, and is labeled
+// with its labels
+func (mg *Migrator) auditMigration(m Migration, format string, args ...interface{}) {
+	mg.auditLabeled(mg.labelsFor(m), format, args...)
+}
+
+func (mg *Migrator) auditLabeled(labels Labels, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...) + labelSuffix(labels)
+	if mg.logger != nil {
+		mg.logger.Print("AUDIT: " + msg)
+		return
+	}
+	log.Print("moogration AUDIT: " + msg)
+}
+
+// runWithoutReplication runs a migration with binary logging disabled for its
+// session, so the change is not replicated. Binary logging is re-enabled
+// before the connection returns to the pool; if that fails, the connection
+// is discarded instead.
+func (mg *Migrator) runWithoutReplication(ctx context.Context, m Migration, down bool) error {
+	if mg.minimalPermissions {
+		return fmt.Errorf("migration '%s' sets SkipReplication, which needs a dedicated session and SUPER, unavailable with WithMinimalPermissions", m.Name)
+	}
+	if mg.driver != mysql {
+		return fmt.Errorf("migration '%s' sets SkipReplication, which is only supported on MySQL", m.Name)
+	}
+
+	mg.auditMigration(m, "migration '%s' (%s) is running with sql_log_bin = 0 and will not be replicated", m.Name, direction(down))
+
+	conn, release, err := session(ctx, mg.db)
+	if err != nil {
+		return fmt.Errorf("error reserving connection for migration '%s': %w", m.Name, err)
+	}
+
+	_, err = conn.ExecContext(ctx, "SET SESSION sql_log_bin = 0")
+	if err != nil {
+		release(false)
+		return fmt.Errorf("error disabling binary logging for migration '%s': %w", m.Name, err)
+	}
+	err = mg.watchSession(ctx, conn)
+	if err != nil {
+		release(false)
+		return fmt.Errorf("migration '%s': %w", m.Name, err)
+	}
+	defer func() {
+		// the restore must not be cancelled with the migration's statement
+		endSession(ctx)
+		// restore even if ctx was cancelled mid-migration
+		_, err := conn.ExecContext(context.Background(), "SET SESSION sql_log_bin = 1")
+		if err != nil {
+			mg.auditMigration(m, "failed to re-enable binary logging after migration '%s', discarding connection: %s", m.Name, err)
+		}
+		release(err != nil)
+	}()
+
+	if m.fn(down) == nil {
+		return m.run(ctx, down, conn, mg)
+	}
+
+	// Go migrations need a transaction, opened on the same session
+	tx, err := begin(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("error starting transaction for migration '%s': %w", m.Name, err)
+	}
+	if tx == nil {
+		// conn is already a transaction
+		return m.run(ctx, down, conn, mg)
+	}
+	err = m.run(ctx, down, tx, mg)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
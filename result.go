@@ -0,0 +1,186 @@
+package moogration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Result summarizes what a run or rollback did
+type Result struct {
+	// Applied lists the migrations run, up or down, in the order they ran
+	Applied []MigrationResult
+	// Skipped lists migrations that were due to run but didn't
+	Skipped []SkippedMigration
+	// Failed is the migration whose failure stopped the run, if any. A
+	// failure recorded as dirty is listed in Applied instead, and one the run
+	// continued past in Skipped.
+	Failed *MigrationResult
+	// Locked is set if the run was skipped because another instance held the
+	// migration lock, with WithLockSkip
+	Locked bool
+}
+
+// MigrationResult is a single migration run
+type MigrationResult struct {
+	Name string
+	// Direction is "up" or "down"
+	Direction string
+	Batch     int
+	Duration  time.Duration
+	// RowsAffected is the number of rows affected by the statements of a SQL
+	// migration, where the driver reports it
+	RowsAffected int64
+	// Err is the error of a migration that failed partway and was recorded
+	// as dirty under MarkDirty
+	Err error
+}
+
+// SkippedMigration is a migration that was due to run but didn't
+type SkippedMigration struct {
+	Name   string
+	Reason string
+}
+
+// RunLatestReport is like RunLatest, and returns a summary of the run
+func RunLatestReport(db DBTX, down, force bool, logger *log.Logger) (Result, error) {
+	return defaultMigrator(db, logger).RunLatestReportContext(context.Background(), down, force)
+}
+
+// RollbackReport is like Rollback, and returns a summary of the rollback
+func RollbackReport(db DBTX, numBatches int, force bool, logger *log.Logger) (Result, error) {
+	return defaultMigrator(db, logger).RollbackReportContext(context.Background(), numBatches, force)
+}
+
+// RunLatestReport is like RunLatest, and returns a summary of the run. If the
+// run fails, the summary lists the migrations applied before the failure.
+func (mg *Migrator) RunLatestReport(down, force bool) (Result, error) {
+	return mg.RunLatestReportContext(context.Background(), down, force)
+}
+
+// RollbackReport is like Rollback, and returns a summary of the rollback. If
+// the rollback fails, the summary lists the migrations rolled back before the
+// failure.
+func (mg *Migrator) RollbackReport(numBatches int, force bool) (Result, error) {
+	return mg.RollbackReportContext(context.Background(), numBatches, force)
+}
+
+// merge appends the migrations of another result
+func (r *Result) merge(other Result) {
+	r.Applied = append(r.Applied, other.Applied...)
+	r.Skipped = append(r.Skipped, other.Skipped...)
+	if other.Failed != nil {
+		r.Failed = other.Failed
+	}
+	r.Locked = r.Locked || other.Locked
+}
+
+// WriteSummary writes a line per migration run or skipped, then the totals
+func (r Result) WriteSummary(w io.Writer) error {
+	if r.Locked {
+		_, err := fmt.Fprintln(w, "skipped: the migration lock is held by another instance")
+		return err
+	}
+	var total time.Duration
+	migrations := r.Applied
+	if r.Failed != nil {
+		migrations = append(migrations[:len(migrations):len(migrations)], *r.Failed)
+	}
+	for _, m := range migrations {
+		total += m.Duration
+		status := ""
+		if m.Err != nil {
+			status = fmt.Sprintf(" FAILED: %s", m.Err)
+		}
+		_, err := fmt.Fprintf(w, "%-4s %s (batch %d, %s)%s\n", m.Direction, m.Name, m.Batch, m.Duration.Round(time.Millisecond), status)
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range r.Skipped {
+		_, err := fmt.Fprintf(w, "skip %s: %s\n", s.Name, s.Reason)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d migrations run in %s, %d skipped\n", len(r.Applied), total.Round(time.Millisecond), len(r.Skipped))
+	return err
+}
+
+// Report is the serializable form of a run's Result and error, written by
+// WriteJSON and exchanged by a control plane and its agents through a Codec
+type Report struct {
+	// Bundle is the digest of the Bundle the run applied, if any
+	Bundle     string              `json:"bundle,omitempty"`
+	OK         bool                `json:"ok"`
+	Locked     bool                `json:"locked"`
+	Error      string              `json:"error,omitempty"`
+	Migrations []ReportedMigration `json:"migrations"`
+}
+
+// ReportedMigration is a migration in a Report, or in the JSON written by
+// WriteStatusJSON
+type ReportedMigration struct {
+	Name         string `json:"name"`
+	Direction    string `json:"direction,omitempty"`
+	Batch        int    `json:"batch,omitempty"`
+	DurationMS   int64  `json:"duration_ms"`
+	RowsAffected int64  `json:"rows_affected,omitempty"`
+	// Status is "ok", "dirty", "failed" or "skipped" in a Report, and the
+	// migration's State in a status
+	Status     string `json:"status"`
+	Reason     string `json:"reason,omitempty"`
+	Error      string `json:"error,omitempty"`
+	MigratedAt string `json:"migrated_at,omitempty"`
+	AppliedBy  string `json:"applied_by,omitempty"`
+}
+
+// NewReport describes the result of a run that returned err. A migration's
+// status is "ok", "dirty" for a failure recorded as dirty, "failed" for the
+// failure that stopped the run, or "skipped" with a reason.
+func NewReport(r Result, err error) Report {
+	report := Report{OK: err == nil, Locked: r.Locked, Migrations: []ReportedMigration{}}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	migrations := r.Applied
+	if r.Failed != nil {
+		migrations = append(migrations[:len(migrations):len(migrations)], *r.Failed)
+	}
+	for _, m := range migrations {
+		rm := ReportedMigration{
+			Name:         m.Name,
+			Direction:    m.Direction,
+			Batch:        m.Batch,
+			DurationMS:   m.Duration.Milliseconds(),
+			RowsAffected: m.RowsAffected,
+			Status:       "ok",
+		}
+		if m.Err != nil {
+			rm.Status = "failed"
+			if errors.Is(m.Err, ErrDirty) {
+				rm.Status = "dirty"
+			}
+			rm.Error = m.Err.Error()
+		}
+		report.Migrations = append(report.Migrations, rm)
+	}
+	for _, s := range r.Skipped {
+		report.Migrations = append(report.Migrations, ReportedMigration{Name: s.Name, Status: "skipped", Reason: s.Reason})
+	}
+	return report
+}
+
+// WriteJSON writes the Report of a run that returned err as a single JSON
+// object, for deploy automation to consume in place of the log:
+//
+//	{"ok": false, "locked": false, "error": "...", "migrations": [
+//	  {"name": "001_users", "direction": "up", "batch": 3, "duration_ms": 12, "status": "ok"},
+//	  {"name": "002_posts", "direction": "up", "batch": 3, "duration_ms": 4, "status": "failed", "error": "..."}]}
+func (r Result) WriteJSON(w io.Writer, err error) error {
+	return json.NewEncoder(w).Encode(NewReport(r, err))
+}
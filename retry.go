@@ -0,0 +1,151 @@
+package moogration
+
+import (
+	"context"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how transient database errors are retried, with
+// WithRetry
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is attempted,
+	// including the first. Less than 2 disables retries.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled after each retry up
+	// to MaxBackoff. It defaults to 500ms.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retryable classifies an error as transient, by default IsTransient
+	Retryable func(error) bool
+}
+
+// WithRetry retries transient database errors, such as a database that isn't
+// accepting connections yet or a deadlock, with backoff. A run first pings
+// the database until it answers, then retries creating and reading the
+// tracking table and recording a migration's status. A migration run in a
+// transaction whose status record fails is rolled back and run again, as
+// nothing of it was committed; a migration's own statements are otherwise
+// never rerun. Retries are logged.
+func WithRetry(policy RetryPolicy) Option {
+	return func(m *Migrator) {
+		if policy.Backoff <= 0 {
+			policy.Backoff = 500 * time.Millisecond
+		}
+		if policy.MaxBackoff < policy.Backoff {
+			policy.MaxBackoff = policy.Backoff
+		}
+		if policy.Retryable == nil {
+			policy.Retryable = IsTransient
+		}
+		m.retry = &policy
+	}
+}
+
+// transientMessages are fragments of the messages of errors that are worth
+// retrying, for drivers that don't expose them as typed errors
+var transientMessages = []string{
+	"invalid connection",
+	"bad connection",
+	"broken pipe",
+	"connection refused",
+	"connection reset",
+	"deadlock",
+	"lock wait timeout",
+	"too many connections",
+	"database is locked",
+	"could not serialize access",
+	"the database system is starting up",
+	"the database system is shutting down",
+}
+
+// IsTransient reports whether err is likely to succeed if retried: a lost
+// or refused connection, a network error, a deadlock or lock wait timeout,
+// a serialization failure, too many connections, or a database that is
+// still starting up
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, sqldriver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry calls fn until it succeeds, fails with an error the retry policy
+// doesn't retry, or has been attempted as many times as the policy allows.
+// what describes fn in the log.
+func (mg *Migrator) withRetry(ctx context.Context, what string, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && mg.retries(attempt, err); attempt++ {
+		wait := mg.retry.backoff(attempt)
+		if mg.logger != nil {
+			mg.logger.Printf("migrate :: %s failed (attempt %d of %d), retrying in %s: %s", what, attempt, mg.retry.MaxAttempts, wait, err)
+		}
+		if sleep(ctx, wait) != nil {
+			return err
+		}
+		err = fn()
+	}
+	return err
+}
+
+// retries reports whether an operation that failed with err on the given
+// attempt is retried
+func (mg *Migrator) retries(attempt int, err error) bool {
+	return mg.retry != nil && attempt < mg.retry.MaxAttempts && mg.retry.Retryable(err)
+}
+
+// backoff is the wait before the retry following the given attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, p.MaxBackoff)
+}
+
+// waitForDB pings the database until it answers, if retries are enabled
+func (mg *Migrator) waitForDB(ctx context.Context) error {
+	p, ok := mg.db.(pinger)
+	if mg.retry == nil || !ok {
+		return nil
+	}
+	err := mg.withRetry(ctx, "connecting to the database", func() error {
+		return p.PingContext(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("error connecting to the database: %w", err)
+	}
+	return nil
+}
+
+// notApplied is the error of a migration that failed before changing
+// anything, or whose transaction was rolled back, so it can be run again
+type notApplied struct {
+	err error
+}
+
+func (e *notApplied) Error() string {
+	return e.err.Error()
+}
+
+func (e *notApplied) Unwrap() error {
+	return e.err
+}
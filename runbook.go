@@ -0,0 +1,163 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Runbook is the rollback procedure for the batch the next run would apply
+type Runbook struct {
+	// Batch is the number the batch will be recorded under
+	Batch int
+	// Previous is the latest migration applied before the batch, which the
+	// database returns to once the batch is rolled back
+	Previous string
+	// Steps lists the migrations in the order they are rolled back
+	Steps []RunbookStep
+}
+
+// RunbookStep is the rollback of a single migration
+type RunbookStep struct {
+	Migration string
+	Down      string
+	Estimate  time.Duration
+	// Irreversible is set if the migration has no Down SQL, in which case
+	// ManualRollback describes how to undo it
+	Irreversible   bool
+	ManualRollback string
+	Preconditions  []string
+}
+
+// RollbackRunbook plans the rollback of the batch the next RunLatest on db
+// would apply. See Migrator.RollbackRunbook.
+func RollbackRunbook(db DBTX) (*Runbook, error) {
+	return defaultMigrator(db, nil).RollbackRunbookContext(context.Background())
+}
+
+// RollbackRunbook plans the rollback of the batch the next RunLatest would
+// apply, so on-call engineers have a procedure ready for every deploy. It
+// does not change the database.
+func (mg *Migrator) RollbackRunbook() (*Runbook, error) {
+	return mg.RollbackRunbookContext(context.Background())
+}
+
+// RollbackRunbookContext is like RollbackRunbook, with a context
+func (mg *Migrator) RollbackRunbookContext(ctx context.Context) (*Runbook, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lastBatch, err := mg.latestBatch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine last-run batch number: %w", err)
+	}
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	rb := &Runbook{Batch: lastBatch + 1}
+	for _, m := range mg.registry.Migrations() {
+		if _, hasRun := applied[m.Name]; hasRun {
+			if m.Name > rb.Previous {
+				rb.Previous = m.Name
+			}
+			continue
+		}
+
+		step := RunbookStep{
+			Migration:      m.Name,
+			Down:           m.Down,
+			Estimate:       m.Estimate,
+			Irreversible:   strings.TrimSpace(m.Down) == "" && m.DownFunc == nil,
+			ManualRollback: m.ManualRollback,
+			Preconditions: []string{
+				fmt.Sprintf("'%s' is recorded in %s with batch %d and hash %s", m.Name, mg.qualifiedTable(), rb.Batch, m.hash()),
+			},
+		}
+		if m.NoTransaction {
+			step.Preconditions = append(step.Preconditions, "the migration ran outside a transaction: check for a partially applied Up before running Down")
+		}
+		if m.SkipReplication {
+			step.Preconditions = append(step.Preconditions, "the migration was not replicated: roll it back on the server it ran on")
+		}
+		rb.Steps = append(rb.Steps, step)
+	}
+
+	// roll back newest first
+	sort.Slice(rb.Steps, func(i, j int) bool {
+		return rb.Steps[i].Migration > rb.Steps[j].Migration
+	})
+	return rb, nil
+}
+
+// Estimate is the sum of the steps' estimates
+func (rb *Runbook) Estimate() time.Duration {
+	var total time.Duration
+	for _, step := range rb.Steps {
+		total += step.Estimate
+	}
+	return total
+}
+
+// WriteMarkdown writes the runbook as a Markdown document
+func (rb *Runbook) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Rollback runbook: batch %d\n\n", rb.Batch)
+	if len(rb.Steps) == 0 {
+		b.WriteString("No pending migrations; there is nothing to roll back.\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	previous := rb.Previous
+	if previous == "" {
+		previous = "no migrations applied"
+	}
+	fmt.Fprintf(&b, "Rolling back returns the database to: %s\n\n", previous)
+	fmt.Fprintf(&b, "Estimated duration: %s\n\n", formatEstimate(rb.Estimate()))
+
+	irreversible := false
+	for _, step := range rb.Steps {
+		irreversible = irreversible || step.Irreversible
+	}
+	if irreversible {
+		b.WriteString("This batch contains irreversible migrations, so `Rollback` cannot undo it; follow the steps below in order.\n\n")
+	} else {
+		b.WriteString("`Rollback(db, 1, false, logger)` runs the steps below in order.\n\n")
+	}
+
+	for i, step := range rb.Steps {
+		fmt.Fprintf(&b, "## %d. %s\n\n", i+1, step.Migration)
+		fmt.Fprintf(&b, "Estimated duration: %s\n\n", formatEstimate(step.Estimate))
+		b.WriteString("Preconditions:\n\n")
+		for _, p := range step.Preconditions {
+			fmt.Fprintf(&b, "- %s\n", p)
+		}
+		b.WriteString("\n")
+		if step.Irreversible {
+			b.WriteString("**Irreversible.** Manual steps:\n\n")
+			manual := step.ManualRollback
+			if manual == "" {
+				manual = "None documented. Escalate before rolling back."
+			}
+			fmt.Fprintf(&b, "%s\n\n", strings.TrimSpace(manual))
+			continue
+		}
+		fmt.Fprintf(&b, "```sql\n%s\n```\n\n", strings.TrimSpace(step.Down))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatEstimate(d time.Duration) string {
+	if d == 0 {
+		return "unknown"
+	}
+	return d.String()
+}
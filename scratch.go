@@ -0,0 +1,130 @@
+package moogration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrNoScratch is returned by ScratchTable when ctx isn't that of a running
+// migration
+var ErrNoScratch = errors.New("scratch tables can only be created by a running migration")
+
+var reScratchName = regexp.MustCompile(`^\w+$`)
+
+// scratchSet tracks the scratch tables created by a migration, so they can be
+// dropped once it has run
+type scratchSet struct {
+	prefix string
+	tables []string
+}
+
+type scratchKey struct{}
+
+// ScratchTable creates a scratch table for a Go migration, with the given
+// column definitions, and returns its name. Scratch tables hold intermediate
+// data such as the ids a backfill has still to process. They are named after
+// the tracking table with a "_scratch_" infix, so "migration_scratch_ids" for
+// name "ids", and are dropped once the migration has run, whether or not it
+// succeeded. With locking enabled, scratch tables left behind by a crashed
+// run are dropped at the start of the next one, so don't use the prefix for
+// tables of your own.
+//
+//	table, err := moogration.ScratchTable(ctx, tx, "ids", "id INT PRIMARY KEY")
+func ScratchTable(ctx context.Context, db DBTX, name, columns string) (string, error) {
+	scratch, ok := ctx.Value(scratchKey{}).(*scratchSet)
+	if !ok {
+		return "", ErrNoScratch
+	}
+	if !reScratchName.MatchString(name) {
+		return "", fmt.Errorf("invalid scratch table name '%s'", name)
+	}
+
+	table := scratch.prefix + name
+	for _, t := range scratch.tables {
+		if t == table {
+			return "", fmt.Errorf("scratch table '%s' already created", table)
+		}
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s)", table, columns))
+	if err != nil {
+		return "", fmt.Errorf("error creating scratch table '%s': %w", table, err)
+	}
+	scratch.tables = append(scratch.tables, table)
+	return table, nil
+}
+
+// scratchPrefix begins the name of the Migrator's scratch tables
+func (mg *Migrator) scratchPrefix() string {
+	return mg.table + "_scratch_"
+}
+
+// withScratch returns a context in which a migration can create scratch
+// tables
+func (mg *Migrator) withScratch(ctx context.Context) (context.Context, *scratchSet) {
+	scratch := &scratchSet{prefix: mg.scratchPrefix()}
+	return context.WithValue(ctx, scratchKey{}, scratch), scratch
+}
+
+// dropScratch drops the scratch tables a migration created. A table created
+// in a transaction that was rolled back is already gone.
+func (mg *Migrator) dropScratch(ctx context.Context, scratch *scratchSet) error {
+	for _, table := range scratch.tables {
+		_, err := mg.db.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", table))
+		if err != nil {
+			return fmt.Errorf("error dropping scratch table '%s': %w", table, err)
+		}
+	}
+	return nil
+}
+
+// dropStaleScratch drops scratch tables left behind by a run that crashed.
+// It is called at the start of each run, and does nothing unless locking is
+// enabled: only while the run holds the migration lock can no other run be
+// using them.
+func (mg *Migrator) dropStaleScratch(ctx context.Context) error {
+	if !mg.lock {
+		return nil
+	}
+	var query string
+	switch mg.driver {
+	case mysql:
+		query = "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name LIKE ?"
+	case postgres:
+		query = "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_name LIKE $1"
+	case sqlite:
+		query = "SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE ?"
+	default:
+		return fmt.Errorf("configured driver unknown: \"%s\"", mg.driver)
+	}
+
+	prefix := mg.scratchPrefix()
+	rows, err := mg.db.QueryContext(ctx, query, prefix+"%")
+	if err != nil {
+		return fmt.Errorf("error listing scratch tables: %w", err)
+	}
+	stale := &scratchSet{}
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error listing scratch tables: %w", err)
+		}
+		// LIKE treats the underscores of the prefix as wildcards
+		if strings.HasPrefix(table, prefix) {
+			stale.tables = append(stale.tables, table)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error listing scratch tables: %w", err)
+	}
+
+	if len(stale.tables) > 0 && mg.logger != nil {
+		mg.logger.Printf("migrate :: dropping %d scratch tables left by an earlier run", len(stale.tables))
+	}
+	return mg.dropScratch(ctx, stale)
+}
@@ -0,0 +1,268 @@
+package moogration
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// scriptHeader begins a script written by GenerateScript, followed by the
+// dialect it was generated for
+const scriptHeader = "-- moogration script: "
+
+// ScriptOptions configures GenerateScript
+type ScriptOptions struct {
+	// AppliedBy is recorded as the applier of the scripted migrations, by
+	// default "script"
+	AppliedBy string
+	// NoTransaction leaves out the BEGIN and COMMIT wrapping the script where
+	// the dialect supports transactional DDL
+	NoTransaction bool
+}
+
+// GenerateScript writes a SQL script applying the migrations in the default
+// registry that are pending on db to w. See Migrator.GenerateScript.
+func GenerateScript(db DBTX, w io.Writer, opts ScriptOptions) error {
+	return defaultMigrator(db, nil).GenerateScriptContext(context.Background(), w, opts)
+}
+
+// GenerateScript writes a single SQL script to w that applies the pending
+// migrations and records them in the tracking table, with their hashes and
+// the batch number RunLatest would use, for shops where a DBA reviews and
+// runs every change by hand. Nothing is written to the database: the
+// tracking table is created by the script if it doesn't exist yet. Where
+// the dialect supports transactional DDL and no migration sets
+// NoTransaction, SkipReplication or ForeignKeysOff, the script runs in one
+// transaction. Once the DBA has run it, Verify reports the migrations as
+// verified rather than pending. Go migrations can't be scripted, and a
+// dirty migration must be resolved first.
+func (mg *Migrator) GenerateScript(w io.Writer, opts ScriptOptions) error {
+	return mg.GenerateScriptContext(context.Background(), w, opts)
+}
+
+// GenerateScriptContext is like GenerateScript, with a context
+func (mg *Migrator) GenerateScriptContext(ctx context.Context, w io.Writer, opts ScriptOptions) error {
+	if len(mg.groups) > 0 {
+		return errors.New("cannot generate a script for migration groups, which are tracked separately; generate one per group")
+	}
+	if opts.AppliedBy == "" {
+		opts.AppliedBy = "script"
+	}
+
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = mg.checkDirty(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	plan, err := mg.PlanLatestContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	caps, err := mg.DetectCapabilitiesContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	registered := map[string]Migration{}
+	for _, m := range mg.registry.snapshot() {
+		registered[m.Name] = m
+	}
+	transactional := caps.TransactionalDDL && !opts.NoTransaction
+	migrations := make([]Migration, len(plan))
+	for i, p := range plan {
+		m := registered[p.Name]
+		if m.UpFunc != nil {
+			return fmt.Errorf("cannot script Go migration '%s'", m.Name)
+		}
+		if m.NoTransaction || m.SkipReplication || m.ForeignKeysOff {
+			transactional = false
+		}
+		migrations[i] = m
+	}
+
+	// the tracking statements are recorded rather than run, so the script
+	// matches what RunLatest would write
+	sub := *mg
+	sub.appliedBy = opts.AppliedBy
+	script := &scriptWriter{mg: &sub}
+
+	b := bufio.NewWriter(w)
+	batch := 1
+	if len(plan) > 0 {
+		batch = plan[0].Batch
+	}
+	fmt.Fprintf(b, "%s%s\n", scriptHeader, mg.driver)
+	fmt.Fprintf(b, "-- batch %d, %d migrations\n\n", batch, len(migrations))
+	if transactional {
+		fmt.Fprint(b, "BEGIN;\n\n")
+	}
+	if exists {
+		err = sub.upgradeTrackingTable(ctx, script, mg.qualifiedTable())
+	} else {
+		var create string
+		create, err = mg.trackingTableSQL(mg.qualifiedTable())
+		script.stmts = append(script.stmts, strings.TrimSuffix(strings.TrimSpace(create), ";"))
+	}
+	if err != nil {
+		return err
+	}
+	script.flush(b)
+
+	for _, m := range migrations {
+		fmt.Fprintf(b, "-- migration: %s\n", m.Name)
+		if m.SkipReplication {
+			fmt.Fprint(b, "SET SESSION sql_log_bin = 0;\n")
+		}
+		if m.ForeignKeysOff && mg.driver == sqlite {
+			fmt.Fprint(b, "PRAGMA foreign_keys = OFF;\n")
+		}
+		for _, stmt := range splitSQL(m.Up, mg.driver) {
+			stmt, _, err := mg.applyOnlineDDL(m, stmt)
+			if err != nil {
+				return fmt.Errorf("error scripting migration '%s': %w", m.Name, err)
+			}
+			fmt.Fprint(b, scriptStatement(stmt, mg.driver))
+		}
+		if m.ForeignKeysOff && mg.driver == sqlite {
+			fmt.Fprint(b, "PRAGMA foreign_key_check;\nPRAGMA foreign_keys = ON;\n")
+		}
+		if m.SkipReplication {
+			fmt.Fprint(b, "SET SESSION sql_log_bin = 1;\n")
+		}
+		err := sub.setMigrationStatus(ctx, script, m, false, batch, 0)
+		if err != nil {
+			return fmt.Errorf("error scripting migration '%s': %w", m.Name, err)
+		}
+		script.flush(b)
+	}
+
+	if transactional {
+		fmt.Fprint(b, "COMMIT;\n")
+	}
+	return b.Flush()
+}
+
+// scriptStatement terminates a migration statement for a script. On MySQL,
+// a statement holding a semicolon, as a BEGIN...END body of a trigger or
+// procedure does, is wrapped in DELIMITER directives, so the mysql client
+// doesn't end it at its first semicolon.
+func scriptStatement(stmt string, d driver) string {
+	stmt = strings.TrimSuffix(strings.TrimSpace(stmt), ";")
+	if d != mysql || !strings.Contains(stmt, ";") {
+		return stmt + ";\n"
+	}
+	delimiter := "$$"
+	if strings.Contains(stmt, delimiter) {
+		delimiter = "//"
+	}
+	return fmt.Sprintf("DELIMITER %s\n%s %s\nDELIMITER ;\n", delimiter, stmt, delimiter)
+}
+
+// scriptWriter records the statements executed through it, with their
+// arguments inlined as literals, instead of running them. Queries are run on
+// the Migrator's database.
+type scriptWriter struct {
+	mg    *Migrator
+	stmts []string
+}
+
+func (s *scriptWriter) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.mg.db.QueryContext(ctx, query, args...)
+}
+
+func (s *scriptWriter) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.mg.db.QueryRowContext(ctx, query, args...)
+}
+
+func (s *scriptWriter) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := s.mg.inline(query, args)
+	if err != nil {
+		return nil, err
+	}
+	s.stmts = append(s.stmts, strings.TrimSuffix(strings.TrimSpace(stmt), ";"))
+	return driverResult{}, nil
+}
+
+// flush writes the recorded statements and forgets them
+func (s *scriptWriter) flush(w io.Writer) {
+	if len(s.stmts) == 0 {
+		return
+	}
+	for _, stmt := range s.stmts {
+		fmt.Fprintf(w, "%s;\n", stmt)
+	}
+	fmt.Fprintln(w)
+	s.stmts = nil
+}
+
+// driverResult is the result of a statement that was recorded, not run
+type driverResult struct{}
+
+func (driverResult) LastInsertId() (int64, error) { return 0, nil }
+func (driverResult) RowsAffected() (int64, error) { return 0, nil }
+
+// inline replaces the placeholders of an internal query with its arguments
+// as literals
+func (mg *Migrator) inline(query string, args []interface{}) (string, error) {
+	literals := make([]string, len(args))
+	for i, arg := range args {
+		v, err := sqldriver.DefaultParameterConverter.ConvertValue(arg)
+		if err != nil {
+			return "", err
+		}
+		literals[i] = mg.driver.literal(v)
+	}
+	if len(args) == 0 {
+		return query, nil
+	}
+	positional := mg.rebind("?") == "?"
+
+	// a single pass, so a literal containing a placeholder isn't replaced
+	// again
+	var b strings.Builder
+	next := 0
+	for rest := query; rest != ""; {
+		i, size := -1, 0
+		if positional {
+			if rest[0] == '?' && next < len(literals) {
+				i, size = next, 1
+				next++
+			}
+		} else {
+			// the highest first, so $1 doesn't match the start of $10
+			for n := len(literals); n > 0; n-- {
+				if p := mg.placeholder(n); strings.HasPrefix(rest, p) {
+					i, size = n-1, len(p)
+					break
+				}
+			}
+		}
+		if i < 0 {
+			b.WriteByte(rest[0])
+			rest = rest[1:]
+			continue
+		}
+		b.WriteString(literals[i])
+		rest = rest[size:]
+	}
+	return b.String(), nil
+}
+
+// placeholder is the nth numbered placeholder of the Migrator's dialect
+func (mg *Migrator) placeholder(n int) string {
+	if mg.dialect != nil {
+		return mg.dialect.Placeholder(n)
+	}
+	return "$" + strconv.Itoa(n)
+}
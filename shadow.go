@@ -0,0 +1,89 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+)
+
+// ValidateShadow runs the default registry's pending migrations on a
+// throwaway database. See Migrator.ValidateShadow.
+func ValidateShadow(shadow DBTX, opts ...Option) ([]Finding, error) {
+	return defaultMigrator(shadow, nil).ValidateShadowContext(context.Background(), shadow, opts...)
+}
+
+// ValidateShadow checks that the pending migrations actually execute, for
+// gating CI before new migrations are merged. On shadow, a throwaway
+// database such as an empty one created for the job, it runs them up, rolls
+// each back, newest first, and runs them up again, so a Down that fails, or
+// doesn't undo its Up, is caught too. A migration that fails is returned as
+// an error Finding located where it was registered; later steps are then
+// skipped. The error is for failures unrelated to a single migration.
+//
+// The shadow Migrator shares the registry, dialect and tracking table name,
+// without a schema, lock, hooks or other targets; opts override them, e.g.
+// WithSQLite to validate portable SQL on an in-memory SQLite database. Rows
+// of fixtures set with WithFixtures are loaded ahead of the migrations they
+// name.
+func (mg *Migrator) ValidateShadow(shadow DBTX, opts ...Option) ([]Finding, error) {
+	return mg.ValidateShadowContext(context.Background(), shadow, opts...)
+}
+
+// ValidateShadowContext is like ValidateShadow, with a context
+func (mg *Migrator) ValidateShadowContext(ctx context.Context, shadow DBTX, opts ...Option) ([]Finding, error) {
+	if len(mg.groups) > 0 {
+		return nil, fmt.Errorf("ValidateShadow is not supported with migration groups")
+	}
+
+	sub := &Migrator{
+		db:          shadow,
+		registry:    mg.registry,
+		table:       mg.table,
+		driver:      mg.driver,
+		logger:      mg.logger,
+		onlineDDL:   mg.onlineDDL,
+		includeTags: mg.includeTags,
+		excludeTags: mg.excludeTags,
+		shadow:      true,
+		fixtures:    mg.fixtures,
+		fixtureSeed: mg.fixtureSeed,
+	}
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	var failed *MigrationEvent
+	sub.OnAfterMigration(func(ctx context.Context, e MigrationEvent) {
+		if e.Err != nil && failed == nil {
+			failed = &e
+		}
+	})
+	finding := func(step string, err error) ([]Finding, error) {
+		if failed == nil {
+			return nil, err
+		}
+		file, line := mg.registry.location(failed.Migration.Name)
+		return []Finding{{
+			Severity:  SeverityError,
+			Migration: failed.Migration.Name,
+			File:      file,
+			Line:      line,
+			Message:   fmt.Sprintf("%s failed on the shadow database: %s", step, failed.Err),
+		}}, nil
+	}
+
+	result, err := sub.RunLatestReportContext(ctx, false, false)
+	if err != nil {
+		return finding("Up", err)
+	}
+	for i := len(result.Applied) - 1; i >= 0; i-- {
+		err = sub.RollbackMigrationContext(ctx, result.Applied[i].Name, false)
+		if err != nil {
+			return finding("Down", err)
+		}
+	}
+	_, err = sub.RunLatestReportContext(ctx, false, false)
+	if err != nil {
+		return finding("Up after Down", err)
+	}
+	return []Finding{}, nil
+}
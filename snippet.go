@@ -0,0 +1,73 @@
+package moogration
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// DefineSnippet adds a reusable SQL fragment to the default registry. See
+// Registry.DefineSnippet.
+func DefineSnippet(name, sql string) error {
+	return defaultRegistry.DefineSnippet(name, sql)
+}
+
+// DefineSnippet adds a reusable SQL fragment, such as a set of timestamp or
+// soft-delete columns, that migrations with Template set can include with
+// {{ template "name" }}. A snippet is itself a template, and receives any
+// argument passed to it, as in {{ template "audit_trigger" "post" }}.
+// Snippets must be defined before the migrations using them are registered.
+func (r *Registry) DefineSnippet(name, sql string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snippets == nil {
+		r.snippets = template.New("")
+	}
+	_, err := r.snippets.New(name).Parse(sql)
+	if err != nil {
+		return fmt.Errorf("error parsing snippet '%s': %w", name, err)
+	}
+	return nil
+}
+
+// expand executes the Up and Down templates of a migration with Template
+// set. The registry must be locked.
+func (r *Registry) expand(m Migration) (Migration, error) {
+	if !m.Template {
+		return m, nil
+	}
+	up, err := r.execute(m.Name+".up", m.Up)
+	if err != nil {
+		return m, err
+	}
+	down, err := r.execute(m.Name+".down", m.Down)
+	if err != nil {
+		return m, err
+	}
+	m.Up, m.Down = up, down
+	// expanded SQL is not expanded again if the migration is re-registered
+	m.Template = false
+	return m, nil
+}
+
+func (r *Registry) execute(name, text string) (string, error) {
+	t := template.New(name)
+	if r.snippets != nil {
+		var err error
+		t, err = r.snippets.Clone()
+		if err != nil {
+			return "", err
+		}
+		t = t.New(name)
+	}
+	_, err := t.Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing migration template: %w", err)
+	}
+	var out bytes.Buffer
+	err = t.Execute(&out, nil)
+	if err != nil {
+		return "", fmt.Errorf("error expanding migration template: %w", err)
+	}
+	return out.String(), nil
+}
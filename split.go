@@ -0,0 +1,202 @@
+package moogration
+
+import (
+	"strings"
+)
+
+// splitStatements splits SQL into statements without regard to dialect. See
+// splitSQL.
+func splitStatements(sql string) []string {
+	return splitSQL(sql, "")
+}
+
+// splitSQL splits SQL into the statements it contains, so they can be
+// executed one at a time on connections that accept a single statement per
+// Exec. Statements end at a semicolon outside string literals, quoted
+// identifiers, comments and BEGIN...END blocks, or at the delimiter set by a
+// MySQL DELIMITER directive, which is itself dropped. Comments are dropped,
+// except MySQL executable comments and optimizer hints, and so are empty
+// statements.
+//
+// Backslash escapes in strings are recognised except on SQLite and
+// PostgreSQL, and dollar-quoted strings except on MySQL. An empty dialect
+// recognises both.
+func splitSQL(sql string, d driver) []string {
+	backslashEscapes := d != sqlite && d != postgres
+	dollarQuotes := d != mysql
+	hashComments := d == mysql
+
+	stmts := []string{}
+	var b strings.Builder
+	hasCode := false
+	flush := func() {
+		if stmt := strings.TrimSpace(b.String()); hasCode && stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		b.Reset()
+		hasCode = false
+	}
+
+	delimiter := ";"
+	depth := 0
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case !hasCode && d != postgres && d != sqlite && isDelimiterDirective(sql[i:]):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			if fields := strings.Fields(sql[i : i+end]); len(fields) > 1 {
+				delimiter = fields[1]
+			}
+			b.Reset()
+			i += end
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(sql) && sql[end] != c {
+				if sql[end] == '\\' && backslashEscapes {
+					end++
+				}
+				end++
+			}
+			if end >= len(sql) {
+				end = len(sql) - 1
+			}
+			b.WriteString(sql[i : end+1])
+			hasCode = true
+			i = end
+		case c == '$' && dollarQuotes && (i == 0 || !isWordByte(sql[i-1])) && dollarTag(sql[i:]) != "":
+			tag := dollarTag(sql[i:])
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end = i + len(tag) + end + len(tag)
+			}
+			b.WriteString(sql[i:end])
+			hasCode = true
+			i = end - 1
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-', c == '#' && hashComments:
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			b.WriteByte('\n')
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql)
+			} else {
+				end = i + 2 + end + 2
+			}
+			if i+2 < len(sql) && (sql[i+2] == '!' || sql[i+2] == '+') {
+				// executable comments and optimizer hints are part of the statement
+				b.WriteString(sql[i:end])
+				hasCode = true
+			} else {
+				b.WriteByte(' ')
+			}
+			i = end - 1
+		case delimiter != ";" && strings.HasPrefix(sql[i:], delimiter):
+			flush()
+			i += len(delimiter) - 1
+		case c == ';' && delimiter == ";" && depth == 0:
+			flush()
+		case isWordStart(c) && (i == 0 || !isWordByte(sql[i-1])):
+			end := i
+			for end < len(sql) && isWordByte(sql[end]) {
+				end++
+			}
+			word := strings.ToUpper(sql[i:end])
+			switch word {
+			case "BEGIN":
+				if opensBlock(sql[end:]) {
+					depth++
+				}
+			case "CASE":
+				depth++
+			case "END":
+				next := nextWord(sql[end:])
+				switch next {
+				case "IF", "LOOP", "WHILE", "REPEAT":
+					// closes a block that wasn't counted
+				default:
+					if depth > 0 {
+						depth--
+					}
+				}
+				if next == "CASE" {
+					// don't count END CASE as opening another CASE
+					end += strings.Index(strings.ToUpper(sql[end:]), "CASE") + len("CASE")
+				}
+			}
+			b.WriteString(sql[i:end])
+			hasCode = true
+			i = end - 1
+		default:
+			b.WriteByte(c)
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				hasCode = true
+			}
+		}
+	}
+	flush()
+	return stmts
+}
+
+// isDelimiterDirective reports whether s starts with a MySQL client
+// DELIMITER directive
+func isDelimiterDirective(s string) bool {
+	const directive = "DELIMITER"
+	return len(s) > len(directive) &&
+		strings.EqualFold(s[:len(directive)], directive) &&
+		(s[len(directive)] == ' ' || s[len(directive)] == '\t')
+}
+
+// dollarTag returns the PostgreSQL dollar quote, such as "$$" or "$body$",
+// that s starts with, if any
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1]
+		case isWordStart(s[i]) || i > 1 && s[i] >= '0' && s[i] <= '9':
+			continue
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// opensBlock reports whether BEGIN, followed by s, opens a compound statement
+// rather than a transaction
+func opensBlock(s string) bool {
+	trimmed := strings.TrimLeft(s, " \t\r\n")
+	if trimmed == "" || trimmed[0] == ';' {
+		return false
+	}
+	switch nextWord(s) {
+	case "TRANSACTION", "WORK", "DEFERRED", "IMMEDIATE", "EXCLUSIVE", "ISOLATION", "READ":
+		return false
+	}
+	return true
+}
+
+// nextWord returns the upper-cased word at the start of s, after whitespace
+func nextWord(s string) string {
+	s = strings.TrimLeft(s, " \t\r\n")
+	end := 0
+	for end < len(s) && isWordByte(s[end]) {
+		end++
+	}
+	return strings.ToUpper(s[:end])
+}
+
+func isWordStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isWordByte(c byte) bool {
+	return isWordStart(c) || c >= '0' && c <= '9'
+}
@@ -0,0 +1,196 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBusyTimeout is how long SQLite waits on a locked database during a
+// run, unless configured otherwise
+const defaultBusyTimeout = 5 * time.Second
+
+// WithBusyTimeout sets how long SQLite waits for another connection to
+// release the database before failing with "database is locked". It is
+// applied for the duration of each run, and defaults to 5 seconds; a longer
+// timeout already set on the connection is kept.
+func WithBusyTimeout(d time.Duration) Option {
+	return func(m *Migrator) {
+		m.busyTimeout = d
+	}
+}
+
+// WithWAL switches a SQLite database to write-ahead logging for each run,
+// so readers aren't blocked while migrations write. Its previous journal
+// mode is restored afterwards if no other connection has the database open,
+// as SQLite requires; otherwise it is left in WAL mode, which persists.
+func WithWAL() Option {
+	return func(m *Migrator) {
+		m.wal = true
+	}
+}
+
+// sqliteLocks serializes runs against each SQLite database in the process,
+// keyed by database file. They are channels so waiting honours a context.
+var sqliteLocks = struct {
+	sync.Mutex
+	files map[string]chan struct{}
+}{files: map[string]chan struct{}{}}
+
+// sqliteLock returns the lock for the database file
+func sqliteLock(file string) chan struct{} {
+	sqliteLocks.Lock()
+	defer sqliteLocks.Unlock()
+	lock, ok := sqliteLocks.files[file]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		sqliteLocks.files[file] = lock
+	}
+	return lock
+}
+
+// sqliteSession calls fn with a Migrator bound to a single connection
+// reserved from the Migrator's pool. SQLite settings are per connection, and
+// a pool's other connections would contend with the run for the database's
+// write lock, so a run uses one connection throughout. Runs against the same
+// database file from one process are serialized, and the busy timeout and
+// journal mode are set for the run and restored afterwards.
+func (mg *Migrator) sqliteSession(ctx context.Context, fn func(mg *Migrator) error) error {
+	conn, release, err := session(ctx, mg.db)
+	if err != nil {
+		return fmt.Errorf("error reserving SQLite connection: %w", err)
+	}
+	// deferred first, so the connection is released after the settings are
+	// restored, and discarded if one couldn't be
+	discard := mg.isolated
+	defer func() { release(discard) }()
+	sub := *mg
+	sub.db = conn
+	sub.pool = mg.db
+	sub.discard = &discard
+
+	// the busy timeout is set first, as even reading the database list
+	// waits on another connection's write
+	restore, err := sub.sqliteBusyTimeout(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	file, err := sqliteFile(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		// an in-memory database belongs to its handle
+		file = fmt.Sprintf("%p", mg.db)
+	}
+	lock := sqliteLock(file)
+	select {
+	case lock <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-lock }()
+
+	if mg.wal {
+		restore, err := sub.sqliteWAL(ctx, conn)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	}
+
+	return fn(&sub)
+}
+
+// sqliteFile returns the file of the connection's main database, empty if it
+// is in memory
+func sqliteFile(ctx context.Context, db DBTX) (string, error) {
+	rows, err := db.QueryContext(ctx, "PRAGMA database_list")
+	if err != nil {
+		return "", fmt.Errorf("error listing SQLite databases: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seq int
+		var name, file string
+		err := rows.Scan(&seq, &name, &file)
+		if err != nil {
+			return "", fmt.Errorf("error listing SQLite databases: %w", err)
+		}
+		if name == "main" {
+			return file, nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// sqliteBusyTimeout sets the busy timeout of the connection, unless it is
+// already longer. The returned func restores the previous timeout.
+func (mg *Migrator) sqliteBusyTimeout(ctx context.Context, db DBTX) (func(), error) {
+	timeout := mg.busyTimeout
+	if timeout == 0 {
+		timeout = defaultBusyTimeout
+	}
+	var previous int64
+	err := db.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&previous)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SQLite busy timeout: %w", err)
+	}
+	if previous >= timeout.Milliseconds() {
+		return func() {}, nil
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d", timeout.Milliseconds()))
+	if err != nil {
+		return nil, fmt.Errorf("error setting SQLite busy timeout: %w", err)
+	}
+	return mg.sqliteRestore(db, fmt.Sprintf("PRAGMA busy_timeout = %d", previous)), nil
+}
+
+// sqliteWAL switches the connection's database to write-ahead logging. The
+// returned func restores the previous journal mode.
+func (mg *Migrator) sqliteWAL(ctx context.Context, db DBTX) (func(), error) {
+	var mode string
+	err := db.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&mode)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SQLite journal mode: %w", err)
+	}
+	mode = strings.ToLower(mode)
+	// an in-memory database can't use a write-ahead log
+	if mode == "wal" || mode == "memory" {
+		return func() {}, nil
+	}
+	err = db.QueryRowContext(ctx, "PRAGMA journal_mode = WAL").Scan(new(string))
+	if err != nil {
+		return nil, fmt.Errorf("error switching SQLite to WAL: %w", err)
+	}
+	return func() {
+		// SQLite leaves WAL only once no other connection has the database
+		// open, reporting the mode it kept
+		var restored string
+		err := db.QueryRowContext(context.Background(), fmt.Sprintf("PRAGMA journal_mode = %s", mode)).Scan(&restored)
+		if err == nil && !strings.EqualFold(restored, mode) {
+			err = fmt.Errorf("journal mode is still %s", restored)
+		}
+		if err != nil && mg.logger != nil {
+			// not worth discarding the connection over, as the mode belongs
+			// to the database
+			mg.logger.Printf("migrate :: error restoring SQLite journal mode %s: %s", mode, err)
+		}
+	}, nil
+}
+
+// sqliteRestore returns a func running stmt to restore a setting. If it
+// fails, the error is logged and the connection discarded rather than
+// returned to the pool with the setting changed.
+func (mg *Migrator) sqliteRestore(db DBTX, stmt string) func() {
+	return func() {
+		_, err := db.ExecContext(context.Background(), stmt)
+		if err != nil {
+			mg.discardSession(fmt.Sprintf("error restoring SQLite setting with '%s': %s", stmt, err))
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Squash consolidates the migrations applied to db into a single migration.
+// See Migrator.Squash.
+func Squash(db DBTX, name string, logger *log.Logger) (Migration, error) {
+	return defaultMigrator(db, logger).SquashContext(context.Background(), name)
+}
+
+// Squash generates a single migration named name that builds the schema of
+// the Migrator's database from scratch, to replace a long history of
+// migrations. The database must have every registered migration applied.
+// Up is dumped from the database itself (sqlite_master on SQLite, SHOW
+// CREATE TABLE and SHOW CREATE VIEW on MySQL; PostgreSQL isn't supported),
+// leaving out the tracking table and the tables kept alongside it; Down drops
+// what Up creates. Squashes lists the migrations it replaces, other than
+// repeatable migrations, which are kept and run after it as usual.
+//
+// Register the squashed migration in place of the originals: a fresh
+// database runs it, while on a database that has the originals applied it is
+// recorded as applied without being run, and their tracking rows are moved to
+// the archive table Prune uses.
+func (mg *Migrator) Squash(name string) (Migration, error) {
+	return mg.SquashContext(context.Background(), name)
+}
+
+// SquashContext is like Squash, with a context
+func (mg *Migrator) SquashContext(ctx context.Context, name string) (Migration, error) {
+	if err := mg.refuseDryRun("Squash"); err != nil {
+		return Migration{}, err
+	}
+	if err := mg.refuseStrict("Squash"); err != nil {
+		return Migration{}, err
+	}
+	if len(mg.groups) > 0 {
+		return Migration{}, fmt.Errorf("Squash is not supported with migration groups")
+	}
+	statuses, err := mg.StatusContext(ctx)
+	if err != nil {
+		return Migration{}, err
+	}
+	squashes := []string{}
+	pending := []string{}
+	for _, s := range statuses {
+		switch {
+		case !s.Registered:
+		case s.Dirty:
+			return Migration{}, fmt.Errorf("cannot squash: migration '%s' is dirty", s.Name)
+		case !s.Applied:
+			pending = append(pending, s.Name)
+		case !mg.isRepeatable(s.Name):
+			squashes = append(squashes, s.Name)
+		}
+	}
+	if len(pending) > 0 {
+		return Migration{}, fmt.Errorf("cannot squash: %d migrations are pending, starting with '%s'", len(pending), pending[0])
+	}
+	if len(squashes) == 0 {
+		return Migration{}, fmt.Errorf("cannot squash: no migrations are applied")
+	}
+
+	objects, err := mg.schemaObjects(ctx, false)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	var up, down strings.Builder
+	for _, o := range objects {
+		fmt.Fprintf(&up, "%s;\n\n", strings.TrimSuffix(strings.TrimSpace(o.sql), ";"))
+	}
+	for i := len(objects) - 1; i >= 0; i-- {
+		o := objects[i]
+		// indexes and triggers are dropped with their tables
+		if o.kind == "table" || o.kind == "view" {
+			fmt.Fprintf(&down, "DROP %s %s;\n", strings.ToUpper(o.kind), mg.driver.quote(o.name))
+		}
+	}
+
+	return Migration{
+		Name:        name,
+		Up:          strings.TrimSuffix(up.String(), "\n"),
+		Down:        down.String(),
+		Description: fmt.Sprintf("squashes %d migrations, %s through %s", len(squashes), squashes[0], squashes[len(squashes)-1]),
+		Squashes:    squashes,
+	}, nil
+}
+
+// isRepeatable reports whether the migration registered under name is
+// repeatable
+func (mg *Migrator) isRepeatable(name string) bool {
+	m, ok := mg.registry.Get(name)
+	return ok && m.Repeatable
+}
+
+// schemaObjects dumps the schema of the Migrator's database, leaving out the
+// tables kept alongside the tracking table, and the tracking table itself
+// unless tracking is set
+func (mg *Migrator) schemaObjects(ctx context.Context, tracking bool) ([]schemaObject, error) {
+	var objects []schemaObject
+	var err error
+	switch mg.driver {
+	case sqlite:
+		objects, err = mg.sqliteSchema(ctx, tracking)
+	case mysql:
+		objects, err = mg.mysqlSchema(ctx, tracking)
+	default:
+		return nil, fmt.Errorf("dumping the schema is not supported on %s", mg.driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error dumping schema: %w", err)
+	}
+	return objects, nil
+}
+
+// ownedSuffixes are the suffixes of the tables kept alongside the tracking
+// table, which is their prefix
+var ownedSuffixes = []string{"_lock", "_lock_holder", "_followup", "_label", "_archive"}
+
+// trackedSuffixes are the suffixes of the tracking table itself and the
+// tables recording the state of applied migrations alongside it, which a
+// schema dump keeps with their rows
+var trackedSuffixes = []string{"", "_followup", "_label"}
+
+// ownsTable reports whether table is the tracking table or one kept alongside
+// it, including scratch tables, which a schema dump leaves out, other than
+// the tables recording applied migrations if tracking is set. Other tables
+// sharing the tracking table's prefix, such as migration_jobs, are the
+// user's.
+func (mg *Migrator) ownsTable(table string, tracking bool) bool {
+	if mg.tracksTable(table) {
+		return !tracking
+	}
+	table = strings.ToLower(table)
+	own := strings.ToLower(mg.table)
+	if strings.HasPrefix(table, strings.ToLower(mg.scratchPrefix())) {
+		return true
+	}
+	for _, suffix := range ownedSuffixes {
+		if table == own+suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// tracksTable reports whether table is the tracking table or one recording
+// the state of applied migrations alongside it
+func (mg *Migrator) tracksTable(table string) bool {
+	for _, suffix := range trackedSuffixes {
+		if strings.EqualFold(table, mg.table+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// quote quotes an identifier for the dialect
+func (d driver) quote(name string) string {
+	if d == mysql {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return quoteIdent(name)
+}
+
+// sqliteSchema returns the schema of a SQLite database: its tables, then
+// indexes, views and triggers, each in the order they were created
+func (mg *Migrator) sqliteSchema(ctx context.Context, tracking bool) ([]schemaObject, error) {
+	rows, err := mg.db.QueryContext(ctx, `SELECT type, name, tbl_name, sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		ORDER BY CASE type WHEN 'table' THEN 0 WHEN 'index' THEN 1 WHEN 'view' THEN 2 ELSE 3 END, rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	objects := []schemaObject{}
+	for rows.Next() {
+		var o schemaObject
+		var table string
+		err := rows.Scan(&o.kind, &o.name, &table, &o.sql)
+		if err != nil {
+			return nil, err
+		}
+		if mg.ownsTable(table, tracking) {
+			continue
+		}
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+// reDefiner matches the DEFINER clause of a MySQL view, which names an
+// account that may not exist where the squashed migration runs
+var reDefiner = regexp.MustCompile("DEFINER=`[^`]*`@`[^`]*` ")
+
+// reAutoIncrement matches the AUTO_INCREMENT counter of a MySQL table
+var reAutoIncrement = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// mysqlSchema returns the schema of a MySQL database: its tables, ordered so
+// that each follows the tables its foreign keys reference, then its views
+func (mg *Migrator) mysqlSchema(ctx context.Context, tracking bool) ([]schemaObject, error) {
+	query := "SHOW FULL TABLES"
+	if mg.schema != "" {
+		query += " FROM " + mysql.quote(mg.schema)
+	}
+	rows, err := mg.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	tables, views := []string{}, []string{}
+	for rows.Next() {
+		var name, kind string
+		err := rows.Scan(&name, &kind)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch {
+		case mg.ownsTable(name, tracking):
+		case kind == "VIEW":
+			views = append(views, name)
+		default:
+			tables = append(tables, name)
+		}
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tables)
+	sort.Strings(views)
+
+	objects := []schemaObject{}
+	creates := map[string]string{}
+	for _, table := range tables {
+		var name, create string
+		err := mg.db.QueryRowContext(ctx, "SHOW CREATE TABLE "+mg.mysqlName(table)).Scan(&name, &create)
+		if err != nil {
+			return nil, err
+		}
+		creates[table] = reAutoIncrement.ReplaceAllString(create, "")
+	}
+	references, err := mg.mysqlReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range orderByReferences(tables, references) {
+		objects = append(objects, schemaObject{kind: "table", name: table, sql: creates[table]})
+	}
+	for _, view := range views {
+		var name, create, charset, collation string
+		err := mg.db.QueryRowContext(ctx, "SHOW CREATE VIEW "+mg.mysqlName(view)).Scan(&name, &create, &charset, &collation)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, schemaObject{kind: "view", name: view, sql: reDefiner.ReplaceAllString(create, "")})
+	}
+	return objects, nil
+}
+
+// mysqlName quotes a table name, qualified with the Migrator's schema
+func (mg *Migrator) mysqlName(table string) string {
+	if mg.schema == "" {
+		return mysql.quote(table)
+	}
+	return mysql.quote(mg.schema) + "." + mysql.quote(table)
+}
+
+// mysqlReferences maps each table to the tables its foreign keys reference
+func (mg *Migrator) mysqlReferences(ctx context.Context) (map[string][]string, error) {
+	rows, err := mg.db.QueryContext(ctx, `SELECT DISTINCT TABLE_NAME, REFERENCED_TABLE_NAME FROM information_schema.KEY_COLUMN_USAGE
+		WHERE TABLE_SCHEMA = COALESCE(NULLIF(?, ''), DATABASE()) AND REFERENCED_TABLE_NAME IS NOT NULL`, mg.schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	references := map[string][]string{}
+	for rows.Next() {
+		var table, referenced string
+		err := rows.Scan(&table, &referenced)
+		if err != nil {
+			return nil, err
+		}
+		references[table] = append(references[table], referenced)
+	}
+	return references, rows.Err()
+}
+
+// orderByReferences orders tables so each follows those it references,
+// otherwise keeping their order. Tables in a reference cycle keep theirs.
+func orderByReferences(tables []string, references map[string][]string) []string {
+	ordered := []string{}
+	visited := map[string]bool{}
+	var visit func(table string)
+	visit = func(table string) {
+		if visited[table] {
+			return
+		}
+		visited[table] = true
+		for _, referenced := range references[table] {
+			visit(referenced)
+		}
+		ordered = append(ordered, table)
+	}
+	known := map[string]bool{}
+	for _, table := range tables {
+		known[table] = true
+	}
+	for _, table := range tables {
+		visit(table)
+	}
+	// drop referenced tables that aren't part of the dump
+	kept := ordered[:0]
+	for _, table := range ordered {
+		if known[table] {
+			kept = append(kept, table)
+		}
+	}
+	return kept
+}
+
+// checkSquash decides how a run treats a pending migration that squashes
+// others, given the migrations applied to the database. It returns true if
+// the migrations it squashes are applied, so it is to be recorded as applied
+// rather than run, and an error if only some of them are, or if any of them
+// is still registered.
+func (mg *Migrator) checkSquash(m Migration, applied map[string]string) (bool, error) {
+	have := 0
+	for _, name := range m.Squashes {
+		if _, ok := mg.registry.Get(name); ok {
+			return false, fmt.Errorf("migration '%s' is squashed into '%s' and must no longer be registered", name, m.Name)
+		}
+		if _, ok := applied[name]; ok {
+			have++
+		}
+	}
+	if have > 0 && have < len(m.Squashes) {
+		return false, fmt.Errorf("migration '%s' squashes %d migrations, of which only %d are applied; apply the others with a release that still has them first",
+			m.Name, len(m.Squashes), have)
+	}
+	return have > 0, nil
+}
+
+// adoptSquash records a squashed migration as applied in batch, without
+// running it, and archives the tracking rows of the migrations it squashes
+func (mg *Migrator) adoptSquash(ctx context.Context, m Migration, batch int) error {
+	err := mg.createTrackingTable(ctx, mg.qualifiedTable()+"_archive")
+	if err != nil {
+		return err
+	}
+
+	var db DBTX = mg.db
+	tx, err := begin(ctx, mg.db)
+	if err != nil {
+		return fmt.Errorf("error starting transaction for squashed migration '%s': %w", m.Name, err)
+	}
+	if tx != nil {
+		db = tx
+	}
+	fail := func(err error) error {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return fmt.Errorf("error recording squashed migration '%s': %w", m.Name, err)
+	}
+	_, err = db.ExecContext(ctx, mg.stmt("INSERT INTO %s (name, sql_hash, batch, applied_by) VALUES (?, ?, ?, ?)"),
+		m.Name, m.hash(), batch, mg.applier())
+	if err != nil {
+		return fail(err)
+	}
+	archive := mg.stmt("INSERT INTO %s_archive (name, batch, sql_hash, migrated_at, duration_ms, applied_by, applied_sql) SELECT name, batch, sql_hash, migrated_at, duration_ms, applied_by, applied_sql FROM %s WHERE name = ?")
+	remove := mg.stmt("DELETE FROM %s WHERE name = ?")
+	for _, name := range m.Squashes {
+		_, err := db.ExecContext(ctx, archive, name)
+		if err == nil {
+			_, err = db.ExecContext(ctx, remove, name)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if tx != nil {
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("error committing squashed migration '%s': %w", m.Name, err)
+		}
+	}
+
+	mg.auditMigration(m, "recorded squashed migration '%s' as applied without running it, archiving the records of the %d migrations it squashes", m.Name, len(m.Squashes))
+	return nil
+}
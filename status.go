@@ -0,0 +1,163 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// MigrationStatus is the state of a single migration, drawn from both the
+// registry and the tracking table
+type MigrationStatus = MigrationInfo
+
+// Status returns the state of every migration in the default registry or
+// recorded in db, sorted by name
+func Status(db DBTX) ([]MigrationStatus, error) {
+	return defaultMigrator(db, nil).StatusContext(context.Background())
+}
+
+// Status returns the state of every migration in the Migrator's registry or
+// recorded in its tracking table, sorted by name
+func (mg *Migrator) Status() ([]MigrationStatus, error) {
+	return mg.StatusContext(context.Background())
+}
+
+// StatusContext is like Status, with a context
+func (mg *Migrator) StatusContext(ctx context.Context) ([]MigrationStatus, error) {
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := mg.db.QueryContext(ctx, mg.stmt("SELECT name, sql_hash, batch, migrated_at, dirty, duration_ms, applied_by, applied_sql FROM %s"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+	defer rows.Close()
+
+	type record struct {
+		hash       string
+		batch      int
+		migratedAt time.Time
+		dirty      bool
+		durationMS sql.NullInt64
+		appliedBy  sql.NullString
+		appliedSQL sql.NullString
+	}
+	records := map[string]record{}
+	for rows.Next() {
+		var name string
+		var r record
+		err := rows.Scan(&name, &r.hash, &r.batch, (*timestamp)(&r.migratedAt), &r.dirty, &r.durationMS, &r.appliedBy, &r.appliedSQL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+		}
+		records[name] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	labels, err := mg.recordedLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range mg.registry.Migrations() {
+		status := mg.registry.info(m)
+		status.Labels = mg.labelsFor(m)
+		if r, ok := records[m.Name]; ok {
+			status.Labels = labels[m.Name]
+			status.Applied = true
+			status.Batch = r.batch
+			status.MigratedAt = r.migratedAt
+			status.Changed = !m.matchesHash(r.hash)
+			status.Dirty = r.dirty
+			status.Duration = time.Duration(r.durationMS.Int64) * time.Millisecond
+			status.AppliedBy = r.appliedBy.String
+			status.AppliedSQL = r.appliedSQL.String
+			delete(records, m.Name)
+		}
+		statuses = append(statuses, status)
+	}
+	for name, r := range records {
+		statuses = append(statuses, MigrationStatus{
+			Name:       name,
+			Hash:       r.hash,
+			Applied:    true,
+			Batch:      r.batch,
+			MigratedAt: r.migratedAt,
+			Dirty:      r.dirty,
+			Duration:   time.Duration(r.durationMS.Int64) * time.Millisecond,
+			AppliedBy:  r.appliedBy.String,
+			AppliedSQL: r.appliedSQL.String,
+			Labels:     labels[name],
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses, nil
+}
+
+// WriteStatusJSON writes statuses as a JSON array, for deploy automation to
+// consume in place of a table. Each migration has its name, its State as
+// status, and, once applied, its batch, migrated_at, duration_ms and
+// applied_by.
+func WriteStatusJSON(w io.Writer, statuses []MigrationStatus) error {
+	out := make([]ReportedMigration, 0, len(statuses))
+	for _, s := range statuses {
+		rm := ReportedMigration{Name: s.Name, Status: s.State()}
+		if s.Applied {
+			rm.Batch = s.Batch
+			rm.DurationMS = s.Duration.Milliseconds()
+			rm.MigratedAt = s.MigratedAt.UTC().Format(time.RFC3339)
+			rm.AppliedBy = s.AppliedBy
+		}
+		out = append(out, rm)
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+// timestamp scans the migrated_at column, which drivers return as a
+// time.Time or, like MySQL without parseTime, as text
+type timestamp time.Time
+
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+func (t *timestamp) Scan(src interface{}) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+		*t = timestamp{}
+		return nil
+	case time.Time:
+		*t = timestamp(v)
+		return nil
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", src)
+	}
+
+	for _, layout := range timestampLayouts {
+		parsed, err := time.Parse(layout, text)
+		if err == nil {
+			*t = timestamp(parsed)
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse timestamp %q", text)
+}
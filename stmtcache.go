@@ -0,0 +1,72 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+)
+
+// schemaEpoch is the number of batches run or rolled back by this process
+var schemaEpoch atomic.Uint64
+
+// SchemaEpoch returns a counter bumped after each batch of migrations this
+// process runs or rolls back successfully, starting from 0. Code that
+// caches prepared statements or pooled connections can record the epoch
+// they were made at, and replace them once it has moved on, instead of
+// retrying "unknown column" errors. It only counts batches run by this
+// process, so it suits applications that migrate on boot or from an admin
+// endpoint; other processes don't see it move.
+func SchemaEpoch() uint64 {
+	return schemaEpoch.Load()
+}
+
+// DiscardAll returns an OnAfterBatch hook that runs DISCARD ALL on up to
+// conns connections of a PostgreSQL pool, such as the application's, so
+// prepared statements and cached plans made against the old schema aren't
+// reused. Connections are reserved together so each is a different one;
+// conns is capped by the pool's maximum open connections. Behind PgBouncer
+// in transaction or statement pooling mode, a client connection doesn't own
+// a server connection and this can't reach them all: set
+// server_reset_query_always, or reconnect the application, instead. Errors
+// are logged, as the migrations have already been applied.
+func DiscardAll(db *sql.DB, conns int) func(ctx context.Context, e BatchEvent) {
+	return func(ctx context.Context, e BatchEvent) {
+		if max := db.Stats().MaxOpenConnections; max > 0 && conns > max {
+			conns = max
+		}
+		reserved := []*sql.Conn{}
+		defer func() {
+			for _, conn := range reserved {
+				conn.Close()
+			}
+		}()
+		for i := 0; i < conns; i++ {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				log.Printf("moogration: error reserving connection to discard after batch %d: %s", e.Batch, err)
+				return
+			}
+			reserved = append(reserved, conn)
+			_, err = conn.ExecContext(ctx, "DISCARD ALL")
+			if err != nil {
+				log.Printf("moogration: error discarding session state after batch %d: %s", e.Batch, err)
+				return
+			}
+		}
+	}
+}
+
+// CloseIdleConns returns an OnAfterBatch hook that closes the idle
+// connections of a pool, such as the application's, so they are reopened
+// without server-side prepared statements made against the old schema, the
+// usual cause of "unknown column" errors from MySQL right after a deploy.
+// maxIdle restores the pool's idle limit afterwards, as set with
+// SetMaxIdleConns; database/sql defaults to 2. Connections in use are not
+// affected.
+func CloseIdleConns(db *sql.DB, maxIdle int) func(ctx context.Context, e BatchEvent) {
+	return func(ctx context.Context, e BatchEvent) {
+		db.SetMaxIdleConns(0)
+		db.SetMaxIdleConns(maxIdle)
+	}
+}
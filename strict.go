@@ -0,0 +1,94 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// EnvVar is the environment variable read by New. If it is set to
+// "production", the Migrator runs in strict mode.
+const EnvVar = "MOOGRATION_ENV"
+
+var (
+	// ErrStrictForce is returned when force is requested in strict mode
+	ErrStrictForce = errors.New("force is not permitted in strict mode")
+	// ErrStrictDown is returned when a down migration or rollback is requested
+	// in strict mode without a matching confirmation token
+	ErrStrictDown = errors.New("down migrations in strict mode require a confirmation token matching the most recently applied migration")
+	// ErrStrictSkip is returned when a run is requested in strict mode with
+	// the SkipAndContinue failure policy
+	ErrStrictSkip = errors.New("skipping failed migrations is not permitted in strict mode")
+	// ErrStrict is wrapped by the error of an operation that rewrites the
+	// tracking table without running migrations, or accepts an edited
+	// migration, called in strict mode
+	ErrStrict = errors.New("operation is not permitted in strict mode")
+)
+
+// WithStrict enables strict mode, intended for production databases: force
+// and the SkipAndContinue failure policy are refused, down migrations and
+// rollbacks only run if confirmed with WithDownConfirmation, and operations
+// that rewrite the tracking table without running migrations, such as
+// RepairHashes, Baseline, Prune, Squash, LoadSchema and ResolveDirty, return
+// an error wrapping ErrStrict, as does Redo, which accepts an edited
+// migration without checking its hash.
+func WithStrict() Option {
+	return func(m *Migrator) {
+		m.strict = true
+	}
+}
+
+// WithDownConfirmation confirms a down migration or rollback in strict mode.
+// The token must be the name of the most recently applied migration, so the
+// operator has to look up what they are about to undo.
+func WithDownConfirmation(token string) Option {
+	return func(m *Migrator) {
+		m.downConfirmation = token
+	}
+}
+
+func strictFromEnv() bool {
+	return os.Getenv(EnvVar) == "production"
+}
+
+// guard enforces strict mode before a run
+func (mg *Migrator) guard(ctx context.Context, down, force bool) error {
+	if !mg.strict {
+		return nil
+	}
+	if force {
+		return ErrStrictForce
+	}
+	if mg.failurePolicy == SkipAndContinue {
+		return ErrStrictSkip
+	}
+	if !down {
+		return nil
+	}
+
+	var latest string
+	err := mg.db.QueryRowContext(ctx, mg.stmt("SELECT name FROM %s ORDER BY id DESC LIMIT 1")).Scan(&latest)
+	if err == sql.ErrNoRows {
+		// nothing has been applied, so there is nothing to undo
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error confirming down migration: %w", err)
+	}
+	if mg.downConfirmation != latest {
+		return ErrStrictDown
+	}
+	return nil
+}
+
+// refuseStrict returns an error wrapping ErrStrict for an operation that
+// rewrites the tracking table without running migrations, if the Migrator
+// is in strict mode
+func (mg *Migrator) refuseStrict(operation string) error {
+	if mg.strict {
+		return fmt.Errorf("%w: %s", ErrStrict, operation)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package moogration
+
+// WithTags makes RunLatest run only the tagged migrations that have at least
+// one of tags, e.g. "prod" for a heavy index build only production needs.
+// Untagged migrations always run.
+func WithTags(tags ...string) Option {
+	return func(m *Migrator) {
+		m.includeTags = append(m.includeTags, tags...)
+	}
+}
+
+// WithoutTags makes RunLatest skip migrations with any of tags, e.g. "dev"
+// for fixture tables. Untagged migrations always run.
+func WithoutTags(tags ...string) Option {
+	return func(m *Migrator) {
+		m.excludeTags = append(m.excludeTags, tags...)
+	}
+}
+
+// selected reports whether m passes the Migrator's tag filters
+func (mg *Migrator) selected(m Migration) bool {
+	if len(m.Tags) == 0 {
+		return true
+	}
+	for _, tag := range m.Tags {
+		for _, excluded := range mg.excludeTags {
+			if tag == excluded {
+				return false
+			}
+		}
+	}
+	if len(mg.includeTags) == 0 {
+		return true
+	}
+	for _, tag := range m.Tags {
+		for _, included := range mg.includeTags {
+			if tag == included {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectTagged splits migrations into those passing the Migrator's tag
+// filters and those excluded by them
+func (mg *Migrator) selectTagged(migrations []Migration) (selected, excluded []Migration) {
+	selected = make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		if mg.selected(m) {
+			selected = append(selected, m)
+		} else {
+			excluded = append(excluded, m)
+		}
+	}
+	return selected, excluded
+}
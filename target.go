@@ -0,0 +1,88 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// MigrateTo applies or rolls back the migrations in the default registry
+// needed to reach target. See Migrator.MigrateTo.
+func MigrateTo(db DBTX, target string, logger *log.Logger) error {
+	return defaultMigrator(db, logger).MigrateToContext(context.Background(), target)
+}
+
+// MigrateTo brings the database to the registered migration named target:
+// applied migrations sorting after target are rolled back, newest first, and
+// unapplied migrations up to and including target are run. A migration to be
+// rolled back that has changed since it was applied is an error, as with
+// Rollback.
+func (mg *Migrator) MigrateTo(target string) error {
+	return mg.MigrateToContext(context.Background(), target)
+}
+
+// MigrateToContext is like MigrateTo, with a context
+func (mg *Migrator) MigrateToContext(ctx context.Context, target string) (err error) {
+	if err := mg.refuseDryRun("MigrateTo"); err != nil {
+		return err
+	}
+	if len(mg.groups) > 0 {
+		return fmt.Errorf("MigrateTo is not supported with migration groups")
+	}
+
+	found := false
+	for _, m := range mg.registry.snapshot() {
+		if m.Name == target {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("target migration '%s' is not registered", target)
+	}
+
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+	return mg.withLock(ctx, func(mg *Migrator) error {
+		return mg.migrateTo(ctx, target, state)
+	})
+}
+
+func (mg *Migrator) migrateTo(ctx context.Context, target string, state *runState) error {
+	state.set("", "setup")
+	err := mg.createMigrationTable(ctx)
+	if err != nil {
+		return err
+	}
+
+	applied, err := mg.appliedHashes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+
+	up := []Migration{}
+	down := []Migration{}
+	for _, m := range mg.registry.Migrations() {
+		hash, hasRun := applied[m.Name]
+		switch {
+		case m.Name <= target && !hasRun:
+			up = append(up, m)
+		case m.Name > target && hasRun:
+			if !m.matchesHash(hash) {
+				return fmt.Errorf("previously run migration '%s' has changed since run", m.Name)
+			}
+			down = append(down, m)
+		}
+	}
+
+	if len(down) > 0 {
+		err = mg.runLatest(ctx, down, true, false, state)
+		if err != nil {
+			return err
+		}
+	}
+	if len(up) > 0 {
+		return mg.runLatest(ctx, up, false, false, state)
+	}
+	return nil
+}
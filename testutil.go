@@ -1,6 +1,7 @@
 package moogration
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -77,7 +78,7 @@ func getTestMySQLDB(t *testing.T) (*sql.DB, func()) {
 		t.FailNow()
 	}
 
-	err = createMigrationTable(conn)
+	err = New(conn).createMigrationTable(context.Background())
 	if err != nil {
 		t.Log("failed creating migration table", err)
 		t.FailNow()
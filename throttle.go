@@ -0,0 +1,63 @@
+package moogration
+
+import (
+	"context"
+	"time"
+)
+
+// WithPause waits d between consecutive migrations in a run, giving replicas,
+// caches and ORMs time to catch up with each schema change
+func WithPause(d time.Duration) Option {
+	return func(m *Migrator) {
+		m.pause = d
+	}
+}
+
+// WithMaxPerMinute limits a run to starting at most n migrations per minute
+func WithMaxPerMinute(n int) Option {
+	return func(m *Migrator) {
+		if n > 0 {
+			m.interval = time.Minute / time.Duration(n)
+		}
+	}
+}
+
+// throttle spaces out the migrations of a single run
+type throttle struct {
+	pause    time.Duration
+	interval time.Duration
+	last     time.Time
+}
+
+// newRunState starts the state of a single run
+func (mg *Migrator) newRunState() *runState {
+	return &runState{
+		throttle: &throttle{pause: mg.pause, interval: mg.interval},
+		result:   &Result{Applied: []MigrationResult{}, Skipped: []SkippedMigration{}},
+	}
+}
+
+// wait blocks until the next migration may start or ctx is done, logging
+// any delay
+func (t *throttle) wait(ctx context.Context, mg *Migrator) error {
+	if t.last.IsZero() {
+		t.last = time.Now()
+		return nil
+	}
+
+	delay := t.pause
+	if remaining := t.interval - time.Since(t.last); remaining > delay {
+		delay = remaining
+	}
+	if delay > 0 {
+		if mg.logger != nil {
+			mg.logger.Printf("migrate :: waiting %s before next migration", delay)
+		}
+		err := sleep(ctx, delay)
+		if err != nil {
+			return err
+		}
+	}
+	t.last = time.Now()
+	return nil
+}
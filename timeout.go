@@ -0,0 +1,213 @@
+package moogration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cancelTimeout bounds the statement that cancels a migration's running
+// statement on the server
+const cancelTimeout = 5 * time.Second
+
+// ErrMigrationTimeout is wrapped by the error of a migration that ran longer
+// than its timeout
+var ErrMigrationTimeout = errors.New("migration exceeded its timeout")
+
+// WithMigrationTimeout cancels a migration that runs longer than d, unless
+// it sets its own Timeout, so a statement stuck behind a lock fails the run
+// instead of hanging it. The migration's error wraps ErrMigrationTimeout.
+//
+// Cancelling a context only drops the client's side of a statement with
+// some drivers, so on MySQL and Postgres the statement still running at the
+// timeout is also cancelled on the server, with KILL QUERY or
+// pg_cancel_backend from another connection, and doesn't keep holding its
+// locks after the run gave up on it. That needs the Migrator's database to
+// be a pool such as *sql.DB and a user allowed to cancel its own queries;
+// on other dialects, or bound to a single *sql.Conn or *sql.Tx, how promptly
+// a running statement stops depends on the driver.
+func WithMigrationTimeout(d time.Duration) Option {
+	return func(m *Migrator) {
+		m.migrationTimeout = d
+	}
+}
+
+// WithSlowMigrationWarning logs a warning every interval while a migration
+// is still running
+func WithSlowMigrationWarning(interval time.Duration) Option {
+	return func(m *Migrator) {
+		m.slowWarning = interval
+	}
+}
+
+// timeout returns the timeout of m, which is zero if it has none
+func (mg *Migrator) timeout(m Migration) time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return mg.migrationTimeout
+}
+
+// runContext returns the context m's statements run with, bounded by its
+// timeout. Once it is cancelled, by the timeout or by ctx, the statement
+// running on the session recorded by watchSession is cancelled on the
+// server. The returned func stops the timeout and cancels the context,
+// releasing it from ctx. It must only be called once m's transaction has
+// been committed or rolled back: a driver such as modernc.org/sqlite can
+// interrupt whatever its connection is running when the context of a
+// statement is cancelled, which would otherwise fail the migration's own
+// commit.
+func (mg *Migrator) runContext(ctx context.Context, m Migration) (context.Context, func()) {
+	timeout := mg.timeout(m)
+	if timeout <= 0 && !mg.cancelsStatements() {
+		return ctx, func() {}
+	}
+	runCtx, cancel := context.WithCancelCause(ctx)
+	s := &runSession{}
+	runCtx = context.WithValue(runCtx, runSessionKey{}, s)
+	stopCancel := func() bool { return true }
+	if mg.cancelsStatements() {
+		stopCancel = context.AfterFunc(runCtx, func() { mg.cancelStatement(m, s) })
+	}
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) })
+	}
+	return runCtx, func() {
+		s.end()
+		stopCancel()
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel(context.Canceled)
+	}
+}
+
+// runSession is the database session a migration's statements run on, so
+// the one still running when its run context is cancelled can be cancelled
+// on the server
+type runSession struct {
+	mu sync.Mutex
+	id int64
+	// ok is set while the session runs the migration's statements
+	ok bool
+}
+
+type runSessionKey struct{}
+
+// end stops the session from being cancelled, once the migration's
+// statements have finished. It waits for a cancellation in progress.
+func (s *runSession) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ok = false
+}
+
+// endSession stops the session recorded for the migration ctx is the run
+// context of from being cancelled, so the statements recording it aren't
+func endSession(ctx context.Context) {
+	s, ok := ctx.Value(runSessionKey{}).(*runSession)
+	if ok {
+		s.end()
+	}
+}
+
+// cancelsStatements reports whether a migration's running statement is
+// cancelled on the server when its run context is: on MySQL and Postgres,
+// with a pool to cancel it from
+func (mg *Migrator) cancelsStatements() bool {
+	if mg.driver != mysql && mg.driver != postgres {
+		return false
+	}
+	_, ok := mg.cancelPool().(conner)
+	return ok
+}
+
+// cancelPool is the pool a statement is cancelled from, which is the one a
+// reserved connection came from
+func (mg *Migrator) cancelPool() DBTX {
+	if mg.pool != nil {
+		return mg.pool
+	}
+	return mg.db
+}
+
+// watchSession records the session db runs on as the one running the
+// statements of the migration ctx is the run context of
+func (mg *Migrator) watchSession(ctx context.Context, db DBTX) error {
+	s, ok := ctx.Value(runSessionKey{}).(*runSession)
+	if !ok || !mg.cancelsStatements() {
+		return nil
+	}
+	query := "SELECT CONNECTION_ID()"
+	if mg.driver == postgres {
+		query = "SELECT pg_backend_pid()"
+	}
+	var id int64
+	err := db.QueryRowContext(ctx, query).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("error reading session id: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id, s.ok = id, true
+	return nil
+}
+
+// cancelStatement cancels the statement running on s on the server, from
+// another connection of the pool. It holds s, so the statements recording
+// the migration can't start until it has finished.
+func (mg *Migrator) cancelStatement(m Migration, s *runSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	conn, release, err := session(ctx, mg.cancelPool())
+	if err == nil {
+		if mg.driver == postgres {
+			_, err = conn.ExecContext(ctx, "SELECT pg_cancel_backend($1)", s.id)
+		} else {
+			_, err = conn.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", s.id))
+		}
+		release(err != nil)
+	}
+	if mg.logger == nil {
+		return
+	}
+	if err != nil {
+		mg.logger.Printf("migrate :: failed to cancel statement of migration '%s' on session %d: %s", m.Name, s.id, err)
+		return
+	}
+	mg.logger.Printf("migrate :: cancelled statement of migration '%s' on session %d", m.Name, s.id)
+}
+
+// warnWhileRunning logs a warning every slow warning interval until the
+// returned func is called
+func (mg *Migrator) warnWhileRunning(m Migration, down bool) (stop func()) {
+	if mg.slowWarning <= 0 || mg.logger == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(mg.slowWarning)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mg.logger.Printf("migrate :: WARNING :: %s :: %s still running after %s",
+					strings.ToUpper(direction(down)), m.Name, time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
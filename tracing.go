@@ -0,0 +1,90 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Span attribute keys set by a Migrator with a Tracer
+const (
+	AttrMigrationName = "moogration.migration.name"
+	AttrDirection     = "moogration.direction"
+	AttrBatch         = "moogration.batch"
+	AttrRowsAffected  = "moogration.rows_affected"
+	AttrApplied       = "moogration.applied"
+	AttrSkipped       = "moogration.skipped"
+)
+
+// Attribute is a key and value recorded on a span. Values are strings, ints,
+// int64s or bools.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Tracer starts the spans of a Migrator set with WithTracer. It is a small
+// subset of OpenTelemetry's trace.Tracer, so that moogration doesn't depend
+// on OpenTelemetry; see the README for an adapter.
+type Tracer interface {
+	// Start starts a span as a child of any span in ctx, and returns a
+	// context holding the new span
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError records err on the span and marks it as failed
+	RecordError(err error)
+	End()
+}
+
+// WithTracer traces RunLatest and Rollback with t: a span named
+// "moogration.run" or "moogration.rollback" per call, with a child span named
+// after each migration it runs, so migration time shows up in deploy traces.
+// Dry runs aren't traced.
+func WithTracer(t Tracer) Option {
+	return func(m *Migrator) {
+		m.tracer = t
+	}
+}
+
+// startSpan starts a span if the Migrator has a Tracer, returning ctx and a
+// nil Span otherwise
+func (mg *Migrator) startSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	if mg.tracer == nil {
+		return ctx, nil
+	}
+	return mg.tracer.Start(ctx, name, attrs...)
+}
+
+// endSpan records err, if any, and ends span, which may be nil
+func endSpan(span Span, err error, attrs ...Attribute) {
+	if span == nil {
+		return
+	}
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// rowCounter sums the rows affected by the statements executed through it
+type rowCounter struct {
+	execer
+	rows int64
+}
+
+func (c *rowCounter) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := c.execer.ExecContext(ctx, query, args...)
+	if err == nil {
+		// drivers that can't report rows affected count as none
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			c.rows += n
+		}
+	}
+	return result, err
+}
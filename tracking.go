@@ -0,0 +1,176 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// LatestTrackingVersion is the version of the tracking table's structure
+// this release creates and upgrades to. Version 1 is the original table;
+// each column added since raises it by one.
+const LatestTrackingVersion = 6
+
+// trackingColumn is a column added to the tracking table after its first
+// release, with its definition on each dialect
+type trackingColumn struct {
+	name     string
+	mysql    string
+	sqlite   string
+	postgres string
+}
+
+// trackingColumns are added, in order, to a tracking table lacking them, so
+// tables created by earlier releases are upgraded when next used. New
+// columns are appended here, never inserted or removed, and
+// LatestTrackingVersion raised with them.
+var trackingColumns = []trackingColumn{
+	{"dirty", "BOOLEAN NOT NULL DEFAULT FALSE", "INTEGER NOT NULL DEFAULT 0", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"duration_ms", "BIGINT", "INTEGER", "BIGINT"},
+	{"applied_by", "VARCHAR(255)", "TEXT", "VARCHAR(255)"},
+	{"applied_sql", "LONGTEXT", "TEXT", "TEXT"},
+	{"dirty_direction", "VARCHAR(4)", "TEXT", "VARCHAR(4)"},
+}
+
+func (c trackingColumn) definition(d driver) string {
+	switch d {
+	case mysql:
+		return c.mysql
+	case postgres:
+		return c.postgres
+	default:
+		return c.sqlite
+	}
+}
+
+// trackingColumnsOf returns the lowercased columns of the table name
+func trackingColumnsOf(ctx context.Context, db DBTX, name string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", name))
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, column := range columns {
+		existing[strings.ToLower(column)] = true
+	}
+	return existing, nil
+}
+
+// trackingVersion returns the version of a tracking table with the given
+// columns: 1, plus one for each tracking column it has, in order
+func trackingVersion(existing map[string]bool) int {
+	version := 1
+	for _, c := range trackingColumns {
+		if !existing[c.name] {
+			break
+		}
+		version++
+	}
+	return version
+}
+
+// upgradeTrackingTable adds the tracking columns the table name lacks
+func (mg *Migrator) upgradeTrackingTable(ctx context.Context, db DBTX, name string) error {
+	existing, err := trackingColumnsOf(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	version := trackingVersion(existing)
+	if version == LatestTrackingVersion {
+		return nil
+	}
+
+	for _, c := range trackingColumns {
+		if existing[c.name] {
+			continue
+		}
+		_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", name, c.name, c.definition(mg.driver)))
+		if err != nil {
+			return fmt.Errorf("error adding column %s: %w", c.name, err)
+		}
+	}
+	if mg.logger != nil {
+		mg.logger.Printf("migrate :: upgraded tracking table %s from version %d to %d", name, version, LatestTrackingVersion)
+	}
+	return nil
+}
+
+// TrackingVersion returns the version of the tracking table in db used by
+// the package functions. See Migrator.TrackingVersion.
+func TrackingVersion(db DBTX, logger *log.Logger) (int, error) {
+	return defaultMigrator(db, logger).TrackingVersionContext(context.Background())
+}
+
+// TrackingVersion returns the version of the tracking table's structure as
+// it stands, without upgrading it: LatestTrackingVersion once this release
+// has used it, lower if it was created by an earlier release and not used
+// since, or 0 if it doesn't exist yet
+func (mg *Migrator) TrackingVersion() (int, error) {
+	return mg.TrackingVersionContext(context.Background())
+}
+
+// TrackingVersionContext is like TrackingVersion, with a context
+func (mg *Migrator) TrackingVersionContext(ctx context.Context) (int, error) {
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error checking for the migration table: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	existing, err := trackingColumnsOf(ctx, mg.db, mg.qualifiedTable())
+	if err != nil {
+		return 0, fmt.Errorf("error reading the migration table's columns: %w", err)
+	}
+	return trackingVersion(existing), nil
+}
+
+// WithAppliedBy sets who the tracking table records as applying migrations,
+// such as a CI job or deploy user. The default is the operating system user
+// and host, as in deploy@web-1.
+func WithAppliedBy(name string) Option {
+	return func(m *Migrator) {
+		m.appliedBy = name
+	}
+}
+
+// WithRecordSQL records the SQL each migration ran in the tracking table,
+// after template expansion, so an audit can see exactly what was applied.
+// Go migrations record none.
+func WithRecordSQL() Option {
+	return func(m *Migrator) {
+		m.recordSQL = true
+	}
+}
+
+// applier returns who the tracking table records as applying migrations
+func (mg *Migrator) applier() string {
+	if mg.appliedBy != "" {
+		return mg.appliedBy
+	}
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// appliedSQL returns the SQL recorded for m, or nil
+func (mg *Migrator) appliedSQL(m Migration) interface{} {
+	if !mg.recordSQL || m.UpFunc != nil {
+		return nil
+	}
+	return m.Up
+}
@@ -0,0 +1,107 @@
+package moogration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrNoTransactionalDDL is returned by RunAllInTx on MySQL, where DDL
+// statements implicitly commit the transaction
+var ErrNoTransactionalDDL = errors.New("dialect does not support transactional DDL, so migrations can't run inside a caller's transaction")
+
+// RunAllInTx applies the pending migrations in the default registry inside
+// tx. See Migrator.RunAllInTx.
+func RunAllInTx(tx *sql.Tx, logger *log.Logger) error {
+	return defaultMigrator(nil, logger).RunAllInTxContext(context.Background(), tx)
+}
+
+// RunAllInTx applies the pending migrations inside tx, which the caller
+// commits or rolls back. It is intended for test frameworks that wrap each
+// test in a transaction and roll it back: the migrations, the tracking table
+// and its records are all written through tx, so rolling it back leaves the
+// database as it was.
+//
+// Migrations are selected and ordered as RunLatest would select them, by
+// tag, with Repeatable migrations run again after the others when changed.
+//
+// Only dialects with transactional DDL are supported. Migrations that set
+// NoTransaction, SkipReplication or ForeignKeysOff are refused, as is a Migrator with
+// groups, dual writes or dry runs. The migration lock is not taken.
+func (mg *Migrator) RunAllInTx(tx *sql.Tx) error {
+	return mg.RunAllInTxContext(context.Background(), tx)
+}
+
+// RunAllInTxContext is like RunAllInTx, with a context
+func (mg *Migrator) RunAllInTxContext(ctx context.Context, tx *sql.Tx) (err error) {
+	switch {
+	case mg.driver == mysql && mg.dialect == nil, mg.dialect != nil && !mg.dialect.TransactionalDDL():
+		return ErrNoTransactionalDDL
+	case len(mg.groups) > 0, mg.dualWrite != nil:
+		return errors.New("RunAllInTx does not support groups or dual writes")
+	}
+	if err := mg.refuseDryRun("RunAllInTx"); err != nil {
+		return err
+	}
+
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+
+	state.set("", "setup")
+	err = mg.createTrackingTableOn(ctx, tx, mg.qualifiedTable())
+	if err != nil {
+		return err
+	}
+
+	// the tracking table is read and written through tx
+	inTx := *mg
+	inTx.db = tx
+	applied, err := inTx.appliedHashes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load migration statuses: %w", err)
+	}
+	lastBatch, err := inTx.latestBatch(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to determine last-run batch number: %w", err)
+	}
+	batch := lastBatch + 1
+
+	_, pending, _ := mg.planRun(mg.registry.snapshot(), applied, false)
+	err = mg.checkAppVersion(pending)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if m.NoTransaction || m.SkipReplication || m.ForeignKeysOff {
+			return fmt.Errorf("migration '%s' can't run inside a transaction", m.Name)
+		}
+		if _, hasRun := applied[m.Name]; !hasRun && len(m.Squashes) > 0 {
+			adopt, err := mg.checkSquash(m, applied)
+			if err != nil {
+				return err
+			}
+			if adopt {
+				err = inTx.adoptSquash(ctx, m, batch)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		state.set(m.Name, "up")
+		start := time.Now()
+		err := m.run(ctx, false, tx, mg)
+		if err != nil {
+			return err
+		}
+		state.set(m.Name, "status update")
+		err = mg.setMigrationStatus(ctx, tx, m, false, batch, time.Since(start))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
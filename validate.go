@@ -0,0 +1,154 @@
+package moogration
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Validate checks the default registry without a database. See
+// Registry.Validate.
+func Validate() []Finding {
+	return defaultRegistry.Validate()
+}
+
+// Validate checks the registered migrations for problems that would
+// otherwise only surface when they run, or when branches are merged: a name
+// registered twice, a name not following the naming convention set with
+// SetNameStrategy, or mixing conventions if none is set, a numbered name
+// sorting after a higher number, such as 9_add_index after 10_create_users,
+// an Up without statements, a Down without statements or a ManualRollback,
+// a Down dropping an object without IF EXISTS, so it fails if run twice,
+// and a migration referencing a table, by a foreign key, that is created
+// by a migration running after it.
+func (r *Registry) Validate() []Finding {
+	migrations := r.Migrations()
+	sortForRun(migrations, false)
+
+	findings := []Finding{}
+	add := func(m Migration, severity Severity, format string, args ...interface{}) {
+		file, line := r.location(m.Name)
+		findings = append(findings, Finding{
+			Severity:  severity,
+			Migration: m.Name,
+			File:      file,
+			Line:      line,
+			Message:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	seen := map[string]bool{}
+	expected := r.expectedNames(migrations)
+	highest := ""
+	for _, m := range migrations {
+		if seen[m.Name] {
+			add(m, SeverityError, "migration name '%s' is registered more than once", m.Name)
+		}
+		seen[m.Name] = true
+		if expected != AnyNames && nameStrategy(m.Name) != expected {
+			add(m, SeverityWarning, "migration name '%s' doesn't follow the %s naming convention", m.Name, expected)
+		}
+		if match := reNamePrefix.FindStringSubmatch(m.Name); match != nil {
+			if numberLess(match[1], highest) {
+				add(m, SeverityWarning, "migration name '%s' sorts after a higher number, so it runs later than its number suggests; pad numbers to the same width", m.Name)
+			} else {
+				highest = match[1]
+			}
+		}
+
+		if len(splitStatements(m.Up)) == 0 && m.UpFunc == nil {
+			add(m, SeverityError, "migration '%s' has an empty Up", m.Name)
+		}
+		if len(splitStatements(m.Down)) == 0 && m.DownFunc == nil && m.ManualRollback == "" {
+			add(m, SeverityWarning, "migration '%s' has an empty Down; set ManualRollback if it can't be rolled back", m.Name)
+		}
+		if m.DownFunc == nil {
+			for _, stmt := range splitStatements(m.Down) {
+				if match := reDropWithoutIfExists.FindStringSubmatch(stmt); match != nil && match[2] == "" {
+					add(m, SeverityWarning, "migration '%s' drops a %s in its Down without IF EXISTS", m.Name, strings.ToLower(match[1]))
+				}
+			}
+		}
+	}
+
+	for _, e := range foreignKeyOrderErrors(migrations) {
+		add(e.migration, SeverityError, "migration '%s' references table '%s', which is created by the later migration '%s'", e.migration.Name, e.table, e.createdBy)
+	}
+	return findings
+}
+
+// reDropWithoutIfExists matches a statement dropping an object, capturing
+// its kind and any IF EXISTS. DROP INDEX is left out, as MySQL has no IF
+// EXISTS for it.
+var reDropWithoutIfExists = regexp.MustCompile(`(?is)^DROP\s+(TABLE|VIEW|SEQUENCE|TRIGGER|FUNCTION|PROCEDURE|TYPE)\s+(IF\s+EXISTS\b)?`)
+
+// numberLess reports whether the number a is lower than b, which may both
+// be too long for an int
+func numberLess(a, b string) bool {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// reReferences matches the table of a foreign key, which may be schema
+// qualified with each part quoted
+var reReferences = regexp.MustCompile("(?is)\\bREFERENCES\\s+((?:[`\"]?\\w+[`\"]?\\.)?[`\"]?\\w+[`\"]?)")
+
+// tableKey compares table names without quotes, case or schema
+func tableKey(name string) string {
+	name = strings.ToLower(strings.NewReplacer("`", "", `"`, "", "[", "", "]", "").Replace(name))
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// foreignKeyOrderError is a migration referencing a table created after it
+type foreignKeyOrderError struct {
+	migration Migration
+	table     string
+	createdBy string
+}
+
+// foreignKeyOrderErrors builds the graph of tables created and referenced by
+// the up SQL of migrations, in run order, and returns each reference to a
+// table first created by a later migration. Tables no migration creates are
+// assumed to exist already.
+func foreignKeyOrderErrors(migrations []Migration) []foreignKeyOrderError {
+	type reference struct {
+		migration int
+		table     string
+	}
+	createdAt := map[string]int{}
+	references := []reference{}
+	for i, m := range migrations {
+		if m.UpFunc != nil {
+			continue
+		}
+		for _, stmt := range splitStatements(m.Up) {
+			if match := reCreateTable.FindStringSubmatch(stmt); match != nil {
+				table := tableKey(match[1])
+				if _, ok := createdAt[table]; !ok {
+					createdAt[table] = i
+				}
+			} else if !reAlterTable.MatchString(stmt) {
+				continue
+			}
+			for _, match := range reReferences.FindAllStringSubmatch(stmt, -1) {
+				references = append(references, reference{migration: i, table: tableKey(match[1])})
+			}
+		}
+	}
+
+	errs := []foreignKeyOrderError{}
+	for _, ref := range references {
+		created, ok := createdAt[ref.table]
+		if ok && created > ref.migration {
+			errs = append(errs, foreignKeyOrderError{
+				migration: migrations[ref.migration],
+				table:     ref.table,
+				createdBy: migrations[created].Name,
+			})
+		}
+	}
+	return errs
+}
@@ -0,0 +1,68 @@
+package moogration
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	reAddCheckOrFK = regexp.MustCompile(`(?is)^ADD\s+CONSTRAINT\s+` + identifier + `\s+(?:FOREIGN\s+KEY|CHECK)\b`)
+	reNotValid     = regexp.MustCompile(`(?is)\bNOT\s+VALID\s*$`)
+)
+
+// ValidateLater applies the low-lock pattern for adding FOREIGN KEY and CHECK
+// constraints on PostgreSQL. Each "ADD CONSTRAINT name FOREIGN KEY ..." or
+// "ADD CONSTRAINT name CHECK ..." in m's up SQL is rewritten with NOT VALID,
+// so it only checks new rows and takes its lock briefly. The returned
+// follow-up migration, named after m with a "_validate" suffix so it sorts
+// directly after it, runs VALIDATE CONSTRAINT for each, which scans existing
+// rows without blocking writes. Register the follow-up in the same release or
+// a later one. An error is returned if m adds no such constraint.
+func ValidateLater(m Migration) (add Migration, validate Migration, err error) {
+	statements := splitStatements(m.Up)
+	validations := []string{}
+	for i, stmt := range statements {
+		match := reAlterTable.FindStringSubmatch(stmt)
+		if match == nil {
+			continue
+		}
+
+		actions := splitTopLevel(match[2])
+		rewritten := false
+		for j, action := range actions {
+			action = strings.TrimSpace(action)
+			sub := reAddCheckOrFK.FindStringSubmatch(action)
+			if sub == nil {
+				continue
+			}
+			if !reNotValid.MatchString(action) {
+				action += " NOT VALID"
+			}
+			actions[j] = action
+			rewritten = true
+			validations = append(validations, fmt.Sprintf("ALTER TABLE %s VALIDATE CONSTRAINT %s;", match[1], sub[1]))
+		}
+		if rewritten {
+			for j := range actions {
+				actions[j] = strings.TrimSpace(actions[j])
+			}
+			statements[i] = fmt.Sprintf("ALTER TABLE %s %s", match[1], strings.Join(actions, ", "))
+		}
+	}
+
+	if len(validations) == 0 {
+		return m, Migration{}, fmt.Errorf("migration '%s' adds no FOREIGN KEY or CHECK constraint", m.Name)
+	}
+
+	add = m
+	add.SetUp(strings.Join(statements, ";\n") + ";")
+	validate = Migration{
+		Name:  m.Name + "_validate",
+		Group: m.Group,
+		Up:    strings.Join(validations, "\n"),
+		// validation only checks existing rows, so there is nothing to undo
+		ManualRollback: "None needed: validating a constraint does not change the schema.",
+	}
+	return add, validate, nil
+}
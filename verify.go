@@ -0,0 +1,184 @@
+package moogration
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// HashMismatch is an applied migration whose registered SQL no longer
+// matches the hash recorded when it was applied
+type HashMismatch struct {
+	Name  string
+	Batch int
+	// Stored is the hash in the tracking table
+	Stored string
+	// Current is the hash of the registered migration
+	Current string
+}
+
+// VerifyReport compares the hashes recorded in the tracking table with the
+// registry. Each list is sorted by name.
+type VerifyReport struct {
+	// Verified are applied migrations whose hashes match
+	Verified []string
+	// Changed are applied migrations edited since they were applied
+	Changed []HashMismatch
+	// Unregistered are applied migrations missing from the registry
+	Unregistered []string
+	// Pending are registered migrations not yet applied, and repeatable
+	// migrations changed since they were applied
+	Pending []string
+}
+
+// OK reports whether no applied migration has changed
+func (r VerifyReport) OK() bool {
+	return len(r.Changed) == 0
+}
+
+// Verify compares the migrations applied to db with the default registry.
+// See Migrator.Verify.
+func Verify(db DBTX) (VerifyReport, error) {
+	return defaultMigrator(db, nil).VerifyContext(context.Background())
+}
+
+// RepairHashes re-records the hashes of migrations in the default registry
+// applied to db. See Migrator.RepairHashes.
+func RepairHashes(db DBTX, names ...string) ([]HashMismatch, error) {
+	return defaultMigrator(db, nil).RepairHashesContext(context.Background(), names...)
+}
+
+// Verify compares the hash stored for every applied migration with the
+// registry, without running anything or creating the tracking table
+func (mg *Migrator) Verify() (VerifyReport, error) {
+	return mg.VerifyContext(context.Background())
+}
+
+// VerifyContext is like Verify, with a context
+func (mg *Migrator) VerifyContext(ctx context.Context) (VerifyReport, error) {
+	report := VerifyReport{
+		Verified:     []string{},
+		Changed:      []HashMismatch{},
+		Unregistered: []string{},
+		Pending:      []string{},
+	}
+
+	exists, err := mg.tableExists(ctx)
+	if err != nil {
+		return report, err
+	}
+	type record struct {
+		hash  string
+		batch int
+	}
+	applied := map[string]record{}
+	if exists {
+		rows, err := mg.db.QueryContext(ctx, mg.stmt("SELECT name, sql_hash, batch FROM %s"))
+		if err != nil {
+			return report, fmt.Errorf("failed to load migration statuses: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			var r record
+			err := rows.Scan(&name, &r.hash, &r.batch)
+			if err != nil {
+				return report, fmt.Errorf("failed to load migration statuses: %w", err)
+			}
+			applied[name] = r
+		}
+		if err := rows.Err(); err != nil {
+			return report, fmt.Errorf("failed to load migration statuses: %w", err)
+		}
+	}
+
+	for _, m := range mg.registry.Migrations() {
+		r, ok := applied[m.Name]
+		switch {
+		case !ok, m.reapplies(r.hash):
+			report.Pending = append(report.Pending, m.Name)
+		case m.matchesHash(r.hash):
+			report.Verified = append(report.Verified, m.Name)
+		default:
+			report.Changed = append(report.Changed, HashMismatch{
+				Name:    m.Name,
+				Batch:   r.batch,
+				Stored:  r.hash,
+				Current: m.hash(),
+			})
+		}
+		delete(applied, m.Name)
+	}
+	for name := range applied {
+		report.Unregistered = append(report.Unregistered, name)
+	}
+	sort.Strings(report.Unregistered)
+
+	return report, nil
+}
+
+// RepairHashes re-baselines the stored hashes of applied migrations that
+// were edited on purpose, so later runs and rollbacks accept the edit
+// without force. The named migrations must be registered and applied; with
+// no names, every changed migration is repaired. The SQL is not run. It
+// returns the hashes it replaced, and each repair is written to the audit
+// log.
+func (mg *Migrator) RepairHashes(names ...string) ([]HashMismatch, error) {
+	return mg.RepairHashesContext(context.Background(), names...)
+}
+
+// RepairHashesContext is like RepairHashes, with a context
+func (mg *Migrator) RepairHashesContext(ctx context.Context, names ...string) (repaired []HashMismatch, err error) {
+	if err := mg.refuseDryRun("RepairHashes"); err != nil {
+		return nil, err
+	}
+	if err := mg.refuseStrict("RepairHashes"); err != nil {
+		return nil, err
+	}
+	state := mg.newRunState()
+	defer recoverPanic(&err, state)
+	err = mg.withLock(ctx, func(mg *Migrator) error {
+		state.set("", "repair hashes")
+		report, err := mg.VerifyContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		changed := map[string]HashMismatch{}
+		for _, c := range report.Changed {
+			changed[c.Name] = c
+		}
+		verified := map[string]bool{}
+		for _, name := range report.Verified {
+			verified[name] = true
+		}
+
+		toRepair := report.Changed
+		if len(names) > 0 {
+			toRepair = []HashMismatch{}
+			for _, name := range names {
+				c, ok := changed[name]
+				if ok {
+					toRepair = append(toRepair, c)
+					continue
+				}
+				if !verified[name] {
+					return fmt.Errorf("migration '%s' is not both registered and applied", name)
+				}
+			}
+		}
+
+		stmt := mg.stmt("UPDATE %s SET sql_hash = ? WHERE name = ?")
+		for _, c := range toRepair {
+			state.set(c.Name, "repair hash")
+			_, err := mg.db.ExecContext(ctx, stmt, c.Current, c.Name)
+			if err != nil {
+				return fmt.Errorf("error repairing hash of migration '%s': %w", c.Name, err)
+			}
+			mg.audit("re-recorded hash of migration '%s' (%s -> %s)", c.Name, c.Stored, c.Current)
+			repaired = append(repaired, c)
+		}
+		return nil
+	})
+	return repaired, err
+}
@@ -0,0 +1,87 @@
+package moogration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotVisible is returned when a reader set with WithReadYourWrites still
+// doesn't see an applied migration at the timeout
+var ErrNotVisible = errors.New("applied migration is not visible to a reader")
+
+// visibilityPollInterval is how often a reader is checked again
+const visibilityPollInterval = 50 * time.Millisecond
+
+// visibility is the configuration set with WithReadYourWrites
+type visibility struct {
+	timeout time.Duration
+	readers []DBTX
+}
+
+// WithReadYourWrites checks, after each migration is applied or rolled back,
+// that readers see its status, retrying for up to timeout. Behind a proxy
+// such as ProxySQL or PgBouncer, a connection can briefly be routed to a
+// server or session that hasn't caught up with a schema change, or serve a
+// stale prepared plan. Without readers, a second connection from the
+// Migrator's pool is checked. If a reader still doesn't see the change at
+// the timeout, the run stops with an error wrapping ErrNotVisible; the
+// migration itself has already been applied.
+func WithReadYourWrites(timeout time.Duration, readers ...DBTX) Option {
+	return func(m *Migrator) {
+		m.visibility = &visibility{timeout: timeout, readers: readers}
+	}
+}
+
+// checkVisible waits until every reader sees the status of m recorded by
+// the Migrator
+func (mg *Migrator) checkVisible(ctx context.Context, m Migration, down bool) error {
+	if mg.visibility == nil {
+		return nil
+	}
+
+	readers := mg.visibility.readers
+	if len(readers) == 0 && mg.minimalPermissions {
+		readers = []DBTX{mg.db}
+	}
+	if len(readers) == 0 {
+		conn, release, err := session(ctx, mg.db)
+		if err != nil {
+			return fmt.Errorf("error reserving connection to check migration '%s' is visible: %w", m.Name, err)
+		}
+		defer release(false)
+		readers = []DBTX{conn}
+	}
+
+	query := mg.stmt("SELECT COUNT(*) FROM %s WHERE name = ? AND sql_hash = ?")
+	args := []interface{}{m.Name, m.hash()}
+	if down {
+		query = mg.stmt("SELECT COUNT(*) FROM %s WHERE name = ?")
+		args = args[:1]
+	}
+	for i, reader := range readers {
+		deadline := time.Now().Add(mg.visibility.timeout)
+		for {
+			var count int
+			err := reader.QueryRowContext(ctx, query, args...).Scan(&count)
+			if err == nil && (count > 0) != down {
+				break
+			}
+			if !time.Now().Before(deadline) {
+				if err == nil && down {
+					err = errors.New("status still recorded")
+				} else if err == nil {
+					err = errors.New("status not yet recorded")
+				}
+				return fmt.Errorf("%w: migration '%s' (%s) on reader %d after %s: %s",
+					ErrNotVisible, m.Name, direction(down), i+1, mg.visibility.timeout, err)
+			}
+			err = sleep(ctx, visibilityPollInterval)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}